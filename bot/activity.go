@@ -0,0 +1,34 @@
+package bot
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// activityWeight is how much more a member who just started speaking counts compared to a silent member.
+	activityWeight = 2
+	// activityHalfLife is the time after which the activity of a member counts half as much.
+	activityHalfLife = time.Minute
+)
+
+// speakerActivity tells when the members last spoke. It is implemented by *voicechannel.Manager.
+type speakerActivity interface {
+	LastSpoke(userID string) (time.Time, bool)
+}
+
+// memberScore returns how much a member in a voice channel counts when choosing the channel to join.
+// Every member counts for 1, plus up to activityWeight if they spoke recently. The activity decays exponentially with
+// time. lastSpoke is nil if the member was never heard.
+func memberScore(lastSpoke *time.Time, now time.Time) float64 {
+	score := 1.0
+	if lastSpoke == nil {
+		return score
+	}
+
+	age := now.Sub(*lastSpoke)
+	if age < 0 {
+		age = 0
+	}
+	return score + activityWeight*math.Pow(0.5, age.Seconds()/activityHalfLife.Seconds())
+}
@@ -0,0 +1,36 @@
+package bot
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMemberScore(t *testing.T) {
+	now := time.Unix(1000, 0)
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(-d)
+		return &t
+	}
+
+	tests := []struct {
+		name      string
+		lastSpoke *time.Time
+		expected  float64
+	}{
+		{name: "never spoke", lastSpoke: nil, expected: 1},
+		{name: "speaking now", lastSpoke: at(0), expected: 1 + activityWeight},
+		{name: "one half-life ago", lastSpoke: at(activityHalfLife), expected: 1 + activityWeight/2.},
+		{name: "two half-lives ago", lastSpoke: at(2 * activityHalfLife), expected: 1 + activityWeight/4.},
+		{name: "in the future", lastSpoke: at(-time.Second), expected: 1 + activityWeight},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.InDelta(t, tt.expected, memberScore(tt.lastSpoke, now), 1e-9)
+		})
+	}
+
+	// The score keeps decreasing and tends to the score of a silent member.
+	assert.Greater(t, memberScore(at(time.Minute), now), memberScore(at(2*time.Minute), now))
+	assert.InDelta(t, 1, memberScore(at(time.Hour), now), 1e-9)
+}
@@ -0,0 +1,104 @@
+package bot
+
+import (
+	"bigbro2/bot/circular"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"strings"
+	"time"
+)
+
+// durationPresets are always suggested for the seconds option of the replay command, by name. They are suggestions
+// rather than choices of the option: Discord does not allow choices on an autocompleted option, and choices would
+// forbid typing any other number of seconds. Picking a preset sends its number of seconds, like typing it.
+var durationPresets = []struct {
+	name     string
+	duration time.Duration
+}{
+	{name: "Last 10s", duration: 10 * time.Second},
+	{name: "Last 30s", duration: 30 * time.Second},
+	{name: "Last minute", duration: time.Minute},
+}
+
+// handleReplayAutocomplete suggests values for the seconds option of the replay command while the user types it.
+func (b *Bot) handleReplayAutocomplete(i *discordgo.InteractionCreate) error {
+	if !b.servesGuild(i.GuildID, true) {
+		return nil
+	}
+
+	var stats circular.Stats
+	if b.audioBuffer != nil {
+		stats = b.audioBuffer.Stats(b.guildID)
+	}
+
+	choices := filterSuggestions(secondsSuggestions(stats, b.now(), b.maxDuration), typedSeconds(i.ApplicationCommandData().Options))
+	err := b.session.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+		Data: &discordgo.InteractionResponseData{Choices: choices},
+	})
+	if err != nil {
+		return fmt.Errorf("could not respond to autocomplete interaction: %w", err)
+	}
+	return nil
+}
+
+// secondsSuggestions returns the values suggested for the seconds option of the replay command.
+// In addition to the durationPresets up to maxDuration, it suggests the duration of the audio in the buffer when it
+// is shorter than maxDuration.
+func secondsSuggestions(stats circular.Stats, now time.Time, maxDuration time.Duration) []*discordgo.ApplicationCommandOptionChoice {
+	var choices []*discordgo.ApplicationCommandOptionChoice
+	for _, preset := range durationPresets {
+		if preset.duration > maxDuration {
+			continue
+		}
+		choices = append(choices, &discordgo.ApplicationCommandOptionChoice{
+			Name:  preset.name,
+			Value: int(preset.duration.Seconds()),
+		})
+	}
+
+	if stats.Packets == 0 {
+		return choices
+	}
+
+	available := now.Sub(stats.Oldest).Truncate(time.Second)
+	if available < minDuration {
+		return choices
+	}
+	if available > maxDuration {
+		available = maxDuration
+	}
+
+	choices = append(choices, &discordgo.ApplicationCommandOptionChoice{
+		Name:  fmt.Sprintf("max available (%d seconds)", int(available.Seconds())),
+		Value: int(available.Seconds()),
+	})
+	return choices
+}
+
+// typedSeconds returns what the user typed so far in the seconds option, empty if nothing.
+func typedSeconds(options []*discordgo.ApplicationCommandInteractionDataOption) string {
+	for _, opt := range options {
+		// The value of the focused option is sent as typed, it may not be a number yet.
+		if opt.Focused && opt.Name == "seconds" && opt.Value != nil {
+			return strings.TrimSpace(fmt.Sprint(opt.Value))
+		}
+	}
+	return ""
+}
+
+// filterSuggestions returns the choices matching what the user typed: the ones whose number of seconds starts with
+// it, or whose name contains it, e.g. "min" for "Last minute". Every choice matches when nothing was typed.
+func filterSuggestions(choices []*discordgo.ApplicationCommandOptionChoice, typed string) []*discordgo.ApplicationCommandOptionChoice {
+	if typed == "" {
+		return choices
+	}
+
+	var filtered []*discordgo.ApplicationCommandOptionChoice
+	for _, choice := range choices {
+		if strings.HasPrefix(fmt.Sprint(choice.Value), typed) || strings.Contains(strings.ToLower(choice.Name), strings.ToLower(typed)) {
+			filtered = append(filtered, choice)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,115 @@
+package bot
+
+import (
+	"bigbro2/bot/circular"
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSecondsSuggestions(t *testing.T) {
+	now := time.Unix(1000, 0)
+	fixed := []*discordgo.ApplicationCommandOptionChoice{
+		{Name: "Last 10s", Value: 10},
+		{Name: "Last 30s", Value: 30},
+		{Name: "Last minute", Value: 60},
+	}
+
+	tests := []struct {
+		name     string
+		stats    circular.Stats
+		expected *discordgo.ApplicationCommandOptionChoice
+	}{
+		{
+			name:     "empty buffer",
+			stats:    circular.Stats{},
+			expected: nil,
+		},
+		{
+			name:     "less than the minimum duration",
+			stats:    circular.Stats{Packets: 10, Bytes: 100, Oldest: now.Add(-time.Second)},
+			expected: nil,
+		},
+		{
+			name:     "partially filled buffer",
+			stats:    circular.Stats{Packets: 1000, Bytes: 10000, Oldest: now.Add(-20500 * time.Millisecond)},
+			expected: &discordgo.ApplicationCommandOptionChoice{Name: "max available (20 seconds)", Value: 20},
+		},
+		{
+			name:     "buffer longer than a replay",
+			stats:    circular.Stats{Packets: 90000, Bytes: 900000, Oldest: now.Add(-30 * time.Minute)},
+			expected: &discordgo.ApplicationCommandOptionChoice{Name: "max available (60 seconds)", Value: 60},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expected := fixed
+			if tt.expected != nil {
+				expected = append(fixed[:len(fixed):len(fixed)], tt.expected)
+			}
+			assert.Equal(t, expected, secondsSuggestions(tt.stats, now, maxDuration))
+		})
+	}
+}
+
+func TestSecondsSuggestions_maxDuration(t *testing.T) {
+	now := time.Unix(1000, 0)
+	stats := circular.Stats{Packets: 90000, Bytes: 900000, Oldest: now.Add(-30 * time.Minute)}
+
+	assert.Equal(t, []*discordgo.ApplicationCommandOptionChoice{
+		{Name: "Last 10s", Value: 10},
+		{Name: "max available (20 seconds)", Value: 20},
+	}, secondsSuggestions(stats, now, 20*time.Second))
+}
+
+func TestFilterSuggestions(t *testing.T) {
+	choices := []*discordgo.ApplicationCommandOptionChoice{
+		{Name: "Last 10s", Value: 10},
+		{Name: "Last 30s", Value: 30},
+		{Name: "Last minute", Value: 60},
+		{Name: "max available (35 seconds)", Value: 35},
+	}
+
+	tests := []struct {
+		name     string
+		options  []*discordgo.ApplicationCommandInteractionDataOption
+		expected []*discordgo.ApplicationCommandOptionChoice
+	}{
+		{name: "nothing typed", expected: choices},
+		{
+			name:     "empty",
+			options:  []*discordgo.ApplicationCommandInteractionDataOption{{Name: "seconds", Value: "", Focused: true}},
+			expected: choices,
+		},
+		{
+			name:     "number prefix",
+			options:  []*discordgo.ApplicationCommandInteractionDataOption{{Name: "seconds", Value: "3", Focused: true}},
+			expected: []*discordgo.ApplicationCommandOptionChoice{choices[1], choices[3]},
+		},
+		{
+			name:     "number",
+			options:  []*discordgo.ApplicationCommandInteractionDataOption{{Name: "seconds", Value: float64(60), Focused: true}},
+			expected: []*discordgo.ApplicationCommandOptionChoice{choices[2]},
+		},
+		{
+			name:     "name",
+			options:  []*discordgo.ApplicationCommandInteractionDataOption{{Name: "seconds", Value: "Min", Focused: true}},
+			expected: []*discordgo.ApplicationCommandOptionChoice{choices[2]},
+		},
+		{
+			name:    "no match",
+			options: []*discordgo.ApplicationCommandInteractionDataOption{{Name: "seconds", Value: "9", Focused: true}},
+		},
+		{
+			name:     "other option focused",
+			options:  []*discordgo.ApplicationCommandInteractionDataOption{{Name: "seconds", Value: "9"}},
+			expected: choices,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, filterSuggestions(choices, typedSeconds(tt.options)))
+		})
+	}
+}
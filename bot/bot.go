@@ -1,8 +1,11 @@
 package bot
 
 import (
+	"bigbro2/bot/circular"
 	"bigbro2/bot/cleanup"
 	"bigbro2/bot/command"
+	"bigbro2/bot/logging"
+	"bigbro2/bot/ratelimit"
 	"bigbro2/bot/voicechannel"
 	"context"
 	"errors"
@@ -10,21 +13,127 @@ import (
 	"github.com/bwmarrin/discordgo"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 )
 
 const (
 	defaultDuration = 30 * time.Second
+	minDuration     = 2 * time.Second
 	maxDuration     = time.Minute
+	// minRequestedDuration is the shortest replay created if Discord sends a seconds option below minDuration.
+	minRequestedDuration = time.Second
+	// guildWaitWindow is how long after the session is ready a guild missing from the state cache is waited for, see
+	// stateGuild. Past it, the guild is not coming.
+	guildWaitWindow = 30 * time.Second
+	// interactionGuildWait bounds the wait for the guild while handling an interaction, so the response is still
+	// deferred within the 3 seconds Discord waits for it.
+	interactionGuildWait = time.Second
 )
 
 type (
 	Bot struct {
 		logger                    *zap.Logger
+		now                       func() time.Time
 		session                   *discordgo.Session
 		guildID                   string
 		createVoiceChannelManager voicechannel.CreateManager
 		replayCmd                 *command.Replay
+		audioBuffer               bufferStats
+		commands                  commandSession
+		interactions              interactionSession
+		permissions               *permissions
+		settings                  *settings
+		options                   Options
+		defaultDuration           time.Duration // Duration of a replay until it is changed with /config.
+		maxDuration               time.Duration // Longest replay that can be asked for.
+		openBackoff               backoff
+		deferBackoff              backoff
+		guildBackoff              backoff // Waits for the guild to be in the state cache, see stateGuild.
+		readyAt                   int64   // Unix nanoseconds the session was ready at, zero before. Accessed atomically.
+		status                    statusSession
+		breaker                   *ratelimit.Breaker // Shared with the replay command.
+		statusTemplate            *template.Template
+		statusMu                  sync.Mutex
+		lastStatus                string // Status shown, to only update it when it changes.
+		handlersMu                sync.Mutex
+		handlers                  []commandHandler // Registered with RegisterCommand.
+		requests                  requests         // Interactions and reactions being handled, drained by Run.
+		drainTimeout              time.Duration    // How long Run waits for the requests being handled when it stops.
+	}
+	// CommandHandler handles the interactions of an application command.
+	CommandHandler = func(ctx context.Context, i *discordgo.InteractionCreate) error
+	commandHandler struct {
+		command *discordgo.ApplicationCommand
+		handle  CommandHandler
+	}
+	// Options contains the optional settings of the bot.
+	Options struct {
+		// AllowedRoleID is the ID of a role allowed to use the admin commands, in addition to the server managers.
+		AllowedRoleID string
+		// GlobalCommands registers the commands for every guild instead of only the configured one.
+		GlobalCommands bool
+		// IncludeMuted counts the muted and deafened members when choosing the voice channel to join, and the audience
+		// of the stage channels.
+		IncludeMuted bool
+		// SkipStageChannels never joins a stage channel. Otherwise, the bot joins them as a member of the audience,
+		// which hears the speakers.
+		SkipStageChannels bool
+		// AllowDMs accepts replays asked in a DM, from users in the voice channel of the configured guild.
+		// It requires GlobalCommands, as guild commands are not available in DMs.
+		AllowDMs bool
+		// ReactionMessageID is the ID of a message on which adding ReactionEmoji creates a replay. Empty disables it.
+		ReactionMessageID string
+		// ReactionEmoji is the emoji creating a replay, either a unicode emoji or "name:id" for a custom emoji.
+		ReactionEmoji string
+		// OpenMaxAttempts is the number of times opening the discord session is attempted before giving up.
+		// Zero means the default.
+		OpenMaxAttempts int
+		// DefaultDuration is the duration of a replay when the user does not specify one. Zero means 30 seconds.
+		DefaultDuration time.Duration
+		// MaxDuration is the longest replay that can be asked for. Zero means one minute.
+		MaxDuration time.Duration
+		// SettingsPath is the JSON file the settings changed with /config are saved to, so they survive a restart.
+		// Empty keeps them in memory.
+		SettingsPath string
+		// GuildAllowlist contains the IDs of other guilds whose members can ask for a replay, when the commands are
+		// global. The members must be in the voice channel of the configured guild, the only one recorded, and the
+		// replay is sent in their guild. Each guild has its own settings, see /config. Empty serves the configured
+		// guild only.
+		GuildAllowlist []string
+		// VoiceStateDebounce is how long the bot waits after a member joins or leaves a voice channel before choosing
+		// the channel to join, so a burst of changes (e.g. an event starting) is handled once. Zero disables it.
+		VoiceStateDebounce time.Duration
+		// StatusTemplate renders the status of the bot, shown as "Listening to ...", from the channel it is in and the
+		// number of people in it. Nil means DefaultStatusTemplate. See ParseStatusTemplate.
+		StatusTemplate *template.Template
+		// Breaker stops calling the Discord API for a while when the bot is rate limited over and over. It should be
+		// the one given to the replay command. Nil means a new one.
+		Breaker *ratelimit.Breaker
+		// Intents are the gateway intents requested when opening the session. Zero means DefaultIntents.
+		// Without the members intent, the names of the speakers may be missing from the replay summaries.
+		Intents discordgo.Intent
+	}
+	// discordSession is the part of the discord session used to open and close the connection to the gateway.
+	discordSession interface {
+		Open() error
+		Close() error
+	}
+	// bufferStats gives statistics about the audio buffer of a guild. It is implemented by circular.BufferRegistry.
+	bufferStats interface {
+		Stats(guildID string) circular.Stats
+	}
+	// interactionSession is the part of the discord session used to respond to interactions.
+	interactionSession interface {
+		InteractionRespond(interaction *discordgo.Interaction, resp *discordgo.InteractionResponse) error
+	}
+	// commandSession is the part of the discord session used to manage application commands.
+	commandSession interface {
+		ApplicationCommandCreate(appID string, guildID string, cmd *discordgo.ApplicationCommand) (*discordgo.ApplicationCommand, error)
+		ApplicationCommandDelete(appID, guildID, cmdID string) error
 	}
 	readyChannel              = <-chan struct{}
 	interactionCreateCallback = func(ctx context.Context, i *discordgo.InteractionCreate) error
@@ -35,63 +144,138 @@ func NewBot(
 	session *discordgo.Session,
 	guildID string,
 	withManager voicechannel.CreateManager,
+	audioBuffers *circular.BufferRegistry,
 	replayCmd *command.Replay,
+	options Options,
 ) *Bot {
+	openBackoff := defaultOpenBackoff
+	if options.OpenMaxAttempts > 0 {
+		openBackoff.maxAttempts = options.OpenMaxAttempts
+	}
+	defaultReplayDuration, maxReplayDuration := resolveDurations(options.DefaultDuration, options.MaxDuration)
+	statusTemplate := options.StatusTemplate
+	if statusTemplate == nil {
+		statusTemplate = template.Must(ParseStatusTemplate(DefaultStatusTemplate))
+	}
+	breaker := options.Breaker
+	if breaker == nil {
+		breaker = ratelimit.NewBreaker(logger, time.Now)
+	}
+	apiSession := breakerSession{session: session, breaker: breaker}
+
 	return &Bot{
 		session:                   session,
 		guildID:                   guildID,
 		logger:                    logger,
+		now:                       time.Now,
 		createVoiceChannelManager: withManager,
 		replayCmd:                 replayCmd,
+		audioBuffer:               audioBuffers,
+		commands:                  apiSession,
+		interactions:              session,
+		permissions:               newPermissions(options.AllowedRoleID, session, time.Now),
+		settings:                  newSettings(options.SettingsPath, defaultReplayDuration, maxReplayDuration),
+		options:                   options,
+		defaultDuration:           defaultReplayDuration,
+		maxDuration:               maxReplayDuration,
+		openBackoff:               openBackoff,
+		deferBackoff:              defaultDeferBackoff,
+		guildBackoff:              defaultGuildBackoff,
+		status:                    apiSession,
+		statusTemplate:            statusTemplate,
+		breaker:                   breaker,
+		drainTimeout:              defaultDrainTimeout,
 	}
 }
 
+// Run connects the bot to Discord and handles the commands until ctx is done. It then shuts down in order, see
+// shutdownPhase: the replays asked right before ctx is done are still created and sent.
 func (b *Bot) Run(ctx context.Context) error {
+	if err := b.settings.Load(); err != nil {
+		return fmt.Errorf("failed to load settings: %w", err)
+	}
+
+	var s shutdown
+	defer s.run(b)
+
+	// The requests are not cancelled with ctx, which only starts the shutdown. They are cancelled if they are not done
+	// once the shutdown stops waiting for them.
+	requestsCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	s.add(drainRequests, "requests", b.drainRequests(cancelRequests))
+
 	manager, cleanupManager, err := b.createVoiceChannelManager(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to create voice connection manager: %w", err)
 	}
-	defer b.cleanup("voice channel manager", cleanupManager)
+	s.add(disconnectVoice, "voice channel manager", cleanupManager)
 
 	onReadyChan, cleanupOnReadyHandler := b.registerOnReadyHandler()
-	defer b.cleanup("onReady handler", cleanupOnReadyHandler)
+	s.add(closeSession, "onReady handler", cleanupOnReadyHandler)
 
 	cleanupVoiceStateUpdateHandler := b.registerVoiceStateUpdateHandler(manager)
-	defer b.cleanup("voiceStatusUpdate handler", cleanupVoiceStateUpdateHandler)
+	s.add(stopAccepting, "voiceStatusUpdate handler", cleanupVoiceStateUpdateHandler)
+
+	cleanupRateLimitHandler := b.registerRateLimitHandler()
+	s.add(closeSession, "rate limit handler", cleanupRateLimitHandler)
 
-	cleanupSession, err := b.openDiscordSession()
+	cleanupSession, err := b.openDiscordSession(ctx, b.session)
 	if err != nil {
 		return fmt.Errorf("failed to open session: %w", err)
 	}
-	defer b.cleanup("discord session", cleanupSession)
+	s.add(closeSession, "discord session", cleanupSession)
 
-	b.waitToBeReady(onReadyChan)
+	if err := b.waitToBeReady(ctx, onReadyChan); err != nil {
+		return err
+	}
+
+	// Closed once the requests are drained, or cancelled, it waits for the replays they were creating to stop.
+	s.add(drainRequests, "replay command", b.replayCmd.Close)
+
+	b.RegisterCommand(b.replayCommand(), func(ctx context.Context, i *discordgo.InteractionCreate) error {
+		return b.handleReplayCommand(ctx, manager, i)
+	})
+	b.RegisterCommand(b.meCommand(), func(ctx context.Context, i *discordgo.InteractionCreate) error {
+		return b.handleReplayCommand(ctx, manager, i)
+	})
+	b.RegisterCommand(configCommand(), b.handleConfigCommand)
+	b.RegisterCommand(speakersCommand(), func(ctx context.Context, i *discordgo.InteractionCreate) error {
+		return b.handleSpeakersCommand(ctx, manager, i)
+	})
+	b.RegisterCommand(exportRawCommand(), func(ctx context.Context, i *discordgo.InteractionCreate) error {
+		return b.handleExportRawCommand(ctx, manager, i)
+	})
+	if manager.ArmingRequired() {
+		b.RegisterCommand(armCommand(), func(ctx context.Context, i *discordgo.InteractionCreate) error {
+			return b.handleArmCommand(ctx, manager, i)
+		})
+		b.RegisterCommand(disarmCommand(), func(ctx context.Context, i *discordgo.InteractionCreate) error {
+			return b.handleArmCommand(ctx, manager, i)
+		})
+	}
 
-	replayCommandID, cleanupApplicationCommand, err := b.createReplayCommand()
+	routes, cleanupApplicationCommands, err := b.createCommands()
 	if err != nil {
 		return err
 	}
-	defer b.cleanup("application command", cleanupApplicationCommand)
+	s.add(stopAccepting, "application commands", cleanupApplicationCommands)
 
-	cleanupReplayCommandHandler := b.registerInteractionCreateHandler(ctx, func(ctx context.Context, i *discordgo.InteractionCreate) error {
-		data, ok := i.Data.(discordgo.ApplicationCommandInteractionData)
-		if !ok {
-			b.logger.Debug("unexpected_interaction_create_data_type", zap.String("type", fmt.Sprintf("%T", i.Data)))
-			return nil
-		}
-		if data.ID != replayCommandID {
-			b.logger.Debug("interaction_command_id_unknown", zap.String("id", data.ID))
-			return nil
-		}
-		return b.handleReplayCommand(ctx, manager, i, data)
+	cleanupCommandHandler := b.registerInteractionCreateHandler(requestsCtx, func(ctx context.Context, i *discordgo.InteractionCreate) error {
+		return b.routeInteraction(ctx, routes, i)
 	})
-	defer b.cleanup("replay command handler", cleanupReplayCommandHandler)
+	s.add(stopAccepting, "command handler", cleanupCommandHandler)
+
+	if b.options.ReactionMessageID != "" {
+		cleanupReactionHandler := b.registerMessageReactionAddHandler(requestsCtx, manager)
+		s.add(stopAccepting, "message reaction add handler", cleanupReactionHandler)
+	}
 
 	g, ctx := errgroup.WithContext(ctx)
-	g.Go(func() error { return b.joinVoiceChannel(manager) })
+	g.Go(func() error { return b.joinVoiceChannel(ctx, manager) })
 	g.Go(func() error {
 		b.logger.Info("bot is running")
 		<-ctx.Done()
+		b.logger.Info("shutting down")
 		return nil
 	})
 
@@ -100,10 +284,12 @@ func (b *Bot) Run(ctx context.Context) error {
 
 func (b *Bot) registerOnReadyHandler() (readyChannel, cleanup.Func) {
 	onReadyCh := make(chan struct{})
+	// The session sends Ready again every time it reconnects.
+	var once sync.Once
 
 	b.logger.Debug("registering on ready handler")
 	removeReady := b.session.AddHandler(func(_ *discordgo.Session, i *discordgo.Ready) {
-		close(onReadyCh)
+		once.Do(func() { close(onReadyCh) })
 	})
 	cleanupFunc := func() error {
 		b.logger.Debug("unregistering onReady update handler")
@@ -117,6 +303,13 @@ func (b *Bot) registerOnReadyHandler() (readyChannel, cleanup.Func) {
 func (b *Bot) registerInteractionCreateHandler(ctx context.Context, cb interactionCreateCallback) cleanup.Func {
 	b.logger.Debug("registering interaction create handler")
 	removeInteractionUpdate := b.session.AddHandler(func(_ *discordgo.Session, i *discordgo.InteractionCreate) {
+		done, ok := b.requests.begin()
+		if !ok {
+			b.logger.Debug("interaction received while shutting down discarded", zap.String("interaction_id", i.ID))
+			return
+		}
+		defer done()
+
 		err := cb(ctx, i)
 		if err != nil {
 			b.logger.Error("could not handle interaction create", zap.Error(err))
@@ -132,32 +325,84 @@ func (b *Bot) registerInteractionCreateHandler(ctx context.Context, cb interacti
 
 func (b *Bot) registerVoiceStateUpdateHandler(manager *voicechannel.Manager) cleanup.Func {
 	b.logger.Debug("registering voice state update handler")
-	removeVoiceStateUpdate := b.session.AddHandler(func(_ *discordgo.Session, u *discordgo.VoiceStateUpdate) {
-		err := b.joinVoiceChannel(manager)
+	// Cancels the wait for the guild once the handler is unregistered.
+	ctx, cancel := context.WithCancel(context.Background())
+	join := newDebouncer(b.options.VoiceStateDebounce, func() {
+		err := b.joinVoiceChannel(ctx, manager)
 		if err != nil {
 			b.logger.Error("could not handle voice state update", zap.Error(err))
 		}
 	})
+	removeVoiceStateUpdate := b.session.AddHandler(func(_ *discordgo.Session, u *discordgo.VoiceStateUpdate) {
+		if !b.servesGuild(u.GuildID, false) {
+			return
+		}
+		manager.HandleVoiceStateUpdate(u)
+		join.Call()
+	})
 	cleanupFunc := func() error {
 		b.logger.Debug("unregistering voice state handler")
 		removeVoiceStateUpdate()
+		// Cancelled first, so a join running stops waiting for the guild and Stop returns.
+		cancel()
+		join.Stop()
 		return nil
 	}
 
 	return cleanupFunc
 }
 
-func (b *Bot) openDiscordSession() (cleanup.Func, error) {
+// resolveDurations returns the default and maximum durations of a replay, replacing the zero values by the defaults.
+// The maximum is at least minDuration, and the default is kept between minDuration and the maximum.
+func resolveDurations(defaultReplayDuration, maxReplayDuration time.Duration) (time.Duration, time.Duration) {
+	if maxReplayDuration <= 0 {
+		maxReplayDuration = maxDuration
+	}
+	if maxReplayDuration < minDuration {
+		maxReplayDuration = minDuration
+	}
+
+	if defaultReplayDuration <= 0 {
+		defaultReplayDuration = defaultDuration
+	}
+	if defaultReplayDuration < minDuration {
+		defaultReplayDuration = minDuration
+	}
+	if defaultReplayDuration > maxReplayDuration {
+		defaultReplayDuration = maxReplayDuration
+	}
+	return defaultReplayDuration, maxReplayDuration
+}
+
+// openDiscordSession opens the session, retrying with an exponential backoff if it fails.
+func (b *Bot) openDiscordSession(ctx context.Context, session discordSession) (cleanup.Func, error) {
 	b.logger.Debug("opening discord session")
-	b.session.Identify.Intents = discordgo.IntentGuilds | discordgo.IntentGuildMembers | discordgo.IntentGuildVoiceStates
+	intents, err := buildIntents(b.options)
+	if err != nil {
+		return nil, fmt.Errorf("invalid intents: %w", err)
+	}
+	if intents&discordgo.IntentGuildMembers == 0 {
+		b.logger.Info("the members intent is not requested, the names of the speakers may be missing from the summaries")
+	}
+	b.session.Identify.Intents = intents
 
-	if err := b.session.Open(); err != nil {
+	err = retry(ctx, b.logger, b.openBackoff, func() error {
+		if err := session.Open(); err != nil {
+			// The session may be half-open, it needs to be closed before opening it again.
+			if err := session.Close(); err != nil {
+				b.logger.Debug("could not close discord session after failing to open it", zap.Error(err))
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
 		return nil, fmt.Errorf("could not open discord session: %w", err)
 	}
 
 	cleanupFunc := func() error {
 		b.logger.Debug("closing discord session")
-		if err := b.session.Close(); err != nil {
+		if err := session.Close(); err != nil {
 			return fmt.Errorf("could not close discord session: %w", err)
 		}
 		return nil
@@ -166,27 +411,85 @@ func (b *Bot) openDiscordSession() (cleanup.Func, error) {
 	return cleanupFunc, nil
 }
 
-func (b *Bot) waitToBeReady(ch <-chan struct{}) {
+// waitToBeReady waits for the ready channel to be closed. It returns the error of the context if it is done first, e.g.
+// the session never becomes ready and the bot is interrupted.
+func (b *Bot) waitToBeReady(ctx context.Context, ch readyChannel) error {
 	b.logger.Debug("waiting for discord client to be ready")
-	<-ch
-	b.logger.Info("discord client is ready")
+	select {
+	case <-ch:
+		b.logger.Info("discord client is ready")
+		atomic.StoreInt64(&b.readyAt, b.now().UnixNano())
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("discord client was not ready: %w", ctx.Err())
+	}
 }
 
-func (b *Bot) createReplayCommand() (string, cleanup.Func, error) {
-	if b.session == nil {
-		return "", nil, errors.New("nil session")
+// RegisterCommand adds an application command to the bot. It must be called before Run.
+// The command is created when the bot starts and deleted when it stops. The interactions of the command are passed to
+// handle.
+func (b *Bot) RegisterCommand(cmd *discordgo.ApplicationCommand, handle CommandHandler) {
+	b.handlersMu.Lock()
+	defer b.handlersMu.Unlock()
+
+	b.handlers = append(b.handlers, commandHandler{command: cmd, handle: handle})
+}
+
+// createCommands creates the registered application commands.
+// It returns the handlers indexed by command ID, and a function to delete the commands.
+func (b *Bot) createCommands() (map[string]CommandHandler, cleanup.Func, error) {
+	b.handlersMu.Lock()
+	defer b.handlersMu.Unlock()
+
+	routes := map[string]CommandHandler{}
+	var cleanupFuncs []cleanup.Func
+	cleanupFunc := func() error {
+		var errs []error
+		for n := len(cleanupFuncs) - 1; n >= 0; n-- {
+			if err := cleanupFuncs[n](); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("could not delete %d application commands: %w", len(errs), errs[0])
+		}
+		return nil
 	}
-	if b.session.State == nil {
-		return "", nil, errors.New("nil state")
+
+	for _, h := range b.handlers {
+		id, cleanupCommand, err := b.createCommand(h.command)
+		if err != nil {
+			if err := cleanupFunc(); err != nil {
+				b.logger.Warn("failed to delete application commands", zap.Error(err))
+			}
+			return nil, nil, err
+		}
+		routes[id] = h.handle
+		cleanupFuncs = append(cleanupFuncs, cleanupCommand)
 	}
-	if b.session.State.User == nil {
-		return "", nil, errors.New("nil user")
+
+	return routes, cleanupFunc, nil
+}
+
+// routeInteraction passes the interaction to the handler of its command.
+func (b *Bot) routeInteraction(ctx context.Context, routes map[string]CommandHandler, i *discordgo.InteractionCreate) error {
+	data, ok := i.Data.(discordgo.ApplicationCommandInteractionData)
+	if !ok {
+		b.logger.Debug("unexpected_interaction_create_data_type", zap.String("type", fmt.Sprintf("%T", i.Data)))
+		return nil
 	}
-	userID := b.session.State.User.ID
 
-	b.logger.Debug("creating discord application command")
-	minValue := float64(2)
-	cmd, err := b.session.ApplicationCommandCreate(userID, b.guildID, &discordgo.ApplicationCommand{
+	handle, ok := routes[data.ID]
+	if !ok {
+		b.logger.Debug("interaction_command_id_unknown", zap.String("id", data.ID))
+		return nil
+	}
+	return handle(ctx, i)
+}
+
+func (b *Bot) replayCommand() *discordgo.ApplicationCommand {
+	minValue := minDuration.Seconds()
+	return &discordgo.ApplicationCommand{
 		Name:        "replay",
 		Description: "Save the last minute",
 		Options: []*discordgo.ApplicationCommandOption{{
@@ -194,69 +497,305 @@ func (b *Bot) createReplayCommand() (string, cleanup.Func, error) {
 			Name:        "seconds",
 			Description: "number of seconds to capture",
 			MinValue:    &minValue,
-			MaxValue:    maxDuration.Seconds(),
+			MaxValue:    b.maxDuration.Seconds(),
+			// See handleReplayAutocomplete.
+			Autocomplete: true,
+		}, {
+			Type:        discordgo.ApplicationCommandOptionBoolean,
+			Name:        "spatial",
+			Description: "place each speaker at a different position, left to right",
+		}, {
+			Type:        discordgo.ApplicationCommandOptionBoolean,
+			Name:        "multitrack",
+			Description: "put each speaker on their own channel, for editing (up to 8 speakers)",
+		}, {
+			Type:        discordgo.ApplicationCommandOptionBoolean,
+			Name:        "dryrun",
+			Description: "only describe what would be recorded, without uploading it",
+		}, {
+			Type:        discordgo.ApplicationCommandOptionBoolean,
+			Name:        "continue",
+			Description: "merge with your previous replay, if it was less than 5 minutes ago",
+		}, {
+			Type:        discordgo.ApplicationCommandOptionBoolean,
+			Name:        "all",
+			Description: "record everything the bot still has, however long (admins only)",
 		}},
-	})
+	}
+}
+
+// meCommand is a replay of the voice of the user asking for it only, see handleReplayCommand.
+func (b *Bot) meCommand() *discordgo.ApplicationCommand {
+	minValue := minDuration.Seconds()
+	return &discordgo.ApplicationCommand{
+		Name:        "me",
+		Description: "Save the last minute of your voice only",
+		Options: []*discordgo.ApplicationCommandOption{{
+			Type:        discordgo.ApplicationCommandOptionInteger,
+			Name:        "seconds",
+			Description: "number of seconds to capture",
+			MinValue:    &minValue,
+			MaxValue:    b.maxDuration.Seconds(),
+			// See handleReplayAutocomplete.
+			Autocomplete: true,
+		}},
+	}
+}
+
+func configCommand() *discordgo.ApplicationCommand {
+	return &discordgo.ApplicationCommand{
+		Name:        "config",
+		Description: "Change the bot configuration (admin only)",
+		Options: []*discordgo.ApplicationCommandOption{{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "default-seconds",
+			Description: "Change the number of seconds captured when it is not specified",
+			Options: []*discordgo.ApplicationCommandOption{{
+				Type:        discordgo.ApplicationCommandOptionInteger,
+				Name:        "seconds",
+				Description: "number of seconds to capture by default",
+				Required:    true,
+			}},
+		}},
+	}
+}
+
+func speakersCommand() *discordgo.ApplicationCommand {
+	return &discordgo.ApplicationCommand{
+		Name:        "speakers",
+		Description: "List the people who can be heard in a replay",
+	}
+}
+
+func exportRawCommand() *discordgo.ApplicationCommand {
+	minValue := minDuration.Seconds()
+	return &discordgo.ApplicationCommand{
+		Name:        "export-raw",
+		Description: "Download the voice of each speaker, unmixed, with a manifest (admin only)",
+		Options: []*discordgo.ApplicationCommandOption{{
+			Type:        discordgo.ApplicationCommandOptionInteger,
+			Name:        "seconds",
+			Description: "number of seconds to export, everything recorded by default",
+			MinValue:    &minValue,
+		}},
+	}
+}
+
+func armCommand() *discordgo.ApplicationCommand {
+	return &discordgo.ApplicationCommand{
+		Name:        "arm",
+		Description: "Start recording the voice channel, so replays can be created (admin only)",
+	}
+}
+
+func disarmCommand() *discordgo.ApplicationCommand {
+	return &discordgo.ApplicationCommand{
+		Name:        "disarm",
+		Description: "Stop recording the voice channel and forget what was recorded (admin only)",
+	}
+}
+
+// createCommand registers an application command, either in the guild or globally.
+// It returns the ID of the command and a function to unregister it.
+func (b *Bot) createCommand(command *discordgo.ApplicationCommand) (string, cleanup.Func, error) {
+	if b.session == nil {
+		return "", nil, errors.New("nil session")
+	}
+	if b.session.State == nil {
+		return "", nil, errors.New("nil state")
+	}
+	if b.session.State.User == nil {
+		return "", nil, errors.New("nil user")
+	}
+	userID := b.session.State.User.ID
+	guildID := b.commandGuildID()
 
+	logger := b.logger.With(zap.String("name", command.Name), zap.Bool("global", guildID == ""))
+	logger.Debug("creating discord application command")
+	cmd, err := b.commands.ApplicationCommandCreate(userID, guildID, command)
 	if err != nil {
-		return "", nil, fmt.Errorf("could not register application command: %w", err)
+		return "", nil, fmt.Errorf("could not register application command %q: %w", command.Name, err)
 	}
 	cleanupFunc := func() error {
-		b.logger.Debug("deleting application command", zap.String("id", cmd.ApplicationID))
-		err := b.session.ApplicationCommandDelete(userID, b.guildID, cmd.ID)
+		logger.Debug("deleting application command", zap.String("id", cmd.ID))
+		err := b.commands.ApplicationCommandDelete(userID, guildID, cmd.ID)
 		if err != nil {
-			b.logger.Debug("could not unregister application command", zap.Error(err))
+			logger.Debug("could not unregister application command", zap.Error(err))
 			return err
 		}
 		return nil
 	}
 
-	b.logger.Debug("created discord application command", zap.String("id", cmd.ID))
+	logger.Debug("created discord application command", zap.String("id", cmd.ID))
+	if guildID == "" {
+		logger.Info("global application commands can take up to an hour to be available in every server")
+	}
 	return cmd.ID, cleanupFunc, nil
 }
 
-func (b *Bot) joinVoiceChannel(m *voicechannel.Manager) error {
+// commandGuildID returns the guild in which the commands are registered, empty to register them globally.
+func (b *Bot) commandGuildID() string {
+	if b.options.GlobalCommands {
+		return ""
+	}
+	return b.guildID
+}
+
+func (b *Bot) joinVoiceChannel(ctx context.Context, m *voicechannel.Manager) error {
 	b.logger.Debug("finding channel with most members")
-	chanID, err := b.findChannelToJoin()
+	chanID, err := b.findChannelToJoin(ctx, m, b.now())
 	if err != nil {
 		return fmt.Errorf("could not get the channel with most members: %w", err)
 	}
 
 	m.JoinChannel(chanID)
+	b.updateStatus(chanID)
 	return nil
 }
 
-// findChannelToJoin returns the channel that the bot should join.
-func (b *Bot) findChannelToJoin() (*string, error) {
-	guild, err := b.session.State.Guild(b.guildID)
+// findChannelToJoin returns the channel that the bot should join: the one with the highest score.
+// Each member in a channel adds to its score, members who spoke recently add more, see memberScore.
+// If activity is nil, only the members are counted. The bot itself is not a member: it would make the channel it is
+// in look busier than it is. The audience of a stage channel cannot speak: it only counts with IncludeMuted, like the
+// muted members.
+func (b *Bot) findChannelToJoin(ctx context.Context, activity speakerActivity, now time.Time) (*string, error) {
+	guild, err := b.stateGuild(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("could not fetch guild: %w", err)
 	}
 
-	channelMembers := map[string]int{}
+	botUserID := ""
+	if b.session.State.User != nil {
+		botUserID = b.session.State.User.ID
+	}
+
+	channelScores := map[string]float64{}
 	for _, vs := range guild.VoiceStates {
-		if vs.SelfMute || vs.SelfDeaf {
+		if vs.UserID == botUserID {
+			continue
+		}
+		stage := b.isStageChannel(vs.ChannelID)
+		if stage && b.options.SkipStageChannels {
+			continue
+		}
+		if (vs.SelfMute || vs.SelfDeaf || stage && vs.Suppress) && !b.options.IncludeMuted {
 			// We do not account for people on mute, we want to join the channel with the most people that can speak.
 			continue
 		}
-		n, _ := channelMembers[vs.ChannelID]
-		channelMembers[vs.ChannelID] = n + 1
+
+		var lastSpoke *time.Time
+		if activity != nil {
+			if t, ok := activity.LastSpoke(vs.UserID); ok {
+				lastSpoke = &t
+			}
+		}
+		channelScores[vs.ChannelID] += memberScore(lastSpoke, now)
 	}
 
 	var result *string
-	var maxCount int
-	for channelID, memberCount := range channelMembers {
-		if memberCount > maxCount {
+	var maxScore float64
+	for channelID, score := range channelScores {
+		if score > maxScore {
 			cID := channelID // Copy because channelID is an iterator.
 			result = &cID
-			maxCount = memberCount
+			maxScore = score
 		}
 	}
 	return result, nil
 }
 
-func (b *Bot) isInVoiceChannel(voiceChannelID, userID string) (bool, error) {
+// isStageChannel returns whether the channel is a stage channel, where only the speakers can talk and the audience is
+// suppressed. A channel missing from the state cache is taken for a voice channel.
+func (b *Bot) isStageChannel(channelID string) bool {
+	channel, err := b.session.State.Channel(channelID)
+	return err == nil && channel.Type == discordgo.ChannelTypeGuildStageVoice
+}
+
+// stateGuild returns the guild from the state cache, with its voice states. Right after the session is ready, the
+// large guilds are not in the cache yet: within guildWaitWindow, it waits for the guild to be added until ctx is done,
+// see defaultGuildBackoff. Fetching the guild from the API instead would not help, it does not give the voice states.
+func (b *Bot) stateGuild(ctx context.Context) (*discordgo.Guild, error) {
+	if b.session.State == nil {
+		return nil, discordgo.ErrNilState
+	}
+
 	guild, err := b.session.State.Guild(b.guildID)
+	if !errors.Is(err, discordgo.ErrStateNotFound) || !b.justReady() {
+		return guild, err
+	}
+
+	err = retry(ctx, b.logger, b.guildBackoff, func() error {
+		var err error
+		guild, err = b.session.State.Guild(b.guildID)
+		return err
+	})
+	return guild, err
+}
+
+// justReady returns whether the session was ready less than guildWaitWindow ago.
+func (b *Bot) justReady() bool {
+	readyAt := atomic.LoadInt64(&b.readyAt)
+	return readyAt != 0 && b.now().Sub(time.Unix(0, readyAt)) < guildWaitWindow
+}
+
+// requester returns the user asking for a replay.
+// It returns false if the interaction was sent in a DM and DMs are not allowed. The requester of a replay asked in a DM
+// must be in the voice channel of the configured guild, like any other requester.
+func (b *Bot) requester(i *discordgo.InteractionCreate) (*discordgo.User, bool) {
+	if i.Member != nil {
+		return i.Member.User, true
+	}
+	if i.GuildID == "" && b.options.AllowDMs {
+		return i.User, true
+	}
+	return nil, false
+}
+
+// servesGuild returns whether the bot serves the guild: it only records the configured one. With remote, the guilds of
+// GuildAllowlist are served too, and an interaction sent in a DM if AllowDMs is set: their users ask for a replay of
+// the configured guild.
+func (b *Bot) servesGuild(guildID string, remote bool) bool {
+	switch {
+	case guildID == b.guildID:
+		return true
+	case !remote:
+		return false
+	case guildID == "":
+		return b.options.AllowDMs
+	default:
+		return b.guildAllowed(guildID)
+	}
+}
+
+// guildAllowed returns whether the guild is in GuildAllowlist.
+func (b *Bot) guildAllowed(guildID string) bool {
+	for _, id := range b.options.GuildAllowlist {
+		if id == guildID {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptInteraction returns whether the interaction comes from a guild the bot serves, see servesGuild. It is the guild
+// gate of every command. Global commands are visible in every server: the user of another one is told why nothing
+// happens, the interaction is discarded otherwise.
+func (b *Bot) acceptInteraction(logger *zap.Logger, i *discordgo.InteractionCreate, remote bool) (bool, error) {
+	if b.servesGuild(i.GuildID, remote) {
+		return true, nil
+	}
+	if b.options.GlobalCommands {
+		logger.Info("rejecting request from another guild")
+		return false, b.respondEphemeral(i, "❌ The bot does not record this server.")
+	}
+	logger.Debug("interaction from wrong guild discarded")
+	return false, nil
+}
+
+// isInVoiceChannel returns whether the user is in the voice channel.
+// Muted and deafened users are in the channel too: they can ask for a replay of what they heard (or missed).
+func (b *Bot) isInVoiceChannel(ctx context.Context, voiceChannelID, userID string) (bool, error) {
+	guild, err := b.stateGuild(ctx)
 	if err != nil {
 		return false, fmt.Errorf("could not fetch guild: %w", err)
 	}
@@ -269,8 +808,16 @@ func (b *Bot) isInVoiceChannel(voiceChannelID, userID string) (bool, error) {
 	return false, nil
 }
 
-func (b *Bot) handleReplayCommand(ctx context.Context, manager *voicechannel.Manager, i *discordgo.InteractionCreate, data discordgo.ApplicationCommandInteractionData) error {
+// handleReplayCommand creates a replay for /replay, and for /me, a replay of the voice streams of the user asking for
+// it only.
+func (b *Bot) handleReplayCommand(ctx context.Context, manager *voicechannel.Manager, i *discordgo.InteractionCreate) error {
+	if i.Type == discordgo.InteractionApplicationCommandAutocomplete {
+		return b.handleReplayAutocomplete(i)
+	}
+
+	data := i.ApplicationCommandData()
 	logger := b.logger.With(
+		zap.String("request_id", logging.NewRequestID()),
 		zap.String("interaction_id", i.ID),
 		zap.Uint8("interaction_type", uint8(i.Type)),
 		zap.String("guild_id", i.GuildID),
@@ -278,9 +825,8 @@ func (b *Bot) handleReplayCommand(ctx context.Context, manager *voicechannel.Man
 	)
 
 	logger.Debug("received interaction create")
-	if i.GuildID != b.guildID {
-		logger.Debug("interaction from wrong guild discarded")
-		return nil
+	if ok, err := b.acceptInteraction(logger, i, true); !ok {
+		return err
 	}
 
 	logger = logger.With(
@@ -297,21 +843,22 @@ func (b *Bot) handleReplayCommand(ctx context.Context, manager *voicechannel.Man
 		logger.Info("rejecting request as bot is not connected to the voice channel")
 		return b.session.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 			Type: discordgo.InteractionResponseChannelMessageWithSource,
-			Data: &discordgo.InteractionResponseData{Content: "❌ Bot is not connected to any voice channel."},
+			Data: &discordgo.InteractionResponseData{Content: notConnectedContent(manager.AccessErr())},
 		})
 	}
 
-	member := i.Member
-	if member == nil {
+	user, ok := b.requester(i)
+	if !ok {
 		logger.Info("rejecting request as it is not a guild message")
 		return b.session.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 			Type: discordgo.InteractionResponseChannelMessageWithSource,
 			Data: &discordgo.InteractionResponseData{Content: "❌ Can only be invoked in a server."},
 		})
 	}
-	logger = logger.With(zap.String("member_nick", member.Nick))
+	if i.Member != nil {
+		logger = logger.With(zap.String("member_nick", i.Member.Nick))
+	}
 
-	user := member.User
 	if user == nil {
 		return errors.New("user is nil")
 	}
@@ -327,7 +874,9 @@ func (b *Bot) handleReplayCommand(ctx context.Context, manager *voicechannel.Man
 		return nil
 	}
 
-	inVoiceChannel, err := b.isInVoiceChannel(*currentChannel, user.ID)
+	guildCtx, cancel := context.WithTimeout(ctx, interactionGuildWait)
+	defer cancel()
+	inVoiceChannel, err := b.isInVoiceChannel(guildCtx, *currentChannel, user.ID)
 	if err != nil {
 		return fmt.Errorf("could not check if bot is in voice channel of the user: %w", err)
 	}
@@ -339,38 +888,386 @@ func (b *Bot) handleReplayCommand(ctx context.Context, manager *voicechannel.Man
 			Data: &discordgo.InteractionResponseData{Content: "❌ You are not in the voice channel."},
 		})
 	}
+	if !manager.Armed() {
+		logger.Info("rejecting request as the capture is not armed")
+		return b.respondEphemeral(i, notArmedContent)
+	}
+
+	// A replay asked in an allowed guild uses its settings, one asked in a DM those of the configured guild.
+	settingsGuildID := i.GuildID
+	if settingsGuildID == "" {
+		settingsGuildID = b.guildID
+	}
+	opts, err := parseReplayOptions(data.Options, b.settings.DefaultDuration(settingsGuildID), b.maxDuration)
+	if err != nil {
+		return fmt.Errorf("could not parse options: %w", err)
+	}
+	if opts.All {
+		refusal, err := b.recordAllRefusal(i)
+		if err != nil {
+			return err
+		}
+		if refusal != "" {
+			logger.Info("rejecting request for the whole buffer", zap.String("refusal", refusal))
+			return b.respondEphemeral(i, refusal)
+		}
+		opts.Duration = bufferCoverage(b.audioBuffer.Stats(b.guildID), b.now())
+		opts.Continue = false
+	}
+	logger = logger.With(
+		zap.Duration("duration", opts.Duration),
+		zap.Bool("spatial", opts.Spatial),
+		zap.Bool("multitrack", opts.Multitrack),
+		zap.Bool("dry_run", opts.DryRun),
+		zap.Bool("continue", opts.Continue),
+		zap.Bool("all", opts.All),
+	)
+	if opts.Duration <= 0 {
+		logger.Info("rejecting request as the replay would be empty")
+		return b.respondEphemeral(i, "Nothing to record.")
+	}
+
+	speakers := manager.Speakers()
+	var ssrcs []uint32
+	if data.Name == "me" {
+		ssrcs = userSSRCs(speakers, user.ID)
+		if len(ssrcs) == 0 {
+			logger.Info("rejecting request for a clip of the user as they were not heard")
+			return b.respondEphemeral(i, "No audio of you to replay.")
+		}
+	}
+
+	// The replay could not be sent anyway. Interaction responses are not subject to the global rate limit.
+	if !b.breaker.Available() {
+		logger.Info("rejecting request as discord is rate limiting the bot")
+		return b.respondEphemeral(i, unavailableContent)
+	}
+
+	req := command.Request{
+		Interaction:    i.Interaction,
+		GuildID:        b.guildID,
+		Duration:       opts.Duration,
+		VoiceChannelID: *currentChannel,
+		Speakers:       speakers,
+		SSRCs:          ssrcs,
+		Departures:     manager.Departures(),
+		Spatial:        opts.Spatial,
+		Multitrack:     opts.Multitrack,
+		DryRun:         opts.DryRun,
+		Continue:       opts.Continue,
+		All:            opts.All,
+		JoinedAt:       manager.JoinedAt(),
+	}
+	b.deferReplayResponse(ctx, logger, i, user, &req)
+
+	err = b.replayCmd.Run(logging.WithLogger(ctx, logger), req)
+	if err != nil {
+		return fmt.Errorf("could not create replay: %w", err)
+	}
+
+	logger.Info("created replay")
+	return nil
+}
+
+// recordAllRefusal returns why the user cannot record the whole buffer, empty if they can. The replay can be much
+// longer than the longest one allowed, only the admins of the configured guild can archive it. The interactions sent
+// in a DM or in another guild do not tell whether the user is one: they are refused.
+func (b *Bot) recordAllRefusal(i *discordgo.InteractionCreate) (string, error) {
+	if i.GuildID != b.guildID {
+		return "❌ Recording everything can only be asked in the recorded server.", nil
+	}
+
+	admin, err := b.permissions.isAdmin(b.guildID, i.Member)
+	if err != nil {
+		return "", fmt.Errorf("could not check member permissions: %w", err)
+	}
+	if !admin {
+		return "❌ Only admins can record everything.", nil
+	}
+	return "", nil
+}
+
+// userSSRCs returns the voice streams of the user, sorted, given the user speaking in each voice stream. The user has
+// several of them if they reconnected to the voice channel.
+func userSSRCs(speakers map[uint32]string, userID string) []uint32 {
+	var ssrcs []uint32
+	for ssrc, speaker := range speakers {
+		if speaker == userID {
+			ssrcs = append(ssrcs, ssrc)
+		}
+	}
+	sort.Slice(ssrcs, func(i, j int) bool { return ssrcs[i] < ssrcs[j] })
+	return ssrcs
+}
+
+func (b *Bot) handleConfigCommand(_ context.Context, i *discordgo.InteractionCreate) error {
+	data := i.ApplicationCommandData()
+	logger := b.logger.With(
+		zap.String("interaction_id", i.ID),
+		zap.String("guild_id", i.GuildID),
+		zap.String("interaction_data_name", data.Name),
+	)
+
+	// The allowed guilds change their own settings.
+	if ok, err := b.acceptInteraction(logger, i, true); !ok {
+		return err
+	}
+	if i.GuildID == "" {
+		logger.Info("rejecting config request as it is not a guild message")
+		return b.respondEphemeral(i, "❌ Can only be invoked in a server.")
+	}
+
+	admin, err := b.permissions.isAdmin(i.GuildID, i.Member)
+	if err != nil {
+		return fmt.Errorf("could not check member permissions: %w", err)
+	}
+	if !admin {
+		logger.Info("rejecting config request as the member is not an admin")
+		return b.respondEphemeral(i, "❌ You are not allowed to change the configuration.")
+	}
+
+	if len(data.Options) != 1 {
+		return errors.New("expected exactly one subcommand")
+	}
+	subcommand := data.Options[0]
+	logger = logger.With(zap.String("subcommand", subcommand.Name))
 
-	duration := defaultDuration
-	if len(data.Options) == 1 {
-		opt := data.Options[0]
-		v, ok := opt.Value.(float64)
+	switch subcommand.Name {
+	case "default-seconds":
+		if len(subcommand.Options) != 1 {
+			return errors.New("expected exactly one option")
+		}
+		v, ok := subcommand.Options[0].Value.(float64)
 		if !ok {
 			return errors.New("unexpected type for value")
 		}
 
-		duration = time.Duration(1e9 * int64(v))
-		if duration > maxDuration {
-			duration = maxDuration
+		duration := time.Duration(1e9 * int64(v))
+		if err := b.settings.CheckDefaultDuration(duration); err != nil {
+			logger.Info("rejecting invalid default duration", zap.Duration("duration", duration), zap.Error(err))
+			return b.respondEphemeral(i, fmt.Sprintf("❌ Invalid value: %s.", err))
+		}
+		if err := b.settings.SetDefaultDuration(i.GuildID, duration); err != nil {
+			return fmt.Errorf("could not change default duration: %w", err)
+		}
+
+		logger.Info("changed default duration", zap.Duration("duration", duration))
+		return b.respondEphemeral(i, fmt.Sprintf("✅ Replays now last %d seconds by default.", int(duration.Seconds())))
+
+	default:
+		return fmt.Errorf("unknown subcommand %q", subcommand.Name)
+	}
+}
+
+// handleExportRawCommand sends the admins an archive of the voice streams of the audio buffer, unmixed, so the
+// moderators investigating an incident get the audio as Discord sent it. The archive is only shown to the admin
+// asking for it.
+func (b *Bot) handleExportRawCommand(ctx context.Context, manager *voicechannel.Manager, i *discordgo.InteractionCreate) error {
+	data := i.ApplicationCommandData()
+	logger := b.logger.With(
+		zap.String("interaction_id", i.ID),
+		zap.String("guild_id", i.GuildID),
+		zap.String("interaction_data_name", data.Name),
+	)
+
+	if ok, err := b.acceptInteraction(logger, i, false); !ok {
+		return err
+	}
+
+	admin, err := b.permissions.isAdmin(i.GuildID, i.Member)
+	if err != nil {
+		return fmt.Errorf("could not check member permissions: %w", err)
+	}
+	if !admin {
+		logger.Info("rejecting export request as the member is not an admin")
+		return b.respondEphemeral(i, "❌ Only admins can export the raw audio.")
+	}
+
+	duration := bufferCoverage(b.audioBuffer.Stats(b.guildID), b.now())
+	for _, option := range data.Options {
+		if seconds, ok := option.Value.(float64); ok && option.Name == "seconds" && time.Duration(seconds)*time.Second < duration {
+			duration = time.Duration(seconds) * time.Second
 		}
 	}
 	logger = logger.With(zap.Duration("duration", duration))
+	if duration <= 0 {
+		logger.Info("rejecting export request as the audio buffer is empty")
+		return b.respondEphemeral(i, "Nothing to record.")
+	}
+
+	if !b.breaker.Available() {
+		logger.Info("rejecting export request as discord is rate limiting the bot")
+		return b.respondEphemeral(i, unavailableContent)
+	}
 
-	err = b.session.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+	// Unlike a replay, the export is never sent in a new message, where everyone would see it.
+	deferred := &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Flags: discordgo.MessageFlagsEphemeral},
+	}
+	err = retry(ctx, logger, b.deferBackoff, func() error {
+		return b.interactions.InteractionRespond(i.Interaction, deferred)
 	})
 	if err != nil {
 		return fmt.Errorf("could not respond to interaction: %w", err)
 	}
 
-	err = b.replayCmd.Run(ctx, duration, i.Interaction)
+	req := command.Request{
+		Interaction: i.Interaction,
+		GuildID:     b.guildID,
+		Duration:    duration,
+		Speakers:    manager.Speakers(),
+	}
+	if err := b.replayCmd.Export(logging.WithLogger(ctx, logger), req); err != nil {
+		return fmt.Errorf("could not export voice streams: %w", err)
+	}
+	return nil
+}
+
+// handleArmCommand starts the capture of the voice channel on /arm, and stops it and clears the audio buffer on
+// /disarm. Only the admins can change it, as it decides whether the members are recorded.
+func (b *Bot) handleArmCommand(_ context.Context, manager *voicechannel.Manager, i *discordgo.InteractionCreate) error {
+	data := i.ApplicationCommandData()
+	logger := b.logger.With(
+		zap.String("interaction_id", i.ID),
+		zap.String("guild_id", i.GuildID),
+		zap.String("interaction_data_name", data.Name),
+	)
+
+	if ok, err := b.acceptInteraction(logger, i, false); !ok {
+		return err
+	}
+
+	admin, err := b.permissions.isAdmin(i.GuildID, i.Member)
 	if err != nil {
-		return fmt.Errorf("could not create replay: %w", err)
+		return fmt.Errorf("could not check member permissions: %w", err)
+	}
+	if !admin {
+		logger.Info("rejecting arming request as the member is not an admin")
+		return b.respondEphemeral(i, "❌ Only admins can start or stop the recording.")
 	}
 
-	logger.Info("created replay")
+	switch data.Name {
+	case "arm":
+		manager.Arm()
+		return b.respondEphemeral(i, "🔴 Recording, replays can be created until /disarm.")
+	case "disarm":
+		if err := manager.Disarm(); err != nil {
+			return fmt.Errorf("could not disarm capture: %w", err)
+		}
+		return b.respondEphemeral(i, "⏹️ Recording stopped, what was recorded was forgotten.")
+	default:
+		return fmt.Errorf("unknown command %q", data.Name)
+	}
+}
+
+// handleSpeakersCommand tells the user whose audio could be replayed, so they know what a replay would contain. Like a
+// replay, it is only answered to the users in the voice channel.
+func (b *Bot) handleSpeakersCommand(ctx context.Context, manager *voicechannel.Manager, i *discordgo.InteractionCreate) error {
+	logger := b.logger.With(
+		zap.String("interaction_id", i.ID),
+		zap.String("guild_id", i.GuildID),
+	)
+
+	if ok, err := b.acceptInteraction(logger, i, false); !ok {
+		return err
+	}
+
+	currentChannel := manager.CurrentChannelID()
+	if currentChannel == nil {
+		logger.Info("rejecting speakers request as bot is not connected to the voice channel")
+		return b.respondEphemeral(i, notConnectedContent(manager.AccessErr()))
+	}
+	user, ok := b.requester(i)
+	if !ok || user == nil {
+		logger.Info("rejecting speakers request as it is not a guild message")
+		return b.respondEphemeral(i, "❌ Can only be invoked in a server.")
+	}
+	guildCtx, cancel := context.WithTimeout(ctx, interactionGuildWait)
+	defer cancel()
+	inVoiceChannel, err := b.isInVoiceChannel(guildCtx, *currentChannel, user.ID)
+	if err != nil {
+		return fmt.Errorf("could not check if bot is in voice channel of the user: %w", err)
+	}
+	if !inVoiceChannel {
+		logger.Info("rejecting speakers request as the user is not in same the voice channel as the bot")
+		return b.respondEphemeral(i, "❌ You are not in the voice channel.")
+	}
+
+	// Reading the audio buffer can outlast the 3 seconds Discord waits for a response.
+	deferred := &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Flags: discordgo.MessageFlagsEphemeral},
+	}
+	err = retry(ctx, logger, b.deferBackoff, func() error {
+		return b.interactions.InteractionRespond(i.Interaction, deferred)
+	})
+	if err != nil {
+		return fmt.Errorf("could not respond to interaction: %w", err)
+	}
+
+	// Only the audio a replay can go back to is reported.
+	req := command.Request{
+		Interaction: i.Interaction,
+		GuildID:     b.guildID,
+		Duration:    b.maxDuration,
+		Speakers:    manager.Speakers(),
+	}
+	if err := b.replayCmd.ListSpeakers(logging.WithLogger(ctx, logger), req); err != nil {
+		return fmt.Errorf("could not list speakers: %w", err)
+	}
 	return nil
 }
 
+// deferReplayResponse tells Discord that the replay is being created, the user sees the bot "thinking" until the
+// response is edited with the replay. Discord must be told within 3 seconds, so it is only retried briefly.
+// If it still fails, the request is changed so the replay is sent in a new message in the channel of the interaction.
+func (b *Bot) deferReplayResponse(ctx context.Context, logger *zap.Logger, i *discordgo.InteractionCreate, user *discordgo.User, req *command.Request) {
+	deferred := &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+	}
+	if req.DryRun {
+		// A dry run is only useful to the person testing the bot.
+		deferred.Data = &discordgo.InteractionResponseData{Flags: discordgo.MessageFlagsEphemeral}
+	}
+
+	err := retry(ctx, logger, b.deferBackoff, func() error {
+		return b.interactions.InteractionRespond(i.Interaction, deferred)
+	})
+	if err == nil {
+		return
+	}
+
+	logger.Warn("could not respond to interaction, the replay will be sent in a new message", zap.Error(err))
+	req.Interaction = nil
+	req.ChannelID = i.ChannelID
+	req.Requester = user
+}
+
+// respondEphemeral responds to the interaction with a message only the user can see.
+func (b *Bot) respondEphemeral(i *discordgo.InteractionCreate, content string) error {
+	return b.interactions.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: content,
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+}
+
+// notArmedContent is the response to the replays asked for while the capture is disarmed, see voicechannel.Manager.Arm.
+const notArmedContent = "⏹️ Recording is not armed, an admin can start it with /arm."
+
+// notConnectedContent is the response to the requests refused because the bot is not in a voice channel. accessErr is
+// why it could not join the last channel, if it tried.
+func notConnectedContent(accessErr error) string {
+	var err *voicechannel.AccessError
+	if errors.As(accessErr, &err) {
+		return fmt.Sprintf("❌ Bot cannot join the voice channel: %s.", err.Reason)
+	}
+	return "❌ Bot is not connected to any voice channel."
+}
+
 // cleanup is a helper function to clean up resource and log failures.
 func (b *Bot) cleanup(name string, f cleanup.Func) {
 	err := f()
@@ -0,0 +1,1045 @@
+package bot
+
+import (
+	"bigbro2/bot/command"
+	"bigbro2/bot/voicechannel"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+// fakeCommandSession records the calls made to manage application commands.
+type fakeCommandSession struct {
+	createdGuildIDs []string
+	deletedGuildIDs []string
+	deletedIDs      []string
+	failOn          string // Name of a command that cannot be created.
+}
+
+func (f *fakeCommandSession) ApplicationCommandCreate(_ string, guildID string, cmd *discordgo.ApplicationCommand) (*discordgo.ApplicationCommand, error) {
+	if cmd.Name == f.failOn {
+		return nil, errors.New("create failed")
+	}
+	f.createdGuildIDs = append(f.createdGuildIDs, guildID)
+	return &discordgo.ApplicationCommand{ID: cmd.Name + "-id", Name: cmd.Name}, nil
+}
+
+func (f *fakeCommandSession) ApplicationCommandDelete(_, guildID, cmdID string) error {
+	f.deletedGuildIDs = append(f.deletedGuildIDs, guildID)
+	f.deletedIDs = append(f.deletedIDs, cmdID)
+	return nil
+}
+
+// newTestSession returns a session whose state contains the bot user.
+func newTestSession() *discordgo.Session {
+	state := discordgo.NewState()
+	state.User = &discordgo.User{ID: "bot-user-id"}
+	return &discordgo.Session{State: state}
+}
+
+func TestBot_createCommand(t *testing.T) {
+	tests := []struct {
+		name            string
+		globalCommands  bool
+		expectedGuildID string
+	}{
+		{name: "guild commands", globalCommands: false, expectedGuildID: "guild-id"},
+		{name: "global commands", globalCommands: true, expectedGuildID: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commands := &fakeCommandSession{}
+			b := &Bot{
+				logger:   zap.NewNop(),
+				session:  newTestSession(),
+				guildID:  "guild-id",
+				commands: commands,
+				options:  Options{GlobalCommands: tt.globalCommands},
+			}
+
+			id, cleanupFunc, err := b.createCommand(b.replayCommand())
+			require.NoError(t, err)
+			assert.Equal(t, "replay-id", id)
+			assert.Equal(t, []string{tt.expectedGuildID}, commands.createdGuildIDs)
+
+			require.NoError(t, cleanupFunc())
+			assert.Equal(t, []string{tt.expectedGuildID}, commands.deletedGuildIDs)
+		})
+	}
+}
+
+// commandInteraction returns the interaction sent when a command is used.
+func commandInteraction(commandID string) *discordgo.InteractionCreate {
+	return &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{
+		Type: discordgo.InteractionApplicationCommand,
+		Data: discordgo.ApplicationCommandInteractionData{ID: commandID},
+	}}
+}
+
+func TestBot_RegisterCommand(t *testing.T) {
+	commands := &fakeCommandSession{}
+	b := &Bot{
+		logger:   zap.NewNop(),
+		session:  newTestSession(),
+		guildID:  "guild-id",
+		commands: commands,
+	}
+
+	var handled []string
+	for _, name := range []string{"ping", "pong"} {
+		name := name
+		b.RegisterCommand(&discordgo.ApplicationCommand{Name: name}, func(_ context.Context, i *discordgo.InteractionCreate) error {
+			handled = append(handled, name)
+			return nil
+		})
+	}
+
+	routes, cleanupFunc, err := b.createCommands()
+	require.NoError(t, err)
+	assert.Len(t, commands.createdGuildIDs, 2)
+
+	require.NoError(t, b.routeInteraction(context.Background(), routes, commandInteraction("pong-id")))
+	require.NoError(t, b.routeInteraction(context.Background(), routes, commandInteraction("ping-id")))
+	require.NoError(t, b.routeInteraction(context.Background(), routes, commandInteraction("unknown-id")))
+	assert.Equal(t, []string{"pong", "ping"}, handled)
+
+	require.NoError(t, cleanupFunc())
+	assert.Equal(t, []string{"pong-id", "ping-id"}, commands.deletedIDs)
+}
+
+func TestBot_createCommands_failure(t *testing.T) {
+	commands := &fakeCommandSession{failOn: "broken"}
+	b := &Bot{
+		logger:   zap.NewNop(),
+		session:  newTestSession(),
+		guildID:  "guild-id",
+		commands: commands,
+	}
+	handle := func(context.Context, *discordgo.InteractionCreate) error { return nil }
+	b.RegisterCommand(&discordgo.ApplicationCommand{Name: "ping"}, handle)
+	b.RegisterCommand(&discordgo.ApplicationCommand{Name: "broken"}, handle)
+
+	_, _, err := b.createCommands()
+	assert.Error(t, err)
+	// The commands created before the failure are deleted.
+	assert.Equal(t, []string{"ping-id"}, commands.deletedIDs)
+}
+
+// fakeSpeakerActivity returns fixed times at which the members last spoke.
+type fakeSpeakerActivity map[string]time.Time
+
+func (f fakeSpeakerActivity) LastSpoke(userID string) (time.Time, bool) {
+	t, ok := f[userID]
+	return t, ok
+}
+
+// newTestSessionWithVoiceStates returns a session whose state contains the guild and its voice states.
+func newTestSessionWithVoiceStates(t *testing.T, guildID string, voiceStates []*discordgo.VoiceState) *discordgo.Session {
+	t.Helper()
+
+	session := newTestSession()
+	require.NoError(t, session.State.GuildAdd(&discordgo.Guild{ID: guildID, VoiceStates: voiceStates}))
+	return session
+}
+
+func TestBot_findChannelToJoin(t *testing.T) {
+	voiceStates := []*discordgo.VoiceState{
+		{UserID: "a", ChannelID: "talking"},
+		{UserID: "b", ChannelID: "talking"},
+		{UserID: "c", ChannelID: "muted", SelfMute: true},
+		{UserID: "d", ChannelID: "muted", SelfMute: true},
+		{UserID: "e", ChannelID: "muted", SelfDeaf: true},
+	}
+
+	tests := []struct {
+		name         string
+		includeMuted bool
+		expected     string
+	}{
+		{name: "muted members ignored", includeMuted: false, expected: "talking"},
+		{name: "muted members included", includeMuted: true, expected: "muted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Bot{
+				logger:  zap.NewNop(),
+				session: newTestSessionWithVoiceStates(t, "guild-id", voiceStates),
+				guildID: "guild-id",
+				options: Options{IncludeMuted: tt.includeMuted},
+			}
+
+			got, err := b.findChannelToJoin(context.Background(), nil, time.Now())
+			require.NoError(t, err)
+			require.NotNil(t, got)
+			assert.Equal(t, tt.expected, *got)
+		})
+	}
+}
+
+func TestBot_findChannelToJoin_stage(t *testing.T) {
+	// A stage with 2 speakers and a large audience, and a voice channel with 3 members.
+	voiceStates := []*discordgo.VoiceState{
+		{UserID: "a", ChannelID: "stage"},
+		{UserID: "b", ChannelID: "stage"},
+		{UserID: "c", ChannelID: "stage", Suppress: true},
+		{UserID: "d", ChannelID: "stage", Suppress: true},
+		{UserID: "e", ChannelID: "stage", Suppress: true},
+		{UserID: "f", ChannelID: "voice"},
+		{UserID: "g", ChannelID: "voice"},
+		{UserID: "h", ChannelID: "voice"},
+		{UserID: "i", ChannelID: "unknown", Suppress: true},
+	}
+
+	tests := []struct {
+		name        string
+		options     Options
+		voiceStates []*discordgo.VoiceState
+		expected    *string
+	}{
+		{name: "audience ignored", voiceStates: voiceStates, expected: ptr("voice")},
+		{name: "audience included", options: Options{IncludeMuted: true}, voiceStates: voiceStates, expected: ptr("stage")},
+		{name: "stage skipped", options: Options{IncludeMuted: true, SkipStageChannels: true}, voiceStates: voiceStates, expected: ptr("voice")},
+		{
+			name:        "only a stage",
+			voiceStates: []*discordgo.VoiceState{{UserID: "a", ChannelID: "stage"}, {UserID: "c", ChannelID: "stage", Suppress: true}},
+			expected:    ptr("stage"),
+		},
+		{
+			name:        "only a skipped stage",
+			options:     Options{SkipStageChannels: true},
+			voiceStates: []*discordgo.VoiceState{{UserID: "a", ChannelID: "stage"}, {UserID: "c", ChannelID: "stage", Suppress: true}},
+			expected:    nil,
+		},
+		{
+			// Suppress only matters in a stage channel, a channel missing from the state is a voice channel.
+			name:        "suppressed outside of a stage",
+			options:     Options{SkipStageChannels: true},
+			voiceStates: []*discordgo.VoiceState{{UserID: "i", ChannelID: "unknown", Suppress: true}},
+			expected:    ptr("unknown"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newTestSession()
+			require.NoError(t, session.State.GuildAdd(&discordgo.Guild{
+				ID:          "guild-id",
+				VoiceStates: tt.voiceStates,
+				Channels: []*discordgo.Channel{
+					{ID: "stage", GuildID: "guild-id", Type: discordgo.ChannelTypeGuildStageVoice},
+					{ID: "voice", GuildID: "guild-id", Type: discordgo.ChannelTypeGuildVoice},
+				},
+			}))
+			b := &Bot{logger: zap.NewNop(), session: session, guildID: "guild-id", options: tt.options}
+
+			got, err := b.findChannelToJoin(context.Background(), nil, time.Now())
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestBot_findChannelToJoin_botIgnored(t *testing.T) {
+	tests := []struct {
+		name        string
+		voiceStates []*discordgo.VoiceState
+		expected    *string
+	}{
+		{
+			name: "bot does not make its channel win",
+			voiceStates: []*discordgo.VoiceState{
+				{UserID: "bot-user-id", ChannelID: "current"},
+				{UserID: "a", ChannelID: "current"},
+				{UserID: "b", ChannelID: "other"},
+				{UserID: "c", ChannelID: "other"},
+			},
+			expected: ptr("other"),
+		},
+		{
+			name: "bot alone",
+			voiceStates: []*discordgo.VoiceState{
+				{UserID: "bot-user-id", ChannelID: "current"},
+			},
+			expected: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Bot{
+				logger:  zap.NewNop(),
+				session: newTestSessionWithVoiceStates(t, "guild-id", tt.voiceStates),
+				guildID: "guild-id",
+			}
+
+			got, err := b.findChannelToJoin(context.Background(), nil, time.Now())
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestBot_stateGuild(t *testing.T) {
+	testBackoff := backoff{maxAttempts: 5, initialDelay: 10 * time.Millisecond, maxDelay: 10 * time.Millisecond}
+	now := time.Unix(1_000_000, 0)
+	newBot := func(session *discordgo.Session, readyAt time.Time) *Bot {
+		return &Bot{
+			logger:       zap.NewNop(),
+			now:          func() time.Time { return now },
+			session:      session,
+			guildID:      "guild-id",
+			guildBackoff: testBackoff,
+			readyAt:      readyAt.UnixNano(),
+		}
+	}
+
+	t.Run("guild added late", func(t *testing.T) {
+		session := newTestSession()
+		b := newBot(session, now.Add(-time.Second))
+
+		// The guild is added to the state cache after the first lookup failed.
+		added := make(chan error)
+		go func() {
+			time.Sleep(5 * time.Millisecond)
+			added <- session.State.GuildAdd(&discordgo.Guild{
+				ID:          "guild-id",
+				VoiceStates: []*discordgo.VoiceState{{UserID: "a", ChannelID: "channel"}},
+			})
+		}()
+
+		got, err := b.findChannelToJoin(context.Background(), nil, now)
+		require.NoError(t, <-added)
+		require.NoError(t, err)
+		require.NotNil(t, got)
+		assert.Equal(t, "channel", *got)
+
+		inChannel, err := b.isInVoiceChannel(context.Background(), "channel", "a")
+		require.NoError(t, err)
+		assert.True(t, inChannel)
+	})
+
+	t.Run("guild never added", func(t *testing.T) {
+		b := newBot(newTestSession(), now.Add(-time.Second))
+
+		_, err := b.isInVoiceChannel(context.Background(), "channel", "a")
+		assert.ErrorIs(t, err, discordgo.ErrStateNotFound)
+		assert.ErrorContains(t, err, "giving up after 5 attempts")
+	})
+
+	t.Run("ready long ago", func(t *testing.T) {
+		b := newBot(newTestSession(), now.Add(-guildWaitWindow))
+
+		_, err := b.isInVoiceChannel(context.Background(), "channel", "a")
+		assert.ErrorIs(t, err, discordgo.ErrStateNotFound)
+		assert.NotContains(t, err.Error(), "giving up")
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		b := newBot(newTestSession(), now.Add(-time.Second))
+		b.guildBackoff = backoff{maxAttempts: 5, initialDelay: time.Hour, maxDelay: time.Hour}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := b.isInVoiceChannel(ctx, "channel", "a")
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func TestBot_isInVoiceChannel(t *testing.T) {
+	voiceStates := []*discordgo.VoiceState{
+		{UserID: "talking", ChannelID: "channel"},
+		{UserID: "muted", ChannelID: "channel", SelfMute: true},
+		{UserID: "deafened", ChannelID: "channel", SelfDeaf: true},
+		{UserID: "elsewhere", ChannelID: "other-channel"},
+	}
+
+	tests := []struct {
+		userID   string
+		expected bool
+	}{
+		{userID: "talking", expected: true},
+		{userID: "muted", expected: true},
+		{userID: "deafened", expected: true},
+		{userID: "elsewhere", expected: false},
+		{userID: "absent", expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.userID, func(t *testing.T) {
+			b := &Bot{
+				logger:  zap.NewNop(),
+				session: newTestSessionWithVoiceStates(t, "guild-id", voiceStates),
+				guildID: "guild-id",
+			}
+
+			got, err := b.isInVoiceChannel(context.Background(), "channel", tt.userID)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+// fakeDiscordSession fails to open a given number of times before succeeding.
+type fakeDiscordSession struct {
+	failures   int
+	openCalls  int
+	closeCalls int
+}
+
+func (f *fakeDiscordSession) Open() error {
+	f.openCalls++
+	if f.openCalls <= f.failures {
+		return errors.New("gateway unavailable")
+	}
+	return nil
+}
+
+func (f *fakeDiscordSession) Close() error {
+	f.closeCalls++
+	return nil
+}
+
+func TestBot_openDiscordSession(t *testing.T) {
+	tests := []struct {
+		name              string
+		failures          int
+		maxAttempts       int
+		wantErr           bool
+		expectedOpenCalls int
+	}{
+		{name: "opens first time", failures: 0, maxAttempts: 3, expectedOpenCalls: 1},
+		{name: "opens after failures", failures: 2, maxAttempts: 3, expectedOpenCalls: 3},
+		{name: "gives up", failures: 5, maxAttempts: 3, wantErr: true, expectedOpenCalls: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := &fakeDiscordSession{failures: tt.failures}
+			b := &Bot{
+				logger:      zap.NewNop(),
+				session:     newTestSession(),
+				openBackoff: backoff{maxAttempts: tt.maxAttempts, initialDelay: time.Millisecond, maxDelay: time.Millisecond},
+			}
+
+			cleanupFunc, err := b.openDiscordSession(context.Background(), session)
+			assert.Equal(t, tt.expectedOpenCalls, session.openCalls)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			// Every failed attempt closes the session, and so does the cleanup.
+			require.NoError(t, cleanupFunc())
+			assert.Equal(t, tt.failures+1, session.closeCalls)
+		})
+	}
+}
+
+func TestBot_openDiscordSession_cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	session := &fakeDiscordSession{failures: 5}
+	b := &Bot{
+		logger:      zap.NewNop(),
+		session:     newTestSession(),
+		openBackoff: backoff{maxAttempts: 5, initialDelay: time.Hour, maxDelay: time.Hour},
+	}
+
+	_, err := b.openDiscordSession(ctx, session)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, session.openCalls)
+}
+
+func TestBot_waitToBeReady(t *testing.T) {
+	b := &Bot{logger: zap.NewNop()}
+
+	ready := make(chan struct{})
+	close(ready)
+	assert.NoError(t, b.waitToBeReady(context.Background(), ready))
+
+	// The session never becomes ready.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- b.waitToBeReady(ctx, make(chan struct{})) }()
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("waitToBeReady did not return once the context was cancelled")
+	}
+}
+
+func TestBot_findChannelToJoin_activity(t *testing.T) {
+	now := time.Unix(1000, 0)
+	voiceStates := []*discordgo.VoiceState{
+		{UserID: "a", ChannelID: "crowded"},
+		{UserID: "b", ChannelID: "crowded"},
+		{UserID: "c", ChannelID: "crowded"},
+		{UserID: "d", ChannelID: "lively"},
+		{UserID: "e", ChannelID: "lively"},
+	}
+
+	tests := []struct {
+		name     string
+		activity fakeSpeakerActivity
+		expected string
+	}{
+		{
+			name:     "nobody spoke",
+			activity: fakeSpeakerActivity{},
+			expected: "crowded",
+		},
+		{
+			name:     "members speaking in the smaller channel",
+			activity: fakeSpeakerActivity{"d": now.Add(-5 * time.Second), "e": now},
+			expected: "lively",
+		},
+		{
+			name:     "members spoke a long time ago",
+			activity: fakeSpeakerActivity{"d": now.Add(-10 * time.Minute), "e": now.Add(-10 * time.Minute)},
+			expected: "crowded",
+		},
+		{
+			name:     "members speaking in both channels",
+			activity: fakeSpeakerActivity{"a": now, "b": now, "d": now},
+			expected: "crowded",
+		},
+		{
+			name:     "every member speaking in the smaller channel",
+			activity: fakeSpeakerActivity{"a": now, "d": now, "e": now},
+			expected: "lively",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Bot{
+				logger:  zap.NewNop(),
+				session: newTestSessionWithVoiceStates(t, "guild-id", voiceStates),
+				guildID: "guild-id",
+			}
+
+			got, err := b.findChannelToJoin(context.Background(), tt.activity, now)
+			require.NoError(t, err)
+			require.NotNil(t, got)
+			assert.Equal(t, tt.expected, *got)
+		})
+	}
+}
+
+func TestBot_requester_dm(t *testing.T) {
+	voiceStates := []*discordgo.VoiceState{
+		{UserID: "in-channel", ChannelID: "channel-id"},
+		{UserID: "elsewhere", ChannelID: "other-channel-id"},
+	}
+
+	tests := []struct {
+		name              string
+		allowDMs          bool
+		interaction       *discordgo.Interaction
+		expectedOK        bool
+		expectedInChannel bool
+	}{
+		{
+			name:              "guild interaction",
+			interaction:       &discordgo.Interaction{GuildID: "guild-id", Member: &discordgo.Member{User: &discordgo.User{ID: "in-channel"}}},
+			expectedOK:        true,
+			expectedInChannel: true,
+		},
+		{
+			name:        "DM not allowed",
+			allowDMs:    false,
+			interaction: &discordgo.Interaction{User: &discordgo.User{ID: "in-channel"}},
+			expectedOK:  false,
+		},
+		{
+			name:              "DM from a user in the voice channel",
+			allowDMs:          true,
+			interaction:       &discordgo.Interaction{User: &discordgo.User{ID: "in-channel"}},
+			expectedOK:        true,
+			expectedInChannel: true,
+		},
+		{
+			name:              "DM from a user in another voice channel",
+			allowDMs:          true,
+			interaction:       &discordgo.Interaction{User: &discordgo.User{ID: "elsewhere"}},
+			expectedOK:        true,
+			expectedInChannel: false,
+		},
+		{
+			name:              "DM from a user not in the guild voice channels",
+			allowDMs:          true,
+			interaction:       &discordgo.Interaction{User: &discordgo.User{ID: "stranger"}},
+			expectedOK:        true,
+			expectedInChannel: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Bot{
+				logger:  zap.NewNop(),
+				session: newTestSessionWithVoiceStates(t, "guild-id", voiceStates),
+				guildID: "guild-id",
+				options: Options{AllowDMs: tt.allowDMs},
+			}
+
+			user, ok := b.requester(&discordgo.InteractionCreate{Interaction: tt.interaction})
+			require.Equal(t, tt.expectedOK, ok)
+			if !ok {
+				return
+			}
+
+			require.NotNil(t, user)
+			inChannel, err := b.isInVoiceChannel(context.Background(), "channel-id", user.ID)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedInChannel, inChannel)
+		})
+	}
+}
+
+func TestBot_acceptInteraction(t *testing.T) {
+	tests := []struct {
+		name              string
+		guildID           string
+		remote            bool
+		allowDMs          bool
+		allowlist         []string
+		globalCommands    bool
+		expected          bool
+		expectedResponses int
+	}{
+		{name: "recorded guild", guildID: "guild-id", expected: true},
+		{name: "other guild", guildID: "other-guild-id"},
+		{name: "other guild with global commands", guildID: "other-guild-id", globalCommands: true, expectedResponses: 1},
+		{name: "DM", remote: true, allowDMs: true, globalCommands: true, expected: true},
+		{name: "DM not allowed", remote: true, globalCommands: true, expectedResponses: 1},
+		{name: "DM to a command not accepting them", allowDMs: true, globalCommands: true, expectedResponses: 1},
+		{
+			name:           "allowed guild",
+			guildID:        "other-guild-id",
+			remote:         true,
+			allowlist:      []string{"third-guild-id", "other-guild-id"},
+			globalCommands: true,
+			expected:       true,
+		},
+		{
+			name:              "guild not allowed",
+			guildID:           "other-guild-id",
+			remote:            true,
+			allowlist:         []string{"third-guild-id"},
+			globalCommands:    true,
+			expectedResponses: 1,
+		},
+		{
+			name:              "allowed guild to a command not accepting them",
+			guildID:           "other-guild-id",
+			allowlist:         []string{"other-guild-id"},
+			globalCommands:    true,
+			expectedResponses: 1,
+		},
+		{name: "DM with an allowlist", remote: true, allowlist: []string{"other-guild-id"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interactions := &fakeInteractionSession{}
+			b := &Bot{
+				logger:       zap.NewNop(),
+				guildID:      "guild-id",
+				interactions: interactions,
+				options: Options{
+					AllowDMs:       tt.allowDMs,
+					GuildAllowlist: tt.allowlist,
+					GlobalCommands: tt.globalCommands,
+				},
+			}
+
+			i := &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{GuildID: tt.guildID}}
+			ok, err := b.acceptInteraction(b.logger, i, tt.remote)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, ok)
+			assert.Len(t, interactions.responses, tt.expectedResponses)
+		})
+	}
+}
+
+func TestResolveDurations(t *testing.T) {
+	tests := []struct {
+		name            string
+		defaultDuration time.Duration
+		maxDuration     time.Duration
+		expectedDefault time.Duration
+		expectedMax     time.Duration
+	}{
+		{name: "zero values", expectedDefault: defaultDuration, expectedMax: maxDuration},
+		{
+			name:            "injected values",
+			defaultDuration: 45 * time.Second,
+			maxDuration:     2 * time.Minute,
+			expectedDefault: 45 * time.Second,
+			expectedMax:     2 * time.Minute,
+		},
+		{
+			name:            "default above maximum",
+			maxDuration:     20 * time.Second,
+			expectedDefault: 20 * time.Second,
+			expectedMax:     20 * time.Second,
+		},
+		{
+			name:            "below minimum",
+			defaultDuration: time.Second,
+			maxDuration:     time.Second,
+			expectedDefault: minDuration,
+			expectedMax:     minDuration,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotDefault, gotMax := resolveDurations(tt.defaultDuration, tt.maxDuration)
+			assert.Equal(t, tt.expectedDefault, gotDefault)
+			assert.Equal(t, tt.expectedMax, gotMax)
+		})
+	}
+}
+
+func TestNewBot_durations(t *testing.T) {
+	b := NewBot(zap.NewNop(), newTestSession(), "guild-id", nil, nil, nil, Options{MaxDuration: 2 * time.Minute})
+
+	assert.Equal(t, defaultDuration, b.settings.DefaultDuration("guild-id"))
+	assert.Equal(t, 2*time.Minute, b.maxDuration)
+	assert.Equal(t, float64(120), b.replayCommand().Options[0].MaxValue)
+	assert.NoError(t, b.settings.SetDefaultDuration("guild-id", 90*time.Second))
+}
+
+// fakeInteractionSession fails to respond to the first interactions.
+type fakeInteractionSession struct {
+	failures  int
+	responses []*discordgo.InteractionResponse
+}
+
+func (f *fakeInteractionSession) InteractionRespond(_ *discordgo.Interaction, resp *discordgo.InteractionResponse) error {
+	f.responses = append(f.responses, resp)
+	if len(f.responses) <= f.failures {
+		return errors.New("connection reset by peer")
+	}
+	return nil
+}
+
+func TestBot_deferReplayResponse(t *testing.T) {
+	user := &discordgo.User{ID: "user-id"}
+	interaction := &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{ChannelID: "text-channel-id"}}
+
+	tests := []struct {
+		name             string
+		failures         int
+		expectedAttempts int
+		expectedRequest  command.Request
+	}{
+		{
+			name:             "deferred",
+			failures:         0,
+			expectedAttempts: 1,
+			expectedRequest:  command.Request{Interaction: interaction.Interaction},
+		},
+		{
+			name:             "deferred after a failure",
+			failures:         2,
+			expectedAttempts: 3,
+			expectedRequest:  command.Request{Interaction: interaction.Interaction},
+		},
+		{
+			name:             "fallback to a new message",
+			failures:         3,
+			expectedAttempts: 3,
+			expectedRequest:  command.Request{ChannelID: "text-channel-id", Requester: user},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interactions := &fakeInteractionSession{failures: tt.failures}
+			b := &Bot{
+				logger:       zap.NewNop(),
+				interactions: interactions,
+				deferBackoff: backoff{maxAttempts: 3, initialDelay: time.Millisecond, maxDelay: time.Millisecond},
+			}
+
+			req := command.Request{Interaction: interaction.Interaction}
+			b.deferReplayResponse(context.Background(), b.logger, interaction, user, &req)
+
+			assert.Len(t, interactions.responses, tt.expectedAttempts)
+			assert.Equal(t, tt.expectedRequest, req)
+		})
+	}
+}
+
+func TestBot_deferReplayResponse_dryRun(t *testing.T) {
+	interactions := &fakeInteractionSession{}
+	b := &Bot{logger: zap.NewNop(), interactions: interactions, deferBackoff: defaultDeferBackoff}
+
+	req := command.Request{Interaction: &discordgo.Interaction{}, DryRun: true}
+	b.deferReplayResponse(context.Background(), b.logger, &discordgo.InteractionCreate{Interaction: req.Interaction}, nil, &req)
+
+	require.Len(t, interactions.responses, 1)
+	assert.Equal(t, discordgo.InteractionResponseDeferredChannelMessageWithSource, interactions.responses[0].Type)
+	require.NotNil(t, interactions.responses[0].Data)
+	assert.Equal(t, discordgo.MessageFlagsEphemeral, interactions.responses[0].Data.Flags)
+}
+
+func TestNotConnectedContent(t *testing.T) {
+	tests := []struct {
+		name      string
+		accessErr error
+		expected  string
+	}{
+		{name: "never asked to join", expected: "❌ Bot is not connected to any voice channel."},
+		{
+			name:      "cannot join",
+			accessErr: fmt.Errorf("join: %w", &voicechannel.AccessError{ChannelID: "1", Reason: "the channel is full (5/5)"}),
+			expected:  "❌ Bot cannot join the voice channel: the channel is full (5/5).",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, notConnectedContent(tt.accessErr))
+		})
+	}
+}
+
+func TestBot_handleExportRawCommand_permissions(t *testing.T) {
+	exportRaw := func(guildID string, member *discordgo.Member) *discordgo.InteractionCreate {
+		return &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{
+			Type:    discordgo.InteractionApplicationCommand,
+			GuildID: guildID,
+			Member:  member,
+			Data:    discordgo.ApplicationCommandInteractionData{Name: "export-raw"},
+		}}
+	}
+
+	tests := []struct {
+		name        string
+		interaction *discordgo.InteractionCreate
+		expected    []*discordgo.InteractionResponse
+	}{
+		{
+			name:        "not an admin",
+			interaction: exportRaw("guild-id", &discordgo.Member{User: &discordgo.User{ID: "user-id"}}),
+			expected: []*discordgo.InteractionResponse{{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Content: "❌ Only admins can export the raw audio.",
+					Flags:   discordgo.MessageFlagsEphemeral,
+				},
+			}},
+		},
+		{
+			name:        "other guild",
+			interaction: exportRaw("other-guild-id", &discordgo.Member{Permissions: discordgo.PermissionManageServer}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interactions := &fakeInteractionSession{}
+			b := &Bot{
+				logger:       zap.NewNop(),
+				guildID:      "guild-id",
+				interactions: interactions,
+				permissions:  newPermissions("", nil, time.Now),
+			}
+
+			require.NoError(t, b.handleExportRawCommand(context.Background(), nil, tt.interaction))
+			assert.Equal(t, tt.expected, interactions.responses)
+		})
+	}
+}
+
+func TestBot_handleConfigCommand(t *testing.T) {
+	config := func(guildID string, member *discordgo.Member) *discordgo.InteractionCreate {
+		return &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{
+			Type:    discordgo.InteractionApplicationCommand,
+			GuildID: guildID,
+			Member:  member,
+			Data: discordgo.ApplicationCommandInteractionData{
+				Name: "config",
+				Options: []*discordgo.ApplicationCommandInteractionDataOption{{
+					Name:    "default-seconds",
+					Options: []*discordgo.ApplicationCommandInteractionDataOption{{Name: "seconds", Value: float64(45)}},
+				}},
+			},
+		}}
+	}
+	admin := &discordgo.Member{Permissions: discordgo.PermissionManageServer}
+
+	tests := []struct {
+		name            string
+		interaction     *discordgo.InteractionCreate
+		expectedContent string // Empty if the interaction is discarded.
+		expected        map[string]time.Duration
+	}{
+		{
+			name:            "recorded guild",
+			interaction:     config("guild-id", admin),
+			expectedContent: "✅ Replays now last 45 seconds by default.",
+			expected:        map[string]time.Duration{"guild-id": 45 * time.Second, "allowed-guild-id": defaultDuration},
+		},
+		{
+			name:            "allowed guild",
+			interaction:     config("allowed-guild-id", admin),
+			expectedContent: "✅ Replays now last 45 seconds by default.",
+			expected:        map[string]time.Duration{"guild-id": defaultDuration, "allowed-guild-id": 45 * time.Second},
+		},
+		{
+			name:        "guild not allowed",
+			interaction: config("other-guild-id", admin),
+			expected:    map[string]time.Duration{"other-guild-id": defaultDuration},
+		},
+		{
+			name:            "DM",
+			interaction:     config("", nil),
+			expectedContent: "❌ Can only be invoked in a server.",
+			expected:        map[string]time.Duration{"guild-id": defaultDuration},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interactions := &fakeInteractionSession{}
+			b := &Bot{
+				logger:       zap.NewNop(),
+				guildID:      "guild-id",
+				interactions: interactions,
+				permissions:  newPermissions("", nil, time.Now),
+				settings:     newSettings("", defaultDuration, maxDuration),
+				options:      Options{AllowDMs: true, GuildAllowlist: []string{"allowed-guild-id"}},
+			}
+
+			require.NoError(t, b.handleConfigCommand(context.Background(), tt.interaction))
+			if tt.expectedContent == "" {
+				assert.Empty(t, interactions.responses)
+			} else if assert.Len(t, interactions.responses, 1) {
+				assert.Equal(t, tt.expectedContent, interactions.responses[0].Data.Content)
+			}
+			for guildID, expected := range tt.expected {
+				assert.Equal(t, expected, b.settings.DefaultDuration(guildID), guildID)
+			}
+		})
+	}
+}
+
+func TestBot_handleArmCommand_permissions(t *testing.T) {
+	arm := func(guildID string, member *discordgo.Member) *discordgo.InteractionCreate {
+		return &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{
+			Type:    discordgo.InteractionApplicationCommand,
+			GuildID: guildID,
+			Member:  member,
+			Data:    discordgo.ApplicationCommandInteractionData{Name: "disarm"},
+		}}
+	}
+
+	tests := []struct {
+		name        string
+		interaction *discordgo.InteractionCreate
+		expected    []*discordgo.InteractionResponse
+	}{
+		{
+			name:        "not an admin",
+			interaction: arm("guild-id", &discordgo.Member{User: &discordgo.User{ID: "user-id"}}),
+			expected: []*discordgo.InteractionResponse{{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Content: "❌ Only admins can start or stop the recording.",
+					Flags:   discordgo.MessageFlagsEphemeral,
+				},
+			}},
+		},
+		{
+			name:        "other guild",
+			interaction: arm("other-guild-id", &discordgo.Member{Permissions: discordgo.PermissionManageServer}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interactions := &fakeInteractionSession{}
+			b := &Bot{
+				logger:       zap.NewNop(),
+				guildID:      "guild-id",
+				interactions: interactions,
+				permissions:  newPermissions("", nil, time.Now),
+			}
+
+			require.NoError(t, b.handleArmCommand(context.Background(), nil, tt.interaction))
+			assert.Equal(t, tt.expected, interactions.responses)
+		})
+	}
+}
+
+func TestBot_recordAllRefusal(t *testing.T) {
+	admin := &discordgo.Member{User: &discordgo.User{ID: "user-id"}, Permissions: discordgo.PermissionManageServer}
+
+	tests := []struct {
+		name     string
+		guildID  string
+		member   *discordgo.Member
+		user     *discordgo.User
+		expected string
+	}{
+		{name: "admin", guildID: "guild-id", member: admin},
+		{
+			name:     "not an admin",
+			guildID:  "guild-id",
+			member:   &discordgo.Member{User: &discordgo.User{ID: "user-id"}},
+			expected: "❌ Only admins can record everything.",
+		},
+		{
+			name:     "DM",
+			user:     &discordgo.User{ID: "user-id"},
+			expected: "❌ Recording everything can only be asked in the recorded server.",
+		},
+		{
+			name:     "admin of an allowed guild",
+			guildID:  "allowed-guild-id",
+			member:   admin,
+			expected: "❌ Recording everything can only be asked in the recorded server.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Bot{
+				logger:      zap.NewNop(),
+				guildID:     "guild-id",
+				permissions: newPermissions("", nil, time.Now),
+				options:     Options{AllowDMs: true, GuildAllowlist: []string{"allowed-guild-id"}},
+			}
+
+			i := &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{
+				GuildID: tt.guildID,
+				Member:  tt.member,
+				User:    tt.user,
+			}}
+			got, err := b.recordAllRefusal(i)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestUserSSRCs(t *testing.T) {
+	speakers := map[uint32]string{1: "user-id", 2: "other-user-id", 5: "user-id", 3: "user-id"}
+
+	tests := []struct {
+		name     string
+		userID   string
+		expected []uint32
+	}{
+		{name: "one stream", userID: "other-user-id", expected: []uint32{2}},
+		{name: "reconnected", userID: "user-id", expected: []uint32{1, 3, 5}},
+		{name: "not heard", userID: "silent-user-id", expected: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, userSSRCs(speakers, tt.userID))
+		})
+	}
+}
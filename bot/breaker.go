@@ -0,0 +1,51 @@
+package bot
+
+import (
+	"bigbro2/bot/cleanup"
+	"bigbro2/bot/ratelimit"
+	"github.com/bwmarrin/discordgo"
+)
+
+// unavailableContent is the response to the requests refused while Discord rate limits the bot.
+const unavailableContent = "⏳ Discord is rate limiting the bot, try again in a minute."
+
+// breakerSession calls the Discord API through a circuit breaker, so the calls fail fast while Discord rate limits the
+// bot. It implements commandSession and statusSession.
+type breakerSession struct {
+	session *discordgo.Session
+	breaker *ratelimit.Breaker
+}
+
+func (s breakerSession) ApplicationCommandCreate(appID string, guildID string, cmd *discordgo.ApplicationCommand) (created *discordgo.ApplicationCommand, err error) {
+	err = s.breaker.Do(func() error {
+		created, err = s.session.ApplicationCommandCreate(appID, guildID, cmd)
+		return err
+	})
+	return created, err
+}
+
+func (s breakerSession) ApplicationCommandDelete(appID, guildID, cmdID string) error {
+	return s.breaker.Do(func() error {
+		return s.session.ApplicationCommandDelete(appID, guildID, cmdID)
+	})
+}
+
+func (s breakerSession) UpdateStatusComplex(usd discordgo.UpdateStatusData) error {
+	return s.breaker.Do(func() error {
+		return s.session.UpdateStatusComplex(usd)
+	})
+}
+
+// registerRateLimitHandler counts the rate limits discordgo waits out by itself towards opening the circuit breaker.
+func (b *Bot) registerRateLimitHandler() cleanup.Func {
+	b.logger.Debug("registering rate limit handler")
+	removeRateLimit := b.session.AddHandler(func(_ *discordgo.Session, r *discordgo.RateLimit) {
+		b.breaker.RecordRateLimit()
+	})
+	cleanupFunc := func() error {
+		b.logger.Debug("unregistering rate limit handler")
+		removeRateLimit()
+		return nil
+	}
+	return cleanupFunc
+}
@@ -6,65 +6,163 @@ import (
 	"time"
 )
 
-const SIZE = 30 * 60 / 0.02 // 30 minutes of 20ms segments.
+const (
+	// PacketsPerSecond is the number of packets a voice stream sends every second, one every 20ms.
+	PacketsPerSecond = 50
+	// DefaultCapacity is the number of packets a Buffer holds when its Capacity is not set: 30 minutes of a single
+	// voice stream.
+	DefaultCapacity = 30 * 60 * PacketsPerSecond
+)
 
 // Buffer contains audio packet.
 // Zero value is safe to use and is equivalent to an empty buffer.
 type Buffer struct {
 	sync.RWMutex
-	buffer       [SIZE]AudioPacket
+	buffer       []AudioPacket // Allocated with the first packet, Capacity long.
 	size         int
 	nextPosition int
+	bytes        int
+	dropped      int
+
+	// MaxBytes is the maximum number of bytes of opus data stored in the buffer. The oldest packets are evicted to
+	// stay under this limit. Zero means there is no limit other than the number of packets.
+	// It must not be modified once the buffer is in use.
+	MaxBytes int
+	// Capacity is the maximum number of packets stored in the buffer, each voice stream sends PacketsPerSecond of
+	// them. Zero means DefaultCapacity. It must not be modified once the buffer is in use.
+	Capacity int
+}
+
+// Stats describes the content of the buffer.
+type Stats struct {
+	Packets int       // Number of packets stored.
+	Bytes   int       // Number of bytes of opus data stored.
+	Oldest  time.Time // Time the oldest packet stored was received, zero if there is none.
+	// Dropped is the number of packets discarded to make room for newer ones since the buffer was created.
+	// Replays asked for after packets were dropped may be shorter than expected.
+	Dropped int
 }
 
-type Iterator struct {
+type bufferIterator struct {
 	buffer   *Buffer
+	start    int // Position of the first packet.
+	size     int // Number of packets to iterate over.
 	position int
 	count    int
 }
 
+// AudioPacket is an audio packet received from a voice channel.
 type AudioPacket struct {
-	Time     time.Time
-	SSRC     uint32
-	PCMIndex uint32
-	Opus     []byte
+	Time     time.Time // Time the packet was received.
+	SSRC     uint32    // Identifies the voice stream.
+	PCMIndex uint32    // RTP timestamp of the packet, see discordgo.Packet.Timestamp.
+	Opus     []byte    // Opus encoded audio.
 }
 
 func (b *Buffer) Add(t time.Time, pkt discordgo.Packet) {
 	b.Lock()
 	defer b.Unlock()
 
-	b.buffer[b.nextPosition] = AudioPacket{
+	b.add(AudioPacket{
 		Time:     t,
 		SSRC:     pkt.SSRC,
 		PCMIndex: pkt.Timestamp,
 		Opus:     pkt.Opus,
+	})
+}
+
+// AddBatch adds several packets at once, oldest first.
+// It is equivalent to calling Add for each packet, but only takes the lock once.
+func (b *Buffer) AddBatch(packets []AudioPacket) {
+	b.Lock()
+	defer b.Unlock()
+
+	for _, pkt := range packets {
+		b.add(pkt)
+	}
+}
+
+// add adds a packet to the buffer, evicting the oldest ones if needed.
+// The lock must be held.
+func (b *Buffer) add(pkt AudioPacket) {
+	if b.buffer == nil {
+		capacity := b.Capacity
+		if capacity <= 0 {
+			capacity = DefaultCapacity
+		}
+		b.buffer = make([]AudioPacket, capacity)
+	}
+
+	if b.size == len(b.buffer) {
+		// The oldest packet is about to be overwritten.
+		b.bytes -= len(b.buffer[b.nextPosition].Opus)
+		b.dropped++
 	}
 
-	if b.size < SIZE {
+	b.buffer[b.nextPosition] = pkt
+
+	if b.size < len(b.buffer) {
 		b.size++
 	}
 
 	b.nextPosition++
-	if b.nextPosition >= SIZE {
+	if b.nextPosition >= len(b.buffer) {
 		b.nextPosition = 0
 	}
+
+	b.bytes += len(pkt.Opus)
+	for b.MaxBytes > 0 && b.bytes > b.MaxBytes && b.size > 0 {
+		b.evictOldest()
+	}
 }
 
-func (b *Buffer) WithIterator(cb func(iterator *Iterator) error) error {
-	b.RLock()
-	defer b.RUnlock()
+// evictOldest removes the oldest packet from the buffer.
+// The lock must be held.
+func (b *Buffer) evictOldest() {
+	position := b.oldestPosition()
+	b.bytes -= len(b.buffer[position].Opus)
+	b.buffer[position] = AudioPacket{} // Release the opus data.
+	b.size--
+	b.dropped++
+}
 
+// oldestPosition returns the position of the oldest packet in the buffer.
+// The lock must be held.
+func (b *Buffer) oldestPosition() int {
 	position := b.nextPosition - b.size
 	if position < 0 {
-		position += SIZE
+		position += len(b.buffer)
 	}
+	return position
+}
 
-	return cb(&Iterator{
-		buffer:   b,
-		position: position,
-		count:    b.size,
-	})
+// Stats returns statistics about the content of the buffer.
+func (b *Buffer) Stats() Stats {
+	b.RLock()
+	defer b.RUnlock()
+
+	stats := Stats{
+		Packets: b.size,
+		Bytes:   b.bytes,
+		Dropped: b.dropped,
+	}
+	if b.size > 0 {
+		stats.Oldest = b.buffer[b.oldestPosition()].Time
+	}
+	return stats
+}
+
+func (b *Buffer) WithIterator(cb func(iterator Iterator) error) error {
+	b.RLock()
+	defer b.RUnlock()
+
+	iterator := &bufferIterator{
+		buffer: b,
+		start:  b.oldestPosition(),
+		size:   b.size,
+	}
+	iterator.Reset()
+	return cb(iterator)
 }
 
 func (b *Buffer) Reset() {
@@ -73,13 +171,14 @@ func (b *Buffer) Reset() {
 
 	b.size = 0
 	b.nextPosition = 0
+	b.bytes = 0
 }
 
-func (i *Iterator) HasNext() bool {
+func (i *bufferIterator) HasNext() bool {
 	return i.count > 0
 }
 
-func (i *Iterator) Next() *AudioPacket {
+func (i *bufferIterator) Next() *AudioPacket {
 	if !i.HasNext() {
 		panic("iterator is exhausted")
 	}
@@ -87,10 +186,15 @@ func (i *Iterator) Next() *AudioPacket {
 	value := &i.buffer.buffer[i.position]
 
 	i.position++
-	if i.position >= SIZE {
+	if i.position >= len(i.buffer.buffer) {
 		i.position = 0
 	}
 
 	i.count--
 	return value
 }
+
+func (i *bufferIterator) Reset() {
+	i.position = i.start
+	i.count = i.size
+}
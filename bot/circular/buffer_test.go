@@ -19,6 +19,9 @@ func sampleTime(i int) time.Time {
 	return time.Unix(int64(i), 0)
 }
 
+// testCapacity is the capacity of the buffers of the tests, small so they are quickly filled.
+const testCapacity = 1000
+
 func TestBuffer(t *testing.T) {
 	tests := []struct {
 		name             string
@@ -33,27 +36,27 @@ func TestBuffer(t *testing.T) {
 			oldestElement:    0,
 		},
 		{
-			name:             "MAX_SIZE elements",
-			elementsInserted: SIZE,
-			expectedCount:    SIZE,
+			name:             "capacity elements",
+			elementsInserted: testCapacity,
+			expectedCount:    testCapacity,
 			oldestElement:    0,
 		},
 		{
-			name:             "1.5 * MAX_SIZE elements",
-			elementsInserted: 1.5 * SIZE,
-			expectedCount:    SIZE,
-			oldestElement:    SIZE / 2,
+			name:             "1.5 * capacity elements",
+			elementsInserted: 1.5 * testCapacity,
+			expectedCount:    testCapacity,
+			oldestElement:    testCapacity / 2,
 		},
 		{
-			name:             "2 * MAX_SIZE elements",
-			elementsInserted: 2 * SIZE,
-			expectedCount:    SIZE,
-			oldestElement:    SIZE,
+			name:             "2 * capacity elements",
+			elementsInserted: 2 * testCapacity,
+			expectedCount:    testCapacity,
+			oldestElement:    testCapacity,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			b := Buffer{}
+			b := Buffer{Capacity: testCapacity}
 
 			for i := 0; i < tt.elementsInserted; i++ {
 				b.Add(sampleTime(i), samplePacket(i))
@@ -63,8 +66,11 @@ func TestBuffer(t *testing.T) {
 			got := b.WithIterator(func(iterator Iterator) error {
 				for iterator.HasNext() {
 					elem := iterator.Next()
+					expected := samplePacket(counter + tt.oldestElement)
 					require.Equal(t, sampleTime(counter+tt.oldestElement), elem.Time)
-					require.Equal(t, samplePacket(counter+tt.oldestElement), elem.Audio)
+					require.Equal(t, expected.SSRC, elem.SSRC)
+					require.Equal(t, expected.Timestamp, elem.PCMIndex)
+					require.Equal(t, expected.Opus, elem.Opus)
 					counter += 1
 				}
 				return nil
@@ -74,3 +80,215 @@ func TestBuffer(t *testing.T) {
 		})
 	}
 }
+
+func TestBuffer_MaxBytes(t *testing.T) {
+	b := Buffer{MaxBytes: 10}
+
+	add := func(i int, size int) {
+		pkt := samplePacket(i)
+		pkt.Opus = make([]byte, size)
+		b.Add(sampleTime(i), pkt)
+	}
+	ssrcs := func() []uint32 {
+		var result []uint32
+		_ = b.WithIterator(func(iterator Iterator) error {
+			for iterator.HasNext() {
+				result = append(result, iterator.Next().SSRC)
+			}
+			return nil
+		})
+		return result
+	}
+
+	add(0, 4)
+	add(1, 4)
+	assert.Equal(t, Stats{Packets: 2, Bytes: 8, Oldest: sampleTime(0)}, b.Stats())
+	assert.Equal(t, []uint32{0, 1}, ssrcs())
+
+	// Goes over the budget, the oldest packet is evicted.
+	add(2, 4)
+	assert.Equal(t, Stats{Packets: 2, Bytes: 8, Oldest: sampleTime(1), Dropped: 1}, b.Stats())
+	assert.Equal(t, []uint32{1, 2}, ssrcs())
+
+	// A large packet evicts several small ones.
+	add(3, 9)
+	assert.Equal(t, Stats{Packets: 1, Bytes: 9, Oldest: sampleTime(3), Dropped: 3}, b.Stats())
+	assert.Equal(t, []uint32{3}, ssrcs())
+
+	// Small packets fit again.
+	add(4, 1)
+	assert.Equal(t, Stats{Packets: 2, Bytes: 10, Oldest: sampleTime(3), Dropped: 3}, b.Stats())
+	assert.Equal(t, []uint32{3, 4}, ssrcs())
+
+	// The dropped packets are counted since the creation of the buffer.
+	b.Reset()
+	assert.Equal(t, Stats{Dropped: 3}, b.Stats())
+}
+
+func TestBuffer_Stats_overwrite(t *testing.T) {
+	b := Buffer{Capacity: testCapacity}
+
+	for i := 0; i < testCapacity+10; i++ {
+		pkt := samplePacket(i)
+		pkt.Opus = make([]byte, 1+i%2)
+		b.Add(sampleTime(i), pkt)
+	}
+
+	// Only the last testCapacity packets remain, half of them are 2 bytes long. The first 10 were dropped.
+	assert.Equal(t, Stats{Packets: testCapacity, Bytes: testCapacity + testCapacity/2, Oldest: sampleTime(10), Dropped: 10}, b.Stats())
+}
+
+func TestBuffer_Capacity(t *testing.T) {
+	tests := []struct {
+		name             string
+		capacity         int
+		expectedCapacity int
+		expectedPackets  int
+	}{
+		{name: "default", capacity: 0, expectedCapacity: DefaultCapacity, expectedPackets: 5},
+		{name: "configured", capacity: 3, expectedCapacity: 3, expectedPackets: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Buffer{Capacity: tt.capacity}
+			assert.Equal(t, Stats{}, b.Stats())
+			assert.Empty(t, bufferContent(b))
+
+			for i := 0; i < 5; i++ {
+				b.Add(sampleTime(i), samplePacket(i))
+			}
+			assert.Len(t, b.buffer, tt.expectedCapacity)
+			assert.Equal(t, tt.expectedPackets, b.Stats().Packets)
+		})
+	}
+}
+
+func sampleAudioPackets(n int) []AudioPacket {
+	packets := make([]AudioPacket, n)
+	for i := range packets {
+		pkt := samplePacket(i)
+		packets[i] = AudioPacket{
+			Time:     sampleTime(i),
+			SSRC:     pkt.SSRC,
+			PCMIndex: pkt.Timestamp,
+			Opus:     make([]byte, 1+i%3),
+		}
+	}
+	return packets
+}
+
+func bufferContent(b *Buffer) []AudioPacket {
+	var result []AudioPacket
+	_ = b.WithIterator(func(iterator Iterator) error {
+		for iterator.HasNext() {
+			result = append(result, *iterator.Next())
+		}
+		return nil
+	})
+	return result
+}
+
+func TestBuffer_AddBatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		packets  int
+		maxBytes int
+	}{
+		{name: "few packets", packets: 10},
+		{name: "more than the capacity", packets: testCapacity + 100},
+		{name: "byte budget", packets: 100, maxBytes: 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packets := sampleAudioPackets(tt.packets)
+
+			sequential := &Buffer{MaxBytes: tt.maxBytes, Capacity: testCapacity}
+			for _, pkt := range packets {
+				sequential.Add(pkt.Time, discordgo.Packet{SSRC: pkt.SSRC, Timestamp: pkt.PCMIndex, Opus: pkt.Opus})
+			}
+
+			batch := &Buffer{MaxBytes: tt.maxBytes, Capacity: testCapacity}
+			batch.AddBatch(packets[:len(packets)/2])
+			batch.AddBatch(packets[len(packets)/2:])
+
+			assert.Equal(t, sequential.Stats(), batch.Stats())
+			assert.Equal(t, bufferContent(sequential), bufferContent(batch))
+		})
+	}
+}
+
+func BenchmarkBuffer_Add(b *testing.B) {
+	packets := sampleAudioPackets(100)
+	buffer := &Buffer{}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, pkt := range packets {
+			buffer.Add(pkt.Time, discordgo.Packet{SSRC: pkt.SSRC, Timestamp: pkt.PCMIndex, Opus: pkt.Opus})
+		}
+	}
+}
+
+func BenchmarkBuffer_AddBatch(b *testing.B) {
+	packets := sampleAudioPackets(100)
+	buffer := &Buffer{}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buffer.AddBatch(packets)
+	}
+}
+
+func TestIterator_Reset(t *testing.T) {
+	tests := []struct {
+		name     string
+		newStore func(t *testing.T) Store
+		packets  int
+	}{
+		{
+			name:     "buffer",
+			newStore: func(t *testing.T) Store { return &Buffer{Capacity: testCapacity} },
+			packets:  testCapacity + 10, // The packets wrap around the end of the buffer.
+		},
+		{
+			name:     "disk buffer",
+			newStore: func(t *testing.T) Store { return newTestDiskBuffer(t, t.TempDir()) },
+			packets:  25, // Several segments.
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.newStore(t)
+			for i := 0; i < tt.packets; i++ {
+				s.Add(sampleTime(i), samplePacket(i))
+			}
+
+			readAll := func(iterator Iterator) []AudioPacket {
+				var packets []AudioPacket
+				for iterator.HasNext() {
+					packets = append(packets, *iterator.Next())
+				}
+				return packets
+			}
+
+			var first, second, afterPartialPass []AudioPacket
+			err := s.WithIterator(func(iterator Iterator) error {
+				first = readAll(iterator)
+				iterator.Reset()
+				second = readAll(iterator)
+
+				for n := 0; n < 15 && iterator.HasNext(); n++ {
+					iterator.Next()
+				}
+				iterator.Reset()
+				afterPartialPass = readAll(iterator)
+				return nil
+			})
+			require.NoError(t, err)
+
+			assert.NotEmpty(t, first)
+			assert.Equal(t, first, second)
+			assert.Equal(t, first, afterPartialPass)
+		})
+	}
+}
@@ -0,0 +1,384 @@
+package circular
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	segmentExtension  = ".seg"
+	recordHeaderSize  = 8 + 4 + 4 + 4 // Time, SSRC, PCM index and length of the opus data.
+	maxOpusPacketSize = 1 << 16
+)
+
+// DiskBuffer contains audio packets, stored in rolling segment files on disk.
+// Each segment contains the packets received during segmentDuration. Segments older than the retention are deleted.
+//
+// Segments do not use the OGG format as it cannot store the time each packet was received nor the SSRC of the
+// stream. Each packet is stored as a fixed size header followed by the opus data.
+type DiskBuffer struct {
+	sync.Mutex
+	logger          *zap.Logger
+	dir             string
+	segmentDuration time.Duration
+	retention       time.Duration
+	segments        []segment // Oldest first, the last one is the one being written.
+	file            *os.File
+	writer          *bufio.Writer
+
+	// statsMu guards stats, so that Stats, e.g. to suggest replay durations, does not wait for an iteration over the
+	// segments to end. stats is only changed with both locks held.
+	statsMu sync.Mutex
+	stats   Stats
+}
+
+type segment struct {
+	path    string
+	start   time.Time
+	packets int
+	bytes   int
+	oldest  time.Time // Time the first packet of the segment was received.
+}
+
+// NewDiskBuffer creates a DiskBuffer storing its segments in dir.
+// Segments left over in dir by a previous run are deleted.
+func NewDiskBuffer(logger *zap.Logger, dir string, segmentDuration, retention time.Duration) (*DiskBuffer, error) {
+	if segmentDuration <= 0 {
+		return nil, fmt.Errorf("segment duration must be positive, got %s", segmentDuration)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("could not create segment directory: %w", err)
+	}
+
+	if err := removeSegments(dir); err != nil {
+		return nil, err
+	}
+
+	return &DiskBuffer{
+		logger:          logger,
+		dir:             dir,
+		segmentDuration: segmentDuration,
+		retention:       retention,
+	}, nil
+}
+
+// Add adds a packet to the current segment, starting a new one if needed.
+// Packets that cannot be written are dropped.
+func (b *DiskBuffer) Add(t time.Time, pkt discordgo.Packet) {
+	b.Lock()
+	defer b.Unlock()
+
+	if err := b.add(t, pkt); err != nil {
+		b.logger.Warn("failed to write audio packet to disk, dropping it", zap.Error(err))
+	}
+}
+
+func (b *DiskBuffer) add(t time.Time, pkt discordgo.Packet) error {
+	start := t.Truncate(b.segmentDuration)
+	if b.writer == nil || start.After(b.segments[len(b.segments)-1].start) {
+		if err := b.rotate(start); err != nil {
+			return err
+		}
+		b.prune(t)
+	}
+
+	var header [recordHeaderSize]byte
+	binary.LittleEndian.PutUint64(header[0:], uint64(t.UnixNano()))
+	binary.LittleEndian.PutUint32(header[8:], pkt.SSRC)
+	binary.LittleEndian.PutUint32(header[12:], pkt.Timestamp)
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(pkt.Opus)))
+
+	if _, err := b.writer.Write(header[:]); err != nil {
+		return fmt.Errorf("could not write packet header: %w", err)
+	}
+	if _, err := b.writer.Write(pkt.Opus); err != nil {
+		return fmt.Errorf("could not write packet data: %w", err)
+	}
+
+	current := &b.segments[len(b.segments)-1]
+	if current.packets == 0 {
+		current.oldest = t
+	}
+	current.packets++
+	current.bytes += len(pkt.Opus)
+
+	b.statsMu.Lock()
+	defer b.statsMu.Unlock()
+	if b.stats.Packets == 0 {
+		b.stats.Oldest = t
+	}
+	b.stats.Packets++
+	b.stats.Bytes += len(pkt.Opus)
+	return nil
+}
+
+// rotate closes the current segment and starts a new one.
+// The lock must be held.
+func (b *DiskBuffer) rotate(start time.Time) error {
+	if err := b.closeSegment(); err != nil {
+		return err
+	}
+
+	path := filepath.Join(b.dir, fmt.Sprintf("%d%s", start.UnixNano(), segmentExtension))
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("could not create segment: %w", err)
+	}
+
+	b.file = f
+	b.writer = bufio.NewWriter(f)
+	b.segments = append(b.segments, segment{path: path, start: start})
+	return nil
+}
+
+// prune deletes the segments that only contain packets older than the retention.
+// The lock must be held.
+func (b *DiskBuffer) prune(now time.Time) {
+	dropped := 0
+	for len(b.segments) > 1 && now.Sub(b.segments[0].start.Add(b.segmentDuration)) >= b.retention {
+		if err := os.Remove(b.segments[0].path); err != nil {
+			b.logger.Warn("failed to remove segment", zap.String("path", b.segments[0].path), zap.Error(err))
+		}
+		dropped += b.segments[0].packets
+		b.segments = b.segments[1:]
+	}
+	if dropped == 0 {
+		return
+	}
+
+	stats := Stats{Dropped: b.Stats().Dropped + dropped}
+	for _, s := range b.segments {
+		if stats.Packets == 0 {
+			stats.Oldest = s.oldest
+		}
+		stats.Packets += s.packets
+		stats.Bytes += s.bytes
+	}
+	b.setStats(stats)
+}
+
+// closeSegment flushes and closes the segment being written, if any.
+// The lock must be held.
+func (b *DiskBuffer) closeSegment() error {
+	if b.file == nil {
+		return nil
+	}
+
+	flushErr := b.writer.Flush()
+	closeErr := b.file.Close()
+	b.file = nil
+	b.writer = nil
+
+	if flushErr != nil {
+		return fmt.Errorf("could not flush segment: %w", flushErr)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("could not close segment: %w", closeErr)
+	}
+	return nil
+}
+
+func (b *DiskBuffer) WithIterator(cb func(iterator Iterator) error) error {
+	return b.WithIteratorSince(time.Time{}, cb)
+}
+
+// WithIteratorSince calls cb with an iterator over the stored packets, oldest first, like WithIterator, but the
+// segments only holding packets received at start or before are not read. The iterator may still return such packets
+// from the first segment read.
+func (b *DiskBuffer) WithIteratorSince(start time.Time, cb func(iterator Iterator) error) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.writer != nil {
+		if err := b.writer.Flush(); err != nil {
+			return fmt.Errorf("could not flush segment: %w", err)
+		}
+	}
+
+	// A packet goes to a new segment once it is received after the end of the current one, so every packet of a
+	// segment ending at start or before was received before start.
+	paths := make([]string, 0, len(b.segments))
+	for _, s := range b.segments {
+		if s.start.Add(b.segmentDuration).After(start) {
+			paths = append(paths, s.path)
+		}
+	}
+
+	iterator := &diskIterator{paths: paths}
+	defer iterator.close()
+
+	if err := cb(iterator); err != nil {
+		return err
+	}
+	return iterator.err
+}
+
+func (b *DiskBuffer) Reset() {
+	b.Lock()
+	defer b.Unlock()
+
+	if err := b.closeSegment(); err != nil {
+		b.logger.Warn("failed to close segment", zap.Error(err))
+	}
+	for _, s := range b.segments {
+		if err := os.Remove(s.path); err != nil {
+			b.logger.Warn("failed to remove segment", zap.String("path", s.path), zap.Error(err))
+		}
+	}
+	b.segments = nil
+	b.setStats(Stats{Dropped: b.Stats().Dropped})
+}
+
+// Stats returns statistics about the packets stored on disk. Unlike the other methods, it does not wait for an
+// iteration over the packets to end.
+func (b *DiskBuffer) Stats() Stats {
+	b.statsMu.Lock()
+	defer b.statsMu.Unlock()
+
+	return b.stats
+}
+
+// setStats replaces the statistics returned by Stats.
+// The lock must be held.
+func (b *DiskBuffer) setStats(stats Stats) {
+	b.statsMu.Lock()
+	defer b.statsMu.Unlock()
+
+	b.stats = stats
+}
+
+// Close flushes and closes the segment being written. The segments are kept on disk.
+func (b *DiskBuffer) Close() error {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.closeSegment()
+}
+
+// removeSegments deletes all the segment files in dir.
+func removeSegments(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+segmentExtension))
+	if err != nil {
+		return fmt.Errorf("could not list segments: %w", err)
+	}
+
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("could not remove segment: %w", err)
+		}
+	}
+	return nil
+}
+
+// diskIterator reads the packets of the segments one after the other.
+// If a segment cannot be read, the iteration stops and the error is returned by WithIterator.
+type diskIterator struct {
+	paths  []string
+	index  int // Index in paths of the next segment to open.
+	file   *os.File
+	reader *bufio.Reader
+	next   *AudioPacket
+	err    error
+}
+
+func (i *diskIterator) HasNext() bool {
+	for i.next == nil && i.err == nil {
+		if i.reader == nil {
+			if i.index == len(i.paths) {
+				return false
+			}
+			if err := i.open(i.paths[i.index]); err != nil {
+				i.err = err
+				return false
+			}
+			i.index++
+		}
+
+		pkt, err := readRecord(i.reader)
+		if errors.Is(err, io.EOF) {
+			i.close()
+			continue
+		}
+		if err != nil {
+			i.err = fmt.Errorf("could not read segment %s: %w", i.file.Name(), err)
+			return false
+		}
+		i.next = pkt
+	}
+	return i.next != nil
+}
+
+func (i *diskIterator) Next() *AudioPacket {
+	if !i.HasNext() {
+		panic("iterator is exhausted")
+	}
+
+	pkt := i.next
+	i.next = nil
+	return pkt
+}
+
+// Reset starts reading the segments again from the first one. If reading a segment failed, the iteration stays
+// stopped: the error is still returned by WithIterator.
+func (i *diskIterator) Reset() {
+	i.close()
+	i.index = 0
+	i.next = nil
+}
+
+func (i *diskIterator) open(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open segment: %w", err)
+	}
+
+	i.file = f
+	i.reader = bufio.NewReader(f)
+	return nil
+}
+
+func (i *diskIterator) close() {
+	if i.file != nil {
+		_ = i.file.Close()
+	}
+	i.file = nil
+	i.reader = nil
+}
+
+// readRecord reads one packet. It returns io.EOF if there is no packet left.
+func readRecord(r io.Reader) (*AudioPacket, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	length := binary.LittleEndian.Uint32(header[16:])
+	if length > maxOpusPacketSize {
+		return nil, fmt.Errorf("invalid packet length %d", length)
+	}
+
+	opus := make([]byte, length)
+	if _, err := io.ReadFull(r, opus); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("could not read packet data: %w", err)
+	}
+
+	return &AudioPacket{
+		Time:     time.Unix(0, int64(binary.LittleEndian.Uint64(header[0:]))),
+		SSRC:     binary.LittleEndian.Uint32(header[8:]),
+		PCMIndex: binary.LittleEndian.Uint32(header[12:]),
+		Opus:     opus,
+	}, nil
+}
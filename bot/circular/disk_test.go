@@ -0,0 +1,201 @@
+package circular
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestDiskBuffer(t *testing.T, dir string) *DiskBuffer {
+	b, err := NewDiskBuffer(zap.NewNop(), dir, 10*time.Second, 30*time.Second)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, b.Close()) })
+	return b
+}
+
+func storeContent(t *testing.T, s Store) []AudioPacket {
+	var got []AudioPacket
+	err := s.WithIterator(func(iterator Iterator) error {
+		for iterator.HasNext() {
+			got = append(got, *iterator.Next())
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return got
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+segmentExtension))
+	require.NoError(t, err)
+	return paths
+}
+
+func TestDiskBuffer(t *testing.T) {
+	tests := []struct {
+		name             string
+		packetsInserted  int
+		expectedOldest   int
+		expectedSegments int
+	}{
+		{
+			name:             "empty",
+			packetsInserted:  0,
+			expectedSegments: 0,
+		},
+		{
+			name:             "single segment",
+			packetsInserted:  5,
+			expectedOldest:   0,
+			expectedSegments: 1,
+		},
+		{
+			name:             "several segments",
+			packetsInserted:  35,
+			expectedOldest:   0,
+			expectedSegments: 4,
+		},
+		{
+			name:             "old segments pruned",
+			packetsInserted:  65,
+			expectedOldest:   30,
+			expectedSegments: 4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			b := newTestDiskBuffer(t, dir)
+
+			for i := 0; i < tt.packetsInserted; i++ {
+				pkt := samplePacket(i)
+				pkt.Opus = []byte{byte(i), 1, 2}
+				b.Add(sampleTime(i), pkt)
+			}
+
+			got := storeContent(t, b)
+			require.Len(t, got, tt.packetsInserted-tt.expectedOldest)
+			for j, pkt := range got {
+				i := j + tt.expectedOldest
+				assert.Equal(t, AudioPacket{
+					Time:     sampleTime(i),
+					SSRC:     uint32(i),
+					PCMIndex: uint32(i),
+					Opus:     []byte{byte(i), 1, 2},
+				}, pkt)
+			}
+			assert.Len(t, segmentFiles(t, dir), tt.expectedSegments)
+
+			expectedStats := Stats{Packets: len(got), Bytes: 3 * len(got), Dropped: tt.expectedOldest}
+			if len(got) > 0 {
+				expectedStats.Oldest = sampleTime(tt.expectedOldest)
+			}
+			assert.Equal(t, expectedStats, b.Stats())
+		})
+	}
+}
+
+func TestDiskBuffer_Reset(t *testing.T) {
+	dir := t.TempDir()
+	b := newTestDiskBuffer(t, dir)
+
+	for i := 0; i < 25; i++ {
+		b.Add(sampleTime(i), samplePacket(i))
+	}
+	b.Reset()
+
+	assert.Empty(t, storeContent(t, b))
+	assert.Empty(t, segmentFiles(t, dir))
+	assert.Equal(t, Stats{}, b.Stats())
+
+	b.Add(sampleTime(30), samplePacket(30))
+	assert.Len(t, storeContent(t, b), 1)
+}
+
+func TestNewDiskBuffer_removesLeftovers(t *testing.T) {
+	dir := t.TempDir()
+	leftover := filepath.Join(dir, "123"+segmentExtension)
+	other := filepath.Join(dir, "notes.txt")
+	require.NoError(t, os.WriteFile(leftover, []byte("garbage"), 0o644))
+	require.NoError(t, os.WriteFile(other, []byte("keep me"), 0o644))
+
+	b := newTestDiskBuffer(t, dir)
+
+	assert.Empty(t, storeContent(t, b))
+	assert.NoFileExists(t, leftover)
+	assert.FileExists(t, other)
+}
+
+func TestDiskBuffer_WithIterator_corruptSegment(t *testing.T) {
+	dir := t.TempDir()
+	b := newTestDiskBuffer(t, dir)
+	b.Add(sampleTime(0), discordgo.Packet{Opus: []byte{1, 2, 3}})
+	require.NoError(t, b.Close())
+
+	paths := segmentFiles(t, dir)
+	require.Len(t, paths, 1)
+	require.NoError(t, os.Truncate(paths[0], recordHeaderSize+1))
+
+	err := b.WithIterator(func(iterator Iterator) error {
+		for iterator.HasNext() {
+			iterator.Next()
+		}
+		return nil
+	})
+	assert.Error(t, err)
+}
+
+func TestDiskBuffer_WithIteratorSince(t *testing.T) {
+	dir := t.TempDir()
+	b := newTestDiskBuffer(t, dir)
+	for i := 0; i < 25; i++ {
+		b.Add(sampleTime(i), samplePacket(i))
+	}
+	require.NoError(t, b.Close())
+
+	// The oldest segment is not read: it is corrupt, yet no error is returned.
+	paths := segmentFiles(t, dir)
+	require.Len(t, paths, 3)
+	oldest := filepath.Join(dir, fmt.Sprintf("%d%s", sampleTime(0).UnixNano(), segmentExtension))
+	require.NoError(t, os.Truncate(oldest, recordHeaderSize+1))
+
+	var got []uint32
+	err := b.WithIteratorSince(sampleTime(12), func(iterator Iterator) error {
+		for iterator.HasNext() {
+			got = append(got, iterator.Next().SSRC)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	// The packets of the first segment read that are before start are still returned.
+	assert.Equal(t, []uint32{10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24}, got)
+
+	// A start at the end of a segment skips it.
+	got = nil
+	err = b.WithIteratorSince(sampleTime(20), func(iterator Iterator) error {
+		for iterator.HasNext() {
+			got = append(got, iterator.Next().SSRC)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{20, 21, 22, 23, 24}, got)
+}
+
+func TestDiskBuffer_Stats_whileIterating(t *testing.T) {
+	b := newTestDiskBuffer(t, t.TempDir())
+	b.Add(sampleTime(0), discordgo.Packet{Opus: []byte{1, 2, 3}})
+
+	// The stats can be read while the segments are iterated over, e.g. by a replay.
+	err := b.WithIterator(func(iterator Iterator) error {
+		assert.Equal(t, Stats{Packets: 1, Bytes: 3, Oldest: sampleTime(0)}, b.Stats())
+		return nil
+	})
+	require.NoError(t, err)
+}
@@ -0,0 +1,82 @@
+package circular
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// BufferRegistry contains the Store of each guild, so the audio of a guild is never mixed with the audio of another.
+// The Store of a guild is created the first time it is needed.
+type BufferRegistry struct {
+	sync.Mutex
+	newStore func(guildID string) (Store, error)
+	stores   map[string]Store
+}
+
+// NewBufferRegistry creates a registry creating the Store of each guild with newStore.
+func NewBufferRegistry(newStore func(guildID string) (Store, error)) *BufferRegistry {
+	return &BufferRegistry{
+		newStore: newStore,
+		stores:   make(map[string]Store),
+	}
+}
+
+// Get returns the Store of the guild, creating it if needed.
+func (r *BufferRegistry) Get(guildID string) (Store, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if store, ok := r.stores[guildID]; ok {
+		return store, nil
+	}
+
+	store, err := r.newStore(guildID)
+	if err != nil {
+		return nil, fmt.Errorf("could not create the audio buffer of guild %s: %w", guildID, err)
+	}
+	r.stores[guildID] = store
+	return store, nil
+}
+
+// Reset removes all the packets stored for the guild. It does nothing if the guild has no Store yet.
+func (r *BufferRegistry) Reset(guildID string) {
+	r.Lock()
+	store, ok := r.stores[guildID]
+	r.Unlock()
+
+	if ok {
+		store.Reset()
+	}
+}
+
+// Stats returns statistics about the packets stored for the guild. They are empty if the guild has no Store yet.
+func (r *BufferRegistry) Stats(guildID string) Stats {
+	r.Lock()
+	store, ok := r.stores[guildID]
+	r.Unlock()
+
+	if !ok {
+		return Stats{}
+	}
+	return store.Stats()
+}
+
+// Close closes the stores that need to be closed, e.g. DiskBuffer.
+// Every store is closed even if one fails, the first error is returned.
+func (r *BufferRegistry) Close() error {
+	r.Lock()
+	defer r.Unlock()
+
+	var firstErr error
+	for guildID, store := range r.stores {
+		closer, ok := store.(io.Closer)
+		if !ok {
+			continue
+		}
+		if err := closer.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("could not close the audio buffer of guild %s: %w", guildID, err)
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,95 @@
+package circular
+
+import (
+	"errors"
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestRegistry(created *int) *BufferRegistry {
+	return NewBufferRegistry(func(string) (Store, error) {
+		*created++
+		return &Buffer{}, nil
+	})
+}
+
+func TestBufferRegistry_Get_concurrent(t *testing.T) {
+	created := 0
+	r := newTestRegistry(&created)
+
+	const goroutines = 50
+	stores := make([]Store, goroutines)
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			store, err := r.Get("guild-id")
+			require.NoError(t, err)
+			stores[i] = store
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, created)
+	for _, store := range stores {
+		assert.Same(t, stores[0], store)
+	}
+}
+
+func TestBufferRegistry_isolation(t *testing.T) {
+	created := 0
+	r := newTestRegistry(&created)
+	now := time.Unix(1000, 0)
+
+	first, err := r.Get("first-guild-id")
+	require.NoError(t, err)
+	second, err := r.Get("second-guild-id")
+	require.NoError(t, err)
+	require.NotSame(t, first, second)
+	assert.Equal(t, 2, created)
+
+	first.Add(now, discordgo.Packet{SSRC: 1, Opus: []byte{1, 2, 3}})
+	first.Add(now, discordgo.Packet{SSRC: 1, Opus: []byte{4, 5, 6}})
+	second.Add(now, discordgo.Packet{SSRC: 2, Opus: []byte{7}})
+
+	assert.Equal(t, 2, r.Stats("first-guild-id").Packets)
+	assert.Equal(t, 1, r.Stats("second-guild-id").Packets)
+	assert.Equal(t, Stats{}, r.Stats("unknown-guild-id"))
+
+	r.Reset("first-guild-id")
+	assert.Equal(t, 0, r.Stats("first-guild-id").Packets)
+	assert.Equal(t, []AudioPacket{{Time: now, SSRC: 2, Opus: []byte{7}}}, storeContent(t, second))
+
+	// Resetting a guild without a store does not create one.
+	r.Reset("unknown-guild-id")
+	assert.Equal(t, 2, created)
+}
+
+func TestBufferRegistry_Get_error(t *testing.T) {
+	expectedErr := errors.New("no space left")
+	r := NewBufferRegistry(func(string) (Store, error) { return nil, expectedErr })
+
+	_, err := r.Get("guild-id")
+	assert.ErrorIs(t, err, expectedErr)
+}
+
+func TestBufferRegistry_Close(t *testing.T) {
+	dir := t.TempDir()
+	r := NewBufferRegistry(func(guildID string) (Store, error) {
+		return NewDiskBuffer(zap.NewNop(), filepath.Join(dir, guildID), 10*time.Second, 30*time.Second)
+	})
+
+	store, err := r.Get("guild-id")
+	require.NoError(t, err)
+	store.Add(time.Unix(1000, 0), discordgo.Packet{SSRC: 1, Opus: []byte{1, 2, 3}})
+
+	require.NoError(t, r.Close())
+	assert.Len(t, segmentFiles(t, filepath.Join(dir, "guild-id")), 1)
+}
@@ -0,0 +1,91 @@
+package circular
+
+import (
+	"context"
+	"time"
+)
+
+// Window describes the packets Since iterates over.
+type Window struct {
+	// Start is the start of the window: only the packets received after it are returned.
+	Start time.Time
+	// Duration is the duration asked for: Start is this long before now.
+	Duration time.Duration
+	// Available is how far back the store goes, at most the duration asked for.
+	Available time.Duration
+	// Truncated is true if the store does not go back as far as the duration asked for, e.g. the bot joined the
+	// channel recently or older packets were dropped.
+	Truncated bool
+}
+
+// Since calls cb with an iterator over the packets of the store received less than d before now, oldest first, and the
+// window they are in. A packet received exactly d before now is left out.
+// Like Store.WithIterator, no packet can be added while cb runs. Like WithIteratorContext, the iteration ends early
+// once ctx is done, and the error of ctx is then returned.
+func Since(ctx context.Context, store Store, now time.Time, d time.Duration, cb func(iterator Iterator, window Window) error) error {
+	// The stats must be read before iterating: the store cannot be used while it is iterated over.
+	window := newWindow(store.Stats(), now, d)
+	withIterator := func(cb func(iterator Iterator) error) error {
+		return withIteratorSince(store, window.Start, cb)
+	}
+	return withContext(ctx, withIterator, func(iterator Iterator) error {
+		return cb(&sinceIterator{iterator: iterator, start: window.Start}, window)
+	})
+}
+
+// withIteratorSince calls cb with an iterator over the packets of the store, like Store.WithIterator, skipping the
+// packets received at start or before without reading them if the store can. The others are still returned.
+func withIteratorSince(store Store, start time.Time, cb func(iterator Iterator) error) error {
+	if s, ok := store.(seekingStore); ok {
+		return s.WithIteratorSince(start, cb)
+	}
+	return store.WithIterator(cb)
+}
+
+// newWindow returns the window of the packets received less than d before now, in a store described by stats.
+func newWindow(stats Stats, now time.Time, d time.Duration) Window {
+	window := Window{Start: now.Add(-d), Duration: d}
+	if stats.Packets == 0 {
+		window.Truncated = true
+		return window
+	}
+
+	window.Available = now.Sub(stats.Oldest)
+	if window.Available >= d {
+		window.Available = d
+	} else {
+		window.Truncated = true
+	}
+	return window
+}
+
+// sinceIterator skips the packets of iterator received at start or before.
+type sinceIterator struct {
+	iterator Iterator
+	start    time.Time
+	next     *AudioPacket // Next packet in the window, nil if it was not read yet.
+}
+
+func (i *sinceIterator) HasNext() bool {
+	for i.next == nil && i.iterator.HasNext() {
+		if pkt := i.iterator.Next(); pkt.Time.After(i.start) {
+			i.next = pkt
+		}
+	}
+	return i.next != nil
+}
+
+func (i *sinceIterator) Next() *AudioPacket {
+	if !i.HasNext() {
+		panic("iterator is exhausted")
+	}
+
+	pkt := i.next
+	i.next = nil
+	return pkt
+}
+
+func (i *sinceIterator) Reset() {
+	i.iterator.Reset()
+	i.next = nil
+}
@@ -0,0 +1,97 @@
+package circular
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestSince(t *testing.T) {
+	// Packets 0 to 9 are received at seconds 0 to 9.
+	var b Buffer
+	for i := 0; i < 10; i++ {
+		b.Add(sampleTime(i), samplePacket(i))
+	}
+
+	tests := []struct {
+		name              string
+		now               time.Time
+		d                 time.Duration
+		expected          []uint32
+		expectedAvailable time.Duration
+		expectedTruncated bool
+	}{
+		{
+			name:              "packet exactly at the cutoff",
+			now:               sampleTime(9),
+			d:                 2 * time.Second,
+			expected:          []uint32{8, 9},
+			expectedAvailable: 2 * time.Second,
+		},
+		{
+			name:              "packet just after the cutoff",
+			now:               sampleTime(9).Add(-time.Nanosecond),
+			d:                 2 * time.Second,
+			expected:          []uint32{7, 8, 9},
+			expectedAvailable: 2 * time.Second,
+		},
+		{
+			name:              "oldest packet exactly at the cutoff",
+			now:               sampleTime(10),
+			d:                 10 * time.Second,
+			expected:          []uint32{1, 2, 3, 4, 5, 6, 7, 8, 9},
+			expectedAvailable: 10 * time.Second,
+		},
+		{
+			name:              "further back than the oldest packet",
+			now:               sampleTime(10),
+			d:                 time.Minute,
+			expected:          []uint32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+			expectedAvailable: 10 * time.Second,
+			expectedTruncated: true,
+		},
+		{
+			name:              "every packet too old",
+			now:               sampleTime(20),
+			d:                 5 * time.Second,
+			expectedAvailable: 5 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Since(context.Background(), &b, tt.now, tt.d, func(iterator Iterator, window Window) error {
+				assert.Equal(t, tt.now.Add(-tt.d), window.Start)
+				assert.Equal(t, tt.expectedAvailable, window.Available)
+				assert.Equal(t, tt.expectedTruncated, window.Truncated)
+
+				// The iterator can be rewound.
+				for pass := 0; pass < 2; pass++ {
+					var ssrcs []uint32
+					for iterator.HasNext() {
+						ssrcs = append(ssrcs, iterator.Next().SSRC)
+					}
+					assert.Equal(t, tt.expected, ssrcs)
+					assert.Panics(t, func() { iterator.Next() })
+					iterator.Reset()
+				}
+				return nil
+			})
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestSince_empty(t *testing.T) {
+	var b Buffer
+	called := false
+	err := Since(context.Background(), &b, sampleTime(10), 30*time.Second, func(iterator Iterator, window Window) error {
+		called = true
+		assert.False(t, iterator.HasNext())
+		assert.Equal(t, Window{Start: sampleTime(-20), Duration: 30 * time.Second, Truncated: true}, window)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.True(t, called)
+}
@@ -0,0 +1,149 @@
+package circular
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	// contextCheckInterval is the number of packets iterated over between two checks of the context cancellation.
+	contextCheckInterval = 1024
+	// MaxSnapshotBytes is the most opus data SnapshotSince copies in memory: about two hours of a single voice stream,
+	// or a few minutes of a crowded channel.
+	MaxSnapshotBytes = 128 << 20
+)
+
+// SnapshotTooLargeErr is returned by SnapshotSince when the packets hold more than MaxSnapshotBytes of opus data.
+var SnapshotTooLargeErr = errors.New("too many packets to copy")
+
+// WithIteratorContext calls cb with an iterator over the stored packets, oldest first, like Store.WithIterator. The
+// iterator ends early once ctx is done, and the error of ctx is then returned, so a long iteration gives the store back
+// soon after the request it serves is abandoned. cb must still return as soon as the iteration ends.
+func WithIteratorContext(ctx context.Context, store Store, cb func(iterator Iterator) error) error {
+	return withContext(ctx, store.WithIterator, cb)
+}
+
+// withContext calls cb with the iterator given by withIterator, ending early once ctx is done like
+// WithIteratorContext.
+func withContext(ctx context.Context, withIterator func(cb func(iterator Iterator) error) error, cb func(iterator Iterator) error) error {
+	iterator := &contextIterator{ctx: ctx}
+	err := withIterator(func(storeIterator Iterator) error {
+		iterator.iterator = storeIterator
+		return cb(iterator)
+	})
+	if iterator.err != nil {
+		return iterator.err
+	}
+	return err
+}
+
+// contextIterator stops iterating once its context is done.
+type contextIterator struct {
+	ctx      context.Context
+	iterator Iterator
+	count    int   // Number of calls to HasNext, the context is checked every contextCheckInterval calls.
+	err      error // Error of the context, once the iteration was stopped.
+}
+
+func (i *contextIterator) HasNext() bool {
+	if i.err != nil {
+		return false
+	}
+	if i.count%contextCheckInterval == 0 {
+		if err := i.ctx.Err(); err != nil {
+			i.err = err
+			return false
+		}
+	}
+	i.count++
+	return i.iterator.HasNext()
+}
+
+func (i *contextIterator) Next() *AudioPacket {
+	if !i.HasNext() {
+		panic("iterator is exhausted")
+	}
+	return i.iterator.Next()
+}
+
+func (i *contextIterator) Reset() {
+	i.iterator.Reset()
+}
+
+// Snapshot is a copy of packets of a store, oldest first. Unlike the packets of an iterator, it can be used after
+// the store was given back, for as long as needed.
+type Snapshot []AudioPacket
+
+// SnapshotSince returns a copy of the packets of the store received less than d before now, oldest first, and the
+// window they are in, like Since. The store is only held while the packets are copied, not while they are used, e.g.
+// to encode and mix a replay. The copy is abandoned once ctx is done, or once it holds more than MaxSnapshotBytes of
+// opus data, with SnapshotTooLargeErr: a shorter duration must be asked for.
+//
+// The opus data of the packets is not copied: the stores never modify it.
+func SnapshotSince(ctx context.Context, store Store, now time.Time, d time.Duration) (Snapshot, Window, error) {
+	var (
+		snapshot Snapshot
+		window   Window
+		bytes    int
+	)
+	err := Since(ctx, store, now, d, func(iterator Iterator, w Window) error {
+		window = w
+		for iterator.HasNext() {
+			pkt := iterator.Next()
+			if bytes += len(pkt.Opus); bytes > MaxSnapshotBytes {
+				return SnapshotTooLargeErr
+			}
+			snapshot = append(snapshot, *pkt)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, Window{}, err
+	}
+	return snapshot, window, nil
+}
+
+// Streams returns the packets of the snapshot from the voice streams in ssrcs, in the same order.
+func (s Snapshot) Streams(ssrcs []uint32) Snapshot {
+	keep := make(map[uint32]bool, len(ssrcs))
+	for _, ssrc := range ssrcs {
+		keep[ssrc] = true
+	}
+
+	var streams Snapshot
+	for _, pkt := range s {
+		if keep[pkt.SSRC] {
+			streams = append(streams, pkt)
+		}
+	}
+	return streams
+}
+
+// Iterator returns an iterator over the packets of the snapshot.
+func (s Snapshot) Iterator() Iterator {
+	return &snapshotIterator{packets: s}
+}
+
+type snapshotIterator struct {
+	packets  []AudioPacket
+	position int // Index of the next packet.
+}
+
+func (i *snapshotIterator) HasNext() bool {
+	return i.position < len(i.packets)
+}
+
+func (i *snapshotIterator) Next() *AudioPacket {
+	if !i.HasNext() {
+		panic("iterator is exhausted")
+	}
+
+	pkt := &i.packets[i.position]
+	i.position++
+	return pkt
+}
+
+func (i *snapshotIterator) Reset() {
+	i.position = 0
+}
@@ -0,0 +1,127 @@
+package circular
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestWithIteratorContext(t *testing.T) {
+	var b Buffer
+	for i := 0; i < 3*contextCheckInterval; i++ {
+		b.Add(sampleTime(i), samplePacket(i))
+	}
+
+	t.Run("done", func(t *testing.T) {
+		consumed := 0
+		err := WithIteratorContext(context.Background(), &b, func(iterator Iterator) error {
+			for iterator.HasNext() {
+				iterator.Next()
+				consumed++
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 3*contextCheckInterval, consumed)
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		consumed := 0
+		err := WithIteratorContext(ctx, &b, func(iterator Iterator) error {
+			for iterator.HasNext() {
+				iterator.Next()
+				consumed++
+				if consumed == 10 {
+					cancel()
+				}
+			}
+			return nil
+		})
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Less(t, consumed, 10+contextCheckInterval+1)
+
+		// The store was given back.
+		b.Add(sampleTime(3*contextCheckInterval), samplePacket(0))
+	})
+}
+
+func TestSnapshotSince(t *testing.T) {
+	// Packets 0 to 9 are received at seconds 0 to 9.
+	var b Buffer
+	for i := 0; i < 10; i++ {
+		b.Add(sampleTime(i), samplePacket(i))
+	}
+
+	snapshot, window, err := SnapshotSince(context.Background(), &b, sampleTime(9), 2*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, Window{Start: sampleTime(7), Duration: 2 * time.Second, Available: 2 * time.Second}, window)
+
+	// The snapshot is not changed by the packets added after it was taken.
+	for i := 10; i < 20; i++ {
+		b.Add(sampleTime(i), samplePacket(i))
+	}
+	b.Reset()
+
+	iterator := snapshot.Iterator()
+	for pass := 0; pass < 2; pass++ {
+		var ssrcs []uint32
+		for iterator.HasNext() {
+			pkt := iterator.Next()
+			ssrcs = append(ssrcs, pkt.SSRC)
+			assert.Equal(t, sampleTime(int(pkt.SSRC)), pkt.Time)
+		}
+		assert.Equal(t, []uint32{8, 9}, ssrcs)
+		assert.Panics(t, func() { iterator.Next() })
+		iterator.Reset()
+	}
+}
+
+func TestSnapshotSince_cancelled(t *testing.T) {
+	var b Buffer
+	b.Add(sampleTime(0), samplePacket(0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	snapshot, _, err := SnapshotSince(ctx, &b, sampleTime(1), time.Minute)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Nil(t, snapshot)
+}
+
+func TestSnapshot_Streams(t *testing.T) {
+	snapshot := Snapshot{
+		{Time: sampleTime(0), SSRC: 1},
+		{Time: sampleTime(1), SSRC: 2},
+		{Time: sampleTime(2), SSRC: 1},
+		{Time: sampleTime(3), SSRC: 3},
+	}
+
+	assert.Equal(t, Snapshot{{Time: sampleTime(0), SSRC: 1}, {Time: sampleTime(2), SSRC: 1}}, snapshot.Streams([]uint32{1}))
+	assert.Equal(t, Snapshot{{Time: sampleTime(1), SSRC: 2}, {Time: sampleTime(3), SSRC: 3}}, snapshot.Streams([]uint32{3, 2}))
+	assert.Empty(t, snapshot.Streams([]uint32{4}))
+	assert.Empty(t, snapshot.Streams(nil))
+}
+
+func TestSnapshotSince_tooLarge(t *testing.T) {
+	// The packets share their opus data, the test does not allocate it.
+	opus := make([]byte, MaxSnapshotBytes/4)
+	var b Buffer
+	for i := 0; i < 5; i++ {
+		pkt := samplePacket(i)
+		pkt.Opus = opus
+		b.Add(sampleTime(i), pkt)
+	}
+
+	_, _, err := SnapshotSince(context.Background(), &b, sampleTime(4), 10*time.Second)
+	assert.ErrorIs(t, err, SnapshotTooLargeErr)
+
+	// A shorter window fits.
+	snapshot, _, err := SnapshotSince(context.Background(), &b, sampleTime(4), 3*time.Second)
+	require.NoError(t, err)
+	assert.Len(t, snapshot, 3)
+}
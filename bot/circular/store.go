@@ -0,0 +1,44 @@
+package circular
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"time"
+)
+
+var (
+	_ Store        = (*Buffer)(nil)
+	_ Store        = (*DiskBuffer)(nil)
+	_ seekingStore = (*DiskBuffer)(nil)
+)
+
+// Store keeps the most recent audio packets received.
+// Buffer keeps them in memory, DiskBuffer keeps them in rolling segment files on disk.
+type Store interface {
+	// Add adds a packet received at time t.
+	Add(t time.Time, pkt discordgo.Packet)
+	// WithIterator calls cb with an iterator over the stored packets, oldest first.
+	// No packet can be added while cb runs, so cb must be fast: to use the packets for long, e.g. to create a replay,
+	// copy them with SnapshotSince. See also WithIteratorContext.
+	WithIterator(cb func(iterator Iterator) error) error
+	// Reset removes all the stored packets.
+	Reset()
+	// Stats returns statistics about the stored packets.
+	Stats() Stats
+}
+
+// seekingStore is a Store that can skip the packets received before a time without reading them.
+type seekingStore interface {
+	// WithIteratorSince calls cb with an iterator over the stored packets, oldest first, like Store.WithIterator. Some
+	// of the packets received at start or before may be skipped.
+	WithIteratorSince(start time.Time, cb func(iterator Iterator) error) error
+}
+
+// Iterator iterates over the packets of a Store.
+// The packets returned must not be modified, and must not be used once the WithIterator callback returned.
+type Iterator interface {
+	HasNext() bool
+	Next() *AudioPacket
+	// Reset rewinds the iterator to the first packet, so the packets can be iterated over several times.
+	// Every pass returns the same packets since no packet can be added while the WithIterator callback runs.
+	Reset()
+}
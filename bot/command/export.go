@@ -0,0 +1,89 @@
+package command
+
+import (
+	"bigbro2/bot/circular"
+	"bigbro2/bot/logging"
+	"bigbro2/bot/replayfile"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"go.uber.org/zap"
+	"os"
+	"time"
+)
+
+// Export sends an archive of the voice streams of the last req.Duration of the audio buffer in the response to the
+// request, see replayfile.Creator.Export. The streams are not mixed, so the moderators get the audio as Discord sent
+// it. Only the guild, the duration and the speakers of the request are used, and the response should be ephemeral.
+func (r *Replay) Export(ctx context.Context, req Request) error {
+	logger := logging.FromContext(ctx, r.logger)
+
+	audioBuffer, err := r.audioBuffers.Get(req.GuildID)
+	if err != nil {
+		return err
+	}
+
+	var path string
+	defer func() {
+		if err := os.Remove(path); err != nil {
+			logger.Warn("could not delete file", zap.Error(err))
+		}
+	}()
+	if err := r.createTemporaryFile(ctx, &path); err != nil {
+		return err
+	}
+
+	manifest, err := r.creator.Export(ctx, audioBuffer, path, req.Duration, replayfile.Options{Speakers: req.Speakers})
+	if err == replayfile.NoAudioDataErr || err == replayfile.CreatorClosedErr {
+		content := "No audio data."
+		if err == replayfile.CreatorClosedErr {
+			content = "❌ The bot is shutting down."
+		}
+		return r.respond(req, &discordgo.WebhookEdit{Content: &content})
+	}
+	if errors.Is(err, circular.SnapshotTooLargeErr) {
+		logger.Info("too much audio to export")
+		content := tooMuchAudioContent
+		return r.respond(req, &discordgo.WebhookEdit{Content: &content})
+	}
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	if limit := maxUploadBytes(r.guild(req.GuildID)); int64(len(data)) > limit {
+		logger.Info("export is too large to be uploaded", zap.Int("size", len(data)), zap.Int64("limit", limit))
+		content := tooLargeContent("export", int64(len(data)), limit)
+		return r.respond(req, &discordgo.WebhookEdit{Content: &content})
+	}
+
+	content := exportContent(req.Duration, manifest)
+	err = r.respond(req, &discordgo.WebhookEdit{
+		Content: &content,
+		Files: []*discordgo.File{{
+			Name:        fmt.Sprintf("export-%s.zip", manifest.CreatedAt.Format(time.RFC3339)),
+			ContentType: "application/zip",
+			Reader:      bytes.NewReader(data),
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.Info("exported voice streams", zap.Int("streams", len(manifest.Streams)), zap.Int("size", len(data)))
+	return nil
+}
+
+// exportContent returns the message sent with the export of the last duration.
+func exportContent(duration time.Duration, manifest replayfile.Manifest) string {
+	streams := "1 voice stream"
+	if len(manifest.Streams) != 1 {
+		streams = fmt.Sprintf("%d voice streams", len(manifest.Streams))
+	}
+	return fmt.Sprintf("Raw audio of the last %d seconds: %s, described in manifest.json.", int(duration.Seconds()), streams)
+}
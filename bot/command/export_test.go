@@ -0,0 +1,80 @@
+package command
+
+import (
+	"bigbro2/bot/circular"
+	"bigbro2/bot/replayfile"
+	"bytes"
+	"context"
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReplay_Export(t *testing.T) {
+	createdAt := time.Date(2022, 7, 14, 21, 40, 0, 0, time.UTC)
+	manifest := replayfile.Manifest{
+		CreatedAt: createdAt,
+		Streams:   []replayfile.ExportedStream{{SSRC: 1}, {SSRC: 2}},
+	}
+
+	tests := []struct {
+		name            string
+		content         []byte
+		creatorErr      error
+		expectedFile    bool
+		expectedContent string
+	}{
+		{
+			name:            "export",
+			content:         []byte("PK archive"),
+			expectedFile:    true,
+			expectedContent: "Raw audio of the last 120 seconds: 2 voice streams, described in manifest.json.",
+		},
+		{
+			name:            "too large",
+			content:         bytes.Repeat([]byte{0}, 8*megabyte+1),
+			expectedContent: "❌ The export is too large to be uploaded in this server (9 MiB, the limit is 8 MiB). Try a shorter one.",
+		},
+		{name: "no audio", creatorErr: replayfile.NoAudioDataErr, expectedContent: "No audio data."},
+		{name: "too much audio", creatorErr: circular.SnapshotTooLargeErr, expectedContent: tooMuchAudioContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := &fakeMessageSession{}
+			r := newTestReplay(session)
+			creator := &fakeCreator{content: tt.content, manifest: manifest, err: tt.creatorErr}
+			r.creator = creator
+
+			err := r.Export(context.Background(), Request{Interaction: &discordgo.Interaction{}, GuildID: "guild-id", Duration: 2 * time.Minute})
+			require.NoError(t, err)
+
+			assert.Equal(t, 2*time.Minute, creator.recordingDuration)
+			require.Len(t, session.edits, 1)
+			assert.Equal(t, tt.expectedContent, *session.edits[0].Content)
+			if !tt.expectedFile {
+				assert.Empty(t, session.edits[0].Files)
+			} else {
+				require.Len(t, session.edits[0].Files, 1)
+				file := session.edits[0].Files[0]
+				assert.Equal(t, "export-2022-07-14T21:40:00Z.zip", file.Name)
+				assert.Equal(t, "application/zip", file.ContentType)
+				uploaded, err := io.ReadAll(file.Reader)
+				require.NoError(t, err)
+				assert.Equal(t, tt.content, uploaded)
+			}
+
+			// The archive is deleted once sent.
+			_, err = os.Stat(creator.path)
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func TestExportContent(t *testing.T) {
+	one := replayfile.Manifest{Streams: []replayfile.ExportedStream{{SSRC: 1}}}
+	assert.Equal(t, "Raw audio of the last 30 seconds: 1 voice stream, described in manifest.json.", exportContent(30*time.Second, one))
+}
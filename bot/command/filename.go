@@ -0,0 +1,114 @@
+package command
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// FilenameTemplate is the name of the replay files without the extension, e.g. "{channel}-{date}". The tokens are
+// replaced when a replay is sent:
+//   - {guild}: name of the guild recorded,
+//   - {channel}: name of the voice channel recorded,
+//   - {date}: date of the replay, in the RFC 3339 format,
+//   - {user}: username of the user asking for the replay,
+//   - {seconds}: duration of the replay, in seconds.
+//
+// The names unknown when the replay is sent are replaced by their ID.
+type FilenameTemplate string
+
+// DefaultFilenameTemplate is the name of the replay files when none is configured.
+const DefaultFilenameTemplate FilenameTemplate = "recording-{date}"
+
+// maxFilenameLength is the longest name of a replay file, extension excluded, in characters.
+const maxFilenameLength = 100
+
+var (
+	filenameToken = regexp.MustCompile(`{[^{}]*}`)
+	// filenameTokens are the tokens supported by FilenameTemplate.
+	filenameTokens = map[string]bool{"{guild}": true, "{channel}": true, "{date}": true, "{user}": true, "{seconds}": true}
+	// unsafeFilenameChars are the characters not allowed in the text of a template. They are either path separators or
+	// not allowed in the file names of some systems.
+	unsafeFilenameChars = `/\:*?"<>|`
+)
+
+// filenameData is what a FilenameTemplate can show.
+type filenameData struct {
+	Guild    string
+	Channel  string
+	Date     time.Time
+	User     string
+	Duration time.Duration
+}
+
+// ParseFilenameTemplate parses the name of the replay files. The empty string is DefaultFilenameTemplate.
+// It fails if the template uses an unknown token, or if its text contains a character that is not safe in a file name.
+func ParseFilenameTemplate(s string) (FilenameTemplate, error) {
+	if strings.TrimSpace(s) == "" {
+		return DefaultFilenameTemplate, nil
+	}
+
+	for _, token := range filenameToken.FindAllString(s, -1) {
+		if !filenameTokens[token] {
+			return "", fmt.Errorf("unknown token %s, expected {guild}, {channel}, {date}, {user} or {seconds}", token)
+		}
+	}
+
+	text := filenameToken.ReplaceAllString(s, "")
+	for _, r := range text {
+		if strings.ContainsRune(unsafeFilenameChars, r) || unicode.IsControl(r) {
+			return "", fmt.Errorf("character %q is not allowed in a file name", r)
+		}
+	}
+	return FilenameTemplate(s), nil
+}
+
+// render returns the name of the replay file, without the extension. The names are sanitized, so they cannot change
+// the directory of the file or contain characters that are not safe in a file name.
+func (t FilenameTemplate) render(data filenameData) string {
+	if t == "" {
+		t = DefaultFilenameTemplate
+	}
+
+	replacer := strings.NewReplacer(
+		"{guild}", sanitizeFilename(data.Guild),
+		"{channel}", sanitizeFilename(data.Channel),
+		"{date}", data.Date.Format(time.RFC3339),
+		"{user}", sanitizeFilename(data.User),
+		"{seconds}", strconv.Itoa(int(data.Duration.Seconds())),
+	)
+	name := strings.TrimSpace(replacer.Replace(string(t)))
+
+	if runes := []rune(name); len(runes) > maxFilenameLength {
+		name = string(runes[:maxFilenameLength])
+	}
+	return name
+}
+
+// sanitizeFilename returns s usable in a file name: the characters other than letters, digits, dashes and dots are
+// replaced by underscores, and consecutive underscores are merged. An empty name is "unknown".
+func sanitizeFilename(s string) string {
+	var b strings.Builder
+	underscore := false
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '.' {
+			b.WriteRune(r)
+			underscore = false
+			continue
+		}
+		if !underscore {
+			b.WriteRune('_')
+			underscore = true
+		}
+	}
+
+	// Leading dots would make the file hidden, or refer to a parent directory.
+	name := strings.Trim(b.String(), "_.")
+	if name == "" {
+		return "unknown"
+	}
+	return name
+}
@@ -0,0 +1,103 @@
+package command
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFilenameTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected FilenameTemplate
+		wantErr  bool
+	}{
+		{name: "default", value: "", expected: DefaultFilenameTemplate},
+		{name: "every token", value: "{guild} {channel} {date} {user} {seconds}s", expected: "{guild} {channel} {date} {user} {seconds}s"},
+		{name: "unknown token", value: "{channel}-{time}", wantErr: true},
+		{name: "path separator", value: "../{channel}", wantErr: true},
+		{name: "windows separator", value: `replays\{channel}`, wantErr: true},
+		{name: "colon", value: "replay:{channel}", wantErr: true},
+		{name: "control character", value: "replay\n{channel}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseFilenameTemplate(tt.value)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestFilenameTemplate_render(t *testing.T) {
+	data := filenameData{
+		Guild:    "My Guild",
+		Channel:  "général",
+		Date:     time.Date(2022, 7, 14, 21, 40, 0, 0, time.UTC),
+		User:     "alice",
+		Duration: 30 * time.Second,
+	}
+	tests := []struct {
+		name     string
+		template FilenameTemplate
+		data     filenameData
+		expected string
+	}{
+		{name: "default", template: DefaultFilenameTemplate, data: data, expected: "recording-2022-07-14T21:40:00Z"},
+		{name: "zero value", template: "", data: data, expected: "recording-2022-07-14T21:40:00Z"},
+		{name: "every token", template: "{guild}-{channel}-{user}-{seconds}s", data: data, expected: "My_Guild-général-alice-30s"},
+		{
+			name:     "path traversal",
+			template: "{channel}",
+			data:     filenameData{Channel: "../../etc/passwd"},
+			expected: "etc_passwd",
+		},
+		{
+			name:     "unsafe characters",
+			template: "{user}-{channel}",
+			data:     filenameData{User: `a<b>:c"d|e?f*g\h`, Channel: "🔊 voice"},
+			expected: "a_b_c_d_e_f_g_h-voice",
+		},
+		{name: "empty name", template: "{user}-{seconds}", data: filenameData{User: "***"}, expected: "unknown-0"},
+		{
+			name:     "too long",
+			template: "{channel}",
+			data:     filenameData{Channel: strings.Repeat("a", 200)},
+			expected: strings.Repeat("a", maxFilenameLength),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.template.render(tt.data))
+		})
+	}
+}
+
+func TestReplay_filenameData(t *testing.T) {
+	state := discordgo.NewState()
+	require.NoError(t, state.GuildAdd(&discordgo.Guild{ID: "guild-id", Name: "My Guild"}))
+	require.NoError(t, state.ChannelAdd(&discordgo.Channel{ID: "channel-id", GuildID: "guild-id", Name: "general"}))
+	now := time.Unix(1000, 0)
+
+	r := newTestReplay(&fakeMessageSession{})
+	r.session = &discordgo.Session{State: state}
+	req := Request{
+		GuildID:        "guild-id",
+		VoiceChannelID: "channel-id",
+		Requester:      &discordgo.User{ID: "user-id", Username: "alice"},
+		Duration:       30 * time.Second,
+	}
+	assert.Equal(t, filenameData{Guild: "My Guild", Channel: "general", Date: now, User: "alice", Duration: 30 * time.Second}, r.filenameData(req, now))
+
+	// The names missing from the state are replaced by their ID.
+	req = Request{GuildID: "other-guild-id", VoiceChannelID: "other-channel-id", Requester: &discordgo.User{ID: "user-id"}}
+	assert.Equal(t, filenameData{Guild: "other-guild-id", Channel: "other-channel-id", Date: now, User: "user-id"}, r.filenameData(req, now))
+}
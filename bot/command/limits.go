@@ -0,0 +1,59 @@
+package command
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+)
+
+const megabyte = 1024 * 1024
+
+// maxUploadBytes returns the maximum size of a file uploaded in the guild, which depends on its boost level.
+// A nil guild, when it is not in the state, gets the limit of the lowest level.
+func maxUploadBytes(guild *discordgo.Guild) int64 {
+	if guild == nil {
+		return 8 * megabyte
+	}
+
+	switch guild.PremiumTier {
+	case discordgo.PremiumTier2:
+		return 50 * megabyte
+	case discordgo.PremiumTier3:
+		return 100 * megabyte
+	default:
+		return 8 * megabyte
+	}
+}
+
+// tooLargeContent is the response when a file of size bytes, e.g. a "replay", is larger than limit, the maximum size
+// of a file uploaded in the guild.
+func tooLargeContent(what string, size, limit int64) string {
+	return fmt.Sprintf(
+		"❌ The %s is too large to be uploaded in this server (%d MiB, the limit is %d MiB). Try a shorter one.",
+		what,
+		size/megabyte+1,
+		limit/megabyte,
+	)
+}
+
+// tooLargeAllContent is the response when a replay of the whole audio buffer is still larger than limit once encoded
+// at a lower bitrate, see Replay.fitUploadLimit.
+func tooLargeAllContent(size, limit int64) string {
+	return fmt.Sprintf(
+		"❌ Everything recorded does not fit in a file uploaded in this server, even at a lower quality (%d MiB, the limit is %d MiB). Ask for a number of seconds instead.",
+		size/megabyte+1,
+		limit/megabyte,
+	)
+}
+
+// guild returns the guild from the state, or nil if it is unknown.
+func (r *Replay) guild(guildID string) *discordgo.Guild {
+	if r.session == nil || r.session.State == nil {
+		return nil
+	}
+
+	guild, err := r.session.State.Guild(guildID)
+	if err != nil {
+		return nil
+	}
+	return guild
+}
@@ -0,0 +1,26 @@
+package command
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMaxUploadBytes(t *testing.T) {
+	tests := []struct {
+		name     string
+		guild    *discordgo.Guild
+		expected int64
+	}{
+		{name: "unknown guild", guild: nil, expected: 8 * 1024 * 1024},
+		{name: "no boost", guild: &discordgo.Guild{PremiumTier: discordgo.PremiumTierNone}, expected: 8 * 1024 * 1024},
+		{name: "tier 1", guild: &discordgo.Guild{PremiumTier: discordgo.PremiumTier1}, expected: 8 * 1024 * 1024},
+		{name: "tier 2", guild: &discordgo.Guild{PremiumTier: discordgo.PremiumTier2}, expected: 50 * 1024 * 1024},
+		{name: "tier 3", guild: &discordgo.Guild{PremiumTier: discordgo.PremiumTier3}, expected: 100 * 1024 * 1024},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, maxUploadBytes(tt.guild))
+		})
+	}
+}
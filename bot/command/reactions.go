@@ -0,0 +1,71 @@
+package command
+
+import (
+	"bigbro2/bot/logging"
+	"context"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"go.uber.org/zap"
+	"strings"
+)
+
+// Reactions are the emojis the bot reacts with to the message of a replay, so its requester sees at a glance whether
+// it was sent even if they miss the text. Each emoji is either a unicode emoji or "name:id" for a custom emoji. An empty
+// emoji adds no reaction.
+type Reactions struct {
+	// Success reacts to the message of a replay that was uploaded.
+	Success string
+	// Failure reacts to the response to an interaction whose replay failed. A replay asked without an interaction,
+	// e.g. with a reaction, has no message to react to when it fails.
+	Failure string
+}
+
+// DefaultReactions are the reactions when they are enabled without choosing the emojis.
+var DefaultReactions = Reactions{Success: "✅", Failure: "❌"}
+
+// ParseReactions parses the reactions to the replays: "true" for DefaultReactions, or the success and failure emojis
+// separated by a comma, e.g. "👍,👎". Either emoji can be left empty, e.g. "👍," only reacts to the successes. The empty
+// string disables them.
+func ParseReactions(s string) (Reactions, error) {
+	switch s = strings.TrimSpace(s); s {
+	case "", "false":
+		return Reactions{}, nil
+	case "true":
+		return DefaultReactions, nil
+	}
+
+	success, failure, ok := strings.Cut(s, ",")
+	if !ok {
+		return Reactions{}, fmt.Errorf("reactions must be \"true\" or formatted as success,failure, got %q", s)
+	}
+	return Reactions{Success: strings.TrimSpace(success), Failure: strings.TrimSpace(failure)}, nil
+}
+
+// react adds the emoji to the message. The replay was already answered, a failure is only logged.
+func (r *Replay) react(ctx context.Context, msg *discordgo.Message, emoji string) {
+	if emoji == "" || msg == nil {
+		return
+	}
+
+	logger := logging.FromContext(ctx, r.logger).With(zap.String("message_id", msg.ID), zap.String("emoji", emoji))
+	if err := r.messages.MessageReactionAdd(msg.ChannelID, msg.ID, emoji); err != nil {
+		logger.Warn("failed to react to replay message", zap.Error(err))
+		return
+	}
+	logger.Debug("reacted to replay message")
+}
+
+// reactToFailure adds the failure reaction to the response to the interaction of a replay that failed. The response
+// is fetched: it is the deferred response, which was not edited.
+func (r *Replay) reactToFailure(ctx context.Context, req Request) {
+	if r.reactions.Failure == "" || req.Interaction == nil {
+		return
+	}
+
+	msg, err := r.messages.InteractionResponse(req.Interaction)
+	if err != nil {
+		logging.FromContext(ctx, r.logger).Warn("failed to get the response to react to", zap.Error(err))
+		return
+	}
+	r.react(ctx, msg, r.reactions.Failure)
+}
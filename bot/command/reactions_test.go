@@ -0,0 +1,122 @@
+package command
+
+import (
+	"bigbro2/bot/replayfile"
+	"context"
+	"errors"
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseReactions(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected Reactions
+		wantErr  bool
+	}{
+		{name: "empty", value: ""},
+		{name: "disabled", value: "false"},
+		{name: "default", value: "true", expected: DefaultReactions},
+		{name: "custom", value: "👍, 👎", expected: Reactions{Success: "👍", Failure: "👎"}},
+		{name: "custom emoji", value: "yes:123,no:456", expected: Reactions{Success: "yes:123", Failure: "no:456"}},
+		{name: "success only", value: "👍,", expected: Reactions{Success: "👍"}},
+		{name: "single emoji", value: "👍", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reactions, err := ParseReactions(tt.value)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, reactions)
+		})
+	}
+}
+
+func TestReplay_Run_reactions(t *testing.T) {
+	tests := []struct {
+		name               string
+		reactions          Reactions
+		creatorErr         error
+		withoutInteraction bool
+		wantErr            bool
+		expected           []string
+	}{
+		{
+			name:      "uploaded",
+			reactions: DefaultReactions,
+			expected:  []string{"interaction-channel-id/response-id/✅"},
+		},
+		{
+			name:               "uploaded without interaction",
+			reactions:          DefaultReactions,
+			withoutInteraction: true,
+			expected:           []string{"text-channel-id/message-id/✅"},
+		},
+		{
+			name:       "failed",
+			reactions:  DefaultReactions,
+			creatorErr: errors.New("ffmpeg crashed"),
+			wantErr:    true,
+			expected:   []string{"interaction-channel-id/response-id/❌"},
+		},
+		{
+			name:               "failed without interaction",
+			reactions:          DefaultReactions,
+			creatorErr:         errors.New("ffmpeg crashed"),
+			withoutInteraction: true,
+			wantErr:            true,
+		},
+		{
+			// The response already tells the user why there is no replay.
+			name:       "nothing to replay",
+			reactions:  DefaultReactions,
+			creatorErr: replayfile.NoAudioDataErr,
+		},
+		{
+			name:      "success only",
+			reactions: Reactions{Success: "👍"},
+			expected:  []string{"interaction-channel-id/response-id/👍"},
+		},
+		{
+			name:       "failure only",
+			reactions:  Reactions{Failure: "👎"},
+			creatorErr: errors.New("ffmpeg crashed"),
+			wantErr:    true,
+			expected:   []string{"interaction-channel-id/response-id/👎"},
+		},
+		{
+			name:       "disabled",
+			creatorErr: errors.New("ffmpeg crashed"),
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := &fakeMessageSession{}
+			r := newTestReplay(session)
+			r.creator = &fakeCreator{content: []byte("OggS"), err: tt.creatorErr}
+			r.reactions = tt.reactions
+
+			req := newTestRequest()
+			if tt.withoutInteraction {
+				req.Interaction = nil
+				req.ChannelID = "text-channel-id"
+				req.Requester = &discordgo.User{ID: "requester-id"}
+			}
+
+			err := r.Run(context.Background(), req)
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			assert.Equal(t, tt.expected, session.reactions)
+		})
+	}
+}
@@ -2,97 +2,629 @@ package command
 
 import (
 	"bigbro2/bot/circular"
+	"bigbro2/bot/logging"
+	"bigbro2/bot/ratelimit"
 	"bigbro2/bot/replayfile"
+	"bigbro2/bot/tempfile"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/bwmarrin/discordgo"
 	"go.uber.org/zap"
+	"io"
+	"net/http"
 	"os"
+	"strings"
 	"time"
 )
 
 type Replay struct {
-	logger      *zap.Logger
-	creator     *replayfile.Creator
-	session     *discordgo.Session
-	audioBuffer *circular.Buffer
+	logger            *zap.Logger
+	creator           creator
+	session           *discordgo.Session
+	audioBuffers      *circular.BufferRegistry
+	summaryWebhookURL string
+	minSpeakers       int
+	httpClient        *http.Client
+	messages          messageSession
+	sessions          *sessions
+	transcriber       Transcriber
+	filenameTemplate  FilenameTemplate
+	uploadRetryDelay  time.Duration // Wait between two attempts to upload a replay.
+	reactions         Reactions
+	now               func() time.Time
 }
 
-func NewReplay(logger *zap.Logger, creator *replayfile.Creator, session *discordgo.Session, audioBuffer *circular.Buffer) *Replay {
+// creator creates the replay files. It is implemented by *replayfile.Creator.
+type creator interface {
+	Create(ctx context.Context, audioBuffer circular.Store, path string, recordingDuration time.Duration, opts replayfile.Options) (replayfile.Result, error)
+	CreateStream(ctx context.Context, audioBuffer circular.Store, recordingDuration time.Duration, opts replayfile.Options) (io.ReadCloser, replayfile.Result, error)
+	Export(ctx context.Context, audioBuffer circular.Store, path string, recordingDuration time.Duration, opts replayfile.Options) (replayfile.Manifest, error)
+	Container() replayfile.Container
+	Close() error
+}
+
+// messageSession is the part of the discord session used to send the replays.
+type messageSession interface {
+	InteractionResponseEdit(interaction *discordgo.Interaction, newresp *discordgo.WebhookEdit) (*discordgo.Message, error)
+	ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend) (*discordgo.Message, error)
+	InteractionResponse(interaction *discordgo.Interaction) (*discordgo.Message, error)
+	MessageReactionAdd(channelID, messageID, emojiID string) error
+}
+
+// breakerMessageSession sends the replays through a circuit breaker, so they fail fast while Discord rate limits the
+// bot.
+type breakerMessageSession struct {
+	messages messageSession
+	breaker  *ratelimit.Breaker
+}
+
+func (s breakerMessageSession) InteractionResponseEdit(interaction *discordgo.Interaction, newresp *discordgo.WebhookEdit) (msg *discordgo.Message, err error) {
+	err = s.breaker.Do(func() error {
+		msg, err = s.messages.InteractionResponseEdit(interaction, newresp)
+		return err
+	})
+	return msg, err
+}
+
+func (s breakerMessageSession) ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend) (msg *discordgo.Message, err error) {
+	err = s.breaker.Do(func() error {
+		msg, err = s.messages.ChannelMessageSendComplex(channelID, data)
+		return err
+	})
+	return msg, err
+}
+
+func (s breakerMessageSession) InteractionResponse(interaction *discordgo.Interaction) (msg *discordgo.Message, err error) {
+	err = s.breaker.Do(func() error {
+		msg, err = s.messages.InteractionResponse(interaction)
+		return err
+	})
+	return msg, err
+}
+
+func (s breakerMessageSession) MessageReactionAdd(channelID, messageID, emojiID string) error {
+	return s.breaker.Do(func() error {
+		return s.messages.MessageReactionAdd(channelID, messageID, emojiID)
+	})
+}
+
+// uploadAttempts is the number of times uploading a replay is attempted before giving up.
+const uploadAttempts = 3
+
+// streamMaxDuration is the duration of the longest replay mixed straight into memory, without an output file, see
+// Replay.streamable. Such a replay is far below the upload limit.
+const streamMaxDuration = time.Minute
+
+// tooMuchAudioContent answers a request whose audio is too large to be copied from the audio buffer, see
+// circular.SnapshotSince.
+const tooMuchAudioContent = "❌ There is too much audio to go back that far, ask for fewer seconds."
+
+// tooMuchAudioAllContent answers a request for the whole audio buffer when it is too large to be copied, see
+// circular.SnapshotSince. There are no fewer seconds to ask for.
+const tooMuchAudioAllContent = "❌ There is too much audio in the buffer to record all of it, ask for a number of seconds instead."
+
+const (
+	// fitAttempts is the number of times a replay of the whole audio buffer is encoded again to fit the upload limit.
+	fitAttempts = 3
+	// fitMargin is the part of the upload limit aimed at when encoding a replay again, the rest is left for the
+	// container and for the encoder missing its target.
+	fitMargin = 0.9
+	// minFitBitrate is the lowest bitrate a replay is encoded at, in bits per second. Below it, speech is hard to
+	// understand.
+	minFitBitrate = 6_000
+)
+
+// streamTooLongContent answers a request whose audio has a voice stream that cannot be placed in the replay, see
+// replayfile.StreamTooLongErr.
+const streamTooLongContent = "❌ The audio of a speaker is out of sync and could not be replayed, try again later."
+
+// Request describes a replay asked by a user.
+// It is asked either with an interaction, whose deferred response is edited with the replay, or by other means (e.g.
+// a reaction), in which case the replay is sent in a new message in ChannelID.
+type Request struct {
+	Interaction    *discordgo.Interaction
+	ChannelID      string          // Text channel the replay is sent to when there is no interaction.
+	Requester      *discordgo.User // User asking for the replay when there is no interaction.
+	GuildID        string          // Guild recorded. The interaction has no guild when the replay is asked in a DM.
+	Duration       time.Duration
+	VoiceChannelID string
+	Speakers       map[uint32]string // ID of the user speaking in each voice stream, indexed by SSRC.
+	Spatial        bool              // Pan each speaker to a different position in the stereo field.
+	Multitrack     bool              // Put each speaker in their own channel instead of mixing them.
+	DryRun         bool              // Create the replay but only describe it instead of uploading it.
+	Continue       bool              // Merge the replay with the previous replay of the user, see mergeWindow.
+	All            bool              // Duration is how far back the audio buffer goes, to record all of it.
+	JoinedAt       time.Time         // Time the bot joined the voice channel, zero if unknown.
+	// Departures is when the user of each voice stream left the voice channel, indexed by SSRC.
+	Departures map[uint32]time.Time
+	// SSRCs restricts the replay to these voice streams, e.g. the ones of the user asking for a clip of themselves. Nil
+	// includes every stream.
+	SSRCs []uint32
+}
+
+// ReplayOptions contains the optional settings of the replay command.
+type ReplayOptions struct {
+	// SummaryWebhookURL is a webhook the summary of every replay is posted to. Empty disables it.
+	SummaryWebhookURL string
+	// MinSpeakers is the number of people who must speak in a replay for it to be sent, 1 or less never refuses one.
+	MinSpeakers int
+	// Transcriber transcribes every replay, the transcript being sent along with it. Nil disables it.
+	Transcriber Transcriber
+	// Breaker is the circuit breaker the replays are sent through. Nil sends them directly.
+	Breaker *ratelimit.Breaker
+	// FilenameTemplate names the replay files, the empty template is DefaultFilenameTemplate.
+	FilenameTemplate FilenameTemplate
+	// Reactions are added to the messages of the replays, see Reactions.
+	Reactions Reactions
+}
+
+// NewReplay creates the replay command.
+func NewReplay(logger *zap.Logger, creator *replayfile.Creator, session *discordgo.Session, audioBuffers *circular.BufferRegistry, options ReplayOptions) *Replay {
+	transcriber := options.Transcriber
+	if transcriber == nil {
+		transcriber = noTranscriber{}
+	}
+	var messages messageSession = session
+	if options.Breaker != nil {
+		messages = breakerMessageSession{messages: session, breaker: options.Breaker}
+	}
 	return &Replay{
-		logger:      logger,
-		creator:     creator,
-		session:     session,
-		audioBuffer: audioBuffer,
+		logger:            logger,
+		creator:           creator,
+		session:           session,
+		audioBuffers:      audioBuffers,
+		summaryWebhookURL: options.SummaryWebhookURL,
+		minSpeakers:       options.MinSpeakers,
+		httpClient:        &http.Client{Timeout: 10 * time.Second},
+		messages:          messages,
+		sessions:          newSessions(),
+		transcriber:       transcriber,
+		filenameTemplate:  options.FilenameTemplate,
+		uploadRetryDelay:  time.Second,
+		reactions:         options.Reactions,
+		now:               time.Now,
 	}
 }
 
-func (r *Replay) Run(ctx context.Context, duration time.Duration, i *discordgo.Interaction) error {
-	var path string
-	defer func() {
-		if err := os.Remove(path); err != nil {
-			r.logger.Warn("could not delete file", zap.Error(err))
-		}
+// Run creates the replay and sends it in the response to the interaction.
+// If the context carries a logger (see logging.WithLogger), it is used for every log of the replay.
+func (r *Replay) Run(ctx context.Context, req Request) error {
+	msg, err := r.run(ctx, req)
+	switch {
+	case err != nil:
+		r.reactToFailure(ctx, req)
+	case msg != nil:
+		r.react(ctx, msg, r.reactions.Success)
+	}
+	return err
+}
 
-		r.logger.Debug("deleted file", zap.String("path", path))
-	}()
+// run creates the replay and sends it, see Run. It returns the message of the replay, nil if none was uploaded, e.g.
+// there was nothing to replay.
+func (r *Replay) run(ctx context.Context, req Request) (*discordgo.Message, error) {
+	logger := logging.FromContext(ctx, r.logger)
+	userID := ""
+	if user := req.requester(); user != nil {
+		userID = user.ID
+	}
 
-	err := r.createTemporaryFile(&path)
+	now := r.now()
+	current := window{start: now.Add(-req.Duration), end: now}
+	if req.Continue {
+		previous, ok := r.sessions.Last(userID)
+		current = mergeWindow(previous, ok, current)
+		req.Duration = current.end.Sub(current.start)
+		logger.Debug("continuing previous replay", zap.Bool("found", ok), zap.Duration("merged_duration", req.Duration))
+	}
+	duration := req.Duration
+
+	audioBuffer, err := r.audioBuffers.Get(req.GuildID)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// A clip of some voice streams is not a conversation, the minimum number of speakers does not apply.
+	if r.minSpeakers > 1 && req.SSRCs == nil {
+		speakers, err := countSpeakers(ctx, audioBuffer, now, duration)
+		if err != nil {
+			return nil, err
+		}
+		if speakers < r.minSpeakers {
+			logger.Info("not enough speakers to create a replay", zap.Int("speakers", speakers))
+			content := "Not enough audio to replay."
+			return nil, r.respond(req, &discordgo.WebhookEdit{Content: &content})
+		}
 	}
 
-	err = r.creator.Create(ctx, r.audioBuffer, path, duration)
-	if err == replayfile.NoAudioDataErr {
+	opts := replayfile.Options{
+		Spatial:    req.Spatial,
+		Multitrack: req.Multitrack,
+		// The loudness is only reported in the summary.
+		Loudness:   r.summaryWebhookURL != "",
+		Speakers:   req.Speakers,
+		JoinedAt:   req.JoinedAt,
+		Departures: req.Departures,
+		SSRCs:      req.SSRCs,
+	}
+	var path string // File the replay is written to, empty if it is mixed into memory.
+	if !r.streamable(duration) {
+		err = r.createTemporaryFile(ctx, &path)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err := os.Remove(path); err != nil {
+				logger.Warn("could not delete file", zap.Error(err))
+			}
+
+			logger.Debug("deleted file", zap.String("path", path))
+		}()
+	}
+	// data is the content of the replay, read from path if it was written to a file.
+	result, data, err := r.create(ctx, audioBuffer, path, duration, opts)
+	if err == replayfile.NoAudioDataErr || err == replayfile.CreatorClosedErr {
 		content := "No audio data."
-		_, err = r.session.InteractionResponseEdit(i, &discordgo.WebhookEdit{Content: &content})
+		if err == replayfile.CreatorClosedErr {
+			content = "❌ The bot is shutting down."
+		}
+		return nil, r.respond(req, &discordgo.WebhookEdit{Content: &content})
+	}
+	if errors.Is(err, circular.SnapshotTooLargeErr) {
+		logger.Info("too much audio to create the replay")
+		content := tooMuchAudioContent
+		if req.All {
+			content = tooMuchAudioAllContent
+		}
+		return nil, r.respond(req, &discordgo.WebhookEdit{Content: &content})
+	}
+	if errors.Is(err, replayfile.StreamTooLongErr) {
+		logger.Warn("could not create the replay", zap.Error(err))
+		content := streamTooLongContent
+		return nil, r.respond(req, &discordgo.WebhookEdit{Content: &content})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Truncated {
+		logger.Info("replay is shorter than asked for", zap.Duration("available_duration", result.AvailableDuration))
+	}
+
+	if req.DryRun {
+		return nil, r.reportDryRun(req, r.Summary(req, result, result.FileSize))
+	}
+
+	limit := maxUploadBytes(r.guild(req.GuildID))
+	if req.All && result.FileSize > limit {
+		// There is no shorter replay to ask for: the whole buffer is encoded again at a lower bitrate.
+		result, data, err = r.fitUploadLimit(ctx, audioBuffer, path, duration, opts, result, limit)
 		if err != nil {
-			return fmt.Errorf("failed to send message: %w", err)
+			return nil, err
+		}
+	}
+	if result.FileSize > limit {
+		logger.Info("replay is too large to be uploaded", zap.Int64("size", result.FileSize), zap.Int64("limit", limit))
+		content := tooLargeContent("replay", result.FileSize, limit)
+		if req.All {
+			content = tooLargeAllContent(result.FileSize, limit)
 		}
-		return nil
+		return nil, r.respond(req, &discordgo.WebhookEdit{Content: &content})
 	}
+
+	var transcript string
+	if path != "" {
+		transcript = r.transcribe(ctx, path)
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("failed to read file: %w", err)
+		}
+	}
+	msg, err := r.uploadReplay(ctx, req, replayContent(duration, req.All, result), data, transcript)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if userID != "" {
+		r.sessions.Save(userID, current)
+	}
+
+	if r.summaryWebhookURL != "" {
+		// The replay was delivered, failing to post the summary should not be reported to the user.
+		if err := r.postSummary(ctx, r.Summary(req, result, int64(len(data)))); err != nil {
+			logger.Warn("failed to post replay summary", zap.Error(err))
+		}
 	}
 
-	f, err := os.Open(path)
+	return msg, nil
+}
+
+// Close waits for the replays being created to be done. Replays cannot be created once Close is called.
+func (r *Replay) Close() error {
+	if err := r.creator.Close(); err != nil {
+		return fmt.Errorf("could not close replay creator: %w", err)
+	}
+	return nil
+}
+
+// replayContent returns the message sent with a replay of the last duration.
+// If all is set, the replay contains the whole audio buffer: it is expected to be shorter than duration.
+func replayContent(duration time.Duration, all bool, result replayfile.Result) string {
+	var content string
+	switch {
+	case all:
+		content = fmt.Sprintf("Everything recorded, the last %d seconds.", int(result.AvailableDuration.Seconds()))
+	case !result.Truncated:
+		content = fmt.Sprintf("Last %d seconds.", int(duration.Seconds()))
+	default:
+		content = fmt.Sprintf(
+			"Last %d seconds (only %d of the %d seconds asked for were recorded).",
+			int(result.AvailableDuration.Seconds()),
+			int(result.AvailableDuration.Seconds()),
+			int(duration.Seconds()),
+		)
+	}
+
+	switch {
+	case result.DroppedStreams == 1:
+		content += "\nThere were too many people speaking: the least active one was left out."
+	case result.DroppedStreams > 1:
+		content += fmt.Sprintf("\nThere were too many people speaking: the %d least active ones were left out.", result.DroppedStreams)
+	}
+	if result.MultitrackMixed {
+		content += fmt.Sprintf("\nThe speakers could not each get their own channel (at most %d), they were mixed together.", replayfile.MaxMultitrackChannels)
+	}
+	return content
+}
+
+// uploadReplay sends the replay file with the content in the response to the request, and returns the message it
+// was sent in. The whole file is read in memory before the upload starts, so the upload never depends on the file still
+// existing and the file can safely be deleted as soon as this function returns.
+// If transcript is not empty, it is sent in a text file along with the replay.
+// A failed upload is attempted again up to uploadAttempts times, unless it failed because of the request itself or
+// because Discord rate limits the bot.
+func (r *Replay) uploadReplay(ctx context.Context, req Request, content string, data []byte, transcript string) (*discordgo.Message, error) {
+	now := r.now()
+	container := r.creator.Container()
+	files := []*discordgo.File{{
+		Name:        r.filenameTemplate.render(r.filenameData(req, now)) + container.Extension(),
+		ContentType: container.ContentType(),
+		Reader:      bytes.NewReader(data),
+	}}
+	if transcript != "" {
+		files = append(files, &discordgo.File{
+			Name:        fmt.Sprintf("transcript-%s.txt", now.Format(time.RFC3339)),
+			ContentType: "text/plain; charset=utf-8",
+			Reader:      strings.NewReader(transcript),
+		})
+	}
+
+	edit := &discordgo.WebhookEdit{Content: &content, Files: files}
+	for attempt := 1; ; attempt++ {
+		// The files were read by the previous attempt.
+		if err := rewindFiles(files); err != nil {
+			return nil, err
+		}
+
+		msg, err := r.send(req, edit)
+		if err == nil {
+			return msg, nil
+		}
+		if attempt >= uploadAttempts || !retriableUpload(err) {
+			return nil, err
+		}
+
+		logging.FromContext(ctx, r.logger).Warn("failed to upload replay, retrying", zap.Int("attempt", attempt), zap.Error(err))
+		timer := time.NewTimer(r.uploadRetryDelay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// rewindFiles seeks the readers of the files back to their start, so they can be sent again.
+func rewindFiles(files []*discordgo.File) error {
+	for _, f := range files {
+		seeker, ok := f.Reader.(io.Seeker)
+		if !ok {
+			return fmt.Errorf("file %s cannot be sent again", f.Name)
+		}
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind file %s: %w", f.Name, err)
+		}
+	}
+	return nil
+}
+
+// retriableUpload returns whether an upload that failed with err may succeed if attempted again. The rate limits are
+// handled by the circuit breaker, and Discord refusing the request (4xx) would refuse it again.
+func retriableUpload(err error) bool {
+	if errors.Is(err, ratelimit.OpenErr) || ratelimit.IsRateLimited(err) {
+		return false
+	}
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) && restErr.Response != nil {
+		return restErr.Response.StatusCode >= http.StatusInternalServerError
+	}
+	return true
+}
+
+// filenameData returns what the name of the replay file of the request sent at now can show.
+func (r *Replay) filenameData(req Request, now time.Time) filenameData {
+	data := filenameData{
+		Guild:    req.GuildID,
+		Channel:  req.VoiceChannelID,
+		Date:     now,
+		Duration: req.Duration,
+	}
+	if guild := r.guild(req.GuildID); guild != nil && guild.Name != "" {
+		data.Guild = guild.Name
+	}
+	if r.session != nil && r.session.State != nil {
+		if channel, err := r.session.State.Channel(req.VoiceChannelID); err == nil && channel.Name != "" {
+			data.Channel = channel.Name
+		}
+	}
+	if user := req.requester(); user != nil {
+		data.User = user.Username
+		if data.User == "" {
+			data.User = user.ID
+		}
+	}
+	return data
+}
+
+// reportDryRun describes the replay that would have been uploaded in the response to the request.
+func (r *Replay) reportDryRun(req Request, summary Summary) error {
+	var speakers []string
+	for _, speaker := range summary.Speakers {
+		switch {
+		case speaker.Username != "":
+			speakers = append(speakers, speaker.Username)
+		case speaker.UserID != "":
+			speakers = append(speakers, fmt.Sprintf("<@%s>", speaker.UserID))
+		default:
+			speakers = append(speakers, "unknown")
+		}
+	}
+
+	content := fmt.Sprintf(
+		"Dry run, nothing was uploaded.\nStreams: %d (%s)\nDuration: %d seconds\nFile size: %d KiB",
+		summary.SpeakerCount,
+		strings.Join(speakers, ", "),
+		int(summary.DurationSeconds),
+		summary.FileSize/1024,
+	)
+	return r.respond(req, &discordgo.WebhookEdit{Content: &content})
+}
+
+// respond sends the response to the request: it edits the deferred response to the interaction, or sends a new
+// message in the channel of the request if there is no interaction.
+func (r *Replay) respond(req Request, edit *discordgo.WebhookEdit) error {
+	_, err := r.send(req, edit)
+	return err
+}
+
+// send sends the response to the request like respond, and returns the message it was sent in.
+func (r *Replay) send(req Request, edit *discordgo.WebhookEdit) (*discordgo.Message, error) {
+	var (
+		msg *discordgo.Message
+		err error
+	)
+	if req.Interaction != nil {
+		msg, err = r.messages.InteractionResponseEdit(req.Interaction, edit)
+	} else {
+		send := &discordgo.MessageSend{Files: edit.Files}
+		if edit.Content != nil {
+			send.Content = *edit.Content
+		}
+		msg, err = r.messages.ChannelMessageSendComplex(req.ChannelID, send)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
+		return nil, fmt.Errorf("failed to send message: %w", err)
+	}
+	return msg, nil
+}
+
+// streamable returns whether a replay of duration can be mixed into memory rather than into a file: it must be short
+// enough to always be uploaded, and not be transcribed, which needs a file.
+func (r *Replay) streamable(duration time.Duration) bool {
+	_, noTranscript := r.transcriber.(noTranscriber)
+	return noTranscript && duration <= streamMaxDuration
+}
+
+// create creates the replay into path, or into memory if path is empty, see createInMemory. The content is only
+// returned when it is created into memory.
+func (r *Replay) create(ctx context.Context, audioBuffer circular.Store, path string, duration time.Duration, opts replayfile.Options) (replayfile.Result, []byte, error) {
+	if path == "" {
+		return r.createInMemory(ctx, audioBuffer, duration, opts)
+	}
+	result, err := r.creator.Create(ctx, audioBuffer, path, duration, opts)
+	return result, nil, err
+}
+
+// fitUploadLimit creates the replay again at lower bitrates until it is at most limit bytes, given the result of the
+// replay created at the default bitrate. It gives up once the bitrate would go below minFitBitrate, or after
+// fitAttempts replays, and returns the result of the last one, which is still too large.
+// The bitrate of each attempt is the one at which the replay would be limit bytes, judged from the size of the
+// previous one, less a margin for the container.
+func (r *Replay) fitUploadLimit(ctx context.Context, audioBuffer circular.Store, path string, duration time.Duration, opts replayfile.Options, result replayfile.Result, limit int64) (replayfile.Result, []byte, error) {
+	logger := logging.FromContext(ctx, r.logger)
+
+	var data []byte
+	seconds := result.AvailableDuration.Seconds()
+	if seconds <= 0 {
+		seconds = duration.Seconds()
+	}
+	// The actual bitrate of the replay, whatever the encoder was asked for.
+	bitrate := float64(result.FileSize) * 8 / seconds
+	for attempt := 0; attempt < fitAttempts && result.FileSize > limit; attempt++ {
+		bitrate = bitrate * float64(limit) / float64(result.FileSize) * fitMargin
+		if bitrate < minFitBitrate {
+			logger.Info("replay cannot fit the upload limit", zap.Int64("size", result.FileSize), zap.Int64("limit", limit))
+			break
+		}
+
+		opts.Bitrate = int(bitrate)
+		logger.Info("encoding the replay again to fit the upload limit", zap.Int64("size", result.FileSize), zap.Int64("limit", limit), zap.Int("bitrate", opts.Bitrate))
+		var err error
+		result, data, err = r.create(ctx, audioBuffer, path, duration, opts)
+		if err != nil {
+			return result, nil, fmt.Errorf("failed to encode the replay again: %w", err)
+		}
+	}
+	return result, data, nil
+}
+
+// createInMemory creates the replay and returns its content, read from the output of ffmpeg. Unlike the file of
+// Creator.Create, the output never touches the disk.
+func (r *Replay) createInMemory(ctx context.Context, audioBuffer circular.Store, duration time.Duration, opts replayfile.Options) (replayfile.Result, []byte, error) {
+	output, result, err := r.creator.CreateStream(ctx, audioBuffer, duration, opts)
+	if err != nil {
+		return result, nil, err
 	}
 	defer func() {
-		if err := f.Close(); err != nil {
-			r.logger.Warn("failed to close file", zap.Error(err))
+		if err := output.Close(); err != nil {
+			logging.FromContext(ctx, r.logger).Warn("failed to close replay stream", zap.Error(err))
 		}
 	}()
 
-	content := fmt.Sprintf("Last %d seconds.", int(duration.Seconds()))
-	_, err = r.session.InteractionResponseEdit(i, &discordgo.WebhookEdit{
-		Content: &content,
-		Files: []*discordgo.File{{
-			Name:        fmt.Sprintf("recording-%s.ogg", time.Now().Format(time.RFC3339)),
-			ContentType: "audio/ogg; codecs=opus",
-			Reader:      f,
-		}},
-	})
+	data, err := io.ReadAll(output)
 	if err != nil {
-		return fmt.Errorf("failed to send message: %w", err)
+		return result, nil, fmt.Errorf("failed to read replay: %w", err)
 	}
-
-	return nil
+	result.FileSize = int64(len(data))
+	return result, data, nil
 }
 
-func (r *Replay) createTemporaryFile(path *string) error {
-	f, err := os.CreateTemp("", "*.opus")
+func (r *Replay) createTemporaryFile(ctx context.Context, path *string) error {
+	f, err := tempfile.Create("*.opus")
 	if err != nil {
 		return fmt.Errorf("failed to create temporay file: %w", err)
 	}
 
 	defer func() {
 		if err := f.Close(); err != nil {
-			r.logger.Warn("failed to close temporary file", zap.Error(err))
+			logging.FromContext(ctx, r.logger).Warn("failed to close temporary file", zap.Error(err))
 		}
 	}()
 
 	*path = f.Name()
 	return nil
 }
+
+// requester returns the user asking for the replay, or nil if it is unknown.
+// The user of an interaction can be sent either in a guild or in a DM.
+func (req Request) requester() *discordgo.User {
+	switch {
+	case req.Interaction == nil:
+		return req.Requester
+	case req.Interaction.Member != nil:
+		return req.Interaction.Member.User
+	default:
+		return req.Interaction.User
+	}
+}
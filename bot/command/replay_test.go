@@ -0,0 +1,588 @@
+package command
+
+import (
+	"bigbro2/bot/circular"
+	"bigbro2/bot/ratelimit"
+	"bigbro2/bot/replayfile"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// fakeMessageSession records the responses to interactions and the messages sent.
+type fakeMessageSession struct {
+	onEdit     func(edit *discordgo.WebhookEdit)
+	errs       []error // Returned by the first calls, one per call.
+	edits      []*discordgo.WebhookEdit
+	messages   []*discordgo.MessageSend
+	channelIDs []string
+	reactions  []string // Reactions added, as "channel ID/message ID/emoji".
+}
+
+func (f *fakeMessageSession) InteractionResponseEdit(_ *discordgo.Interaction, edit *discordgo.WebhookEdit) (*discordgo.Message, error) {
+	f.edits = append(f.edits, edit)
+	if f.onEdit != nil {
+		f.onEdit(edit)
+	}
+	return &discordgo.Message{ID: "response-id", ChannelID: "interaction-channel-id"}, f.nextErr()
+}
+
+func (f *fakeMessageSession) ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend) (*discordgo.Message, error) {
+	f.channelIDs = append(f.channelIDs, channelID)
+	f.messages = append(f.messages, data)
+	return &discordgo.Message{ID: "message-id", ChannelID: channelID}, f.nextErr()
+}
+
+func (f *fakeMessageSession) InteractionResponse(*discordgo.Interaction) (*discordgo.Message, error) {
+	return &discordgo.Message{ID: "response-id", ChannelID: "interaction-channel-id"}, nil
+}
+
+func (f *fakeMessageSession) MessageReactionAdd(channelID, messageID, emojiID string) error {
+	f.reactions = append(f.reactions, channelID+"/"+messageID+"/"+emojiID)
+	return nil
+}
+
+func (f *fakeMessageSession) nextErr() error {
+	if len(f.errs) == 0 {
+		return nil
+	}
+	err := f.errs[0]
+	f.errs = f.errs[1:]
+	return err
+}
+
+// fakeCreator writes a fixed content instead of mixing the audio buffer.
+type fakeCreator struct {
+	content   []byte
+	result    replayfile.Result
+	manifest  replayfile.Manifest
+	err       error
+	path      string
+	container replayfile.Container // Empty means replayfile.ContainerOgg.
+	streamed  bool                 // CreateStream was called rather than Create.
+	// contentAt returns the content of a replay encoded at the bitrate, content is used if it is nil.
+	contentAt func(bitrate int) []byte
+	bitrates  []int // Bitrate of each replay created.
+
+	audioBuffer       circular.Store
+	recordingDuration time.Duration
+}
+
+func (f *fakeCreator) Create(_ context.Context, audioBuffer circular.Store, path string, recordingDuration time.Duration, opts replayfile.Options) (replayfile.Result, error) {
+	f.path = path
+	f.audioBuffer = audioBuffer
+	f.recordingDuration = recordingDuration
+	f.bitrates = append(f.bitrates, opts.Bitrate)
+	if f.err != nil {
+		return replayfile.Result{}, f.err
+	}
+	content := f.content
+	if f.contentAt != nil {
+		content = f.contentAt(opts.Bitrate)
+	}
+	result := f.result
+	result.FileSize = int64(len(content))
+	return result, os.WriteFile(path, content, 0o600)
+}
+
+func (f *fakeCreator) CreateStream(_ context.Context, audioBuffer circular.Store, recordingDuration time.Duration, _ replayfile.Options) (io.ReadCloser, replayfile.Result, error) {
+	f.streamed = true
+	f.audioBuffer = audioBuffer
+	f.recordingDuration = recordingDuration
+	if f.err != nil {
+		return nil, replayfile.Result{}, f.err
+	}
+	return io.NopCloser(bytes.NewReader(f.content)), f.result, nil
+}
+
+func (f *fakeCreator) Export(_ context.Context, audioBuffer circular.Store, path string, recordingDuration time.Duration, _ replayfile.Options) (replayfile.Manifest, error) {
+	f.path = path
+	f.audioBuffer = audioBuffer
+	f.recordingDuration = recordingDuration
+	if f.err != nil {
+		return replayfile.Manifest{}, f.err
+	}
+	return f.manifest, os.WriteFile(path, f.content, 0o600)
+}
+
+func (f *fakeCreator) Container() replayfile.Container {
+	if f.container == "" {
+		return replayfile.ContainerOgg
+	}
+	return f.container
+}
+
+func (f *fakeCreator) Close() error {
+	return nil
+}
+
+func newTestReplay(messages messageSession) *Replay {
+	audioBuffers := circular.NewBufferRegistry(func(string) (circular.Store, error) { return &circular.Buffer{}, nil })
+	r := NewReplay(zap.NewNop(), nil, nil, audioBuffers, ReplayOptions{MinSpeakers: 1})
+	r.creator = &fakeCreator{}
+	r.messages = messages
+	return r
+}
+
+func TestReplay_uploadReplay(t *testing.T) {
+	content := []byte("OggS some opus data")
+
+	var uploaded []byte
+	session := &fakeMessageSession{
+		onEdit: func(edit *discordgo.WebhookEdit) {
+			require.Len(t, edit.Files, 1)
+			var err error
+			uploaded, err = io.ReadAll(edit.Files[0].Reader)
+			assert.NoError(t, err)
+		},
+	}
+
+	r := newTestReplay(session)
+	r.now = func() time.Time { return time.Unix(0, 0).UTC() }
+	msg, err := r.uploadReplay(context.Background(), Request{Interaction: &discordgo.Interaction{}}, "Last 30 seconds.", content, "")
+	require.NoError(t, err)
+
+	assert.Equal(t, "response-id", msg.ID)
+	assert.Equal(t, content, uploaded)
+	require.Len(t, session.edits, 1)
+	assert.Equal(t, "Last 30 seconds.", *session.edits[0].Content)
+	assert.Equal(t, "recording-1970-01-01T00:00:00Z.ogg", session.edits[0].Files[0].Name)
+	assert.Equal(t, "audio/ogg; codecs=opus", session.edits[0].Files[0].ContentType)
+}
+
+func TestReplay_uploadReplay_webm(t *testing.T) {
+	session := &fakeMessageSession{}
+	r := newTestReplay(session)
+	r.creator = &fakeCreator{container: replayfile.ContainerWebM}
+	r.now = func() time.Time { return time.Unix(0, 0).UTC() }
+
+	_, err := r.uploadReplay(context.Background(), Request{Interaction: &discordgo.Interaction{}}, "Last 30 seconds.", []byte("webm data"), "")
+	require.NoError(t, err)
+
+	require.Len(t, session.edits, 1)
+	assert.Equal(t, "recording-1970-01-01T00:00:00Z.webm", session.edits[0].Files[0].Name)
+	assert.Equal(t, "audio/webm; codecs=opus", session.edits[0].Files[0].ContentType)
+}
+
+func TestReplay_Run(t *testing.T) {
+	tests := []struct {
+		name            string
+		dryRun          bool
+		truncated       bool
+		content         []byte
+		creatorErr      error
+		expectedFiles   int
+		expectedContent string
+	}{
+		{
+			name:            "replay",
+			expectedFiles:   1,
+			expectedContent: "Last 30 seconds.",
+		},
+		{
+			name:            "truncated",
+			truncated:       true,
+			expectedFiles:   1,
+			expectedContent: "Last 12 seconds (only 12 of the 30 seconds asked for were recorded).",
+		},
+		{
+			name:            "dry run",
+			dryRun:          true,
+			expectedFiles:   0,
+			expectedContent: "Dry run, nothing was uploaded.\nStreams: 2 (<@alice-id>, unknown)\nDuration: 30 seconds\nFile size: 2 KiB",
+		},
+		{
+			name:            "too large",
+			content:         make([]byte, 8*1024*1024+1),
+			expectedFiles:   0,
+			expectedContent: "❌ The replay is too large to be uploaded in this server (9 MiB, the limit is 8 MiB). Try a shorter one.",
+		},
+		{
+			name:            "shutting down",
+			creatorErr:      replayfile.CreatorClosedErr,
+			expectedFiles:   0,
+			expectedContent: "❌ The bot is shutting down.",
+		},
+		{
+			name:            "no audio",
+			creatorErr:      replayfile.NoAudioDataErr,
+			expectedFiles:   0,
+			expectedContent: "No audio data.",
+		},
+		{
+			name:            "too much audio",
+			creatorErr:      fmt.Errorf("failed to copy packets: %w", circular.SnapshotTooLargeErr),
+			expectedFiles:   0,
+			expectedContent: tooMuchAudioContent,
+		},
+		{
+			name:            "stream too long",
+			creatorErr:      fmt.Errorf("failed to create stream files: %w", replayfile.StreamTooLongErr),
+			expectedFiles:   0,
+			expectedContent: streamTooLongContent,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := &fakeMessageSession{}
+			content := tt.content
+			if content == nil {
+				content = make([]byte, 2048)
+			}
+			creator := &fakeCreator{
+				content: content,
+				result:  replayfile.Result{SSRCs: []uint32{1, 3}},
+				err:     tt.creatorErr,
+			}
+			if tt.truncated {
+				creator.result.Truncated = true
+				creator.result.AvailableDuration = 12500 * time.Millisecond
+			}
+			r := newTestReplay(session)
+			r.creator = creator
+
+			req := newTestRequest()
+			req.Speakers = map[uint32]string{1: "alice-id"}
+			req.DryRun = tt.dryRun
+			require.NoError(t, r.Run(context.Background(), req))
+
+			require.Len(t, session.edits, 1)
+			assert.Len(t, session.edits[0].Files, tt.expectedFiles)
+			assert.Equal(t, tt.expectedContent, *session.edits[0].Content)
+
+			// A short replay is mixed into memory. The temporary file is always cleaned up.
+			assert.True(t, creator.streamed)
+			_, err := os.Stat(creator.path)
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func TestReplay_Run_all(t *testing.T) {
+	const (
+		limit    = 8 * megabyte
+		duration = 10 * time.Minute
+		// Bitrate of the replay at the default bitrate, 12 MiB over the duration.
+		defaultBitrate = 12 * megabyte * 8 / 600
+	)
+	// The encoder hits the bitrate it is asked for.
+	accurate := func(bitrate int) []byte {
+		if bitrate == 0 {
+			bitrate = defaultBitrate
+		}
+		return make([]byte, int64(bitrate)*600/8)
+	}
+
+	tests := []struct {
+		name             string
+		contentAt        func(bitrate int) []byte
+		creatorErr       error
+		expectedBitrates []int
+		expectedFiles    int
+		expectedContent  string
+	}{
+		{
+			name:             "fits at a lower bitrate",
+			contentAt:        accurate,
+			expectedBitrates: []int{0, int(float64(defaultBitrate) * 8 / 12 * fitMargin)},
+			expectedFiles:    1,
+			expectedContent:  "Everything recorded, the last 600 seconds.",
+		},
+		{
+			name:             "never fits",
+			contentAt:        func(int) []byte { return make([]byte, 12*megabyte) },
+			expectedBitrates: []int{0, 100_663, 60_397, 36_238},
+			expectedContent:  tooLargeAllContent(12*megabyte, limit),
+		},
+		{
+			name:             "too much audio",
+			creatorErr:       circular.SnapshotTooLargeErr,
+			expectedBitrates: []int{0},
+			expectedContent:  tooMuchAudioAllContent,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := &fakeMessageSession{}
+			creator := &fakeCreator{
+				contentAt: tt.contentAt,
+				result:    replayfile.Result{SSRCs: []uint32{1}, AvailableDuration: duration},
+				err:       tt.creatorErr,
+			}
+			r := newTestReplay(session)
+			r.creator = creator
+
+			req := newTestRequest()
+			req.Duration = duration
+			req.All = true
+			require.NoError(t, r.Run(context.Background(), req))
+
+			assert.Equal(t, tt.expectedBitrates, creator.bitrates)
+			require.Len(t, session.edits, 1)
+			assert.Len(t, session.edits[0].Files, tt.expectedFiles)
+			assert.Equal(t, tt.expectedContent, *session.edits[0].Content)
+		})
+	}
+}
+
+func TestReplay_Run_continue(t *testing.T) {
+	now := time.Unix(1000, 0)
+	creator := &fakeCreator{content: []byte("OggS")}
+	r := newTestReplay(&fakeMessageSession{})
+	r.creator = creator
+	r.now = func() time.Time { return now }
+
+	req := newTestRequest()
+	req.Continue = true
+
+	// Nothing to continue, the requested duration is used.
+	require.NoError(t, r.Run(context.Background(), req))
+	assert.Equal(t, 30*time.Second, creator.recordingDuration)
+
+	// The second replay covers both windows.
+	now = now.Add(time.Minute)
+	require.NoError(t, r.Run(context.Background(), req))
+	assert.Equal(t, 90*time.Second, creator.recordingDuration)
+
+	// Another user does not continue the replays of the first one.
+	other := newTestRequest()
+	other.Interaction.Member.User.ID = "other-id"
+	other.Continue = true
+	require.NoError(t, r.Run(context.Background(), other))
+	assert.Equal(t, 30*time.Second, creator.recordingDuration)
+}
+
+func TestReplay_Run_withoutInteraction(t *testing.T) {
+	session := &fakeMessageSession{}
+	r := newTestReplay(session)
+	r.creator = &fakeCreator{content: []byte("OggS")}
+
+	req := newTestRequest()
+	req.Interaction = nil
+	req.ChannelID = "text-channel-id"
+	req.Requester = &discordgo.User{ID: "requester-id"}
+	require.NoError(t, r.Run(context.Background(), req))
+
+	assert.Empty(t, session.edits)
+	require.Len(t, session.messages, 1)
+	assert.Equal(t, []string{"text-channel-id"}, session.channelIDs)
+	assert.Equal(t, "Last 30 seconds.", session.messages[0].Content)
+	assert.Len(t, session.messages[0].Files, 1)
+}
+
+func TestReplay_Run_guildBuffer(t *testing.T) {
+	creator := &fakeCreator{content: []byte("OggS")}
+	r := newTestReplay(&fakeMessageSession{})
+	r.creator = creator
+
+	for _, guildID := range []string{"guild-id", "other-guild-id"} {
+		req := newTestRequest()
+		req.GuildID = guildID
+		require.NoError(t, r.Run(context.Background(), req))
+
+		expected, err := r.audioBuffers.Get(guildID)
+		require.NoError(t, err)
+		assert.Same(t, expected, creator.audioBuffer)
+	}
+}
+
+func TestReplay_Run_minSpeakers(t *testing.T) {
+	now := time.Unix(1000, 0)
+	speech := []byte{0x78, 0x01, 0x02, 0x03}
+
+	tests := []struct {
+		name            string
+		minSpeakers     int
+		packets         []circular.AudioPacket
+		expectedContent string
+	}{
+		{
+			name:            "disabled",
+			minSpeakers:     1,
+			packets:         nil,
+			expectedContent: "Last 30 seconds.",
+		},
+		{
+			name:        "below threshold",
+			minSpeakers: 2,
+			packets: []circular.AudioPacket{
+				{Time: now.Add(-time.Second), SSRC: 1, Opus: speech},
+				{Time: now.Add(-time.Second), SSRC: 2, Opus: []byte{0xF8, 0xFF, 0xFE}}, // Silent frame.
+				{Time: now.Add(-time.Second), SSRC: 3, Opus: []byte{0x78}},             // DTX.
+				{Time: now.Add(-time.Minute), SSRC: 4, Opus: speech},                   // Before the replay.
+			},
+			expectedContent: "Not enough audio to replay.",
+		},
+		{
+			name:        "at threshold",
+			minSpeakers: 2,
+			packets: []circular.AudioPacket{
+				{Time: now.Add(-2 * time.Second), SSRC: 1, Opus: speech},
+				{Time: now.Add(-time.Second), SSRC: 1, Opus: speech},
+				{Time: now.Add(-time.Second), SSRC: 2, Opus: speech},
+			},
+			expectedContent: "Last 30 seconds.",
+		},
+		{
+			name:        "above threshold",
+			minSpeakers: 2,
+			packets: []circular.AudioPacket{
+				{Time: now.Add(-time.Second), SSRC: 1, Opus: speech},
+				{Time: now.Add(-time.Second), SSRC: 2, Opus: speech},
+				{Time: now.Add(-time.Second), SSRC: 3, Opus: speech},
+			},
+			expectedContent: "Last 30 seconds.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := &fakeMessageSession{}
+			r := newTestReplay(session)
+			r.creator = &fakeCreator{content: []byte("OggS")}
+			r.now = func() time.Time { return now }
+			r.minSpeakers = tt.minSpeakers
+
+			audioBuffer, err := r.audioBuffers.Get("guild-id")
+			require.NoError(t, err)
+			for _, pkt := range tt.packets {
+				audioBuffer.Add(pkt.Time, discordgo.Packet{SSRC: pkt.SSRC, Opus: pkt.Opus})
+			}
+
+			require.NoError(t, r.Run(context.Background(), newTestRequest()))
+			require.Len(t, session.edits, 1)
+			assert.Equal(t, tt.expectedContent, *session.edits[0].Content)
+		})
+	}
+}
+
+func TestBreakerMessageSession(t *testing.T) {
+	session := &fakeMessageSession{}
+	breaker := ratelimit.NewBreaker(zap.NewNop(), time.Now)
+	messages := breakerMessageSession{messages: session, breaker: breaker}
+	content := "Last 30 seconds."
+
+	_, err := messages.InteractionResponseEdit(&discordgo.Interaction{}, &discordgo.WebhookEdit{Content: &content})
+	require.NoError(t, err)
+	assert.Len(t, session.edits, 1)
+
+	for i := 0; i < ratelimit.DefaultThreshold; i++ {
+		breaker.RecordRateLimit()
+	}
+
+	_, err = messages.InteractionResponseEdit(&discordgo.Interaction{}, &discordgo.WebhookEdit{Content: &content})
+	assert.ErrorIs(t, err, ratelimit.OpenErr)
+	_, err = messages.ChannelMessageSendComplex("channel-id", &discordgo.MessageSend{Content: content})
+	assert.ErrorIs(t, err, ratelimit.OpenErr)
+	assert.Len(t, session.edits, 1)
+	assert.Empty(t, session.messages)
+}
+
+func TestReplay_uploadReplay_retry(t *testing.T) {
+	badGateway := &discordgo.RESTError{Response: &http.Response{StatusCode: http.StatusBadGateway}}
+	forbidden := &discordgo.RESTError{Response: &http.Response{StatusCode: http.StatusForbidden}}
+	tests := []struct {
+		name             string
+		errs             []error
+		expectedAttempts int
+		wantErr          bool
+	}{
+		{name: "first attempt", expectedAttempts: 1},
+		{name: "server error", errs: []error{badGateway}, expectedAttempts: 2},
+		{name: "connection reset", errs: []error{errors.New("connection reset by peer"), badGateway}, expectedAttempts: 3},
+		{name: "too many failures", errs: []error{badGateway, badGateway, badGateway}, expectedAttempts: 3, wantErr: true},
+		{name: "refused", errs: []error{forbidden}, expectedAttempts: 1, wantErr: true},
+		{name: "rate limited", errs: []error{ratelimit.OpenErr}, expectedAttempts: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := []byte("OggS some opus data")
+
+			// Every attempt reads the whole files, like an actual upload.
+			var uploads [][]string
+			session := &fakeMessageSession{
+				errs: tt.errs,
+				onEdit: func(edit *discordgo.WebhookEdit) {
+					var files []string
+					for _, f := range edit.Files {
+						data, err := io.ReadAll(f.Reader)
+						require.NoError(t, err)
+						files = append(files, string(data))
+					}
+					uploads = append(uploads, files)
+				},
+			}
+			r := newTestReplay(session)
+			r.uploadRetryDelay = 0
+
+			_, err := r.uploadReplay(context.Background(), Request{Interaction: &discordgo.Interaction{}}, "Last 30 seconds.", content, "Did you hear that?")
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			require.Len(t, uploads, tt.expectedAttempts)
+			for _, files := range uploads {
+				assert.Equal(t, []string{string(content), "Did you hear that?"}, files)
+			}
+		})
+	}
+}
+
+func TestReplayContent(t *testing.T) {
+	tests := []struct {
+		name     string
+		duration time.Duration
+		all      bool
+		result   replayfile.Result
+		expected string
+	}{
+		{name: "complete", duration: 30 * time.Second, expected: "Last 30 seconds."},
+		{
+			name:     "truncated",
+			duration: 30 * time.Second,
+			result:   replayfile.Result{Truncated: true, AvailableDuration: 12 * time.Second},
+			expected: "Last 12 seconds (only 12 of the 30 seconds asked for were recorded).",
+		},
+		{
+			name:     "all",
+			duration: 300 * time.Second,
+			all:      true,
+			result:   replayfile.Result{Truncated: true, AvailableDuration: 290 * time.Second},
+			expected: "Everything recorded, the last 290 seconds.",
+		},
+		{
+			name:     "one stream dropped",
+			duration: 30 * time.Second,
+			result:   replayfile.Result{DroppedStreams: 1},
+			expected: "Last 30 seconds.\nThere were too many people speaking: the least active one was left out.",
+		},
+		{
+			name:     "streams dropped",
+			duration: 30 * time.Second,
+			result:   replayfile.Result{DroppedStreams: 12},
+			expected: "Last 30 seconds.\nThere were too many people speaking: the 12 least active ones were left out.",
+		},
+		{
+			name:     "multitrack mixed",
+			duration: 30 * time.Second,
+			result:   replayfile.Result{MultitrackMixed: true},
+			expected: "Last 30 seconds.\nThe speakers could not each get their own channel (at most 8), they were mixed together.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, replayContent(tt.duration, tt.all, tt.result))
+		})
+	}
+}
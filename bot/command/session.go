@@ -0,0 +1,65 @@
+package command
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// continueBudget is how long after a replay a user can continue it.
+	continueBudget = 5 * time.Minute
+	// maxMergedDuration is the maximum duration of a replay made of consecutive replays.
+	maxMergedDuration = 10 * time.Minute
+)
+
+// window is the time range of the recording included in a replay.
+type window struct {
+	start time.Time
+	end   time.Time
+}
+
+// sessions remembers the last replay of each user, so that the next one can continue it.
+// It is safe for concurrent use.
+type sessions struct {
+	sync.Mutex
+	last map[string]window // Indexed by user ID.
+}
+
+func newSessions() *sessions {
+	return &sessions{last: map[string]window{}}
+}
+
+// Last returns the window of the last replay of the user, if any.
+func (s *sessions) Last(userID string) (window, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	w, ok := s.last[userID]
+	return w, ok
+}
+
+// Save remembers the window of the last replay of the user.
+func (s *sessions) Save(userID string, w window) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.last[userID] = w
+}
+
+// mergeWindow returns the window of a replay continuing the previous one.
+// The windows are merged into a single continuous one, so the audio they have in common is only included once.
+// If the previous replay is too old to be continued, the current window is returned unchanged.
+func mergeWindow(previous window, hasPrevious bool, current window) window {
+	if !hasPrevious || current.end.Sub(previous.end) > continueBudget {
+		return current
+	}
+
+	merged := current
+	if previous.start.Before(merged.start) {
+		merged.start = previous.start
+	}
+	if merged.end.Sub(merged.start) > maxMergedDuration {
+		merged.start = merged.end.Add(-maxMergedDuration)
+	}
+	return merged
+}
@@ -0,0 +1,67 @@
+package command
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMergeWindow(t *testing.T) {
+	at := func(seconds int) time.Time {
+		return time.Unix(int64(seconds), 0)
+	}
+
+	tests := []struct {
+		name        string
+		previous    window
+		hasPrevious bool
+		current     window
+		expected    window
+	}{
+		{
+			name:     "no previous replay",
+			current:  window{start: at(100), end: at(130)},
+			expected: window{start: at(100), end: at(130)},
+		},
+		{
+			name:        "overlapping windows",
+			previous:    window{start: at(80), end: at(110)},
+			hasPrevious: true,
+			current:     window{start: at(100), end: at(130)},
+			expected:    window{start: at(80), end: at(130)},
+		},
+		{
+			name:        "consecutive windows with a gap",
+			previous:    window{start: at(0), end: at(30)},
+			hasPrevious: true,
+			current:     window{start: at(100), end: at(130)},
+			expected:    window{start: at(0), end: at(130)},
+		},
+		{
+			name:        "current window contains the previous one",
+			previous:    window{start: at(110), end: at(120)},
+			hasPrevious: true,
+			current:     window{start: at(100), end: at(130)},
+			expected:    window{start: at(100), end: at(130)},
+		},
+		{
+			name:        "previous replay too old",
+			previous:    window{start: at(0), end: at(30)},
+			hasPrevious: true,
+			current:     window{start: at(1000), end: at(1030)},
+			expected:    window{start: at(1000), end: at(1030)},
+		},
+		{
+			name:        "merged window too long",
+			previous:    window{start: at(0), end: at(500)},
+			hasPrevious: true,
+			current:     window{start: at(700), end: at(730)},
+			expected:    window{start: at(130), end: at(730)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, mergeWindow(tt.previous, tt.hasPrevious, tt.current))
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package command
+
+import (
+	"bigbro2/bot/circular"
+	"bigbro2/bot/logging"
+	"bigbro2/bot/replayfile"
+	"context"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"go.uber.org/zap"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BufferedSpeaker is someone whose audio is in the audio buffer.
+type BufferedSpeaker struct {
+	UserID string   // Empty if the user speaking could not be identified.
+	SSRCs  []uint32 // Voice streams of the user, a user reconnecting gets a new one.
+	Audio  time.Duration
+}
+
+// countSpeakers returns the number of voice streams with audio that is not silent, received less than d before now.
+func countSpeakers(ctx context.Context, audioBuffer circular.Store, now time.Time, d time.Duration) (int, error) {
+	speaking := map[uint32]struct{}{}
+	err := circular.Since(ctx, audioBuffer, now, d, func(iterator circular.Iterator, _ circular.Window) error {
+		for iterator.HasNext() {
+			if pkt := iterator.Next(); !replayfile.IsSilent(pkt.Opus) {
+				speaking[pkt.SSRC] = struct{}{}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not read the audio buffer: %w", err)
+	}
+	return len(speaking), nil
+}
+
+// ListSpeakers sends the people whose audio of the last req.Duration is in the audio buffer, see BufferedSpeakers, in
+// the response to the request. Only the guild, the duration and the speakers of the request are used, and the response
+// should be ephemeral.
+func (r *Replay) ListSpeakers(ctx context.Context, req Request) error {
+	speakers, err := r.BufferedSpeakers(ctx, req.GuildID, req.Speakers, req.Duration)
+	if err != nil {
+		return err
+	}
+
+	logging.FromContext(ctx, r.logger).Debug("listed speakers", zap.Int("speakers", len(speakers)))
+	content := FormatBufferedSpeakers(speakers)
+	return r.respond(req, &discordgo.WebhookEdit{Content: &content})
+}
+
+// BufferedSpeakers returns the people whose audio of the last d is in the audio buffer of the guild, with how much
+// audio that is not silent each of them has. speakers is the ID of the user speaking in each voice stream, indexed by
+// SSRC. The people with the most audio come first.
+func (r *Replay) BufferedSpeakers(ctx context.Context, guildID string, speakers map[uint32]string, d time.Duration) ([]BufferedSpeaker, error) {
+	audioBuffer, err := r.audioBuffers.Get(guildID)
+	if err != nil {
+		return nil, err
+	}
+	return bufferedSpeakers(ctx, audioBuffer, r.now(), d, speakers)
+}
+
+func bufferedSpeakers(ctx context.Context, audioBuffer circular.Store, now time.Time, d time.Duration, speakers map[uint32]string) ([]BufferedSpeaker, error) {
+	frames := map[uint32]int{}
+	err := circular.Since(ctx, audioBuffer, now, d, func(iterator circular.Iterator, _ circular.Window) error {
+		for iterator.HasNext() {
+			pkt := iterator.Next()
+			if !replayfile.IsSilent(pkt.Opus) {
+				frames[pkt.SSRC]++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read the audio buffer: %w", err)
+	}
+
+	ssrcs := make([]uint32, 0, len(frames))
+	for ssrc := range frames {
+		ssrcs = append(ssrcs, ssrc)
+	}
+	sort.Slice(ssrcs, func(i, j int) bool { return ssrcs[i] < ssrcs[j] })
+
+	// The streams of a known user are grouped together, the unknown streams are each reported on their own.
+	var result []BufferedSpeaker
+	byUser := map[string]int{}
+	for _, ssrc := range ssrcs {
+		audio := time.Duration(frames[ssrc]) * replayfile.FrameLengthNs
+		userID := speakers[ssrc]
+		if n, ok := byUser[userID]; ok && userID != "" {
+			result[n].SSRCs = append(result[n].SSRCs, ssrc)
+			result[n].Audio += audio
+			continue
+		}
+		byUser[userID] = len(result)
+		result = append(result, BufferedSpeaker{UserID: userID, SSRCs: []uint32{ssrc}, Audio: audio})
+	}
+
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Audio > result[j].Audio })
+	return result, nil
+}
+
+// FormatBufferedSpeakers describes the people whose audio is in the audio buffer, in a message for the user.
+func FormatBufferedSpeakers(speakers []BufferedSpeaker) string {
+	if len(speakers) == 0 {
+		return "Nobody has spoken yet."
+	}
+
+	var b strings.Builder
+	b.WriteString("Audio that can be replayed:")
+	for _, speaker := range speakers {
+		name := "Unknown speaker"
+		if speaker.UserID != "" {
+			name = fmt.Sprintf("<@%s>", speaker.UserID)
+		}
+
+		seconds := int(speaker.Audio.Round(time.Second).Seconds())
+		switch seconds {
+		case 0:
+			fmt.Fprintf(&b, "\n- %s: less than a second", name)
+		case 1:
+			fmt.Fprintf(&b, "\n- %s: about 1 second", name)
+		default:
+			fmt.Fprintf(&b, "\n- %s: about %d seconds", name, seconds)
+		}
+	}
+	return b.String()
+}
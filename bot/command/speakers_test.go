@@ -0,0 +1,96 @@
+package command
+
+import (
+	"bigbro2/bot/circular"
+	"context"
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestBufferedSpeakers(t *testing.T) {
+	audio := []byte{0x78, 0x01, 0x02}
+	silence := []byte{0xF8, 0xFF, 0xFE}
+
+	var b circular.Buffer
+	add := func(ssrc uint32, opus []byte, count int) {
+		for n := 0; n < count; n++ {
+			b.Add(time.Unix(1000, 0), discordgo.Packet{SSRC: ssrc, Opus: opus})
+		}
+	}
+	add(1, audio, 50)   // Alice, 1 second.
+	add(2, audio, 200)  // Bob, 4 seconds.
+	add(3, audio, 100)  // Alice after reconnecting, 2 seconds.
+	add(4, audio, 20)   // Unknown, 400ms.
+	add(5, silence, 50) // Only silence.
+	// Before the window.
+	b.Add(time.Unix(900, 0), discordgo.Packet{SSRC: 6, Opus: audio})
+
+	got, err := bufferedSpeakers(context.Background(), &b, time.Unix(1001, 0), time.Minute, map[uint32]string{1: "alice-id", 2: "bob-id", 3: "alice-id", 5: "carol-id", 6: "dave-id"})
+	require.NoError(t, err)
+
+	assert.Equal(t, []BufferedSpeaker{
+		{UserID: "bob-id", SSRCs: []uint32{2}, Audio: 4 * time.Second},
+		{UserID: "alice-id", SSRCs: []uint32{1, 3}, Audio: 3 * time.Second},
+		{SSRCs: []uint32{4}, Audio: 400 * time.Millisecond},
+	}, got)
+}
+
+func TestReplay_ListSpeakers(t *testing.T) {
+	session := &fakeMessageSession{}
+	r := newTestReplay(session)
+	now := time.Unix(1000, 0)
+	r.now = func() time.Time { return now }
+
+	audioBuffer, err := r.audioBuffers.Get("guild-id")
+	require.NoError(t, err)
+	audioBuffer.Add(now.Add(-2*time.Minute), discordgo.Packet{SSRC: 1, Opus: []byte{0x78, 0x01, 0x02}})
+	audioBuffer.Add(now.Add(-time.Second), discordgo.Packet{SSRC: 2, Opus: []byte{0x78, 0x01, 0x02}})
+
+	req := Request{Interaction: &discordgo.Interaction{}, GuildID: "guild-id", Duration: time.Minute, Speakers: map[uint32]string{1: "alice-id", 2: "bob-id"}}
+	require.NoError(t, r.ListSpeakers(context.Background(), req))
+	require.Len(t, session.edits, 1)
+	assert.Equal(t, "Audio that can be replayed:\n- <@bob-id>: less than a second", *session.edits[0].Content)
+}
+
+func TestCountSpeakers_cancelled(t *testing.T) {
+	var b circular.Buffer
+	b.Add(time.Unix(1000, 0), discordgo.Packet{SSRC: 1, Opus: []byte{0x78, 0x01, 0x02}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := countSpeakers(ctx, &b, time.Unix(1000, 0), time.Minute)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestFormatBufferedSpeakers(t *testing.T) {
+	tests := []struct {
+		name     string
+		speakers []BufferedSpeaker
+		expected string
+	}{
+		{
+			name:     "nobody",
+			expected: "Nobody has spoken yet.",
+		},
+		{
+			name: "speakers",
+			speakers: []BufferedSpeaker{
+				{UserID: "bob-id", Audio: 4200 * time.Millisecond},
+				{UserID: "alice-id", Audio: 1100 * time.Millisecond},
+				{Audio: 400 * time.Millisecond},
+			},
+			expected: "Audio that can be replayed:\n" +
+				"- <@bob-id>: about 4 seconds\n" +
+				"- <@alice-id>: about 1 second\n" +
+				"- Unknown speaker: less than a second",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, FormatBufferedSpeakers(tt.speakers))
+		})
+	}
+}
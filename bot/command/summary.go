@@ -0,0 +1,110 @@
+package command
+
+import (
+	"bigbro2/bot/logging"
+	"bigbro2/bot/replayfile"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+// Summary is a machine-readable description of a replay, sent to the summary webhook.
+type Summary struct {
+	RequesterID       string    `json:"requester_id"`
+	RequesterUsername string    `json:"requester_username"`
+	GuildID           string    `json:"guild_id"`
+	ChannelID         string    `json:"channel_id"`
+	DurationSeconds   float64   `json:"duration_seconds"`
+	Format            string    `json:"format"`
+	FileSize          int64     `json:"file_size"`
+	SpeakerCount      int       `json:"speaker_count"`
+	Speakers          []Speaker `json:"speakers"`
+}
+
+// Speaker is a voice stream included in a replay.
+// UserID and Username are empty if the user speaking could not be identified.
+type Speaker struct {
+	SSRC     uint32 `json:"ssrc"`
+	UserID   string `json:"user_id,omitempty"`
+	Username string `json:"username,omitempty"`
+	// LoudnessLUFS is the integrated loudness of the voice stream (EBU R128), nil if it could not be measured.
+	LoudnessLUFS *float64 `json:"loudness_lufs,omitempty"`
+}
+
+// Summary builds the summary of a replay.
+func (r *Replay) Summary(req Request, result replayfile.Result, fileSize int64) Summary {
+	summary := Summary{
+		GuildID:         req.GuildID,
+		ChannelID:       req.VoiceChannelID,
+		DurationSeconds: req.Duration.Seconds(),
+		Format:          string(r.creator.Container()),
+		FileSize:        fileSize,
+		SpeakerCount:    len(result.SSRCs),
+		Speakers:        []Speaker{},
+	}
+
+	if user := req.requester(); user != nil {
+		summary.RequesterID = user.ID
+		summary.RequesterUsername = user.Username
+	}
+
+	for n, ssrc := range result.SSRCs {
+		userID := req.Speakers[ssrc]
+		speaker := Speaker{
+			SSRC:     ssrc,
+			UserID:   userID,
+			Username: r.username(req.GuildID, userID),
+		}
+		if n < len(result.Loudness) {
+			loudness := result.Loudness[n]
+			speaker.LoudnessLUFS = &loudness
+		}
+		summary.Speakers = append(summary.Speakers, speaker)
+	}
+	return summary
+}
+
+// username returns the username of a member of the guild, or an empty string if it is unknown.
+func (r *Replay) username(guildID, userID string) string {
+	if userID == "" || r.session == nil || r.session.State == nil {
+		return ""
+	}
+
+	member, err := r.session.State.Member(guildID, userID)
+	if err != nil || member.User == nil {
+		return ""
+	}
+	return member.User.Username
+}
+
+// postSummary sends the summary to the summary webhook.
+func (r *Replay) postSummary(ctx context.Context, summary Summary) error {
+	body, err := json.Marshal(summary)
+	if err != nil {
+		return fmt.Errorf("failed to serialize summary: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.summaryWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send summary: %w", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logging.FromContext(ctx, r.logger).Warn("failed to close response body", zap.Error(err))
+		}
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package command
+
+import (
+	"bigbro2/bot/replayfile"
+	"context"
+	"encoding/json"
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestRequest() Request {
+	return Request{
+		Interaction: &discordgo.Interaction{
+			GuildID: "guild-id",
+			Member: &discordgo.Member{
+				User: &discordgo.User{ID: "requester-id", Username: "requester"},
+			},
+		},
+		GuildID:        "guild-id",
+		Duration:       30 * time.Second,
+		VoiceChannelID: "channel-id",
+		Speakers:       map[uint32]string{1: "alice-id", 2: "bob-id"},
+	}
+}
+
+func TestReplay_Summary(t *testing.T) {
+	state := discordgo.NewState()
+	require.NoError(t, state.GuildAdd(&discordgo.Guild{ID: "guild-id"}))
+	require.NoError(t, state.MemberAdd(&discordgo.Member{
+		GuildID: "guild-id",
+		User:    &discordgo.User{ID: "alice-id", Username: "alice"},
+	}))
+	r := NewReplay(zap.NewNop(), nil, &discordgo.Session{State: state}, nil, ReplayOptions{MinSpeakers: 1})
+	r.creator = &fakeCreator{}
+
+	got := r.Summary(newTestRequest(), replayfile.Result{SSRCs: []uint32{1, 2, 3}}, 1234)
+
+	assert.Equal(t, Summary{
+		RequesterID:       "requester-id",
+		RequesterUsername: "requester",
+		GuildID:           "guild-id",
+		ChannelID:         "channel-id",
+		DurationSeconds:   30,
+		Format:            "ogg",
+		FileSize:          1234,
+		SpeakerCount:      3,
+		Speakers: []Speaker{
+			{SSRC: 1, UserID: "alice-id", Username: "alice"},
+			{SSRC: 2, UserID: "bob-id"}, // Not in the state.
+			{SSRC: 3},                   // Unknown speaker.
+		},
+	}, got)
+}
+
+func TestReplay_Summary_loudness(t *testing.T) {
+	r := NewReplay(zap.NewNop(), nil, nil, nil, ReplayOptions{MinSpeakers: 1})
+	r.creator = &fakeCreator{}
+
+	got := r.Summary(newTestRequest(), replayfile.Result{SSRCs: []uint32{1, 2}, Loudness: []float64{-18.5, -30}}, 1234)
+
+	require.Len(t, got.Speakers, 2)
+	require.NotNil(t, got.Speakers[0].LoudnessLUFS)
+	assert.Equal(t, -18.5, *got.Speakers[0].LoudnessLUFS)
+	require.NotNil(t, got.Speakers[1].LoudnessLUFS)
+	assert.Equal(t, -30.0, *got.Speakers[1].LoudnessLUFS)
+
+	body, err := json.Marshal(got.Speakers[0])
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"ssrc": 1, "user_id": "alice-id", "loudness_lufs": -18.5}`, string(body))
+
+	// Without measures, the loudness is left out.
+	got = r.Summary(newTestRequest(), replayfile.Result{SSRCs: []uint32{1}}, 1234)
+	require.Len(t, got.Speakers, 1)
+	assert.Nil(t, got.Speakers[0].LoudnessLUFS)
+}
+
+func TestReplay_Summary_dm(t *testing.T) {
+	r := NewReplay(zap.NewNop(), nil, nil, nil, ReplayOptions{MinSpeakers: 1})
+	r.creator = &fakeCreator{}
+	req := newTestRequest()
+	req.Interaction = &discordgo.Interaction{User: &discordgo.User{ID: "requester-id", Username: "requester"}}
+
+	got := r.Summary(req, replayfile.Result{}, 0)
+
+	assert.Equal(t, "requester-id", got.RequesterID)
+	assert.Equal(t, "requester", got.RequesterUsername)
+	assert.Equal(t, "guild-id", got.GuildID, "the recorded guild should be reported")
+}
+
+func TestReplay_postSummary(t *testing.T) {
+	var received Summary
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, http.MethodPost, req.Method)
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(req.Body).Decode(&received))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	r := NewReplay(zap.NewNop(), nil, nil, nil, ReplayOptions{SummaryWebhookURL: server.URL, MinSpeakers: 1})
+	r.creator = &fakeCreator{}
+	summary := r.Summary(newTestRequest(), replayfile.Result{SSRCs: []uint32{1}}, 42)
+
+	require.NoError(t, r.postSummary(context.Background(), summary))
+	assert.Equal(t, summary, received)
+}
+
+func TestReplay_postSummary_error(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	r := NewReplay(zap.NewNop(), nil, nil, nil, ReplayOptions{SummaryWebhookURL: server.URL, MinSpeakers: 1})
+	r.creator = &fakeCreator{}
+
+	err := r.postSummary(context.Background(), r.Summary(newTestRequest(), replayfile.Result{}, 0))
+	assert.Error(t, err)
+}
@@ -0,0 +1,118 @@
+package command
+
+import (
+	"bigbro2/bot/logging"
+	"bigbro2/bot/tempfile"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Transcriber turns the audio of a replay into text, so people who cannot listen to it can still read it.
+type Transcriber interface {
+	// Transcribe returns the transcript of the replay file at path. It is empty if nobody can be understood.
+	Transcribe(ctx context.Context, path string) (string, error)
+}
+
+// noTranscriber is the Transcriber used when transcription is disabled: its transcripts are always empty.
+type noTranscriber struct{}
+
+func (noTranscriber) Transcribe(context.Context, string) (string, error) {
+	return "", nil
+}
+
+// HTTPTranscriber sends the audio to a speech-to-text endpoint.
+// The audio is converted to a mono 16kHz WAV file and sent as the body of a POST request. The endpoint responds with a
+// JSON object whose "text" field is the transcript.
+type HTTPTranscriber struct {
+	logger     *zap.Logger
+	url        string
+	convert    func(ctx context.Context, path, out string) error
+	httpClient *http.Client
+}
+
+// transcriptResponse is the response of the speech-to-text endpoint.
+type transcriptResponse struct {
+	Text string `json:"text"`
+}
+
+// NewHTTPTranscriber creates a transcriber posting the audio to url once converted by convert, see
+// replayfile.Creator.ConvertForSpeech.
+func NewHTTPTranscriber(logger *zap.Logger, url string, convert func(ctx context.Context, path, out string) error) *HTTPTranscriber {
+	return &HTTPTranscriber{
+		logger:     logger,
+		url:        url,
+		convert:    convert,
+		httpClient: &http.Client{Timeout: time.Minute},
+	}
+}
+
+func (t *HTTPTranscriber) Transcribe(ctx context.Context, path string) (string, error) {
+	logger := logging.FromContext(ctx, t.logger)
+
+	f, err := tempfile.Create("*.wav")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	wav := f.Name()
+	defer func() {
+		if err := os.Remove(wav); err != nil {
+			logger.Warn("failed to remove temporary file", zap.Error(err))
+		}
+	}()
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("failed to close temporary file: %w", err)
+	}
+
+	if err := t.convert(ctx, path, wav); err != nil {
+		return "", fmt.Errorf("failed to convert audio: %w", err)
+	}
+
+	// The body is closed by the HTTP client.
+	body, err := os.Open(wav)
+	if err != nil {
+		return "", fmt.Errorf("failed to open converted audio: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, body)
+	if err != nil {
+		_ = body.Close()
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "audio/wav")
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send audio: %w", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logger.Warn("failed to close response body", zap.Error(err))
+		}
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	var transcript transcriptResponse
+	if err := json.NewDecoder(resp.Body).Decode(&transcript); err != nil {
+		return "", fmt.Errorf("failed to parse transcript: %w", err)
+	}
+	return strings.TrimSpace(transcript.Text), nil
+}
+
+// transcribe returns the transcript of the replay at path. Transcription is a bonus: if it fails, it is logged and the
+// transcript is empty, so the replay is still delivered.
+func (r *Replay) transcribe(ctx context.Context, path string) string {
+	transcript, err := r.transcriber.Transcribe(ctx, path)
+	if err != nil {
+		logging.FromContext(ctx, r.logger).Warn("failed to transcribe replay", zap.Error(err))
+		return ""
+	}
+	return transcript
+}
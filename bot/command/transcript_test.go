@@ -0,0 +1,135 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// fakeTranscriber returns a fixed transcript.
+type fakeTranscriber struct {
+	transcript string
+	err        error
+	path       string
+}
+
+func (f *fakeTranscriber) Transcribe(_ context.Context, path string) (string, error) {
+	f.path = path
+	return f.transcript, f.err
+}
+
+// fakeConvert writes wav instead of converting the audio.
+func fakeConvert(wav string) func(ctx context.Context, path, out string) error {
+	return func(_ context.Context, _, out string) error {
+		return os.WriteFile(out, []byte(wav), 0o600)
+	}
+}
+
+func TestHTTPTranscriber_Transcribe(t *testing.T) {
+	var body []byte
+	var contentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, http.MethodPost, req.Method)
+		contentType = req.Header.Get("Content-Type")
+
+		var err error
+		body, err = io.ReadAll(req.Body)
+		assert.NoError(t, err)
+		_, _ = w.Write([]byte(`{"text": " Did you hear that? \n"}`))
+	}))
+	defer server.Close()
+
+	transcriber := NewHTTPTranscriber(zap.NewNop(), server.URL, fakeConvert("RIFF mono 16k"))
+	transcript, err := transcriber.Transcribe(context.Background(), "replay.ogg")
+	require.NoError(t, err)
+
+	assert.Equal(t, "Did you hear that?", transcript)
+	assert.Equal(t, "RIFF mono 16k", string(body))
+	assert.Equal(t, "audio/wav", contentType)
+}
+
+func TestHTTPTranscriber_Transcribe_error(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		convert func(ctx context.Context, path, out string) error
+	}{
+		{
+			name:    "conversion failed",
+			status:  http.StatusOK,
+			body:    `{"text": "hello"}`,
+			convert: func(context.Context, string, string) error { return errors.New("ffmpeg exited with code 1") },
+		},
+		{name: "server error", status: http.StatusInternalServerError, convert: fakeConvert("RIFF")},
+		{name: "invalid response", status: http.StatusOK, body: "hello", convert: fakeConvert("RIFF")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			transcriber := NewHTTPTranscriber(zap.NewNop(), server.URL, tt.convert)
+			_, err := transcriber.Transcribe(context.Background(), "replay.ogg")
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestReplay_Run_transcript(t *testing.T) {
+	tests := []struct {
+		name          string
+		transcriber   *fakeTranscriber
+		expectedFiles []string
+	}{
+		{
+			name:          "transcript",
+			transcriber:   &fakeTranscriber{transcript: "Did you hear that?"},
+			expectedFiles: []string{"OggS", "Did you hear that?"},
+		},
+		{
+			name:          "nobody understood",
+			transcriber:   &fakeTranscriber{},
+			expectedFiles: []string{"OggS"},
+		},
+		{
+			name:          "transcription failed",
+			transcriber:   &fakeTranscriber{err: errors.New("connection refused")},
+			expectedFiles: []string{"OggS"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := &fakeMessageSession{}
+			creator := &fakeCreator{content: []byte("OggS")}
+			r := newTestReplay(session)
+			r.creator = creator
+			r.transcriber = tt.transcriber
+
+			require.NoError(t, r.Run(context.Background(), newTestRequest()))
+			assert.Equal(t, creator.path, tt.transcriber.path)
+
+			require.Len(t, session.edits, 1)
+			var files []string
+			for _, f := range session.edits[0].Files {
+				content, err := io.ReadAll(f.Reader)
+				require.NoError(t, err)
+				files = append(files, string(content))
+			}
+			assert.Equal(t, tt.expectedFiles, files)
+			if len(files) > 1 {
+				assert.Equal(t, "text/plain; charset=utf-8", session.edits[0].Files[1].ContentType)
+			}
+		})
+	}
+}
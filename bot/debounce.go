@@ -0,0 +1,65 @@
+package bot
+
+import (
+	"sync"
+	"time"
+)
+
+// debouncer coalesces bursts of calls: the first call of a burst schedules f to run after delay, and the calls made
+// until then are ignored. f runs at most once per delay, and never later than delay after a call.
+type debouncer struct {
+	mu      sync.Mutex
+	delay   time.Duration
+	f       func()
+	timer   *time.Timer    // Not nil while f is scheduled.
+	running sync.WaitGroup // f running, once scheduled.
+	stopped bool
+}
+
+// newDebouncer creates a debouncer running f. If delay is zero or less, f runs on every call.
+func newDebouncer(delay time.Duration, f func()) *debouncer {
+	return &debouncer{delay: delay, f: f}
+}
+
+// Call schedules f, unless it is already scheduled.
+func (d *debouncer) Call() {
+	if d.delay <= 0 {
+		d.f()
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stopped || d.timer != nil {
+		return
+	}
+	d.timer = time.AfterFunc(d.delay, func() {
+		d.mu.Lock()
+		d.timer = nil
+		// The timer may fire while Stop cancels it.
+		if d.stopped {
+			d.mu.Unlock()
+			return
+		}
+		d.running.Add(1)
+		d.mu.Unlock()
+
+		defer d.running.Done()
+		d.f()
+	})
+}
+
+// Stop cancels f if it is scheduled, and ignores the calls made afterwards. It returns once f is not running anymore,
+// so f does not act on what is cleaned up after it.
+func (d *debouncer) Stop() {
+	d.mu.Lock()
+	d.stopped = true
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	d.mu.Unlock()
+
+	d.running.Wait()
+}
@@ -0,0 +1,82 @@
+package bot
+
+import (
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDebouncer(t *testing.T) {
+	var calls int32
+	d := newDebouncer(50*time.Millisecond, func() { atomic.AddInt32(&calls, 1) })
+
+	// A burst of voice state updates.
+	for n := 0; n < 30; n++ {
+		d.Call()
+	}
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&calls) == 1 }, time.Second, 5*time.Millisecond)
+
+	// The calls made once f ran start a new burst.
+	d.Call()
+	d.Call()
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&calls) == 2 }, time.Second, 5*time.Millisecond)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestDebouncer_disabled(t *testing.T) {
+	calls := 0
+	d := newDebouncer(0, func() { calls++ })
+
+	d.Call()
+	d.Call()
+	assert.Equal(t, 2, calls)
+}
+
+func TestDebouncer_Stop(t *testing.T) {
+	var calls int32
+	d := newDebouncer(20*time.Millisecond, func() { atomic.AddInt32(&calls, 1) })
+
+	d.Call()
+	d.Stop()
+	d.Call()
+
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+}
+
+func TestDebouncer_Stop_running(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	d := newDebouncer(time.Millisecond, func() {
+		close(started)
+		<-release
+	})
+
+	d.Call()
+	<-started
+
+	stopped := make(chan struct{})
+	go func() {
+		d.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		t.Fatal("Stop returned while f was running")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		select {
+		case <-stopped:
+			return true
+		default:
+			return false
+		}
+	}, time.Second, 5*time.Millisecond)
+}
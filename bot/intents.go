@@ -0,0 +1,92 @@
+package bot
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"sort"
+	"strings"
+)
+
+const (
+	// RequiredIntents are always needed: the bot cannot find the voice channels and who is in them without them.
+	RequiredIntents = discordgo.IntentGuilds | discordgo.IntentGuildVoiceStates
+	// DefaultIntents are requested when none are configured. The members intent is privileged: it must be enabled
+	// for the application in the Discord developer portal, otherwise opening the session fails.
+	DefaultIntents = RequiredIntents | discordgo.IntentGuildMembers
+)
+
+// intentNames contains the intents that can be configured, indexed by name.
+var intentNames = map[string]discordgo.Intent{
+	"guilds":                  discordgo.IntentGuilds,
+	"guild_members":           discordgo.IntentGuildMembers,
+	"guild_voice_states":      discordgo.IntentGuildVoiceStates,
+	"guild_message_reactions": discordgo.IntentGuildMessageReactions,
+}
+
+// ParseIntents parses a comma-separated list of intent names, e.g. "guilds,guild_voice_states".
+// The empty string is DefaultIntents. It fails if a name is unknown or if one of the RequiredIntents is missing.
+func ParseIntents(s string) (discordgo.Intent, error) {
+	if strings.TrimSpace(s) == "" {
+		return DefaultIntents, nil
+	}
+
+	var intents discordgo.Intent
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		intent, ok := intentNames[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown intent %q, expected one of %s", name, strings.Join(knownIntentNames(), ", "))
+		}
+		intents |= intent
+	}
+
+	if err := validateIntents(intents); err != nil {
+		return 0, err
+	}
+	return intents, nil
+}
+
+// validateIntents returns an error naming the RequiredIntents missing from intents.
+func validateIntents(intents discordgo.Intent) error {
+	var missing []string
+	for _, name := range knownIntentNames() {
+		intent := intentNames[name]
+		if RequiredIntents&intent != 0 && intents&intent == 0 {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required intents: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// knownIntentNames returns the names of the intents that can be configured, sorted.
+func knownIntentNames() []string {
+	names := make([]string, 0, len(intentNames))
+	for name := range intentNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// buildIntents returns the intents to request when opening the session: the configured ones, DefaultIntents if none
+// are, and the ones needed by the enabled features.
+func buildIntents(options Options) (discordgo.Intent, error) {
+	intents := options.Intents
+	if intents == 0 {
+		intents = DefaultIntents
+	}
+	if err := validateIntents(intents); err != nil {
+		return 0, err
+	}
+
+	if options.ReactionMessageID != "" {
+		intents |= discordgo.IntentGuildMessageReactions
+	}
+	return intents, nil
+}
@@ -0,0 +1,71 @@
+package bot
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseIntents(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected discordgo.Intent
+		wantErr  bool
+	}{
+		{name: "default", value: "", expected: DefaultIntents},
+		{
+			name:     "without members",
+			value:    "guilds,guild_voice_states",
+			expected: discordgo.IntentGuilds | discordgo.IntentGuildVoiceStates,
+		},
+		{
+			name:     "spaces, case and blanks",
+			value:    " Guild_Voice_States , ,GUILDS,guild_members,",
+			expected: discordgo.IntentGuilds | discordgo.IntentGuildVoiceStates | discordgo.IntentGuildMembers,
+		},
+		{name: "unknown", value: "guilds,guild_voice_states,guild_presences", wantErr: true},
+		{name: "missing voice states", value: "guilds,guild_members", wantErr: true},
+		{name: "only blanks", value: " , ", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseIntents(tt.value)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestBuildIntents(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  Options
+		expected discordgo.Intent
+		wantErr  bool
+	}{
+		{name: "default", options: Options{}, expected: DefaultIntents},
+		{name: "configured", options: Options{Intents: RequiredIntents}, expected: RequiredIntents},
+		{
+			name:     "reactions",
+			options:  Options{Intents: RequiredIntents, ReactionMessageID: "message-id"},
+			expected: RequiredIntents | discordgo.IntentGuildMessageReactions,
+		},
+		{name: "missing required", options: Options{Intents: discordgo.IntentGuildMembers}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := buildIntents(tt.options)
+			if tt.wantErr {
+				assert.EqualError(t, err, "missing required intents: guild_voice_states, guilds")
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
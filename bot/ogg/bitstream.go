@@ -1,45 +1,54 @@
 package ogg
 
 import (
+	"errors"
 	"fmt"
 	"io"
 )
 
 const BitstreamSerialNumber = 1
 
+// InvalidGranulePositionErr is returned when a packet has a negative granule position, or a granule position lower
+// than the one of the previous packet. Writing it would make the file invalid.
+var InvalidGranulePositionErr = errors.New("invalid granule position")
+
 // bitstreamEncoder encodes a physical OGG bitstream.
 // It it NOT safe for concurrent use.
 // Note: The implementation is simplified for the purpose of this discord bot:
 // - This only encodes ONE logical bitstream.
 // - Every packet has its own page.
+// The last page is only written by Close, as it must be marked as the end of the stream.
 type bitstreamEncoder struct {
-	writer         io.Writer
-	firstPage      bool
-	sequenceNumber uint32
+	writer          *countingWriter
+	firstPage       bool
+	sequenceNumber  uint32
+	granulePosition int64 // Granule position of the last page.
+	pending         *page // Last page, not written yet.
 }
 
 func newBitstreamEncoder(writer io.Writer) bitstreamEncoder {
 	return bitstreamEncoder{
-		writer:         writer,
+		writer:         &countingWriter{w: writer},
 		firstPage:      true,
 		sequenceNumber: 1,
 	}
 }
 
-// Encode adds a packet to the bitstream in a new page.
+// Encode adds a packet to the bitstream in a new page. The granule position is the number of samples from the start of
+// the stream to the end of the packet.
 // It is sub-optimal (as we could have several packets in 1 page), but it is easier to implementat.
+// The granule positions must be non-negative and must never decrease.
 func (s *bitstreamEncoder) Encode(packetData []byte, granulePosition int64) error {
+	if granulePosition < 0 || granulePosition < s.granulePosition {
+		return fmt.Errorf("%w: %d after %d", InvalidGranulePositionErr, granulePosition, s.granulePosition)
+	}
+
 	page := page{
 		Header: pageHeader{
 			Continued: false, // Will never be continued, as we follow the convention 1 packet <=> 1 page.
 
 			FirstPage: s.firstPage,
-
-			// NOTE: We never set this flag to true.
-			// According to the RFC: "implementations need to be prepared to deal with truncated streams that do not
-			// have a page marked 'end of stream'.".
-			// For simplicity, I decided not to set it.
-			LastPage: false,
+			LastPage:  false, // Set by Close.
 
 			GranulePosition:       granulePosition,
 			BitstreamSerialNumber: BitstreamSerialNumber,
@@ -63,11 +72,39 @@ func (s *bitstreamEncoder) Encode(packetData []byte, granulePosition int64) erro
 		page.AddSegment(nil)
 	}
 
-	if err := page.Encode(s.writer); err != nil {
-		return fmt.Errorf("failed to encode page: %w", err)
+	if err := s.writePending(); err != nil {
+		return err
 	}
 
+	s.pending = &page
 	s.sequenceNumber++
 	s.firstPage = false
+	s.granulePosition = granulePosition
+	return nil
+}
+
+// Close writes the last page, marked as the end of the stream.
+func (s *bitstreamEncoder) Close() error {
+	if s.pending == nil {
+		return nil
+	}
+	s.pending.Header.LastPage = true
+	return s.writePending()
+}
+
+// BytesWritten returns the number of bytes written to the writer so far. The last page is only written by the next
+// Encode or by Close.
+func (s *bitstreamEncoder) BytesWritten() int64 {
+	return s.writer.n
+}
+
+func (s *bitstreamEncoder) writePending() error {
+	if s.pending == nil {
+		return nil
+	}
+	if err := s.pending.Encode(s.writer); err != nil {
+		return fmt.Errorf("failed to encode page: %w", err)
+	}
+	s.pending = nil
 	return nil
 }
@@ -0,0 +1,63 @@
+package ogg
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestBitstreamEncoder_Close(t *testing.T) {
+	var buf bytes.Buffer
+	s := newBitstreamEncoder(&buf)
+
+	require.NoError(t, s.Encode([]byte{0x78, 0x01}, 960))
+	require.NoError(t, s.Encode([]byte{0x78, 0x02}, 1920))
+	// The last page is only written once it is known to be the last one.
+	assert.Equal(t, 1, bytes.Count(buf.Bytes(), []byte("OggS")))
+
+	require.NoError(t, s.Close())
+	b := buf.Bytes()
+	require.Equal(t, 2, bytes.Count(b, []byte("OggS")))
+
+	second := bytes.LastIndex(b, []byte("OggS"))
+	assert.Equal(t, byte(firstPageFlag), b[5])
+	assert.Equal(t, byte(lastPageFlag), b[second+5])
+}
+
+func TestBitstreamEncoder_Encode_granulePosition(t *testing.T) {
+	tests := []struct {
+		name             string
+		granulePositions []int64
+		wantErr          bool
+	}{
+		{name: "increasing", granulePositions: []int64{0, 0, 960, 1920}},
+		{name: "repeated", granulePositions: []int64{0, 960, 960}},
+		{name: "decreasing", granulePositions: []int64{0, 1920, 960}, wantErr: true},
+		{name: "negative", granulePositions: []int64{-960}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			s := newBitstreamEncoder(&buf)
+
+			var err error
+			for _, granulePosition := range tt.granulePositions {
+				if err = s.Encode([]byte{0x78, 0x01}, granulePosition); err != nil {
+					break
+				}
+			}
+
+			if !tt.wantErr {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, InvalidGranulePositionErr)
+
+			// The invalid page is not written.
+			require.NoError(t, s.Close())
+			pages := bytes.Count(buf.Bytes(), []byte("OggS"))
+			assert.Equal(t, len(tt.granulePositions)-1, pages)
+		})
+	}
+}
@@ -21,7 +21,9 @@ type Encoder struct {
 	bitstream bitstreamEncoder
 }
 
-func NewEncoder(logger *zap.Logger, writer io.Writer) (*Encoder, error) {
+// NewEncoder creates an encoder writing to writer. The comments are "KEY=value" strings written in the comment header,
+// e.g. "COMMENT=recorded by BigBro".
+func NewEncoder(logger *zap.Logger, writer io.Writer, comments ...string) (*Encoder, error) {
 	enc := &Encoder{
 		logger:    logger,
 		bitstream: newBitstreamEncoder(writer),
@@ -41,6 +43,7 @@ func NewEncoder(logger *zap.Logger, writer io.Writer) (*Encoder, error) {
 
 	commentHeader := opusCommentHeader{
 		VendorString: []byte("discord-replay"),
+		UserComments: comments,
 	}
 	if err := enc.bitstream.Encode(commentHeader.Bytes(), 0); err != nil {
 		return nil, fmt.Errorf("could not write the opus comment page: %w", err)
@@ -49,9 +52,26 @@ func NewEncoder(logger *zap.Logger, writer io.Writer) (*Encoder, error) {
 	return enc, nil
 }
 
-func (e *Encoder) Encode(opusData []byte, pcmSampleIndex int64) error {
-	if err := e.bitstream.Encode(opusData, pcmSampleIndex); err != nil {
+// Encode adds an opus packet to the file. granulePosition is the number of samples from the start of the file to the
+// end of the packet, including the pre-skip.
+func (e *Encoder) Encode(opusData []byte, granulePosition int64) error {
+	if err := e.bitstream.Encode(opusData, granulePosition); err != nil {
 		return fmt.Errorf("failed to write packet to bitstream: %w", err)
 	}
 	return nil
 }
+
+// BytesWritten returns the number of bytes of the stream written so far, headers included. After Close, it is the
+// length of the whole stream.
+func (e *Encoder) BytesWritten() int64 {
+	return e.bitstream.BytesWritten()
+}
+
+// Close ends the file: the last page is marked as the end of the stream. Nothing can be encoded afterwards.
+// It does not close the writer.
+func (e *Encoder) Close() error {
+	if err := e.bitstream.Close(); err != nil {
+		return fmt.Errorf("failed to write the last page: %w", err)
+	}
+	return nil
+}
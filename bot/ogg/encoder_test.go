@@ -0,0 +1,37 @@
+package ogg
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"testing"
+)
+
+func TestEncoder_BytesWritten(t *testing.T) {
+	tests := []struct {
+		name    string
+		packets [][]byte
+	}{
+		{name: "headers only"},
+		{name: "one packet", packets: [][]byte{{0x78, 0x01}}},
+		{name: "several packets", packets: [][]byte{{0x78, 0x01}, {0x78, 0x02, 0x03}, {0xf8, 0xff, 0xfe}}},
+		{name: "packet spanning several segments", packets: [][]byte{bytes.Repeat([]byte{0x78}, 2*maxSegmentLength+10)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			enc, err := NewEncoder(zap.NewNop(), &buf, "COMMENT=test")
+			require.NoError(t, err)
+
+			for n, packet := range tt.packets {
+				require.NoError(t, enc.Encode(packet, int64(n+1)*960))
+				assert.EqualValues(t, buf.Len(), enc.BytesWritten())
+			}
+			require.NoError(t, enc.Close())
+
+			assert.EqualValues(t, buf.Len(), enc.BytesWritten())
+			assert.Equal(t, len(tt.packets)+2, bytes.Count(buf.Bytes(), []byte("OggS")))
+		})
+	}
+}
@@ -16,3 +16,15 @@ func (ew *errWriter) write(v any) {
 	}
 	ew.err = binary.Write(ew.w, binary.LittleEndian, v)
 }
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -8,6 +8,7 @@ import (
 
 type opusCommentHeader struct {
 	VendorString []byte
+	UserComments []string // "KEY=value" strings, the value is UTF-8 (RFC 7845 section 5.2).
 }
 
 func (h *opusCommentHeader) Encode(writer io.Writer) error {
@@ -40,9 +41,13 @@ func (h *opusCommentHeader) Encode(writer io.Writer) error {
 	w := errWriter{w: writer}
 
 	w.write([]uint8{'O', 'p', 'u', 's', 'T', 'a', 'g', 's'}) // Magic signature.
-	w.write(uint32(len(h.VendorString)))                     // Vendor string.
-	w.write(h.VendorString)                                  // Vendor string length.
-	w.write(uint32(0))                                       // User comment list
+	w.write(uint32(len(h.VendorString)))                     // Vendor string length.
+	w.write(h.VendorString)                                  // Vendor string.
+	w.write(uint32(len(h.UserComments)))                     // User comment list length.
+	for _, comment := range h.UserComments {
+		w.write(uint32(len(comment))) // User comment string length, in bytes.
+		w.write([]byte(comment))      // User comment string.
+	}
 
 	if w.err != nil {
 		return fmt.Errorf("failed to write opus comment header: %w", w.err)
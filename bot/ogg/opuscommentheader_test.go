@@ -0,0 +1,58 @@
+package ogg
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// readComments parses the vendor string and the user comments of an opus comment header.
+func readComments(t *testing.T, b []byte) (string, []string) {
+	t.Helper()
+
+	readString := func() string {
+		require.GreaterOrEqual(t, len(b), 4, "truncated length")
+		length := int(binary.LittleEndian.Uint32(b))
+		require.GreaterOrEqual(t, len(b), 4+length, "truncated string")
+		s := string(b[4 : 4+length])
+		b = b[4+length:]
+		return s
+	}
+
+	require.GreaterOrEqual(t, len(b), 8)
+	require.Equal(t, "OpusTags", string(b[:8]))
+	b = b[8:]
+
+	vendor := readString()
+	require.GreaterOrEqual(t, len(b), 4)
+	count := int(binary.LittleEndian.Uint32(b))
+	b = b[4:]
+
+	var comments []string
+	for i := 0; i < count; i++ {
+		comments = append(comments, readString())
+	}
+	assert.Empty(t, b, "unexpected trailing data")
+	return vendor, comments
+}
+
+func TestOpusCommentHeader_Bytes(t *testing.T) {
+	tests := []struct {
+		name     string
+		comments []string
+	}{
+		{name: "no comment"},
+		{name: "watermark", comments: []string{"COMMENT=recorded by BigBro"}},
+		{name: "multi-byte characters", comments: []string{"COMMENT=enregistré sur 🎮 Gaming", "TITLE=replay"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := opusCommentHeader{VendorString: []byte("discord-replay"), UserComments: tt.comments}
+
+			vendor, comments := readComments(t, h.Bytes())
+			assert.Equal(t, "discord-replay", vendor)
+			assert.Equal(t, tt.comments, comments)
+		})
+	}
+}
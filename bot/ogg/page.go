@@ -113,12 +113,17 @@ func (p *page) Encode(w io.Writer) error {
 		return fmt.Errorf("failed to encode page for CRC: %w", err)
 	}
 
-	var checksum uint32
-	for _, b := range buf.Bytes() {
-		checksum = (checksum << 8) ^ crcTable[byte(checksum>>24)^b]
-	}
+	return p.EncodeWithCRC(w, checksum(buf.Bytes()))
+}
 
-	return p.EncodeWithCRC(w, checksum)
+// checksum returns the CRC of an encoded page whose CRC field is zero (RFC 3533, section 6): polynomial 0x04c11db7,
+// initial value and final XOR zero, no bit reflection.
+func checksum(data []byte) uint32 {
+	var crc uint32
+	for _, b := range data {
+		crc = (crc << 8) ^ crcTable[byte(crc>>24)^b]
+	}
+	return crc
 }
 
 // EncodeWithCRC encodes the OGG page with a given pageHeader.
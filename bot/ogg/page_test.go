@@ -0,0 +1,184 @@
+package ogg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// referenceChecksum computes the page CRC bit by bit, as described by RFC 3533, instead of with the table.
+func referenceChecksum(data []byte) uint32 {
+	const poly = 0x04c11db7
+
+	var crc uint32
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = (crc << 1) ^ poly
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func TestChecksum(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want uint32
+	}{
+		{name: "empty", data: nil, want: 0},
+		{name: "check value", data: []byte("123456789"), want: 0x89a1897f},
+		{name: "one byte", data: []byte{0x01}, want: 0x04c11db7},
+		{name: "capture pattern", data: []byte("OggS"), want: referenceChecksum([]byte("OggS"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, checksum(tt.data))
+			assert.Equal(t, tt.want, referenceChecksum(tt.data))
+		})
+	}
+}
+
+func TestPage_Encode(t *testing.T) {
+	tests := []struct {
+		name string
+		page page
+		want []byte
+	}{
+		{
+			name: "id header",
+			page: page{
+				Header: pageHeader{
+					FirstPage:             true,
+					BitstreamSerialNumber: 1,
+					PageSequenceNumber:    1,
+					SegmentTable:          []uint8{19},
+				},
+				Segments: []byte{
+					'O', 'p', 'u', 's', 'H', 'e', 'a', 'd',
+					0x01, 0x02, 0x00, 0x0f, 0x80, 0xbb, 0x00, 0x00, 0x00, 0x00, 0x00,
+				},
+			},
+			want: []byte{
+				'O', 'g', 'g', 'S', 0x00, 0x02,
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Granule position.
+				0x01, 0x00, 0x00, 0x00, // Serial number.
+				0x01, 0x00, 0x00, 0x00, // Sequence number.
+				0xd2, 0x01, 0x3f, 0x86, // CRC.
+				0x01, 0x13,
+				'O', 'p', 'u', 's', 'H', 'e', 'a', 'd',
+				0x01, 0x02, 0x00, 0x0f, 0x80, 0xbb, 0x00, 0x00, 0x00, 0x00, 0x00,
+			},
+		},
+		{
+			name: "last page",
+			page: page{
+				Header: pageHeader{
+					LastPage:              true,
+					GranulePosition:       960,
+					BitstreamSerialNumber: 1,
+					PageSequenceNumber:    3,
+					SegmentTable:          []uint8{3},
+				},
+				Segments: []byte{0xf8, 0xff, 0xfe},
+			},
+			want: []byte{
+				'O', 'g', 'g', 'S', 0x00, 0x04,
+				0xc0, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Granule position.
+				0x01, 0x00, 0x00, 0x00, // Serial number.
+				0x03, 0x00, 0x00, 0x00, // Sequence number.
+				0x2c, 0xc5, 0x14, 0x35, // CRC.
+				0x01, 0x03,
+				0xf8, 0xff, 0xfe,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, tt.page.Encode(&buf))
+			assert.Equal(t, tt.want, buf.Bytes())
+		})
+	}
+}
+
+// parsedPage is a page read back from its encoding by parsePage.
+type parsedPage struct {
+	headerType      uint8
+	granulePosition int64
+	sequenceNumber  uint32
+	crc             uint32 // CRC written in the page.
+	computedCRC     uint32 // CRC of the page computed by referenceChecksum.
+	packet          []byte
+}
+
+// parsePage reads the page at the start of data, which must hold exactly one packet, and returns the rest of data.
+func parsePage(t *testing.T, data []byte) (parsedPage, []byte) {
+	t.Helper()
+
+	const headerLength = 27
+	require.GreaterOrEqual(t, len(data), headerLength)
+	require.Equal(t, []byte("OggS"), data[:4])
+	require.Equal(t, uint8(0), data[4], "version")
+
+	segmentCount := int(data[26])
+	require.GreaterOrEqual(t, len(data), headerLength+segmentCount)
+	segmentTable := data[headerLength : headerLength+segmentCount]
+
+	length := headerLength + segmentCount
+	for i, segment := range segmentTable {
+		length += int(segment)
+		if i < segmentCount-1 {
+			require.Equal(t, uint8(maxSegmentLength), segment, "only the last segment of a packet can be shorter")
+		}
+	}
+	require.NotZero(t, segmentCount)
+	require.Less(t, segmentTable[segmentCount-1], uint8(maxSegmentLength), "the packet must be terminated")
+	require.GreaterOrEqual(t, len(data), length)
+
+	encoded := append([]byte(nil), data[:length]...)
+	copy(encoded[22:26], []byte{0, 0, 0, 0})
+
+	p := parsedPage{
+		headerType:      data[5],
+		granulePosition: int64(binary.LittleEndian.Uint64(data[6:14])),
+		sequenceNumber:  binary.LittleEndian.Uint32(data[18:22]),
+		crc:             binary.LittleEndian.Uint32(data[22:26]),
+		computedCRC:     referenceChecksum(encoded),
+		packet:          append([]byte{}, data[headerLength+segmentCount:length]...),
+	}
+	require.Equal(t, uint32(BitstreamSerialNumber), binary.LittleEndian.Uint32(data[14:18]))
+	return p, data[length:]
+}
+
+func FuzzBitstreamEncoder_roundTrip(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0xf8, 0xff, 0xfe})
+	f.Add(bytes.Repeat([]byte{0x42}, maxSegmentLength))
+	f.Add(bytes.Repeat([]byte{0x42}, 2*maxSegmentLength+1))
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		if len(packet) >= 255*maxSegmentLength {
+			t.Skip("packet does not fit in a page")
+		}
+
+		var buf bytes.Buffer
+		s := newBitstreamEncoder(&buf)
+		require.NoError(t, s.Encode(packet, 960))
+		require.NoError(t, s.Close())
+
+		p, rest := parsePage(t, buf.Bytes())
+		assert.Empty(t, rest)
+		assert.Equal(t, uint8(firstPageFlag|lastPageFlag), p.headerType)
+		assert.Equal(t, int64(960), p.granulePosition)
+		assert.Equal(t, uint32(1), p.sequenceNumber)
+		assert.Equal(t, p.computedCRC, p.crc, "CRC mismatch")
+		assert.Equal(t, packet, p.packet)
+	})
+}
@@ -0,0 +1,108 @@
+package bot
+
+import (
+	"bigbro2/bot/circular"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"math"
+	"time"
+)
+
+// replayOptions contains the options of the /replay command, once parsed.
+type replayOptions struct {
+	Duration   time.Duration
+	Spatial    bool
+	Multitrack bool
+	DryRun     bool
+	Continue   bool
+	// All records everything in the audio buffer, ignoring Duration and the longest replay allowed.
+	All bool
+}
+
+// parseReplayOptions builds the replayOptions from the options sent by Discord.
+// Options that are not provided keep their default value. The duration is clamped to maxDuration.
+func parseReplayOptions(options []*discordgo.ApplicationCommandInteractionDataOption, defaultDuration, maxDuration time.Duration) (replayOptions, error) {
+	opts := replayOptions{
+		Duration: defaultDuration,
+	}
+
+	for _, opt := range options {
+		if opt == nil {
+			continue
+		}
+
+		switch opt.Name {
+		case "seconds":
+			v, ok := opt.Value.(float64)
+			if !ok {
+				return replayOptions{}, fmt.Errorf("unexpected type %T for option %q", opt.Value, opt.Name)
+			}
+
+			opts.Duration = clampSeconds(v, maxDuration)
+
+		case "spatial":
+			v, ok := opt.Value.(bool)
+			if !ok {
+				return replayOptions{}, fmt.Errorf("unexpected type %T for option %q", opt.Value, opt.Name)
+			}
+			opts.Spatial = v
+
+		case "multitrack":
+			v, ok := opt.Value.(bool)
+			if !ok {
+				return replayOptions{}, fmt.Errorf("unexpected type %T for option %q", opt.Value, opt.Name)
+			}
+			opts.Multitrack = v
+
+		case "dryrun":
+			v, ok := opt.Value.(bool)
+			if !ok {
+				return replayOptions{}, fmt.Errorf("unexpected type %T for option %q", opt.Value, opt.Name)
+			}
+			opts.DryRun = v
+
+		case "continue":
+			v, ok := opt.Value.(bool)
+			if !ok {
+				return replayOptions{}, fmt.Errorf("unexpected type %T for option %q", opt.Value, opt.Name)
+			}
+			opts.Continue = v
+
+		case "all":
+			v, ok := opt.Value.(bool)
+			if !ok {
+				return replayOptions{}, fmt.Errorf("unexpected type %T for option %q", opt.Value, opt.Name)
+			}
+			opts.All = v
+
+		default:
+			return replayOptions{}, fmt.Errorf("unknown option %q", opt.Name)
+		}
+	}
+
+	return opts, nil
+}
+
+// clampSeconds converts the seconds option to a duration between minRequestedDuration and maxDuration.
+// Discord enforces the bounds of the option, but the value is checked again in case it sends something unexpected.
+// Fractions of a second are dropped.
+func clampSeconds(v float64, maxDuration time.Duration) time.Duration {
+	seconds := math.Trunc(v)
+	switch {
+	case !(seconds >= minRequestedDuration.Seconds()): // Also true if v is NaN.
+		return minRequestedDuration
+	case seconds > maxDuration.Seconds():
+		return maxDuration
+	default:
+		return time.Duration(seconds) * time.Second
+	}
+}
+
+// bufferCoverage returns how far back the audio described by stats goes, in whole seconds. It is rounded up to the
+// next second, so the oldest packet is still in the replay by the time it is created. It is zero if there is no audio.
+func bufferCoverage(stats circular.Stats, now time.Time) time.Duration {
+	if stats.Packets == 0 || now.Before(stats.Oldest) {
+		return 0
+	}
+	return now.Sub(stats.Oldest).Truncate(time.Second) + time.Second
+}
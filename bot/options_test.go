@@ -0,0 +1,256 @@
+package bot
+
+import (
+	"bigbro2/bot/circular"
+	"encoding/json"
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseReplayOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  []*discordgo.ApplicationCommandInteractionDataOption
+		expected replayOptions
+		wantErr  bool
+	}{
+		{
+			name:     "no options",
+			options:  nil,
+			expected: replayOptions{Duration: defaultDuration},
+		},
+		{
+			name: "seconds",
+			options: []*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: "seconds", Type: discordgo.ApplicationCommandOptionInteger, Value: float64(10)},
+			},
+			expected: replayOptions{Duration: 10 * time.Second},
+		},
+		{
+			name: "seconds above maximum",
+			options: []*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: "seconds", Type: discordgo.ApplicationCommandOptionInteger, Value: float64(3600)},
+			},
+			expected: replayOptions{Duration: maxDuration},
+		},
+		{
+			name: "zero seconds",
+			options: []*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: "seconds", Type: discordgo.ApplicationCommandOptionInteger, Value: float64(0)},
+			},
+			expected: replayOptions{Duration: minRequestedDuration},
+		},
+		{
+			name: "negative seconds",
+			options: []*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: "seconds", Type: discordgo.ApplicationCommandOptionInteger, Value: float64(-5)},
+			},
+			expected: replayOptions{Duration: minRequestedDuration},
+		},
+		{
+			name: "fraction of a second",
+			options: []*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: "seconds", Type: discordgo.ApplicationCommandOptionInteger, Value: 0.5},
+			},
+			expected: replayOptions{Duration: minRequestedDuration},
+		},
+		{
+			name: "fractional seconds",
+			options: []*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: "seconds", Type: discordgo.ApplicationCommandOptionInteger, Value: 10.9},
+			},
+			expected: replayOptions{Duration: 10 * time.Second},
+		},
+		{
+			name: "all options",
+			options: []*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: "spatial", Type: discordgo.ApplicationCommandOptionBoolean, Value: true},
+				{Name: "seconds", Type: discordgo.ApplicationCommandOptionInteger, Value: float64(10)},
+				{Name: "dryrun", Type: discordgo.ApplicationCommandOptionBoolean, Value: true},
+			},
+			expected: replayOptions{Duration: 10 * time.Second, Spatial: true, DryRun: true},
+		},
+		{
+			name: "continue",
+			options: []*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: "continue", Type: discordgo.ApplicationCommandOptionBoolean, Value: true},
+			},
+			expected: replayOptions{Duration: defaultDuration, Continue: true},
+		},
+		{
+			name: "all",
+			options: []*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: "all", Type: discordgo.ApplicationCommandOptionBoolean, Value: true},
+			},
+			expected: replayOptions{Duration: defaultDuration, All: true},
+		},
+		{
+			name: "only spatial",
+			options: []*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: "spatial", Type: discordgo.ApplicationCommandOptionBoolean, Value: true},
+			},
+			expected: replayOptions{Duration: defaultDuration, Spatial: true},
+		},
+		{
+			name: "only multitrack",
+			options: []*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: "multitrack", Type: discordgo.ApplicationCommandOptionBoolean, Value: true},
+			},
+			expected: replayOptions{Duration: defaultDuration, Multitrack: true},
+		},
+		{
+			name: "wrong type",
+			options: []*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: "seconds", Type: discordgo.ApplicationCommandOptionString, Value: "10"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown option",
+			options: []*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: "volume", Type: discordgo.ApplicationCommandOptionInteger, Value: float64(10)},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseReplayOptions(tt.options, defaultDuration, maxDuration)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestClampSeconds(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    float64
+		expected time.Duration
+	}{
+		{name: "in range", value: 30, expected: 30 * time.Second},
+		{name: "zero", value: 0, expected: minRequestedDuration},
+		{name: "negative", value: -1, expected: minRequestedDuration},
+		{name: "fraction", value: 1.99, expected: time.Second},
+		{name: "above maximum", value: 1e12, expected: maxDuration},
+		{name: "infinity", value: math.Inf(1), expected: maxDuration},
+		{name: "not a number", value: math.NaN(), expected: minRequestedDuration},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, clampSeconds(tt.value, maxDuration))
+		})
+	}
+}
+
+func TestParseReplayOptions_durations(t *testing.T) {
+	tests := []struct {
+		name            string
+		defaultDuration time.Duration
+		maxDuration     time.Duration
+		seconds         *float64
+		expected        time.Duration
+	}{
+		{name: "default", defaultDuration: 20 * time.Second, maxDuration: 2 * time.Minute, expected: 20 * time.Second},
+		{name: "requested", defaultDuration: 20 * time.Second, maxDuration: 2 * time.Minute, seconds: ptr(90.0), expected: 90 * time.Second},
+		{name: "above maximum", defaultDuration: 20 * time.Second, maxDuration: 45 * time.Second, seconds: ptr(60.0), expected: 45 * time.Second},
+		{name: "below minimum", defaultDuration: 20 * time.Second, maxDuration: 45 * time.Second, seconds: ptr(0.0), expected: minRequestedDuration},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var options []*discordgo.ApplicationCommandInteractionDataOption
+			if tt.seconds != nil {
+				options = append(options, &discordgo.ApplicationCommandInteractionDataOption{
+					Name:  "seconds",
+					Type:  discordgo.ApplicationCommandOptionInteger,
+					Value: *tt.seconds,
+				})
+			}
+
+			got, err := parseReplayOptions(options, tt.defaultDuration, tt.maxDuration)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, got.Duration)
+		})
+	}
+}
+
+func TestParseReplayOptions_suggestions(t *testing.T) {
+	// Discord sends back the value of the suggestion picked, or the number typed, the same way.
+	receive := func(t *testing.T, value interface{}) []*discordgo.ApplicationCommandInteractionDataOption {
+		data, err := json.Marshal(map[string]interface{}{"name": "seconds", "type": discordgo.ApplicationCommandOptionInteger, "value": value})
+		require.NoError(t, err)
+		var option discordgo.ApplicationCommandInteractionDataOption
+		require.NoError(t, json.Unmarshal(data, &option))
+		return []*discordgo.ApplicationCommandInteractionDataOption{&option}
+	}
+
+	expected := map[string]time.Duration{
+		"Last 10s":    10 * time.Second,
+		"Last 30s":    30 * time.Second,
+		"Last minute": time.Minute,
+	}
+	suggestions := secondsSuggestions(circular.Stats{}, time.Unix(1000, 0), maxDuration)
+	require.Len(t, suggestions, len(expected))
+	for _, suggestion := range suggestions {
+		t.Run(suggestion.Name, func(t *testing.T) {
+			got, err := parseReplayOptions(receive(t, suggestion.Value), defaultDuration, maxDuration)
+			require.NoError(t, err)
+			assert.Equal(t, expected[suggestion.Name], got.Duration)
+		})
+	}
+
+	t.Run("typed", func(t *testing.T) {
+		got, err := parseReplayOptions(receive(t, 45), defaultDuration, maxDuration)
+		require.NoError(t, err)
+		assert.Equal(t, 45*time.Second, got.Duration)
+	})
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestBufferCoverage(t *testing.T) {
+	now := time.Unix(10_000, 0)
+
+	tests := []struct {
+		name     string
+		stats    circular.Stats
+		expected time.Duration
+	}{
+		{name: "empty buffer", stats: circular.Stats{}, expected: 0},
+		{
+			name:     "beyond the longest replay",
+			stats:    circular.Stats{Packets: 1000, Oldest: now.Add(-90*time.Minute - 300*time.Millisecond)},
+			expected: 90*time.Minute + time.Second,
+		},
+		{
+			name:     "whole seconds",
+			stats:    circular.Stats{Packets: 10, Oldest: now.Add(-42 * time.Second)},
+			expected: 43 * time.Second,
+		},
+		{
+			name:     "oldest packet in the future",
+			stats:    circular.Stats{Packets: 1, Oldest: now.Add(time.Second)},
+			expected: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := bufferCoverage(tt.stats, now)
+			assert.Equal(t, tt.expected, got)
+			if tt.stats.Packets > 0 && got > 0 {
+				// The oldest packet is in the replay: it is less than the replay duration old.
+				assert.Less(t, now.Sub(tt.stats.Oldest), got)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package bot
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"sync"
+	"time"
+)
+
+// memberCacheTTL is how long a member fetched from the API is reused before being fetched again.
+const memberCacheTTL = time.Minute
+
+type (
+	// permissions checks whether members are allowed to use the admin commands.
+	// It is safe for concurrent use.
+	permissions struct {
+		sync.Mutex
+		allowedRoleID string
+		members       memberFetcher
+		now           func() time.Time
+		cache         map[string]cachedMember // Indexed by guild ID and user ID, without the expired members.
+	}
+	// memberFetcher fetches guild members from the API. It is implemented by *discordgo.Session.
+	memberFetcher interface {
+		GuildMember(guildID, userID string) (*discordgo.Member, error)
+	}
+	cachedMember struct {
+		member    *discordgo.Member
+		fetchedAt time.Time
+	}
+)
+
+func newPermissions(allowedRoleID string, members memberFetcher, now func() time.Time) *permissions {
+	return &permissions{
+		allowedRoleID: allowedRoleID,
+		members:       members,
+		now:           now,
+		cache:         map[string]cachedMember{},
+	}
+}
+
+// isAdmin returns whether the member is allowed to use the admin commands.
+// Members with the "Manage Server" permission always are. If allowedRoleID is set, members with this role are too.
+//
+// Discord does not always send the roles of the member with the interaction in large guilds. If they are missing,
+// the member is fetched from the API.
+func (p *permissions) isAdmin(guildID string, member *discordgo.Member) (bool, error) {
+	if member == nil {
+		return false, nil
+	}
+
+	if member.Permissions&discordgo.PermissionManageServer != 0 {
+		return true, nil
+	}
+
+	if p.allowedRoleID == "" {
+		return false, nil
+	}
+
+	roles := member.Roles
+	if len(roles) == 0 && member.User != nil {
+		fetched, err := p.fetchMember(guildID, member.User.ID)
+		if err != nil {
+			return false, err
+		}
+		roles = fetched.Roles
+	}
+
+	for _, roleID := range roles {
+		if roleID == p.allowedRoleID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// fetchMember returns the member from the cache if it was fetched recently, or from the API otherwise.
+func (p *permissions) fetchMember(guildID, userID string) (*discordgo.Member, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.removeExpired()
+	key := guildID + "/" + userID
+	if cached, ok := p.cache[key]; ok {
+		return cached.member, nil
+	}
+
+	member, err := p.members.GuildMember(guildID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch guild member: %w", err)
+	}
+
+	p.cache[key] = cachedMember{member: member, fetchedAt: p.now()}
+	return member, nil
+}
+
+// removeExpired removes the members fetched memberCacheTTL ago or more, so the cache only holds the members who used an
+// admin command recently. The permissions must be locked.
+func (p *permissions) removeExpired() {
+	now := p.now()
+	for key, cached := range p.cache {
+		if now.Sub(cached.fetchedAt) >= memberCacheTTL {
+			delete(p.cache, key)
+		}
+	}
+}
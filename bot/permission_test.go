@@ -0,0 +1,123 @@
+package bot
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// fakeMemberFetcher returns members with fixed roles and counts the calls.
+type fakeMemberFetcher struct {
+	roles []string
+	calls int
+}
+
+func (f *fakeMemberFetcher) GuildMember(_, userID string) (*discordgo.Member, error) {
+	f.calls++
+	return &discordgo.Member{User: &discordgo.User{ID: userID}, Roles: f.roles}, nil
+}
+
+func TestPermissions_isAdmin(t *testing.T) {
+	tests := []struct {
+		name          string
+		member        *discordgo.Member
+		allowedRoleID string
+		fetchedRoles  []string
+		expected      bool
+		expectedCalls int
+	}{
+		{
+			name:     "nil member",
+			member:   nil,
+			expected: false,
+		},
+		{
+			name:     "manage server permission",
+			member:   &discordgo.Member{Permissions: discordgo.PermissionManageServer | discordgo.PermissionSendMessages},
+			expected: true,
+		},
+		{
+			name:     "no permission",
+			member:   &discordgo.Member{Permissions: discordgo.PermissionSendMessages, Roles: []string{"123"}},
+			expected: false,
+		},
+		{
+			name:          "allowed role",
+			member:        &discordgo.Member{Roles: []string{"456", "123"}},
+			allowedRoleID: "123",
+			expected:      true,
+		},
+		{
+			name:          "other role",
+			member:        &discordgo.Member{Roles: []string{"456"}},
+			allowedRoleID: "123",
+			expected:      false,
+		},
+		{
+			name:          "missing roles fetched",
+			member:        &discordgo.Member{User: &discordgo.User{ID: "user-id"}},
+			allowedRoleID: "123",
+			fetchedRoles:  []string{"123"},
+			expected:      true,
+			expectedCalls: 1,
+		},
+		{
+			name:          "missing roles fetched without the allowed role",
+			member:        &discordgo.Member{User: &discordgo.User{ID: "user-id"}},
+			allowedRoleID: "123",
+			fetchedRoles:  []string{"456"},
+			expected:      false,
+			expectedCalls: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetcher := &fakeMemberFetcher{roles: tt.fetchedRoles}
+			p := newPermissions(tt.allowedRoleID, fetcher, time.Now)
+
+			got, err := p.isAdmin("guild-id", tt.member)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+			assert.Equal(t, tt.expectedCalls, fetcher.calls)
+		})
+	}
+}
+
+func TestPermissions_isAdmin_cache(t *testing.T) {
+	now := time.Unix(0, 0)
+	fetcher := &fakeMemberFetcher{roles: []string{"123"}}
+	p := newPermissions("123", fetcher, func() time.Time { return now })
+	member := &discordgo.Member{User: &discordgo.User{ID: "user-id"}}
+
+	for i := 0; i < 3; i++ {
+		admin, err := p.isAdmin("guild-id", member)
+		require.NoError(t, err)
+		assert.True(t, admin)
+	}
+	assert.Equal(t, 1, fetcher.calls, "member should be fetched once")
+
+	now = now.Add(memberCacheTTL)
+	_, err := p.isAdmin("guild-id", member)
+	require.NoError(t, err)
+	assert.Equal(t, 2, fetcher.calls, "member should be fetched again once the cache expired")
+}
+
+func TestPermissions_isAdmin_cacheEviction(t *testing.T) {
+	now := time.Unix(0, 0)
+	fetcher := &fakeMemberFetcher{roles: []string{"123"}}
+	p := newPermissions("123", fetcher, func() time.Time { return now })
+
+	for _, userID := range []string{"a", "b", "c"} {
+		_, err := p.isAdmin("guild-id", &discordgo.Member{User: &discordgo.User{ID: userID}})
+		require.NoError(t, err)
+	}
+	assert.Len(t, p.cache, 3)
+
+	now = now.Add(memberCacheTTL)
+	_, err := p.isAdmin("guild-id", &discordgo.Member{User: &discordgo.User{ID: "d"}})
+	require.NoError(t, err)
+	assert.Len(t, p.cache, 1, "expired members should be removed from the cache")
+	assert.Contains(t, p.cache, "guild-id/d")
+}
@@ -0,0 +1,184 @@
+package ratelimit
+
+import (
+	"errors"
+	"github.com/bwmarrin/discordgo"
+	"go.uber.org/zap"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultThreshold is the number of rate limits within DefaultWindow opening the breaker.
+	DefaultThreshold = 5
+	// DefaultWindow is how long a rate limit counts towards DefaultThreshold.
+	DefaultWindow = 10 * time.Second
+	// DefaultCoolDown is how long the breaker stays open before letting a call through to check whether Discord
+	// accepts requests again.
+	DefaultCoolDown = 30 * time.Second
+)
+
+// OpenErr is returned instead of calling the Discord API while the breaker is open.
+var OpenErr = errors.New("discord api is temporarily unavailable")
+
+type state int
+
+const (
+	closed   state = iota // Calls go through.
+	open                  // Calls fail with OpenErr.
+	halfOpen              // A single trial call goes through, the others fail with OpenErr.
+)
+
+func (s state) String() string {
+	switch s {
+	case closed:
+		return "closed"
+	case open:
+		return "open"
+	default:
+		return "half-open"
+	}
+}
+
+// Breaker stops calling the Discord API for a while when the bot is being rate limited over and over, instead of
+// hammering it and making the rate limit last longer.
+// It opens after threshold rate limits within window. Once coolDown has elapsed, it lets a single call through: if
+// it is not rate limited, the breaker closes, otherwise it opens again.
+// It is safe for concurrent use.
+type Breaker struct {
+	mu         sync.Mutex
+	logger     *zap.Logger
+	now        func() time.Time
+	threshold  int
+	window     time.Duration
+	coolDown   time.Duration
+	state      state
+	rateLimits []time.Time // Rate limits within window while closed, oldest first.
+	openedAt   time.Time
+	trial      bool // A trial call is running while half-open.
+}
+
+// NewBreaker creates a closed breaker using DefaultThreshold, DefaultWindow and DefaultCoolDown.
+func NewBreaker(logger *zap.Logger, now func() time.Time) *Breaker {
+	return &Breaker{
+		logger:    logger,
+		now:       now,
+		threshold: DefaultThreshold,
+		window:    DefaultWindow,
+		coolDown:  DefaultCoolDown,
+	}
+}
+
+// Do calls f unless the breaker is open, in which case it returns OpenErr. A rate limit error returned by f counts
+// towards opening the breaker.
+func (b *Breaker) Do(f func() error) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+
+	err := f()
+	b.done(IsRateLimited(err))
+	return err
+}
+
+// Available returns whether a call would go through, without making one.
+func (b *Breaker) Available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case open:
+		return b.now().Sub(b.openedAt) >= b.coolDown
+	case halfOpen:
+		return !b.trial
+	default:
+		return true
+	}
+}
+
+// RecordRateLimit counts a rate limit towards opening the breaker. It is used for the rate limits discordgo handles
+// itself by waiting and retrying, which the calls never return.
+func (b *Breaker) RecordRateLimit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.recordRateLimit()
+}
+
+func (b *Breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case open:
+		if b.now().Sub(b.openedAt) < b.coolDown {
+			return OpenErr
+		}
+		b.setState(halfOpen)
+	case halfOpen:
+		if b.trial {
+			return OpenErr
+		}
+	default:
+		return nil
+	}
+
+	b.trial = true
+	return nil
+}
+
+func (b *Breaker) done(rateLimited bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wasTrial := b.state == halfOpen && b.trial
+	b.trial = false
+	if rateLimited {
+		b.recordRateLimit()
+		return
+	}
+	if wasTrial {
+		b.setState(closed)
+	}
+}
+
+func (b *Breaker) recordRateLimit() {
+	now := b.now()
+	switch b.state {
+	case closed:
+		b.rateLimits = append(b.rateLimits, now)
+		for len(b.rateLimits) > 0 && now.Sub(b.rateLimits[0]) > b.window {
+			b.rateLimits = b.rateLimits[1:]
+		}
+		if len(b.rateLimits) >= b.threshold {
+			b.openedAt = now
+			b.setState(open)
+		}
+	case halfOpen:
+		// Discord still rate limits the bot.
+		b.trial = false
+		b.openedAt = now
+		b.setState(open)
+	}
+}
+
+func (b *Breaker) setState(s state) {
+	b.logger.Info("discord api circuit breaker changed state", zap.Stringer("from", b.state), zap.Stringer("to", s))
+	b.state = s
+	b.rateLimits = nil
+}
+
+// IsRateLimited returns whether err was returned by discordgo because the bot is rate limited.
+func IsRateLimited(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var rateLimitErr *discordgo.RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		return true
+	}
+	var restErr *discordgo.RESTError
+	return errors.As(err, &restErr) && restErr.Response != nil && restErr.Response.StatusCode == http.StatusTooManyRequests
+}
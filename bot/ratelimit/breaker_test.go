@@ -0,0 +1,147 @@
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var rateLimitErr = &discordgo.RateLimitError{RateLimit: &discordgo.RateLimit{
+	TooManyRequests: &discordgo.TooManyRequests{RetryAfter: time.Second},
+	URL:             "https://discord.com/api/v9/channels/1/messages",
+}}
+
+// newTestBreaker returns a breaker opening after 3 rate limits within 10 seconds, for 30 seconds, and its clock.
+func newTestBreaker() (*Breaker, *time.Time) {
+	now := time.Unix(1000, 0)
+	b := NewBreaker(zap.NewNop(), func() time.Time { return now })
+	b.threshold = 3
+	return b, &now
+}
+
+func succeed() error { return nil }
+
+func rateLimited() error { return fmt.Errorf("failed to send message: %w", rateLimitErr) }
+
+func TestBreaker_opens(t *testing.T) {
+	b, now := newTestBreaker()
+
+	// Other errors do not count.
+	assert.EqualError(t, b.Do(func() error { return errors.New("unknown channel") }), "unknown channel")
+
+	assert.ErrorIs(t, b.Do(rateLimited), rateLimitErr)
+	assert.ErrorIs(t, b.Do(rateLimited), rateLimitErr)
+	assert.NoError(t, b.Do(succeed))
+	assert.Equal(t, closed, b.state)
+	assert.True(t, b.Available())
+
+	*now = now.Add(time.Second)
+	b.RecordRateLimit()
+	assert.Equal(t, open, b.state)
+	assert.False(t, b.Available())
+
+	called := false
+	err := b.Do(func() error {
+		called = true
+		return nil
+	})
+	assert.ErrorIs(t, err, OpenErr)
+	assert.False(t, called)
+}
+
+func TestBreaker_window(t *testing.T) {
+	b, now := newTestBreaker()
+
+	b.RecordRateLimit()
+	*now = now.Add(6 * time.Second)
+	b.RecordRateLimit()
+	*now = now.Add(6 * time.Second)
+	b.RecordRateLimit()
+
+	// The first rate limit is too old.
+	assert.Equal(t, closed, b.state)
+
+	*now = now.Add(time.Second)
+	b.RecordRateLimit()
+	assert.Equal(t, open, b.state)
+}
+
+func TestBreaker_halfOpen(t *testing.T) {
+	tests := []struct {
+		name     string
+		trial    func() error
+		expected state
+	}{
+		{name: "trial succeeds", trial: succeed, expected: closed},
+		{name: "trial rate limited", trial: rateLimited, expected: open},
+		{
+			name:     "trial rate limited and retried by discordgo",
+			expected: open,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, now := newTestBreaker()
+			for i := 0; i < 3; i++ {
+				b.RecordRateLimit()
+			}
+			assert.Equal(t, open, b.state)
+
+			*now = now.Add(DefaultCoolDown - time.Second)
+			assert.ErrorIs(t, b.Do(succeed), OpenErr)
+
+			*now = now.Add(time.Second)
+			assert.True(t, b.Available())
+
+			trial := tt.trial
+			if trial == nil {
+				trial = func() error {
+					b.RecordRateLimit()
+					return nil
+				}
+			}
+			_ = b.Do(func() error {
+				assert.Equal(t, halfOpen, b.state)
+				// Only the trial call goes through.
+				assert.False(t, b.Available())
+				assert.ErrorIs(t, b.Do(succeed), OpenErr)
+				return trial()
+			})
+			assert.Equal(t, tt.expected, b.state)
+			assert.Equal(t, tt.expected == closed, b.Available())
+		})
+	}
+}
+
+func TestIsRateLimited(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "no error", err: nil, expected: false},
+		{name: "rate limit error", err: rateLimitErr, expected: true},
+		{name: "wrapped", err: fmt.Errorf("failed to send message: %w", rateLimitErr), expected: true},
+		{
+			name:     "too many requests",
+			err:      &discordgo.RESTError{Response: &http.Response{StatusCode: http.StatusTooManyRequests}},
+			expected: true,
+		},
+		{
+			name:     "other status",
+			err:      &discordgo.RESTError{Response: &http.Response{StatusCode: http.StatusForbidden}},
+			expected: false,
+		},
+		{name: "other error", err: errors.New("connection reset"), expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, IsRateLimited(tt.err))
+		})
+	}
+}
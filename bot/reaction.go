@@ -0,0 +1,123 @@
+package bot
+
+import (
+	"bigbro2/bot/cleanup"
+	"bigbro2/bot/command"
+	"bigbro2/bot/logging"
+	"bigbro2/bot/voicechannel"
+	"context"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"go.uber.org/zap"
+)
+
+func (b *Bot) registerMessageReactionAddHandler(ctx context.Context, manager *voicechannel.Manager) cleanup.Func {
+	b.logger.Debug("registering message reaction add handler")
+	removeMessageReactionAdd := b.session.AddHandler(func(_ *discordgo.Session, r *discordgo.MessageReactionAdd) {
+		done, ok := b.requests.begin()
+		if !ok {
+			b.logger.Debug("reaction received while shutting down discarded", zap.String("message_id", r.MessageID))
+			return
+		}
+		defer done()
+
+		err := b.handleReplayReaction(ctx, manager, r)
+		if err != nil {
+			b.logger.Error("could not handle message reaction add", zap.Error(err))
+		}
+	})
+	cleanupFunc := func() error {
+		b.logger.Debug("unregistering message reaction add handler")
+		removeMessageReactionAdd()
+		return nil
+	}
+	return cleanupFunc
+}
+
+// handleReplayReaction creates a replay of the default duration when a member of the voice channel adds the configured
+// emoji to the configured message. The replay is sent in the channel of the message.
+func (b *Bot) handleReplayReaction(ctx context.Context, manager *voicechannel.Manager, r *discordgo.MessageReactionAdd) error {
+	if !b.isReplayReaction(r) {
+		return nil
+	}
+
+	logger := b.logger.With(
+		zap.String("request_id", logging.NewRequestID()),
+		zap.String("message_id", r.MessageID),
+		zap.String("channel_id", r.ChannelID),
+		zap.String("user_id", r.UserID),
+	)
+	logger.Debug("received replay reaction")
+
+	currentChannel := manager.CurrentChannelID()
+	if currentChannel == nil {
+		logger.Info("ignoring reaction as bot is not connected to the voice channel")
+		return nil
+	}
+
+	inVoiceChannel, err := b.isInVoiceChannel(ctx, *currentChannel, r.UserID)
+	if err != nil {
+		return fmt.Errorf("could not check if bot is in voice channel of the user: %w", err)
+	}
+	if !inVoiceChannel {
+		logger.Info("ignoring reaction as the user is not in same the voice channel as the bot")
+		return nil
+	}
+	if !manager.Armed() {
+		logger.Info("ignoring reaction as the capture is not armed")
+		return nil
+	}
+
+	if !b.breaker.Available() {
+		logger.Info("ignoring reaction as discord is rate limiting the bot")
+		return nil
+	}
+
+	requester := &discordgo.User{ID: r.UserID}
+	if r.Member != nil && r.Member.User != nil {
+		requester = r.Member.User
+	}
+
+	duration := b.settings.DefaultDuration(b.guildID)
+	err = b.replayCmd.Run(logging.WithLogger(ctx, logger), command.Request{
+		ChannelID:      r.ChannelID,
+		Requester:      requester,
+		GuildID:        b.guildID,
+		Duration:       duration,
+		VoiceChannelID: *currentChannel,
+		Speakers:       manager.Speakers(),
+		Departures:     manager.Departures(),
+		JoinedAt:       manager.JoinedAt(),
+	})
+	if err != nil {
+		return fmt.Errorf("could not create replay: %w", err)
+	}
+
+	logger.Info("created replay", zap.Duration("duration", duration))
+	return nil
+}
+
+// isReplayReaction returns whether the reaction asks for a replay: the configured emoji added to the configured
+// message of the recorded guild, by someone other than a bot.
+func (b *Bot) isReplayReaction(r *discordgo.MessageReactionAdd) bool {
+	if b.options.ReactionMessageID == "" || r.MessageReaction == nil {
+		return false
+	}
+
+	if !b.servesGuild(r.GuildID, false) || r.MessageID != b.options.ReactionMessageID {
+		return false
+	}
+
+	// Unicode emojis are identified by their name, custom emojis by "name:id".
+	if r.Emoji.APIName() != b.options.ReactionEmoji {
+		return false
+	}
+
+	if b.session.State.User != nil && r.UserID == b.session.State.User.ID {
+		return false
+	}
+	if r.Member != nil && r.Member.User != nil && r.Member.User.Bot {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+package bot
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"testing"
+)
+
+func TestBot_isReplayReaction(t *testing.T) {
+	reaction := func(userID, messageID string, emoji discordgo.Emoji) *discordgo.MessageReactionAdd {
+		return &discordgo.MessageReactionAdd{
+			MessageReaction: &discordgo.MessageReaction{
+				UserID:    userID,
+				MessageID: messageID,
+				Emoji:     emoji,
+				ChannelID: "text-channel-id",
+				GuildID:   "guild-id",
+			},
+		}
+	}
+	replayEmoji := discordgo.Emoji{Name: "🔁"}
+
+	tests := []struct {
+		name     string
+		options  Options
+		reaction *discordgo.MessageReactionAdd
+		expected bool
+	}{
+		{
+			name:     "replay reaction",
+			options:  Options{ReactionMessageID: "message-id", ReactionEmoji: "🔁"},
+			reaction: reaction("user-id", "message-id", replayEmoji),
+			expected: true,
+		},
+		{
+			name:     "custom emoji",
+			options:  Options{ReactionMessageID: "message-id", ReactionEmoji: "replay:123"},
+			reaction: reaction("user-id", "message-id", discordgo.Emoji{Name: "replay", ID: "123"}),
+			expected: true,
+		},
+		{
+			name:     "disabled",
+			options:  Options{ReactionEmoji: "🔁"},
+			reaction: reaction("user-id", "", replayEmoji),
+			expected: false,
+		},
+		{
+			name:     "wrong emoji",
+			options:  Options{ReactionMessageID: "message-id", ReactionEmoji: "🔁"},
+			reaction: reaction("user-id", "message-id", discordgo.Emoji{Name: "👍"}),
+			expected: false,
+		},
+		{
+			name:     "wrong message",
+			options:  Options{ReactionMessageID: "message-id", ReactionEmoji: "🔁"},
+			reaction: reaction("user-id", "other-message-id", replayEmoji),
+			expected: false,
+		},
+		{
+			name:     "bot's own reaction",
+			options:  Options{ReactionMessageID: "message-id", ReactionEmoji: "🔁"},
+			reaction: reaction("bot-user-id", "message-id", replayEmoji),
+			expected: false,
+		},
+		{
+			name:    "other bot",
+			options: Options{ReactionMessageID: "message-id", ReactionEmoji: "🔁"},
+			reaction: func() *discordgo.MessageReactionAdd {
+				r := reaction("other-bot-id", "message-id", replayEmoji)
+				r.Member = &discordgo.Member{User: &discordgo.User{ID: "other-bot-id", Bot: true}}
+				return r
+			}(),
+			expected: false,
+		},
+		{
+			name:    "other guild",
+			options: Options{ReactionMessageID: "message-id", ReactionEmoji: "🔁"},
+			reaction: func() *discordgo.MessageReactionAdd {
+				r := reaction("user-id", "message-id", replayEmoji)
+				r.GuildID = "other-guild-id"
+				return r
+			}(),
+			expected: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Bot{
+				logger:  zap.NewNop(),
+				session: newTestSession(),
+				guildID: "guild-id",
+				options: tt.options,
+			}
+
+			assert.Equal(t, tt.expected, b.isReplayReaction(tt.reaction))
+		})
+	}
+}
@@ -2,13 +2,19 @@ package replayfile
 
 import (
 	"bigbro2/bot/circular"
+	"bigbro2/bot/logging"
 	"bigbro2/bot/ogg"
+	"bigbro2/bot/tempfile"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"go.uber.org/zap"
+	"io"
 	"os"
-	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -18,141 +24,525 @@ const (
 	FrameSize     = FrameLengthNs * SampleRate / 1e9
 )
 
+const (
+	// ctxCheckInterval is the number of packets processed between two checks of the context cancellation.
+	ctxCheckInterval = 1024
+	// maxConcurrentMixes is the number of ffmpeg processes that can run at the same time.
+	maxConcurrentMixes = 2
+	// streamDurationTolerance is how many times longer than the window of the replay a stream file can be. A stream
+	// is never longer than its window, give or take the jitter: a longer one comes from a bad PCM index, whose gap
+	// would be padded with silence into a huge file.
+	streamDurationTolerance = 2
+)
+
 var (
-	silentFrame    = []byte{0xF8, 0xFF, 0xFE}
-	NoAudioDataErr = errors.New("no audio data")
+	silentFrame      = []byte{0xF8, 0xFF, 0xFE}
+	NoAudioDataErr   = errors.New("no audio data")
+	CreatorClosedErr = errors.New("creator is closed")
+	StreamTooLongErr = errors.New("voice stream longer than the replay")
 )
 
+// Options are the settings of a single replay.
+type Options struct {
+	Spatial    bool // See MixOptions.Spatial.
+	Multitrack bool // See MixOptions.Multitrack.
+	// Loudness measures the loudness of each voice stream, see Result.Loudness. It runs ffmpeg once more per stream.
+	Loudness bool
+	// Speakers is the ID of the user speaking in each voice stream, indexed by SSRC. It is needed to apply
+	// MixOptions.Weights.
+	Speakers map[uint32]string
+	// JoinedAt is when the bot joined the voice channel, zero if unknown. If the replay goes back to it, the replay
+	// starts when the bot joined instead of at the first packet received, see Creator.createStreamFiles.
+	JoinedAt time.Time
+	// Departures is when the user of each voice stream left the voice channel, indexed by SSRC. The packets of a stream
+	// received after its user left are left out, and so is the stream if none is left.
+	Departures map[uint32]time.Time
+	// SSRCs restricts the replay to these voice streams, e.g. the ones of a user asking for a clip of themselves. Nil
+	// includes every stream.
+	SSRCs []uint32
+	// Bitrate overrides MixOptions.Bitrate when it is not zero.
+	Bitrate int
+}
+
+// Result describes a replay that was created.
+type Result struct {
+	SSRCs    []uint32 // SSRC of the voice streams included in the replay.
+	Speakers int      // Number of voice streams included in the replay.
+	FileSize int64    // Size of the replay file, in bytes.
+	// Truncated is true if the audio buffer did not go back as far as the recording duration asked for, e.g. the bot
+	// joined the channel recently or older packets were dropped. The replay is then shorter than expected.
+	Truncated bool
+	// AvailableDuration is how far back the audio buffer went, at most the recording duration asked for.
+	AvailableDuration time.Duration
+	// DroppedStreams is the number of voice streams left out of the replay because there were more than
+	// MixOptions.MaxStreams.
+	DroppedStreams int
+	// MultitrackMixed is true if Options.Multitrack was asked for but the voice streams were mixed together, e.g.
+	// there were more than MaxMultitrackChannels of them.
+	MultitrackMixed bool
+	// Loudness is the integrated loudness of each voice stream in LUFS (EBU R128), in the same order as SSRCs.
+	// It is only measured if Options.Loudness is set, and is empty if a measure failed.
+	Loudness []float64
+}
+
+// Creator creates the replays. It must be closed once it is not used anymore.
 type Creator struct {
-	logger *zap.Logger
-	now    func() time.Time
+	logger     *zap.Logger
+	now        func() time.Time
+	mixOptions MixOptions
+	mixSlots   chan struct{} // Limits the number of ffmpeg processes running.
+	ffmpeg     string        // Name or path of the ffmpeg binary.
+
+	// measureLoudness returns the loudness of a stream file, see Creator.ffmpegLoudness.
+	measureLoudness func(ctx context.Context, path string) (float64, error)
+
+	mu       sync.Mutex
+	closed   bool
+	inFlight sync.WaitGroup
+}
+
+func NewCreator(logger *zap.Logger, now func() time.Time, mixOptions MixOptions) *Creator {
+	c := &Creator{
+		logger:     logger,
+		now:        now,
+		mixOptions: mixOptions,
+		mixSlots:   make(chan struct{}, maxConcurrentMixes),
+		ffmpeg:     "ffmpeg",
+	}
+	c.measureLoudness = c.ffmpegLoudness
+	return c
+}
+
+// Container returns the format of the replay files.
+func (c *Creator) Container() Container {
+	if c.mixOptions.Container == "" {
+		return ContainerOgg
+	}
+	return c.mixOptions.Container
 }
 
-func NewCreator(logger *zap.Logger, now func() time.Time) *Creator {
-	return &Creator{
-		logger: logger,
-		now:    now,
+// Close waits for the replays being created to be done. Replays cannot be created once Close is called.
+func (c *Creator) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+
+	c.inFlight.Wait()
+	return nil
+}
+
+// begin registers a replay being created. The returned function must be called once it is done.
+// It returns CreatorClosedErr if the creator is closed.
+func (c *Creator) begin() (func(), error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, CreatorClosedErr
 	}
+	c.inFlight.Add(1)
+	return c.inFlight.Done, nil
 }
 
 // Create creates a new Opus file containing the packets from the audio buffer.
 // It creates N temporary opus files (one for each voice stream) and mixes them together using ffmpeg.
-func (c *Creator) Create(ctx context.Context, audioBuffer *circular.Buffer, path string, recordingDuration time.Duration) error {
-	return audioBuffer.WithIterator(func(iterator *circular.Iterator) error {
-		return c.create(ctx, iterator, path, recordingDuration)
-	})
+func (c *Creator) Create(ctx context.Context, audioBuffer circular.Store, path string, recordingDuration time.Duration, opts Options) (Result, error) {
+	done, err := c.begin()
+	if err != nil {
+		return Result{}, err
+	}
+	defer done()
+
+	// The packets are copied, so the audio buffer keeps receiving packets while the replay is encoded and mixed.
+	packets, window, err := circular.SnapshotSince(ctx, audioBuffer, c.now(), recordingDuration)
+	if err != nil {
+		return Result{}, err
+	}
+	if opts.SSRCs != nil {
+		packets = packets.Streams(opts.SSRCs)
+	}
+
+	result := Result{AvailableDuration: window.Available, Truncated: window.Truncated}
+	err = c.create(ctx, packets.Iterator(), path, recordingDuration, window, opts, &result)
+	return result, err
 }
 
-func (c *Creator) create(ctx context.Context, iterator *circular.Iterator, path string, recordingDuration time.Duration) error {
+// CreateStream creates a replay like Create, but the mix is not written to a file: it is read from the returned reader
+// while ffmpeg encodes it. Only the stream files are written to disk, they are removed once the reader is closed, which
+// must always be done. The size of the replay is only known once it is read, Result.FileSize is zero.
+func (c *Creator) CreateStream(ctx context.Context, audioBuffer circular.Store, recordingDuration time.Duration, opts Options) (io.ReadCloser, Result, error) {
+	done, err := c.begin()
+	if err != nil {
+		return nil, Result{}, err
+	}
+
+	packets, window, err := circular.SnapshotSince(ctx, audioBuffer, c.now(), recordingDuration)
+	if err != nil {
+		done()
+		return nil, Result{}, err
+	}
+	if opts.SSRCs != nil {
+		packets = packets.Streams(opts.SSRCs)
+	}
+
+	result := Result{AvailableDuration: window.Available, Truncated: window.Truncated}
 	var files []string
-	defer func() {
-		for _, fileName := range files {
-			if err := os.Remove(fileName); err != nil {
-				c.logger.Warn("failed to remove file", zap.Error(err))
-			}
-			c.logger.Debug("removed file", zap.String("path", fileName))
-		}
-	}()
+	cleanup := func() {
+		c.removeFiles(ctx, files)
+		done()
+	}
 
-	err := c.createStreamFiles(iterator, &files, recordingDuration)
+	args, err := c.prepareMix(ctx, packets.Iterator(), "pipe:1", recordingDuration, window, opts, &files, &result)
 	if err != nil {
-		return fmt.Errorf("failed to create temporary stream files: %w", err)
+		cleanup()
+		return nil, result, err
 	}
 
-	if len(files) == 0 {
-		return NoAudioDataErr
+	output, err := c.startFFmpeg(ctx, args, cleanup)
+	if err != nil {
+		cleanup()
+		return nil, result, fmt.Errorf("failed to mix files together: %w", err)
 	}
+	return output, result, nil
+}
 
-	// Now that we have N files, we need to mix them all into one single file.
-	if err := c.mixFiles(ctx, path, files); err != nil {
+// Mix mixes existing stream files into path, the way the stream files of a replay are mixed.
+// It allows reproducing a mix without Discord, e.g. from the stream files of a replay that sounded wrong.
+func (c *Creator) Mix(ctx context.Context, path string, files []string, opts Options) error {
+	done, err := c.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	mixOptions := c.mixOptions
+	mixOptions.Spatial = opts.Spatial
+	// The duration of the stream files is not known, the mix is only faded in. The users speaking in them are not known
+	// either, they all have the same weight.
+	return c.mixFiles(ctx, path, files, mixOptions, 0, 0, nil)
+}
+
+func (c *Creator) create(ctx context.Context, iterator circular.Iterator, path string, recordingDuration time.Duration, window circular.Window, opts Options, result *Result) error {
+	var files []string
+	defer func() { c.removeFiles(ctx, files) }()
+
+	args, err := c.prepareMix(ctx, iterator, path, recordingDuration, window, opts, &files, result)
+	if err != nil {
+		return err
+	}
+	if _, err := c.runFFmpeg(ctx, args); err != nil {
 		return fmt.Errorf("failed to mix files together: %w", err)
 	}
 
+	stat, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	result.FileSize = stat.Size()
 	return nil
 }
 
-// createStreamFiles
+// prepareMix creates the stream files of the packets of iterator and returns the arguments of ffmpeg mixing them into
+// output. It fills result, except for the size of the file. The stream files are added to files, which must be removed
+// even if it fails.
+func (c *Creator) prepareMix(ctx context.Context, iterator circular.Iterator, output string, recordingDuration time.Duration, window circular.Window, opts Options, files *[]string, result *Result) ([]string, error) {
+	ssrcs, durations, dropped, err := c.createStreamFiles(ctx, iterator, files, window, opts.JoinedAt, opts.Departures, c.mixOptions.MaxStreams)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary stream files: %w", err)
+	}
+
+	if len(*files) == 0 {
+		return nil, NoAudioDataErr
+	}
+
+	if opts.Loudness {
+		result.Loudness = c.streamsLoudness(ctx, *files)
+	}
+
+	result.SSRCs = ssrcs
+	result.Speakers = len(ssrcs)
+	result.DroppedStreams = dropped
+
+	// Now that we have N files, we need to mix them all into one single file.
+	mixOptions := c.mixOptions
+	mixOptions.Spatial = opts.Spatial
+	mixOptions.Multitrack = opts.Multitrack
+	if opts.Bitrate > 0 {
+		mixOptions.Bitrate = opts.Bitrate
+	}
+	length := mixLength(durations, mixOptions.Duration)
+	if opts.Multitrack && !multitrack(len(*files), length) {
+		logger := logging.FromContext(ctx, c.logger).With(zap.Int("streams", len(*files)))
+		if len(*files) > MaxMultitrackChannels {
+			logger.Info("too many voice streams for a multitrack replay, mixing them")
+		} else {
+			logger.Info("unknown length of the multitrack replay, mixing the voice streams")
+		}
+		result.MultitrackMixed = true
+	}
+	weights := streamWeights(ssrcs, opts.Speakers, mixOptions.Weights)
+	return mixArgs(output, *files, mixOptions, recordingDuration, length, weights), nil
+}
+
+// removeFiles removes the temporary stream files of a replay.
+func (c *Creator) removeFiles(ctx context.Context, files []string) {
+	logger := logging.FromContext(ctx, c.logger)
+	for _, fileName := range files {
+		if err := os.Remove(fileName); err != nil {
+			logger.Warn("failed to remove file", zap.Error(err))
+		}
+		logger.Debug("removed file", zap.String("path", fileName))
+	}
+}
+
+// createStreamFiles creates one file per voice stream of the packets of iterator, which are in window, and returns the
+// SSRC and the duration of each stream, in the same order. If there are more than maxStreams streams, only the most
+// active ones are kept, it also returns the number of streams dropped.
+// Streams are sorted by the time their first packet was received, then by SSRC.
+//
+// The streams are aligned relative to the start of the replay: the time the first packet was received, or joinedAt,
+// the time the bot joined the voice channel, if the replay goes back to it. Starting at the first packet, the alignment
+// depends on which stream happens to come first and on how late its first packet was. Starting when the bot joined,
+// every stream is placed at the time it started after the join, whoever was already speaking. joinedAt is ignored if
+// it is zero.
+//
+// The packets of a stream received after its user left the voice channel, as given by departures, are skipped: such a
+// ghost stream only wastes an input of the mix.
 // Takes a pointer to slice as argument to make sure we always delete them with defer.
-func (c *Creator) createStreamFiles(iterator *circular.Iterator, files *[]string, recordingDuration time.Duration) error {
-	streams := map[uint32]*streamState{}
+func (c *Creator) createStreamFiles(ctx context.Context, iterator circular.Iterator, files *[]string, window circular.Window, joinedAt time.Time, departures map[uint32]time.Time, maxStreams int) ([]uint32, []time.Duration, int, error) {
+	logger := logging.FromContext(ctx, c.logger)
+
+	var ssrcs []uint32
+	streams := map[uint32][]streamPacket{}
+	unwrappers := map[uint32]*pcmIndexUnwrapper{}
 
 	var streamStartTime *time.Time
-	for iterator.HasNext() {
+	ghosts := 0
+	for n := 0; iterator.HasNext(); n++ {
+		if n%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, nil, 0, err
+			}
+		}
+
 		pkt := iterator.Next()
-		// Discard packets that too old.
-		if c.now().Sub(pkt.Time) >= recordingDuration {
+		if leftAt, ok := departures[pkt.SSRC]; ok && pkt.Time.After(leftAt) {
+			ghosts++
 			continue
 		}
 
 		// This is the first packet we process, since the packets are ordered we can extract the time the replay
 		//starts.
 		if streamStartTime == nil {
-			c.logger.Debug("stream start time", zap.Time("time", pkt.Time))
+			logger.Debug("stream start time", zap.Time("time", pkt.Time))
 			streamStartTime = &pkt.Time
 		}
 
-		ssrc := pkt.SSRC
+		if _, ok := streams[pkt.SSRC]; !ok {
+			ssrcs = append(ssrcs, pkt.SSRC)
+			unwrappers[pkt.SSRC] = &pcmIndexUnwrapper{}
+		}
+		streams[pkt.SSRC] = append(streams[pkt.SSRC], streamPacket{
+			AudioPacket: pkt,
+			pcmIndex:    unwrappers[pkt.SSRC].Unwrap(pkt.PCMIndex),
+		})
+	}
+
+	if ghosts > 0 {
+		logger.Debug("skipped packets received after their user left", zap.Int("packets", ghosts))
+	}
 
-		// We haven't encountered this voice stream before, we need to create a new file & encoder for it.
-		if _, ok := streams[ssrc]; !ok {
-			f, err := os.CreateTemp("", "*.opus")
-			if err != nil {
-				return fmt.Errorf("failed to create temporary file: %w", err)
-			}
-			defer func(f *os.File) {
-				if err := f.Close(); err != nil {
-					c.logger.Warn("failed to close file", zap.Error(err))
-				}
-			}(f)
-
-			c.logger.Debug("created new file for stream",
-				zap.Uint32("ssrc", ssrc),
-				zap.String("path", f.Name()),
-			)
-
-			// Create an encoder for this particular file.
-			encoder, err := ogg.NewEncoder(c.logger, f)
-			if err != nil {
-				return fmt.Errorf("failed to create ogg encoder: %w", err)
+	if streamStartTime != nil && !joinedAt.IsZero() && joinedAt.Before(*streamStartTime) && joinedAt.After(window.Start) {
+		logger.Debug("replay starts when the bot joined", zap.Time("time", joinedAt))
+		streamStartTime = &joinedAt
+	}
+
+	// The streams are ordered by the time they started, then by SSRC, so the same audio always gives the same inputs
+	// to ffmpeg, in the same order. It matters for spatial mixing, which pans each input to a different position.
+	sort.Slice(ssrcs, func(i, j int) bool {
+		first, second := streams[ssrcs[i]][0].Time, streams[ssrcs[j]][0].Time
+		if !first.Equal(second) {
+			return first.Before(second)
+		}
+		return ssrcs[i] < ssrcs[j]
+	})
+
+	dropped := 0
+	if maxStreams > 0 && len(ssrcs) > maxStreams {
+		kept := selectStreams(ssrcs, streams, maxStreams)
+		dropped = len(ssrcs) - len(kept)
+		logger.Info("too many voice streams, dropping the least active ones", zap.Int("streams", len(ssrcs)), zap.Int("dropped", dropped))
+		ssrcs = kept
+	}
+
+	durations := make([]time.Duration, 0, len(ssrcs))
+	for _, ssrc := range ssrcs {
+		duration, err := c.createStreamFile(ctx, ssrc, streams[ssrc], *streamStartTime, streamDurationTolerance*window.Duration, files)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		durations = append(durations, duration)
+	}
+	return ssrcs, durations, dropped, nil
+}
+
+// selectStreams returns the limit most active voice streams: the ones with the most packets that are not silent. The
+// streams are kept in the same order, the first ones are kept when they are as active.
+func selectStreams(ssrcs []uint32, streams map[uint32][]streamPacket, limit int) []uint32 {
+	activity := make(map[uint32]int, len(ssrcs))
+	for _, ssrc := range ssrcs {
+		for _, pkt := range streams[ssrc] {
+			if !IsSilent(pkt.Opus) {
+				activity[ssrc]++
 			}
+		}
+	}
+
+	byActivity := append([]uint32(nil), ssrcs...)
+	sort.SliceStable(byActivity, func(i, j int) bool {
+		return activity[byActivity[i]] > activity[byActivity[j]]
+	})
+	keep := make(map[uint32]bool, limit)
+	for _, ssrc := range byActivity[:limit] {
+		keep[ssrc] = true
+	}
+
+	kept := make([]uint32, 0, limit)
+	for _, ssrc := range ssrcs {
+		if keep[ssrc] {
+			kept = append(kept, ssrc)
+		}
+	}
+	return kept
+}
+
+// createStreamFile encodes the packets of one voice stream in a new temporary file, and adds it to files.
+// It returns the duration of the file once decoded, from the start of the replay to the end of the last packet, minus
+// the pre-skip.
+// It fails with StreamTooLongErr, before padding the gap leading to it, if a packet ends more than maxDuration after
+// the start of the replay. Zero means no limit.
+func (c *Creator) createStreamFile(ctx context.Context, ssrc uint32, packets []streamPacket, streamStartTime time.Time, maxDuration time.Duration, files *[]string) (time.Duration, error) {
+	logger := logging.FromContext(ctx, c.logger)
+
+	f, err := tempfile.Create("*.opus")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	*files = append(*files, f.Name())
+	defer func() {
+		if err := f.Close(); err != nil {
+			logger.Warn("failed to close file", zap.Error(err))
+		}
+	}()
 
-			// Since the voice stream don't all start at the same time, we need to pad the beginning of the stream
-			// with silent data so the voices are synchronized.
-			// We pretend the last packet was at the beginning of the stream so it pads it correctly.
-			timeRelativeStartStream := pkt.Time.Sub(*streamStartTime)
-			pcmSamplesToPad := timeRelativeStartStream.Nanoseconds() * SampleRate / 1e9
+	logger.Debug("created new file for stream",
+		zap.Uint32("ssrc", ssrc),
+		zap.String("path", f.Name()),
+	)
 
-			streams[ssrc] = &streamState{
-				encoder:      encoder,
-				lastPCMIndex: int64(pkt.PCMIndex) - pcmSamplesToPad,
+	// Create an encoder for this particular file.
+	var comments []string
+	if c.mixOptions.Watermark != "" {
+		comments = append(comments, "COMMENT="+c.mixOptions.Watermark)
+	}
+	encoder, err := ogg.NewEncoder(logger, f, comments...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create ogg encoder: %w", err)
+	}
+	stream := newRepacketizer(encoder, c.mixOptions.FramesPerPacket)
+
+	// Packets are stored in the order they arrived, which can be slightly different from the order they were sent.
+	// The encoder needs them in the order of the stream.
+	sort.SliceStable(packets, func(i, j int) bool {
+		return packets[i].pcmIndex < packets[j].pcmIndex
+	})
+
+	// Since the voice stream don't all start at the same time, we need to pad the beginning of the stream
+	// with silent data so the voices are synchronized.
+	// We pretend the last packet ended at the beginning of the stream so it pads it correctly.
+	start := streamStart(packets, streamStartTime)
+	lastPCMIndex := start - FrameSize
+
+	// The granule position of a page is the number of samples from the start of the stream to the end of its packet
+	// (RFC 7845 section 4), so players can compute the duration of the file from its last page.
+	granule := func(pcmIndex int64) int64 {
+		return pcmIndex + FrameSize - start
+	}
+
+	maxSamples := maxDuration.Nanoseconds() * SampleRate / 1e9
+	for n, pkt := range packets {
+		if n%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return 0, err
 			}
-			*files = append(*files, f.Name())
 		}
 
-		stream := streams[ssrc]
+		// A packet received twice must only be encoded once.
+		if n > 0 && pkt.pcmIndex == packets[n-1].pcmIndex {
+			logger.Debug("skipping duplicated packet", zap.Uint32("ssrc", ssrc), zap.Int64("pcm_index", pkt.pcmIndex))
+			continue
+		}
+
+		if maxSamples > 0 && granule(pkt.pcmIndex) > maxSamples {
+			return 0, fmt.Errorf("%w: packet of stream %d ends after %s, at most %s expected", StreamTooLongErr, ssrc, samplesDuration(granule(pkt.pcmIndex)), maxDuration)
+		}
 
 		// OGG file readers by default skip time discontinuities.
 		// We compute the difference between the *start* of the *current* frame and the *end* of the previous frame.
 		// This will give us the number of silent packets we need to insert.
-		pcmSamplesToPad := int64(pkt.PCMIndex) - (stream.lastPCMIndex + FrameSize)
+		pcmSamplesToPad := pkt.pcmIndex - (lastPCMIndex + FrameSize)
 		packetsToPad := pcmSamplesToPad / FrameSize
 		for i := int64(0); i < packetsToPad; i++ {
-			if err := stream.encoder.Encode(silentFrame, stream.lastPCMIndex+(i+1)*FrameSize); err != nil {
-				return fmt.Errorf("failed to encode silent padding frame: %w", err)
+			if err := stream.Encode(silentFrame, granule(lastPCMIndex+(i+1)*FrameSize)); err != nil {
+				return 0, fmt.Errorf("failed to encode silent padding frame: %w", err)
 			}
 		}
 
+		// DTX packets are replaced by a silent frame, so they last exactly one frame like every other packet.
+		data := pkt.Opus
+		if isDTX(data) {
+			data = silentFrame
+		}
+
 		// Now we can encode the actual opus data.
-		if err := stream.encoder.Encode(pkt.Opus, int64(pkt.PCMIndex)); err != nil {
-			return fmt.Errorf("failed to encode opus data: %w", err)
+		if err := stream.Encode(data, granule(pkt.pcmIndex)); err != nil {
+			return 0, fmt.Errorf("failed to encode opus data: %w", err)
 		}
 
-		streams[ssrc].lastPCMIndex = int64(pkt.PCMIndex)
+		lastPCMIndex = pkt.pcmIndex
 	}
-	return nil
+
+	if err := stream.Flush(); err != nil {
+		return 0, fmt.Errorf("failed to encode opus data: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return 0, fmt.Errorf("failed to end ogg stream: %w", err)
+	}
+
+	// Players drop the pre-skip from the start of the decoded audio (RFC 7845 section 4.2), ffmpeg included: the file
+	// plays that much shorter than its granule position.
+	duration := samplesDuration(granule(lastPCMIndex) - ogg.PreSkip)
+	if duration < 0 {
+		duration = 0
+	}
+	logger.Debug("encoded stream",
+		zap.Uint32("ssrc", ssrc),
+		zap.Int64("bytes", encoder.BytesWritten()),
+		zap.Duration("duration", duration),
+	)
+	return duration, nil
+}
+
+// mixFiles mixes the stream files into path, see mixArgs.
+func (c *Creator) mixFiles(ctx context.Context, path string, files []string, opts MixOptions, window, length time.Duration, weights []float64) error {
+	_, err := c.runFFmpeg(ctx, mixArgs(path, files, opts, window, length, weights))
+	return err
 }
 
-func (c *Creator) mixFiles(ctx context.Context, path string, files []string) error {
+// mixArgs returns the arguments of ffmpeg mixing the stream files into output, a path or "pipe:1" for its stdout.
+// weights is the weight of each file, in order, nil if they all have the same weight. window is how far back the replay
+// goes, written in the metadata with the other capture parameters.
+func mixArgs(output string, files []string, opts MixOptions, window, length time.Duration, weights []float64) []string {
 	var args []string
 	args = append(args, "-y") // Overwrite output file.
 
@@ -162,17 +552,109 @@ func (c *Creator) mixFiles(ctx context.Context, path string, files []string) err
 	}
 
 	// Mix files together.
-	args = append(args, "-filter_complex", fmt.Sprintf("amix=inputs=%d:duration=longest", len(files)))
+	args = append(args, "-filter_complex", filterGraph(len(files), opts, length, weights))
 
-	// Output path.
-	args = append(args, path)
-	if err := exec.CommandContext(ctx, "ffmpeg", args...).Run(); err != nil {
-		return fmt.Errorf("ffmpeg errored: %w", err)
+	// The mix is encoded again, in opus rather than in vorbis, the default of ogg.
+	if opts.Application == "" {
+		opts.Application = OpusApplicationVoIP
 	}
-	return nil
+	args = append(args, "-c:a", "libopus", "-application", string(opts.Application))
+	if opts.Bitrate > 0 {
+		args = append(args, "-b:a", strconv.Itoa(opts.Bitrate))
+	}
+	if opts.Multitrack && multitrack(len(files), length) {
+		// Without it, the channels are laid out as surround sound, e.g. one of them is the low frequencies only (LFE).
+		// With it, each channel is encoded on its own and players know nothing of their positions.
+		args = append(args, "-mapping_family", "255")
+	}
+
+	// The temporary files do not have the extension of the container, it is given explicitly.
+	if opts.Container == "" {
+		opts.Container = ContainerOgg
+	}
+	args = append(args, "-f", string(opts.Container))
+
+	for _, comment := range captureParameters(opts, window).Comments() {
+		args = append(args, "-metadata", comment)
+	}
+	if opts.Watermark != "" {
+		args = append(args, "-metadata", "comment="+opts.Watermark)
+	}
+
+	args = append(args, output)
+	return args
+}
+
+// samplesDuration returns the duration of the given number of samples.
+func samplesDuration(samples int64) time.Duration {
+	return time.Duration(samples * 1e9 / SampleRate)
+}
+
+// streamStart returns the PCM index the stream had at streamStartTime, the start of the replay. The packets must be
+// sorted by PCM index.
+//
+// The PCM index of a packet is its media time, set by the sender, while its time is when it was received. The time a
+// packet takes to arrive varies (jitter): aligning each stream on the time its first packet was received would shift
+// the whole stream by the delay of that single packet, and speakers heard by several people would echo.
+// Jitter only ever delays packets, so the packet received the earliest relative to its PCM index is the one delayed the
+// least: the stream is aligned on it.
+//
+// The stream cannot start before its first packet: if it would, the first packet starts the replay instead.
+func streamStart(packets []streamPacket, streamStartTime time.Time) int64 {
+	var start int64
+	for n, pkt := range packets {
+		// PCM index at streamStartTime, if this packet was the least delayed.
+		s := pkt.pcmIndex - pkt.Time.Sub(streamStartTime).Nanoseconds()*SampleRate/1e9
+		if n == 0 || s > start {
+			start = s
+		}
+	}
+	if start > packets[0].pcmIndex {
+		return packets[0].pcmIndex
+	}
+	return start
 }
 
-type streamState struct {
-	encoder      *ogg.Encoder
-	lastPCMIndex int64
+// isDTX returns whether the opus packet is a DTX (discontinuous transmission) packet, sent instead of audio during
+// silence so the decoder generates comfort noise.
+//
+// The first byte of an opus packet is the TOC byte, describing how the frames that follow are encoded (RFC 6716,
+// section 3.1). A DTX packet has no frame data: it is at most 2 bytes long, the TOC byte and possibly a frame count
+// or length byte set to zero. Such a packet decodes to the duration given by its TOC byte, which can be different from
+// the 20ms of the other packets and would shift the rest of the stream. Packets carrying audio are longer.
+func isDTX(opus []byte) bool {
+	return len(opus) <= 2
+}
+
+// IsSilent returns whether the opus packet carries no audio: it is a DTX packet or a silent frame.
+func IsSilent(opus []byte) bool {
+	return isDTX(opus) || bytes.Equal(opus, silentFrame)
+}
+
+// streamPacket is a packet of a voice stream along with its unwrapped PCM index.
+type streamPacket struct {
+	*circular.AudioPacket
+	pcmIndex int64
+}
+
+// pcmIndexUnwrapper converts the PCM indexes of a voice stream, which are 32 bits and wrap around after ~24 hours, into
+// 64 bits indexes that keep increasing across the wraparound.
+type pcmIndexUnwrapper struct {
+	initialized bool
+	last        int64
+}
+
+// Unwrap returns the unwrapped PCM index of the next packet of the stream.
+// The packets do not need to be in order, as long as they are less than half the 32 bits range apart.
+func (u *pcmIndexUnwrapper) Unwrap(pcmIndex uint32) int64 {
+	if !u.initialized {
+		u.initialized = true
+		u.last = int64(pcmIndex)
+		return u.last
+	}
+
+	// The difference is computed modulo 2^32 and interpreted as signed, so a small jump across the boundary stays
+	// a small jump instead of a ~4 billion samples one.
+	u.last += int64(int32(pcmIndex - uint32(u.last)))
+	return u.last
 }
@@ -0,0 +1,1048 @@
+package replayfile
+
+import (
+	"bigbro2/bot/circular"
+	"bigbro2/bot/logging"
+	"bigbro2/bot/ogg"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+var testNow = time.Unix(1_000_000, 0)
+
+func newTestCreator() *Creator {
+	return NewCreator(zap.NewNop(), func() time.Time { return testNow }, MixOptions{})
+}
+
+// decoded returns how long a stream file whose granule position covers d plays for, once the pre-skip is dropped.
+func decoded(d time.Duration) time.Duration {
+	d -= samplesDuration(ogg.PreSkip)
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// oggPage is the part of an OGG page the tests care about.
+type oggPage struct {
+	GranulePosition int64
+	LastPage        bool
+	Data            []byte
+}
+
+// readOggPages parses the OGG pages of a file written by the encoder.
+func readOggPages(t *testing.T, path string) []oggPage {
+	t.Helper()
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return parseOggPages(t, b)
+}
+
+// parseOggPages parses OGG pages written by the encoder.
+func parseOggPages(t *testing.T, b []byte) []oggPage {
+	t.Helper()
+
+	var pages []oggPage
+	for len(b) > 0 {
+		require.GreaterOrEqual(t, len(b), 27, "truncated page header")
+		require.Equal(t, "OggS", string(b[0:4]))
+
+		granulePosition := int64(binary.LittleEndian.Uint64(b[6:14]))
+		segmentCount := int(b[26])
+		segmentTable := b[27 : 27+segmentCount]
+
+		var dataLength int
+		for _, l := range segmentTable {
+			dataLength += int(l)
+		}
+
+		start := 27 + segmentCount
+		pages = append(pages, oggPage{
+			GranulePosition: granulePosition,
+			LastPage:        b[5]&0x04 != 0,
+			Data:            b[start : start+dataLength],
+		})
+		b = b[start+dataLength:]
+	}
+	return pages
+}
+
+// createStreamFiles runs createStreamFiles on the packets and returns the files created.
+func createStreamFiles(t *testing.T, c *Creator, packets []circular.AudioPacket, recordingDuration time.Duration) []string {
+	t.Helper()
+	return createStreamFilesWithContext(t, context.Background(), c, packets, recordingDuration)
+}
+
+func createStreamFilesWithContext(t *testing.T, ctx context.Context, c *Creator, packets []circular.AudioPacket, recordingDuration time.Duration) []string {
+	t.Helper()
+
+	var b circular.Buffer
+	for _, pkt := range packets {
+		b.Add(pkt.Time, discordgo.Packet{SSRC: pkt.SSRC, Timestamp: pkt.PCMIndex, Opus: pkt.Opus})
+	}
+
+	var files []string
+	t.Cleanup(func() {
+		for _, f := range files {
+			_ = os.Remove(f)
+		}
+	})
+
+	err := circular.Since(context.Background(), &b, c.now(), recordingDuration, func(iterator circular.Iterator, window circular.Window) error {
+		_, _, _, err := c.createStreamFiles(ctx, iterator, &files, window, time.Time{}, nil, c.mixOptions.MaxStreams)
+		return err
+	})
+	require.NoError(t, err)
+	return files
+}
+
+// dataGranules returns the granule positions of the audio pages, skipping the two header pages.
+func dataGranules(t *testing.T, path string) []int64 {
+	t.Helper()
+
+	pages := readOggPages(t, path)
+	require.GreaterOrEqual(t, len(pages), 2)
+
+	var granules []int64
+	for _, p := range pages[2:] {
+		granules = append(granules, p.GranulePosition)
+	}
+	return granules
+}
+
+func TestCreator_createStreamFiles_outOfOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		pcmIndexes []uint32
+		expected   []int64
+	}{
+		{
+			name:       "in order",
+			pcmIndexes: []uint32{0, 960, 1920, 2880},
+			expected:   []int64{960, 1920, 2880, 3840},
+		},
+		{
+			name:       "swapped packets",
+			pcmIndexes: []uint32{0, 1920, 960, 2880},
+			expected:   []int64{960, 1920, 2880, 3840},
+		},
+		{
+			name:       "late packet after a gap",
+			pcmIndexes: []uint32{0, 2880, 960},
+			expected:   []int64{960, 1920, 2880, 3840}, // 2880 is silence padding.
+		},
+		{
+			name:       "wraparound",
+			pcmIndexes: []uint32{math.MaxUint32 - 1919, math.MaxUint32 - 959, 0, 960},
+			expected:   []int64{960, 1920, 2880, 3840},
+		},
+		{
+			name:       "out of order wraparound",
+			pcmIndexes: []uint32{math.MaxUint32 - 959, 0, math.MaxUint32 - 1919, 960},
+			expected:   []int64{960, 1920, 2880, 3840},
+		},
+		{
+			name:       "duplicated packet",
+			pcmIndexes: []uint32{0, 960, 960, 1920},
+			expected:   []int64{960, 1920, 2880},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var packets []circular.AudioPacket
+			for _, pcmIndex := range tt.pcmIndexes {
+				packets = append(packets, circular.AudioPacket{
+					Time:     testNow.Add(-time.Second),
+					SSRC:     1,
+					PCMIndex: pcmIndex,
+					Opus:     []byte{0x01},
+				})
+			}
+
+			files := createStreamFiles(t, newTestCreator(), packets, 10*time.Second)
+			require.Len(t, files, 1)
+			assert.Equal(t, tt.expected, dataGranules(t, files[0]))
+		})
+	}
+}
+
+func TestPcmIndexUnwrapper(t *testing.T) {
+	tests := []struct {
+		name       string
+		pcmIndexes []uint32
+		expected   []int64
+	}{
+		{
+			name:       "no wraparound",
+			pcmIndexes: []uint32{1000, 1960, 2920},
+			expected:   []int64{1000, 1960, 2920},
+		},
+		{
+			name:       "wraparound",
+			pcmIndexes: []uint32{math.MaxUint32 - 959, 0, 960},
+			expected:   []int64{math.MaxUint32 - 959, math.MaxUint32 + 1, math.MaxUint32 + 961},
+		},
+		{
+			name:       "late packet from before the wraparound",
+			pcmIndexes: []uint32{0, math.MaxUint32 - 959, 960},
+			expected:   []int64{0, -960, 960},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var u pcmIndexUnwrapper
+
+			var got []int64
+			for _, pcmIndex := range tt.pcmIndexes {
+				got = append(got, u.Unwrap(pcmIndex))
+			}
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestCreator_createStreamFiles_requestID(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	ctx := logging.WithLogger(context.Background(), zap.New(core).With(zap.String("request_id", "abc")))
+
+	packets := []circular.AudioPacket{
+		{Time: testNow.Add(-time.Second), SSRC: 1, PCMIndex: 0, Opus: []byte{0x01}},
+		{Time: testNow.Add(-time.Second), SSRC: 2, PCMIndex: 0, Opus: []byte{0x01}},
+	}
+	createStreamFilesWithContext(t, ctx, newTestCreator(), packets, 10*time.Second)
+
+	require.NotZero(t, logs.Len())
+	for _, entry := range logs.All() {
+		assert.Equal(t, "abc", entry.ContextMap()["request_id"], "log %q has no request ID", entry.Message)
+	}
+}
+
+// cancellingIterator returns an endless stream of packets and cancels the context after cancelAfter packets.
+type cancellingIterator struct {
+	cancel      context.CancelFunc
+	cancelAfter int
+	consumed    int
+}
+
+func (i *cancellingIterator) HasNext() bool {
+	return true
+}
+
+func (i *cancellingIterator) Next() *circular.AudioPacket {
+	i.consumed++
+	if i.consumed == i.cancelAfter {
+		i.cancel()
+	}
+	return &circular.AudioPacket{
+		Time:     testNow.Add(-time.Second),
+		SSRC:     1,
+		PCMIndex: uint32(i.consumed * FrameSize),
+		Opus:     []byte{0x01},
+	}
+}
+
+func (i *cancellingIterator) Reset() {
+	i.consumed = 0
+}
+
+func TestCreator_createStreamFiles_cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	iterator := &cancellingIterator{cancel: cancel, cancelAfter: 5000}
+
+	var files []string
+	ssrcs, _, _, err := newTestCreator().createStreamFiles(ctx, iterator, &files, circular.Window{Start: testNow.Add(-10 * time.Second)}, time.Time{}, nil, 0)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Nil(t, ssrcs)
+	assert.Empty(t, files)
+	assert.LessOrEqual(t, iterator.consumed, iterator.cancelAfter+ctxCheckInterval)
+}
+
+// endlessStore is a store whose iterator is a cancellingIterator.
+type endlessStore struct {
+	circular.Buffer
+	iterator *cancellingIterator
+}
+
+func (s *endlessStore) WithIterator(cb func(iterator circular.Iterator) error) error {
+	return cb(s.iterator)
+}
+
+func (s *endlessStore) Stats() circular.Stats {
+	return circular.Stats{Packets: 1, Oldest: testNow.Add(-time.Minute)}
+}
+
+func TestCreator_Create_cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := &endlessStore{iterator: &cancellingIterator{cancel: cancel, cancelAfter: 5000}}
+	c := newTestCreator()
+	c.ffmpeg = fakeFFmpeg(t, `exit 1`)
+
+	_, err := c.Create(ctx, store, filepath.Join(t.TempDir(), "replay.ogg"), 10*time.Second, Options{})
+	assert.ErrorIs(t, err, context.Canceled)
+	// The copy of the packets is abandoned soon after the request is.
+	assert.LessOrEqual(t, store.iterator.consumed, store.iterator.cancelAfter+1024)
+}
+
+func TestCreator_createStreamFiles_order(t *testing.T) {
+	start := testNow.Add(-5 * time.Second)
+	packets := []circular.AudioPacket{
+		{Time: start, SSRC: 3, PCMIndex: 0, Opus: []byte{0x01, 0x02, 0x03}},
+		{Time: start, SSRC: 1, PCMIndex: 0, Opus: []byte{0x01, 0x02, 0x03}},
+		{Time: start.Add(200 * time.Millisecond), SSRC: 3, PCMIndex: 10 * FrameSize, Opus: []byte{0x01, 0x02, 0x03}},
+		{Time: start.Add(400 * time.Millisecond), SSRC: 2, PCMIndex: 0, Opus: []byte{0x01, 0x02, 0x03}},
+		{Time: start.Add(400 * time.Millisecond), SSRC: 1, PCMIndex: 20 * FrameSize, Opus: []byte{0x01, 0x02, 0x03}},
+	}
+
+	var b circular.Buffer
+	for _, pkt := range packets {
+		b.Add(pkt.Time, discordgo.Packet{SSRC: pkt.SSRC, Timestamp: pkt.PCMIndex, Opus: pkt.Opus})
+	}
+
+	// The order does not depend on the run.
+	for run := 0; run < 3; run++ {
+		var files []string
+		err := circular.Since(context.Background(), &b, testNow, 10*time.Second, func(iterator circular.Iterator, window circular.Window) error {
+			ssrcs, durations, _, err := newTestCreator().createStreamFiles(context.Background(), iterator, &files, window, time.Time{}, nil, 0)
+			assert.Equal(t, []uint32{1, 3, 2}, ssrcs)
+			// Each stream lasts from the start of the replay to the end of its last packet, once decoded.
+			assert.Equal(t, []time.Duration{decoded(420 * time.Millisecond), decoded(220 * time.Millisecond), decoded(420 * time.Millisecond)}, durations)
+			return err
+		})
+		for _, f := range files {
+			require.NoError(t, os.Remove(f))
+		}
+		require.NoError(t, err)
+		assert.Len(t, files, 3)
+	}
+}
+
+func TestCreator_createStreamFiles_departures(t *testing.T) {
+	start := testNow.Add(-5 * time.Second)
+	leftAt := start.Add(time.Second)
+	var b circular.Buffer
+	for n := 0; n < 4; n++ {
+		at := start.Add(time.Duration(n) * 500 * time.Millisecond)
+		pcmIndex := uint32(n * 25 * FrameSize)
+		// Still in the channel.
+		b.Add(at, discordgo.Packet{SSRC: 1, Timestamp: pcmIndex, Opus: []byte{0x01, 0x01, byte(n)}})
+		// Left halfway through.
+		b.Add(at, discordgo.Packet{SSRC: 2, Timestamp: pcmIndex, Opus: []byte{0x01, 0x02, byte(n)}})
+	}
+	// Left before it was heard.
+	b.Add(start.Add(1500*time.Millisecond), discordgo.Packet{SSRC: 3, Opus: []byte{0x01, 0x03, 0x00}})
+
+	var files []string
+	defer func() {
+		for _, f := range files {
+			require.NoError(t, os.Remove(f))
+		}
+	}()
+	departures := map[uint32]time.Time{2: leftAt, 3: leftAt}
+	err := circular.Since(context.Background(), &b, testNow, 10*time.Second, func(iterator circular.Iterator, window circular.Window) error {
+		ssrcs, durations, _, err := newTestCreator().createStreamFiles(context.Background(), iterator, &files, window, time.Time{}, departures, 0)
+		assert.Equal(t, []uint32{1, 2}, ssrcs)
+		assert.Equal(t, []time.Duration{decoded(1500*time.Millisecond + FrameLengthNs), decoded(time.Second + FrameLengthNs)}, durations)
+		return err
+	})
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	kept, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	left, err := os.ReadFile(files[1])
+	require.NoError(t, err)
+	for n := 0; n < 4; n++ {
+		assert.Contains(t, string(kept), string([]byte{0x01, 0x01, byte(n)}))
+	}
+	// The packet received when the user left is still theirs.
+	for n := 0; n < 3; n++ {
+		assert.Contains(t, string(left), string([]byte{0x01, 0x02, byte(n)}))
+	}
+	assert.NotContains(t, string(left), string([]byte{0x01, 0x02, 0x03}))
+}
+
+func TestCreator_createStreamFiles_lateStart(t *testing.T) {
+	start := testNow.Add(-5 * time.Second)
+	packets := []circular.AudioPacket{
+		{Time: start, SSRC: 1, PCMIndex: 5 * FrameSize, Opus: []byte{0x01}},
+		{Time: start.Add(40 * time.Millisecond), SSRC: 2, PCMIndex: 0, Opus: []byte{0x01}},
+	}
+
+	files := createStreamFiles(t, newTestCreator(), packets, 10*time.Second)
+	require.Len(t, files, 2)
+
+	// The second stream starts two frames after the first one: it is padded with two silent frames.
+	assert.Equal(t, []int64{FrameSize}, dataGranules(t, files[0]))
+	assert.Equal(t, []int64{FrameSize, 2 * FrameSize, 3 * FrameSize}, dataGranules(t, files[1]))
+}
+
+func TestCreator_createStreamFiles_jitter(t *testing.T) {
+	start := testNow.Add(-5 * time.Second)
+	// Both people start speaking at the same time, the first packet of the second one is received 50ms late.
+	delays := map[uint32][]time.Duration{
+		1: {0, 0, 0, 0, 0},
+		2: {50 * time.Millisecond, 30 * time.Millisecond, 10 * time.Millisecond, 0, 5 * time.Millisecond},
+	}
+
+	var packets []circular.AudioPacket
+	for n := 0; n < 5; n++ {
+		for _, ssrc := range []uint32{1, 2} {
+			packets = append(packets, circular.AudioPacket{
+				Time:     start.Add(time.Duration(n)*FrameLengthNs + delays[ssrc][n]),
+				SSRC:     ssrc,
+				PCMIndex: uint32(int(ssrc)*100_000 + n*FrameSize),
+				Opus:     []byte{0x78, 0x01},
+			})
+		}
+	}
+	sort.SliceStable(packets, func(i, j int) bool { return packets[i].Time.Before(packets[j].Time) })
+
+	files := createStreamFiles(t, newTestCreator(), packets, 10*time.Second)
+	require.Len(t, files, 2)
+
+	// The streams are aligned on the packets received without delay: the second one is not padded.
+	expected := []int64{FrameSize, 2 * FrameSize, 3 * FrameSize, 4 * FrameSize, 5 * FrameSize}
+	assert.Equal(t, expected, dataGranules(t, files[0]))
+	assert.Equal(t, expected, dataGranules(t, files[1]))
+}
+
+func TestCreator_createStreamFiles_joinedAt(t *testing.T) {
+	joined := testNow.Add(-5 * time.Second)
+	// Five packets of a stream starting at the given time after the bot joined.
+	stream := func(ssrc uint32, after time.Duration) []circular.AudioPacket {
+		var packets []circular.AudioPacket
+		for n := 0; n < 5; n++ {
+			packets = append(packets, circular.AudioPacket{
+				Time:     joined.Add(after + time.Duration(n)*FrameLengthNs),
+				SSRC:     ssrc,
+				PCMIndex: uint32(int(ssrc)*100_000 + n*FrameSize),
+				Opus:     []byte{0x78, 0x01},
+			})
+		}
+		return packets
+	}
+	first := stream(1, 100*time.Millisecond)
+	second := stream(2, 500*time.Millisecond)
+	both := append(append([]circular.AudioPacket{}, first...), second...)
+
+	tests := []struct {
+		name     string
+		packets  []circular.AudioPacket
+		joinedAt time.Time
+		expected []time.Duration
+	}{
+		{name: "both streams", packets: both, joinedAt: joined, expected: []time.Duration{decoded(200 * time.Millisecond), decoded(600 * time.Millisecond)}},
+		// The second stream is placed the same way whether or not someone spoke before.
+		{name: "second stream only", packets: second, joinedAt: joined, expected: []time.Duration{decoded(600 * time.Millisecond)}},
+		{name: "unknown join", packets: both, expected: []time.Duration{decoded(100 * time.Millisecond), decoded(500 * time.Millisecond)}},
+		{name: "unknown join, second stream only", packets: second, expected: []time.Duration{decoded(100 * time.Millisecond)}},
+		{
+			name:     "joined before the replay",
+			packets:  both,
+			joinedAt: testNow.Add(-time.Minute),
+			expected: []time.Duration{decoded(100 * time.Millisecond), decoded(500 * time.Millisecond)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b circular.Buffer
+			for _, pkt := range tt.packets {
+				b.Add(pkt.Time, discordgo.Packet{SSRC: pkt.SSRC, Timestamp: pkt.PCMIndex, Opus: pkt.Opus})
+			}
+
+			var files []string
+			t.Cleanup(func() {
+				for _, f := range files {
+					_ = os.Remove(f)
+				}
+			})
+			err := circular.Since(context.Background(), &b, testNow, 10*time.Second, func(iterator circular.Iterator, window circular.Window) error {
+				_, durations, _, err := newTestCreator().createStreamFiles(context.Background(), iterator, &files, window, tt.joinedAt, nil, 0)
+				assert.Equal(t, tt.expected, durations)
+				return err
+			})
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestSelectStreams(t *testing.T) {
+	// Number of packets of each stream with audio, and of silent ones.
+	stream := func(audio, silent int) []streamPacket {
+		var packets []streamPacket
+		for n := 0; n < audio; n++ {
+			packets = append(packets, streamPacket{AudioPacket: &circular.AudioPacket{Opus: []byte{0x78, 0x01, 0x02}}})
+		}
+		for n := 0; n < silent; n++ {
+			packets = append(packets, streamPacket{AudioPacket: &circular.AudioPacket{Opus: silentFrame}})
+		}
+		return packets
+	}
+	streams := map[uint32][]streamPacket{
+		1: stream(10, 0),
+		2: stream(2, 50), // Long but mostly silent.
+		3: stream(30, 0),
+		4: stream(10, 5),
+	}
+
+	tests := []struct {
+		name     string
+		ssrcs    []uint32
+		limit    int
+		expected []uint32
+	}{
+		{name: "most active kept in order", ssrcs: []uint32{1, 2, 3, 4}, limit: 2, expected: []uint32{1, 3}},
+		{name: "first kept when as active", ssrcs: []uint32{4, 2, 1, 3}, limit: 2, expected: []uint32{4, 3}},
+		{name: "single", ssrcs: []uint32{1, 2, 3, 4}, limit: 1, expected: []uint32{3}},
+		{name: "all", ssrcs: []uint32{1, 2, 3, 4}, limit: 4, expected: []uint32{1, 2, 3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, selectStreams(tt.ssrcs, streams, tt.limit))
+		})
+	}
+}
+
+func TestCreator_createStreamFiles_maxStreams(t *testing.T) {
+	start := testNow.Add(-5 * time.Second)
+	var packets []circular.AudioPacket
+	// Stream n speaks for n frames.
+	for n := 0; n < 5; n++ {
+		for ssrc := uint32(1); ssrc <= 4; ssrc++ {
+			opus := []byte{0x78, 0x01, 0x02}
+			if n >= int(ssrc) {
+				opus = silentFrame
+			}
+			packets = append(packets, circular.AudioPacket{
+				Time:     start.Add(time.Duration(n) * FrameLengthNs),
+				SSRC:     ssrc,
+				PCMIndex: uint32(n * FrameSize),
+				Opus:     opus,
+			})
+		}
+	}
+
+	var b circular.Buffer
+	for _, pkt := range packets {
+		b.Add(pkt.Time, discordgo.Packet{SSRC: pkt.SSRC, Timestamp: pkt.PCMIndex, Opus: pkt.Opus})
+	}
+
+	c := newTestCreator()
+	c.mixOptions.MaxStreams = 2
+	var files []string
+	t.Cleanup(func() {
+		for _, f := range files {
+			_ = os.Remove(f)
+		}
+	})
+	err := circular.Since(context.Background(), &b, testNow, 10*time.Second, func(iterator circular.Iterator, window circular.Window) error {
+		ssrcs, durations, dropped, err := c.createStreamFiles(context.Background(), iterator, &files, window, time.Time{}, nil, 2)
+		assert.Equal(t, []uint32{3, 4}, ssrcs)
+		assert.Len(t, durations, 2)
+		assert.Equal(t, 2, dropped)
+		return err
+	})
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+}
+
+func TestStreamStart(t *testing.T) {
+	start := testNow
+	tests := []struct {
+		name     string
+		times    []time.Duration // Time each packet is received after start, they are one frame apart.
+		expected int64
+	}{
+		{name: "no jitter", times: []time.Duration{40 * time.Millisecond, 60 * time.Millisecond}, expected: 1000 - 2*FrameSize},
+		{name: "first packet late", times: []time.Duration{55 * time.Millisecond, 60 * time.Millisecond}, expected: 1000 - 2*FrameSize},
+		{name: "last packet late", times: []time.Duration{40 * time.Millisecond, 75 * time.Millisecond}, expected: 1000 - 2*FrameSize},
+		{name: "before the start of the replay", times: []time.Duration{0, 5 * time.Millisecond}, expected: 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var packets []streamPacket
+			for n, d := range tt.times {
+				packets = append(packets, streamPacket{
+					AudioPacket: &circular.AudioPacket{Time: start.Add(d)},
+					pcmIndex:    1000 + int64(n)*FrameSize,
+				})
+			}
+			assert.Equal(t, tt.expected, streamStart(packets, start))
+		})
+	}
+}
+
+func TestCreator_prepareMix_fadeOut(t *testing.T) {
+	start := testNow.Add(-5 * time.Second)
+	var packets []circular.AudioPacket
+	for n := 0; n < 50; n++ {
+		packets = append(packets, circular.AudioPacket{
+			Time:     start.Add(time.Duration(n) * FrameLengthNs),
+			SSRC:     1,
+			PCMIndex: uint32(n * FrameSize),
+			Opus:     []byte{0x78, 0x01},
+		})
+	}
+
+	var b circular.Buffer
+	for _, pkt := range packets {
+		b.Add(pkt.Time, discordgo.Packet{SSRC: pkt.SSRC, Timestamp: pkt.PCMIndex, Opus: pkt.Opus})
+	}
+	var files []string
+	t.Cleanup(func() {
+		for _, f := range files {
+			_ = os.Remove(f)
+		}
+	})
+	var durations []time.Duration
+	err := circular.Since(context.Background(), &b, testNow, 10*time.Second, func(iterator circular.Iterator, window circular.Window) error {
+		var err error
+		_, durations, _, err = newTestCreator().createStreamFiles(context.Background(), iterator, &files, window, time.Time{}, nil, 0)
+		return err
+	})
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	pages := readOggPages(t, files[0])
+	played := samplesDuration(pages[len(pages)-1].GranulePosition - ogg.PreSkip)
+
+	// The fade-out ends with the decoded audio, not after it where it would never be heard.
+	length := mixLength(durations, MixDurationLongest)
+	assert.Equal(t, played, length)
+	fade := 200 * time.Millisecond
+	assert.Contains(t, fadeFilters(fade, length), fmt.Sprintf("afade=t=out:st=%.3f:d=%.3f", (played-fade).Seconds(), fade.Seconds()))
+}
+
+func TestCreator_createStreamFiles_duration(t *testing.T) {
+	start := testNow.Add(-5 * time.Second)
+	var packets []circular.AudioPacket
+	// The first speaker talks for one second, the second one starts 200ms later and stops at the same time.
+	for n := 0; n < 50; n++ {
+		packets = append(packets, circular.AudioPacket{
+			Time:     start.Add(time.Duration(n) * FrameLengthNs),
+			SSRC:     1,
+			PCMIndex: uint32(1000 + n*FrameSize),
+			Opus:     []byte{0x78, 0x01},
+		})
+		if n >= 10 {
+			packets = append(packets, circular.AudioPacket{
+				Time:     start.Add(time.Duration(n) * FrameLengthNs),
+				SSRC:     2,
+				PCMIndex: uint32(5000 + n*FrameSize),
+				Opus:     []byte{0x78, 0x01},
+			})
+		}
+	}
+
+	for _, framesPerPacket := range []int{1, 3} {
+		t.Run(fmt.Sprintf("%d frames per packet", framesPerPacket), func(t *testing.T) {
+			c := NewCreator(zap.NewNop(), func() time.Time { return testNow }, MixOptions{FramesPerPacket: framesPerPacket})
+			files := createStreamFiles(t, c, packets, 10*time.Second)
+			require.Len(t, files, 2)
+
+			for _, file := range files {
+				pages := readOggPages(t, file)
+				last := pages[len(pages)-1]
+				assert.True(t, last.LastPage, "the last page does not end the stream")
+				for _, p := range pages[:len(pages)-1] {
+					assert.False(t, p.LastPage)
+				}
+
+				// The granule position of the last page counts the pre-skip, which players drop from the start of the
+				// decoded audio (RFC 7845 section 4).
+				assert.Equal(t, int64(SampleRate), last.GranulePosition)
+				assert.Equal(t, 920*time.Millisecond, samplesDuration(last.GranulePosition-ogg.PreSkip))
+			}
+		})
+	}
+}
+
+func TestCreator_createStreamFiles_watermark(t *testing.T) {
+	packets := []circular.AudioPacket{{Time: testNow.Add(-time.Second), SSRC: 1, Opus: []byte{0x01}}}
+
+	c := NewCreator(zap.NewNop(), func() time.Time { return testNow }, MixOptions{Watermark: "recorded by BigBro"})
+	files := createStreamFiles(t, c, packets, 10*time.Second)
+	require.Len(t, files, 1)
+
+	pages := readOggPages(t, files[0])
+	require.GreaterOrEqual(t, len(pages), 2)
+	assert.Contains(t, string(pages[1].Data), "COMMENT=recorded by BigBro")
+}
+
+func TestCreator_Create_result(t *testing.T) {
+	tests := []struct {
+		name              string
+		oldest            time.Duration // Age of the oldest packet of the buffer.
+		expectedTruncated bool
+		expectedAvailable time.Duration
+	}{
+		{name: "full buffer", oldest: 20 * time.Second, expectedAvailable: 10 * time.Second},
+		{name: "truncated buffer", oldest: 4 * time.Second, expectedTruncated: true, expectedAvailable: 4 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b circular.Buffer
+			for _, ssrc := range []uint32{1, 2} {
+				b.Add(testNow.Add(-tt.oldest), discordgo.Packet{SSRC: ssrc, Opus: []byte{0x01}})
+				b.Add(testNow.Add(-time.Second), discordgo.Packet{SSRC: ssrc, Timestamp: FrameSize, Opus: []byte{0x01}})
+			}
+
+			c := newTestCreator()
+			c.ffmpeg = fakeFFmpeg(t, `for last; do :; done; printf 'OggS1234' > "$last"`)
+
+			result, err := c.Create(context.Background(), &b, filepath.Join(t.TempDir(), "out.ogg"), 10*time.Second, Options{})
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expectedTruncated, result.Truncated)
+			assert.Equal(t, tt.expectedAvailable, result.AvailableDuration)
+			assert.Equal(t, 2, result.Speakers)
+			assert.Equal(t, int64(8), result.FileSize)
+		})
+	}
+}
+
+func TestCreator_Create_ssrcs(t *testing.T) {
+	tests := []struct {
+		name          string
+		ssrcs         []uint32
+		expectedSSRCs []uint32
+		expectedErr   error
+	}{
+		{name: "every stream", ssrcs: nil, expectedSSRCs: []uint32{1, 2}},
+		{name: "one stream", ssrcs: []uint32{2}, expectedSSRCs: []uint32{2}},
+		{name: "no stream", ssrcs: []uint32{}, expectedErr: NoAudioDataErr},
+		{name: "stream not heard", ssrcs: []uint32{3}, expectedErr: NoAudioDataErr},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b circular.Buffer
+			for _, ssrc := range []uint32{1, 2} {
+				b.Add(testNow.Add(-2*time.Second), discordgo.Packet{SSRC: ssrc, Opus: []byte{0x78, 0x01, 0x02}})
+				b.Add(testNow.Add(-time.Second), discordgo.Packet{SSRC: ssrc, Timestamp: FrameSize, Opus: []byte{0x78, 0x01, 0x02}})
+			}
+
+			c := newTestCreator()
+			c.ffmpeg = fakeFFmpeg(t, `for last; do :; done; printf 'OggS1234' > "$last"`)
+
+			result, err := c.Create(context.Background(), &b, filepath.Join(t.TempDir(), "out.ogg"), 10*time.Second, Options{SSRCs: tt.ssrcs})
+			if tt.expectedErr != nil {
+				assert.ErrorIs(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedSSRCs, result.SSRCs)
+		})
+	}
+}
+
+// streamTestBuffer returns an audio buffer with two voice streams, and sets the directory of the temporary files to an
+// empty directory, returned so the tests can check the stream files are removed. ffmpeg must be replaced before.
+func streamTestBuffer(t *testing.T) (*circular.Buffer, string) {
+	t.Helper()
+
+	var b circular.Buffer
+	for _, ssrc := range []uint32{1, 2} {
+		b.Add(testNow.Add(-2*time.Second), discordgo.Packet{SSRC: ssrc, Opus: []byte{0x78, 0x01, 0x02}})
+		b.Add(testNow.Add(-time.Second), discordgo.Packet{SSRC: ssrc, Timestamp: FrameSize, Opus: []byte{0x78, 0x01, 0x02}})
+	}
+
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	return &b, dir
+}
+
+func TestCreator_CreateStream(t *testing.T) {
+	c := newTestCreator()
+	// The mix is the first stream file, written to stdout as it is given "pipe:1" as output.
+	c.ffmpeg = fakeFFmpeg(t, `for last; do :; done; [ "$last" = pipe:1 ] || exit 1; cat "$3"`)
+	b, dir := streamTestBuffer(t)
+
+	output, result, err := c.CreateStream(context.Background(), b, 10*time.Second, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{1, 2}, result.SSRCs)
+	assert.Zero(t, result.FileSize)
+
+	data, err := io.ReadAll(output)
+	require.NoError(t, err)
+	require.NoError(t, output.Close())
+
+	pages := parseOggPages(t, data)
+	require.GreaterOrEqual(t, len(pages), 3)
+	assert.True(t, bytes.HasPrefix(pages[0].Data, []byte("OpusHead")))
+	assert.True(t, bytes.HasPrefix(pages[1].Data, []byte("OpusTags")))
+	assert.True(t, pages[len(pages)-1].LastPage)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "stream files are removed once the output is closed")
+}
+
+func TestCreator_CreateStream_ffmpegError(t *testing.T) {
+	c := newTestCreator()
+	c.ffmpeg = fakeFFmpeg(t, `printf 'OggS'; echo "Unknown encoder" >&2; exit 3`)
+	b, dir := streamTestBuffer(t)
+
+	output, _, err := c.CreateStream(context.Background(), b, 10*time.Second, Options{})
+	require.NoError(t, err)
+
+	data, err := io.ReadAll(output)
+	var ffmpegErr *FFmpegError
+	require.ErrorAs(t, err, &ffmpegErr)
+	assert.Equal(t, 3, ffmpegErr.ExitCode)
+	assert.Equal(t, "Unknown encoder", ffmpegErr.Stderr)
+	assert.Equal(t, []byte("OggS"), data)
+	require.NoError(t, output.Close())
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestCreator_CreateStream_closedEarly(t *testing.T) {
+	c := newTestCreator()
+	c.ffmpeg = fakeFFmpeg(t, `printf 'OggS'; exec sleep 10`)
+	b, dir := streamTestBuffer(t)
+
+	output, _, err := c.CreateStream(context.Background(), b, 10*time.Second, Options{})
+	require.NoError(t, err)
+
+	magic := make([]byte, 4)
+	_, err = io.ReadFull(output, magic)
+	require.NoError(t, err)
+
+	// ffmpeg is killed rather than waited for.
+	start := time.Now()
+	require.NoError(t, output.Close())
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// The creator is not waiting for the replay anymore.
+	require.NoError(t, c.Close())
+}
+
+func TestCreator_CreateStream_noAudio(t *testing.T) {
+	c := newTestCreator()
+	c.ffmpeg = fakeFFmpeg(t, `exit 1`)
+	b, dir := streamTestBuffer(t)
+
+	_, _, err := c.CreateStream(context.Background(), b, 10*time.Second, Options{SSRCs: []uint32{}})
+	assert.ErrorIs(t, err, NoAudioDataErr)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	require.NoError(t, c.Close())
+}
+
+func TestIsDTX(t *testing.T) {
+	tests := []struct {
+		name     string
+		opus     []byte
+		expected bool
+	}{
+		{name: "empty", opus: nil, expected: true},
+		{name: "TOC byte only", opus: []byte{0x78}, expected: true},
+		{name: "TOC byte and zero length", opus: []byte{0x79, 0x00}, expected: true},
+		{name: "silent frame", opus: silentFrame, expected: false},
+		{name: "audio", opus: []byte{0xFC, 0x12, 0x34, 0x56, 0x78}, expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, isDTX(tt.opus))
+		})
+	}
+}
+
+func TestCreator_createStreamFiles_dtx(t *testing.T) {
+	audio := []byte{0xFC, 0x12, 0x34, 0x56, 0x78}
+	dtx := []byte{0x78}
+
+	packets := []circular.AudioPacket{
+		{PCMIndex: 0, Opus: audio},
+		{PCMIndex: 960, Opus: silentFrame},
+		{PCMIndex: 1920, Opus: dtx},
+		{PCMIndex: 2880, Opus: dtx},
+		{PCMIndex: 3840, Opus: audio},
+		{PCMIndex: 6720, Opus: dtx}, // After a gap of two frames.
+		{PCMIndex: 7680, Opus: audio},
+	}
+	for n := range packets {
+		packets[n].Time = testNow.Add(-time.Second)
+		packets[n].SSRC = 1
+	}
+
+	files := createStreamFiles(t, newTestCreator(), packets, 10*time.Second)
+	require.Len(t, files, 1)
+
+	pages := readOggPages(t, files[0])[2:]
+	var granules []int64
+	var data [][]byte
+	for _, p := range pages {
+		granules = append(granules, p.GranulePosition)
+		data = append(data, p.Data)
+	}
+
+	assert.Equal(t, []int64{960, 1920, 2880, 3840, 4800, 5760, 6720, 7680, 8640}, granules)
+	assert.Equal(t, [][]byte{
+		audio,
+		silentFrame,
+		silentFrame, // DTX.
+		silentFrame, // DTX.
+		audio,
+		silentFrame, // Padding.
+		silentFrame, // Padding.
+		silentFrame, // DTX.
+		audio,
+	}, data)
+}
+
+func TestCreator_createStreamFiles_emptyPayload(t *testing.T) {
+	audio := []byte{0xFC, 0x12, 0x34, 0x56, 0x78}
+
+	// Packets without audio stored before they were dropped at ingest, interleaved with real ones.
+	packets := []circular.AudioPacket{
+		{PCMIndex: 0, Opus: audio},
+		{PCMIndex: 960, Opus: nil},
+		{PCMIndex: 1920, Opus: audio},
+		{PCMIndex: 2880, Opus: []byte{}},
+		{PCMIndex: 3840, Opus: []byte{}},
+		{PCMIndex: 4800, Opus: audio},
+	}
+	for n := range packets {
+		packets[n].Time = testNow.Add(-time.Second)
+		packets[n].SSRC = 1
+	}
+
+	files := createStreamFiles(t, newTestCreator(), packets, 10*time.Second)
+	require.Len(t, files, 1)
+
+	// Each one lasts one frame, as a silent frame rather than an empty packet.
+	pages := readOggPages(t, files[0])[2:]
+	var granules []int64
+	var data [][]byte
+	for _, p := range pages {
+		granules = append(granules, p.GranulePosition)
+		data = append(data, p.Data)
+	}
+	assert.Equal(t, []int64{960, 1920, 2880, 3840, 4800, 5760}, granules)
+	assert.Equal(t, [][]byte{audio, silentFrame, audio, silentFrame, silentFrame, audio}, data)
+}
+
+func TestCreator_createStreamFiles_tooLong(t *testing.T) {
+	audio := []byte{0xFC, 0x12, 0x34, 0x56, 0x78}
+
+	tests := []struct {
+		name    string
+		gap     int64 // Samples skipped between the second and the third packet.
+		wantErr bool
+	}{
+		{name: "lost packets", gap: 50 * FrameSize},
+		// The PCM index jumps by more than an hour, e.g. the sender reset its timestamps.
+		{name: "bad gap", gap: 200_000 * FrameSize, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b circular.Buffer
+			for n, pcmIndex := range []int64{0, FrameSize, 2*FrameSize + tt.gap} {
+				b.Add(testNow.Add(time.Duration(n-3)*time.Second), discordgo.Packet{SSRC: 1, Timestamp: uint32(pcmIndex), Opus: audio})
+			}
+
+			var files []string
+			defer func() {
+				for _, f := range files {
+					_ = os.Remove(f)
+				}
+			}()
+			err := circular.Since(context.Background(), &b, testNow, 10*time.Second, func(iterator circular.Iterator, window circular.Window) error {
+				_, _, _, err := newTestCreator().createStreamFiles(context.Background(), iterator, &files, window, time.Time{}, nil, 0)
+				return err
+			})
+			require.Len(t, files, 1)
+
+			stat, statErr := os.Stat(files[0])
+			require.NoError(t, statErr)
+			if !tt.wantErr {
+				require.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, StreamTooLongErr)
+			// The gap was not padded: the file only holds the headers and the first packets.
+			assert.Less(t, stat.Size(), int64(4096))
+		})
+	}
+}
+
+func TestCreator_Close(t *testing.T) {
+	c := newTestCreator()
+	require.NoError(t, c.Close())
+
+	_, err := c.Create(context.Background(), &circular.Buffer{}, "unused.ogg", time.Second, Options{})
+	assert.ErrorIs(t, err, CreatorClosedErr)
+
+	// Closing twice is fine.
+	assert.NoError(t, c.Close())
+}
+
+func TestCreator_Close_drains(t *testing.T) {
+	c := newTestCreator()
+
+	done, err := c.begin()
+	require.NoError(t, err)
+
+	closed := make(chan struct{})
+	go func() {
+		assert.NoError(t, c.Close())
+		close(closed)
+	}()
+
+	// Close waits for the replay being created.
+	select {
+	case <-closed:
+		require.FailNow(t, "Close returned before the replay was done")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// New replays are rejected while draining.
+	require.Eventually(t, func() bool {
+		done, err := c.begin()
+		if err == nil {
+			done()
+		}
+		return err == CreatorClosedErr
+	}, time.Second, time.Millisecond)
+
+	done()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		require.FailNow(t, "Close did not return once the replay was done")
+	}
+}
+
+func TestIsSilent(t *testing.T) {
+	assert.True(t, IsSilent(silentFrame))
+	assert.True(t, IsSilent([]byte{0x78}))
+	assert.False(t, IsSilent([]byte{0x78, 0x01, 0x02, 0x03}))
+}
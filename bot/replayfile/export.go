@@ -0,0 +1,163 @@
+package replayfile
+
+import (
+	"archive/zip"
+	"bigbro2/bot/circular"
+	"bigbro2/bot/logging"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"time"
+)
+
+// manifestName is the name of the manifest in the archive written by Creator.Export.
+const manifestName = "manifest.json"
+
+// Manifest describes the voice streams of an export.
+type Manifest struct {
+	// Start is when the export starts: the stream files are aligned on it, like the streams of a replay.
+	Start     time.Time        `json:"start"`
+	CreatedAt time.Time        `json:"created_at"`
+	Streams   []ExportedStream `json:"streams"`
+}
+
+// ExportedStream describes a voice stream of an export.
+type ExportedStream struct {
+	File        string    `json:"file"` // Name of the stream file in the archive.
+	SSRC        uint32    `json:"ssrc"`
+	UserID      string    `json:"user_id,omitempty"` // Empty if it is unknown who was speaking.
+	FirstPacket time.Time `json:"first_packet"`      // Time the first packet was received.
+	LastPacket  time.Time `json:"last_packet"`       // Time the last packet was received.
+	Packets     int       `json:"packets"`
+}
+
+// Export writes a zip archive in path containing one ogg file per voice stream of the last recordingDuration of the
+// audio buffer, and a manifest describing them. Unlike Create, the streams are not mixed: the audio is the one sent by
+// Discord, and no stream is ever left out. It returns the manifest.
+// Only the Speakers of the options are used.
+func (c *Creator) Export(ctx context.Context, audioBuffer circular.Store, path string, recordingDuration time.Duration, opts Options) (Manifest, error) {
+	done, err := c.begin()
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer done()
+
+	// Like for a replay, the audio buffer keeps receiving packets while the archive is written.
+	packets, window, err := circular.SnapshotSince(ctx, audioBuffer, c.now(), recordingDuration)
+	if err != nil {
+		return Manifest{}, err
+	}
+	return c.export(ctx, packets.Iterator(), window, path, opts)
+}
+
+func (c *Creator) export(ctx context.Context, iterator circular.Iterator, window circular.Window, path string, opts Options) (Manifest, error) {
+	logger := logging.FromContext(ctx, c.logger)
+
+	manifest := Manifest{CreatedAt: c.now()}
+	streams := exportedStreams(iterator)
+	iterator.Reset()
+
+	var files []string
+	defer func() {
+		for _, fileName := range files {
+			if err := os.Remove(fileName); err != nil {
+				logger.Warn("failed to remove file", zap.Error(err))
+			}
+		}
+	}()
+
+	ssrcs, _, _, err := c.createStreamFiles(ctx, iterator, &files, window, time.Time{}, nil, 0)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to create temporary stream files: %w", err)
+	}
+	if len(files) == 0 {
+		return Manifest{}, NoAudioDataErr
+	}
+
+	for n, ssrc := range ssrcs {
+		stream := streams[ssrc]
+		stream.File = fmt.Sprintf("stream-%d-%d.ogg", n+1, ssrc)
+		stream.UserID = opts.Speakers[ssrc]
+		manifest.Streams = append(manifest.Streams, stream)
+		if n == 0 || stream.FirstPacket.Before(manifest.Start) {
+			manifest.Start = stream.FirstPacket
+		}
+	}
+
+	if err := writeExport(path, manifest, files); err != nil {
+		return Manifest{}, fmt.Errorf("failed to write archive: %w", err)
+	}
+	return manifest, nil
+}
+
+// exportedStreams returns the voice streams of the packets of iterator, indexed by SSRC. Their file and user are not
+// set.
+func exportedStreams(iterator circular.Iterator) map[uint32]ExportedStream {
+	streams := map[uint32]ExportedStream{}
+	for iterator.HasNext() {
+		pkt := iterator.Next()
+		stream, ok := streams[pkt.SSRC]
+		if !ok {
+			stream = ExportedStream{SSRC: pkt.SSRC, FirstPacket: pkt.Time}
+		}
+		if pkt.Time.Before(stream.FirstPacket) {
+			stream.FirstPacket = pkt.Time
+		}
+		if pkt.Time.After(stream.LastPacket) {
+			stream.LastPacket = pkt.Time
+		}
+		stream.Packets++
+		streams[pkt.SSRC] = stream
+	}
+	return streams
+}
+
+// writeExport writes the archive of an export in path: the manifest, then the files of its streams, in order.
+func writeExport(path string, manifest Manifest, files []string) (err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	archive := zip.NewWriter(f)
+	w, err := archive.Create(manifestName)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	for n, stream := range manifest.Streams {
+		// The opus data does not compress.
+		w, err := archive.CreateHeader(&zip.FileHeader{Name: stream.File, Method: zip.Store, Modified: manifest.CreatedAt})
+		if err != nil {
+			return err
+		}
+		if err := copyFile(w, files[n]); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+func copyFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,92 @@
+package replayfile
+
+import (
+	"archive/zip"
+	"bigbro2/bot/circular"
+	"context"
+	"encoding/json"
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCreator_Export(t *testing.T) {
+	start := testNow.Add(-5 * time.Second)
+	var b circular.Buffer
+	// Too old to be exported.
+	b.Add(testNow.Add(-time.Minute), discordgo.Packet{SSRC: 1, Opus: []byte{0x78, 0x00, 0x00}})
+	// Three speakers, more than MaxStreams: none is left out.
+	for n := 0; n < 3; n++ {
+		b.Add(start.Add(time.Duration(n)*20*time.Millisecond), discordgo.Packet{SSRC: 1, Timestamp: uint32(n * FrameSize), Opus: []byte{0x78, 0x01, byte(n)}})
+	}
+	b.Add(start.Add(time.Second), discordgo.Packet{SSRC: 2, Opus: []byte{0x78, 0x02, 0x02}})
+	b.Add(start.Add(2*time.Second), discordgo.Packet{SSRC: 3, Opus: []byte{0x78, 0x03, 0x03}})
+
+	c := newTestCreator()
+	c.mixOptions.MaxStreams = 1
+	c.ffmpeg = fakeFFmpeg(t, `exit 1`)
+	path := filepath.Join(t.TempDir(), "export.zip")
+
+	manifest, err := c.Export(context.Background(), &b, path, 10*time.Second, Options{Speakers: map[uint32]string{1: "alice-id", 3: "bob-id"}})
+	require.NoError(t, err)
+
+	expected := Manifest{
+		Start:     start,
+		CreatedAt: testNow,
+		Streams: []ExportedStream{
+			{File: "stream-1-1.ogg", SSRC: 1, UserID: "alice-id", FirstPacket: start, LastPacket: start.Add(40 * time.Millisecond), Packets: 3},
+			{File: "stream-2-2.ogg", SSRC: 2, FirstPacket: start.Add(time.Second), LastPacket: start.Add(time.Second), Packets: 1},
+			{File: "stream-3-3.ogg", SSRC: 3, UserID: "bob-id", FirstPacket: start.Add(2 * time.Second), LastPacket: start.Add(2 * time.Second), Packets: 1},
+		},
+	}
+	assert.Equal(t, expected, manifest)
+
+	archive, err := zip.OpenReader(path)
+	require.NoError(t, err)
+	defer archive.Close()
+
+	var names []string
+	contents := map[string][]byte{}
+	for _, f := range archive.File {
+		names = append(names, f.Name)
+		r, err := f.Open()
+		require.NoError(t, err)
+		contents[f.Name], err = io.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+	}
+	assert.Equal(t, []string{"manifest.json", "stream-1-1.ogg", "stream-2-2.ogg", "stream-3-3.ogg"}, names)
+
+	var written Manifest
+	require.NoError(t, json.Unmarshal(contents["manifest.json"], &written))
+	assert.True(t, expected.Start.Equal(written.Start))
+	require.Len(t, written.Streams, 3)
+	for n, stream := range written.Streams {
+		assert.Equal(t, expected.Streams[n].File, stream.File)
+		assert.Equal(t, expected.Streams[n].SSRC, stream.SSRC)
+		assert.Equal(t, expected.Streams[n].UserID, stream.UserID)
+		assert.Equal(t, expected.Streams[n].Packets, stream.Packets)
+		assert.True(t, expected.Streams[n].FirstPacket.Equal(stream.FirstPacket))
+		assert.True(t, expected.Streams[n].LastPacket.Equal(stream.LastPacket))
+	}
+
+	// The stream files are the encoded voice streams, the old packet is left out.
+	assert.Contains(t, string(contents["stream-1-1.ogg"]), "OpusHead")
+	for n := 0; n < 3; n++ {
+		assert.Contains(t, string(contents["stream-1-1.ogg"]), string([]byte{0x78, 0x01, byte(n)}))
+	}
+	assert.NotContains(t, string(contents["stream-1-1.ogg"]), string([]byte{0x78, 0x00, 0x00}))
+	assert.Contains(t, string(contents["stream-3-3.ogg"]), string([]byte{0x78, 0x03, 0x03}))
+}
+
+func TestCreator_Export_noAudio(t *testing.T) {
+	var b circular.Buffer
+	b.Add(testNow.Add(-time.Minute), discordgo.Packet{SSRC: 1, Opus: []byte{0x78, 0x01}})
+
+	_, err := newTestCreator().Export(context.Background(), &b, filepath.Join(t.TempDir(), "export.zip"), 10*time.Second, Options{})
+	assert.ErrorIs(t, err, NoAudioDataErr)
+}
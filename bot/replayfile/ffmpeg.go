@@ -0,0 +1,172 @@
+package replayfile
+
+import (
+	"bigbro2/bot/logging"
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// stderrTailSize is the number of bytes kept from the end of what ffmpeg writes to stderr.
+const stderrTailSize = 4 * 1024
+
+// FFmpegError is returned when ffmpeg exits with an error.
+type FFmpegError struct {
+	ExitCode int
+	Stderr   string // End of what ffmpeg wrote to stderr, which usually explains the failure.
+	Err      error
+}
+
+func (e *FFmpegError) Error() string {
+	return fmt.Sprintf("ffmpeg exited with code %d: %s", e.ExitCode, e.Stderr)
+}
+
+func (e *FFmpegError) Unwrap() error {
+	return e.Err
+}
+
+// runFFmpeg runs ffmpeg with the arguments once fewer than maxConcurrentMixes ffmpeg processes are running.
+// It returns the end of what ffmpeg wrote to stderr. If it fails, the returned error contains it too.
+func (c *Creator) runFFmpeg(ctx context.Context, args []string) (string, error) {
+	logger := logging.FromContext(ctx, c.logger)
+
+	select {
+	case c.mixSlots <- struct{}{}:
+		defer func() { <-c.mixSlots }()
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	stderr := &tailBuffer{size: stderrTailSize}
+	cmd := exec.CommandContext(ctx, c.ffmpeg, args...)
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	if err == nil {
+		return stderr.String(), nil
+	}
+
+	logger.Debug("ffmpeg failed", zap.Strings("args", args), zap.String("stderr", stderr.String()), zap.Error(err))
+	return "", ffmpegError(err, stderr)
+}
+
+// ffmpegError returns the error of an ffmpeg process which failed with err, given what it wrote to stderr.
+func ffmpegError(err error, stderr *tailBuffer) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return fmt.Errorf("could not run ffmpeg: %w", err)
+	}
+	return &FFmpegError{
+		ExitCode: exitErr.ExitCode(),
+		Stderr:   strings.TrimSpace(stderr.String()),
+		Err:      err,
+	}
+}
+
+// startFFmpeg starts ffmpeg with the arguments once fewer than maxConcurrentMixes ffmpeg processes are running, and
+// returns what it writes to stdout. The process counts as running until the output is closed, which must always be
+// done. done is called once it is closed.
+func (c *Creator) startFFmpeg(ctx context.Context, args []string, done func()) (io.ReadCloser, error) {
+	select {
+	case c.mixSlots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	stderr := &tailBuffer{size: stderrTailSize}
+	cmd := exec.CommandContext(ctx, c.ffmpeg, args...)
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		<-c.mixSlots
+		return nil, fmt.Errorf("could not run ffmpeg: %w", err)
+	}
+
+	return &ffmpegOutput{
+		logger: logging.FromContext(ctx, c.logger),
+		args:   args,
+		cmd:    cmd,
+		stdout: stdout,
+		stderr: stderr,
+		done: func() {
+			<-c.mixSlots
+			done()
+		},
+	}, nil
+}
+
+// ffmpegOutput reads what an ffmpeg process writes to stdout. Once the output is read to the end, the next read
+// returns the error of ffmpeg instead of io.EOF if it failed. Closing it before kills ffmpeg.
+type ffmpegOutput struct {
+	logger *zap.Logger
+	args   []string
+	cmd    *exec.Cmd
+	stdout io.Reader
+	stderr *tailBuffer
+	done   func()
+	exited bool
+	err    error // Error of ffmpeg, once it exited.
+}
+
+func (o *ffmpegOutput) Read(p []byte) (int, error) {
+	n, err := o.stdout.Read(p)
+	if err == io.EOF {
+		if err := o.wait(); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+func (o *ffmpegOutput) Close() error {
+	if o.exited {
+		return nil
+	}
+
+	// The output was not read to the end: ffmpeg is not needed anymore.
+	if err := o.cmd.Process.Kill(); err != nil {
+		o.logger.Warn("failed to kill ffmpeg", zap.Error(err))
+	}
+	_ = o.wait()
+	return nil
+}
+
+// wait waits for ffmpeg to exit, and returns its error.
+func (o *ffmpegOutput) wait() error {
+	if o.exited {
+		return o.err
+	}
+	o.exited = true
+	defer o.done()
+
+	if err := o.cmd.Wait(); err != nil {
+		o.logger.Debug("ffmpeg failed", zap.Strings("args", o.args), zap.String("stderr", o.stderr.String()), zap.Error(err))
+		o.err = ffmpegError(err, o.stderr)
+	}
+	return o.err
+}
+
+// tailBuffer is a writer keeping only the last size bytes written to it.
+type tailBuffer struct {
+	size int
+	data []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.data = append(b.data, p...)
+	if len(b.data) > b.size {
+		b.data = b.data[len(b.data)-b.size:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	return string(b.data)
+}
@@ -0,0 +1,258 @@
+package replayfile
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeFFmpeg creates a shell script standing in for ffmpeg and returns its path.
+func fakeFFmpeg(t *testing.T, script string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "ffmpeg")
+	require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0o700))
+	return path
+}
+
+func TestCreator_mixFiles_ffmpegError(t *testing.T) {
+	tests := []struct {
+		name           string
+		script         string
+		expectedCode   int
+		expectedStderr string
+	}{
+		{
+			name:           "short stderr",
+			script:         `echo "a.opus: Invalid data found when processing input" >&2; exit 3`,
+			expectedCode:   3,
+			expectedStderr: "a.opus: Invalid data found when processing input",
+		},
+		{
+			name:           "long stderr is truncated",
+			script:         `head -c 10000 /dev/zero | tr '\0' 'x' >&2; echo "the end" >&2; exit 1`,
+			expectedCode:   1,
+			expectedStderr: strings.Repeat("x", stderrTailSize-len("the end\n")) + "the end",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCreator()
+			c.ffmpeg = fakeFFmpeg(t, tt.script)
+
+			err := c.mixFiles(context.Background(), "out.ogg", []string{"a.opus"}, MixOptions{}, 0, 0, nil)
+
+			var ffmpegErr *FFmpegError
+			require.ErrorAs(t, err, &ffmpegErr)
+			assert.Equal(t, tt.expectedCode, ffmpegErr.ExitCode)
+			assert.Equal(t, tt.expectedStderr, ffmpegErr.Stderr)
+			assert.Contains(t, err.Error(), tt.expectedStderr)
+		})
+	}
+}
+
+func TestCreator_mixFiles_ffmpegSuccess(t *testing.T) {
+	c := newTestCreator()
+	c.ffmpeg = fakeFFmpeg(t, `echo "some progress" >&2; exit 0`)
+
+	assert.NoError(t, c.mixFiles(context.Background(), "out.ogg", []string{"a.opus"}, MixOptions{}, 0, 0, nil))
+}
+
+func TestCreator_mixFiles_watermark(t *testing.T) {
+	tests := []struct {
+		name      string
+		watermark string
+		expected  string
+	}{
+		{name: "no watermark", expected: "-metadata REPLAY_MAX_STREAMS=0 out.ogg"},
+		{name: "watermark", watermark: "recorded by BigBro", expected: "-metadata comment=recorded by BigBro out.ogg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			argsPath := filepath.Join(t.TempDir(), "args")
+			c := newTestCreator()
+			c.ffmpeg = fakeFFmpeg(t, `echo "$@" > `+argsPath)
+
+			require.NoError(t, c.mixFiles(context.Background(), "out.ogg", []string{"a.opus"}, MixOptions{Watermark: tt.watermark}, 0, 0, nil))
+
+			args, err := os.ReadFile(argsPath)
+			require.NoError(t, err)
+			assert.True(t, strings.HasSuffix(strings.TrimSpace(string(args)), tt.expected), string(args))
+		})
+	}
+}
+
+func TestCreator_opusApplication(t *testing.T) {
+	tests := []struct {
+		name        string
+		application OpusApplication
+		run         func(c *Creator) error
+		expected    []string
+	}{
+		{
+			name: "mix defaults to voip",
+			run: func(c *Creator) error {
+				return c.mixFiles(context.Background(), "out.ogg", []string{"a.opus"}, c.mixOptions, 0, 0, nil)
+			},
+			expected: []string{"-c:a", "libopus", "-application", "voip"},
+		},
+		{
+			name:        "mix",
+			application: OpusApplicationAudio,
+			run: func(c *Creator) error {
+				return c.mixFiles(context.Background(), "out.ogg", []string{"a.opus"}, c.mixOptions, 0, 0, nil)
+			},
+			expected: []string{"-c:a", "libopus", "-application", "audio"},
+		},
+		{
+			name:        "conversion for speech",
+			application: OpusApplicationAudio,
+			run: func(c *Creator) error {
+				return c.ConvertForSpeech(context.Background(), "replay.ogg", "replay.wav")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			argsPath := filepath.Join(t.TempDir(), "args")
+			c := newTestCreator()
+			c.mixOptions.Application = tt.application
+			c.ffmpeg = fakeFFmpeg(t, `printf '%s\n' "$@" > `+argsPath)
+
+			require.NoError(t, tt.run(c))
+
+			content, err := os.ReadFile(argsPath)
+			require.NoError(t, err)
+			args := strings.Split(strings.TrimSpace(string(content)), "\n")
+			n := indexOf(args, "-application")
+			if tt.expected == nil {
+				assert.Equal(t, -1, n, args)
+				assert.Equal(t, -1, indexOf(args, "-c:a"), args)
+				return
+			}
+			require.GreaterOrEqual(t, n, 2, args)
+			assert.Equal(t, tt.expected, args[n-2:n+2])
+		})
+	}
+}
+
+func TestCreator_container(t *testing.T) {
+	tests := []struct {
+		name      string
+		container Container
+		expected  string
+	}{
+		{name: "default", expected: "ogg"},
+		{name: "ogg", container: ContainerOgg, expected: "ogg"},
+		{name: "webm", container: ContainerWebM, expected: "webm"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			argsPath := filepath.Join(t.TempDir(), "args")
+			c := newTestCreator()
+			c.mixOptions.Container = tt.container
+			c.ffmpeg = fakeFFmpeg(t, `printf '%s\n' "$@" > `+argsPath)
+
+			// The temporary files of the replays have the .opus extension, whatever their container.
+			require.NoError(t, c.mixFiles(context.Background(), "replay.opus", []string{"a.opus"}, c.mixOptions, 0, 0, nil))
+
+			content, err := os.ReadFile(argsPath)
+			require.NoError(t, err)
+			args := strings.Split(strings.TrimSpace(string(content)), "\n")
+			n := indexOf(args, "-f")
+			require.GreaterOrEqual(t, n, 0, args)
+			assert.Equal(t, tt.expected, args[n+1])
+			// The audio is encoded in opus in both containers.
+			assert.Equal(t, []string{"-c:a", "libopus"}, args[indexOf(args, "-c:a"):indexOf(args, "-c:a")+2])
+			assert.Equal(t, "replay.opus", args[len(args)-1])
+			assert.Equal(t, Container(tt.expected), c.Container())
+		})
+	}
+}
+
+func TestCreator_multitrackArgs(t *testing.T) {
+	tests := []struct {
+		name       string
+		multitrack bool
+		files      int
+		length     time.Duration
+		expected   bool
+	}{
+		{name: "mixed", files: 2, length: time.Second},
+		{name: "multitrack", multitrack: true, files: 2, length: time.Second, expected: true},
+		{name: "too many streams", multitrack: true, files: MaxMultitrackChannels + 1, length: time.Second},
+		{name: "unknown length", multitrack: true, files: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := make([]string, tt.files)
+			for n := range files {
+				files[n] = fmt.Sprintf("%d.opus", n)
+			}
+			opts := MixOptions{Multitrack: tt.multitrack}
+
+			args := mixArgs("replay.ogg", files, opts, time.Minute, tt.length, nil)
+			n := indexOf(args, "-mapping_family")
+			if !tt.expected {
+				assert.Equal(t, -1, n, args)
+				return
+			}
+			// The channels are discrete, not a surround layout.
+			require.GreaterOrEqual(t, n, 0, args)
+			assert.Equal(t, "255", args[n+1])
+		})
+	}
+}
+
+func TestMixArgs_bitrate(t *testing.T) {
+	args := mixArgs("replay.ogg", []string{"a.opus"}, MixOptions{}, time.Minute, time.Second, nil)
+	assert.Equal(t, -1, indexOf(args, "-b:a"), args)
+
+	args = mixArgs("replay.ogg", []string{"a.opus"}, MixOptions{Bitrate: 12_000}, time.Minute, time.Second, nil)
+	n := indexOf(args, "-b:a")
+	require.GreaterOrEqual(t, n, 0, args)
+	assert.Equal(t, "12000", args[n+1])
+	assert.Contains(t, args, "REPLAY_OPUS_BITRATE=12000")
+}
+
+// indexOf returns the index of the first arg equal to s, -1 if there is none.
+func indexOf(args []string, s string) int {
+	for n, arg := range args {
+		if arg == s {
+			return n
+		}
+	}
+	return -1
+}
+
+func TestTailBuffer(t *testing.T) {
+	b := &tailBuffer{size: 5}
+
+	n, err := b.Write([]byte("abc"))
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, "abc", b.String())
+
+	n, err = b.Write([]byte("defg"))
+	require.NoError(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, "cdefg", b.String())
+}
+
+func TestCreator_ConvertForSpeech(t *testing.T) {
+	argsPath := filepath.Join(t.TempDir(), "args")
+	c := newTestCreator()
+	c.ffmpeg = fakeFFmpeg(t, `echo "$@" > `+argsPath)
+
+	require.NoError(t, c.ConvertForSpeech(context.Background(), "replay.ogg", "replay.wav"))
+
+	args, err := os.ReadFile(argsPath)
+	require.NoError(t, err)
+	assert.Equal(t, "-y -i replay.ogg -ac 1 -ar 16000 -f wav replay.wav", strings.TrimSpace(string(args)))
+}
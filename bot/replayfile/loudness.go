@@ -0,0 +1,55 @@
+package replayfile
+
+import (
+	"bigbro2/bot/logging"
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"regexp"
+	"strconv"
+)
+
+// integratedLoudnessPattern matches the integrated loudness written by ffmpeg's ebur128 filter. It is written for
+// every 100ms of audio, then once more in the summary at the end.
+var integratedLoudnessPattern = regexp.MustCompile(`I:\s+(-?[0-9.]+) LUFS`)
+
+// streamsLoudness returns the loudness of each stream file, in the same order.
+// The loudness is only an indication: if a measure fails, it is logged and nil is returned.
+func (c *Creator) streamsLoudness(ctx context.Context, files []string) []float64 {
+	logger := logging.FromContext(ctx, c.logger)
+
+	loudness := make([]float64, 0, len(files))
+	for _, file := range files {
+		l, err := c.measureLoudness(ctx, file)
+		if err != nil {
+			logger.Warn("could not measure the loudness of a stream", zap.String("path", file), zap.Error(err))
+			return nil
+		}
+		loudness = append(loudness, l)
+	}
+	return loudness
+}
+
+// ffmpegLoudness measures the integrated loudness of an audio file with ffmpeg, in LUFS.
+func (c *Creator) ffmpegLoudness(ctx context.Context, path string) (float64, error) {
+	stderr, err := c.runFFmpeg(ctx, []string{"-nostats", "-hide_banner", "-i", path, "-af", "ebur128", "-f", "null", "-"})
+	if err != nil {
+		return 0, err
+	}
+	return parseIntegratedLoudness(stderr)
+}
+
+// parseIntegratedLoudness returns the integrated loudness of the summary written by the ebur128 filter on stderr.
+func parseIntegratedLoudness(stderr string) (float64, error) {
+	matches := integratedLoudnessPattern.FindAllStringSubmatch(stderr, -1)
+	if len(matches) == 0 {
+		return 0, errors.New("no integrated loudness in the output of ffmpeg")
+	}
+
+	loudness, err := strconv.ParseFloat(matches[len(matches)-1][1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid integrated loudness: %w", err)
+	}
+	return loudness, nil
+}
@@ -0,0 +1,105 @@
+package replayfile
+
+import (
+	"bigbro2/bot/circular"
+	"context"
+	"errors"
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// ebur128Output is the end of what ffmpeg writes to stderr with the ebur128 filter.
+const ebur128Output = `[Parsed_ebur128_0 @ 0x5581] t: 0.9      TARGET:-23 LUFS    M: -21.3 S:-120.7     I: -21.4 LUFS       LRA:   0.0 LU
+[Parsed_ebur128_0 @ 0x5581] t: 1         TARGET:-23 LUFS    M: -20.9 S:-120.7     I: -21.2 LUFS       LRA:   0.0 LU
+[Parsed_ebur128_0 @ 0x5581] Summary:
+
+  Integrated loudness:
+    I:         -21.1 LUFS
+    Threshold: -31.5 LUFS
+
+  Loudness range:
+    LRA:         0.0 LU
+    Threshold:   0.0 LUFS
+    LRA low:     0.0 LUFS
+    LRA high:    0.0 LUFS
+`
+
+func TestParseIntegratedLoudness(t *testing.T) {
+	tests := []struct {
+		name     string
+		stderr   string
+		expected float64
+		wantErr  bool
+	}{
+		{name: "summary", stderr: ebur128Output, expected: -21.1},
+		{name: "silence", stderr: "  Integrated loudness:\n    I:         -70.0 LUFS\n", expected: -70},
+		{name: "no loudness", stderr: "a.opus: Invalid data found when processing input", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseIntegratedLoudness(tt.stderr)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestCreator_ffmpegLoudness(t *testing.T) {
+	c := newTestCreator()
+	c.ffmpeg = fakeFFmpeg(t, "cat >&2 <<'EOF'\n"+ebur128Output+"EOF")
+
+	got, err := c.ffmpegLoudness(context.Background(), "a.opus")
+	require.NoError(t, err)
+	assert.Equal(t, -21.1, got)
+}
+
+func TestCreator_Create_loudness(t *testing.T) {
+	tests := []struct {
+		name       string
+		loudness   bool
+		measureErr error
+		expected   []float64
+	}{
+		{name: "not asked for", loudness: false},
+		{name: "measured", loudness: true, expected: []float64{-25.5, -18, -40}},
+		{name: "measure failed", loudness: true, measureErr: errors.New("ffmpeg crashed")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b circular.Buffer
+			for n, ssrc := range []uint32{2, 1, 3} {
+				b.Add(testNow.Add(-time.Second+time.Duration(n)*FrameLengthNs), discordgo.Packet{SSRC: ssrc, Opus: []byte{0x78, 0x01}})
+			}
+
+			c := newTestCreator()
+			c.ffmpeg = fakeFFmpeg(t, `for last; do :; done; printf 'OggS' > "$last"`)
+			// The streams are measured in the order of their files, i.e. the order of the SSRCs.
+			measures := []float64{-25.5, -18, -40}
+			var measured []string
+			c.measureLoudness = func(_ context.Context, path string) (float64, error) {
+				if tt.measureErr != nil {
+					return 0, tt.measureErr
+				}
+				measured = append(measured, path)
+				return measures[len(measured)-1], nil
+			}
+
+			result, err := c.Create(context.Background(), &b, filepath.Join(t.TempDir(), "out.ogg"), 10*time.Second, Options{Loudness: tt.loudness})
+			require.NoError(t, err, "a failed measure must not fail the replay")
+
+			assert.Equal(t, []uint32{2, 1, 3}, result.SSRCs)
+			assert.Equal(t, tt.expected, result.Loudness)
+			if !tt.loudness {
+				assert.Empty(t, measured)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package replayfile
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Names of the comments describing how a replay was made, see CaptureParameters.
+const (
+	windowComment          = "REPLAY_WINDOW_SECONDS"
+	mixDurationComment     = "REPLAY_MIX_DURATION"
+	normalizationComment   = "REPLAY_NORMALIZATION"
+	spatialComment         = "REPLAY_SPATIAL"
+	fadeComment            = "REPLAY_FADE_MS"
+	framesPerPacketComment = "REPLAY_FRAMES_PER_PACKET"
+	maxStreamsComment      = "REPLAY_MAX_STREAMS"
+	applicationComment     = "REPLAY_OPUS_APPLICATION"
+	bitrateComment         = "REPLAY_OPUS_BITRATE"
+)
+
+// CaptureParameters describes how a replay was recorded and mixed. They are written as comments in the metadata of the
+// replay, so a replay can be audited after the fact.
+// The bitrate of the voice streams is not included, they keep the bitrate they were sent with. The bitrate of the mix
+// is only included when it is not the default of the libopus encoder.
+type CaptureParameters struct {
+	Window          time.Duration // How far back the replay goes, zero if unknown.
+	MixDuration     MixDuration
+	Normalization   Normalization
+	Spatial         bool
+	Fade            time.Duration
+	FramesPerPacket int
+	MaxStreams      int
+	Application     OpusApplication
+	Bitrate         int // Bits per second of the mix, zero for the default.
+}
+
+// captureParameters returns the parameters of a replay going window back, mixed with opts.
+func captureParameters(opts MixOptions, window time.Duration) CaptureParameters {
+	return CaptureParameters{
+		Window:          window,
+		MixDuration:     opts.Duration,
+		Normalization:   opts.Normalization,
+		Spatial:         opts.Spatial,
+		Fade:            opts.Fade,
+		FramesPerPacket: opts.FramesPerPacket,
+		MaxStreams:      opts.MaxStreams,
+		Application:     opts.Application,
+		Bitrate:         opts.Bitrate,
+	}
+}
+
+// Comments returns the parameters as "KEY=value" comments (RFC 7845 section 5.2), which is also the format of the
+// metadata options of ffmpeg.
+func (p CaptureParameters) Comments() []string {
+	var comments []string
+	if p.Window > 0 {
+		comments = append(comments, fmt.Sprintf("%s=%d", windowComment, int(p.Window.Seconds())))
+	}
+	if p.MixDuration != "" {
+		comments = append(comments, fmt.Sprintf("%s=%s", mixDurationComment, p.MixDuration))
+	}
+	if p.Normalization != "" {
+		comments = append(comments, fmt.Sprintf("%s=%s", normalizationComment, p.Normalization))
+	}
+	if p.Application != "" {
+		comments = append(comments, fmt.Sprintf("%s=%s", applicationComment, p.Application))
+	}
+	if p.Bitrate > 0 {
+		comments = append(comments, fmt.Sprintf("%s=%d", bitrateComment, p.Bitrate))
+	}
+	return append(comments,
+		fmt.Sprintf("%s=%t", spatialComment, p.Spatial),
+		fmt.Sprintf("%s=%d", fadeComment, p.Fade.Milliseconds()),
+		fmt.Sprintf("%s=%d", framesPerPacketComment, p.FramesPerPacket),
+		fmt.Sprintf("%s=%d", maxStreamsComment, p.MaxStreams),
+	)
+}
+
+// ParseCaptureComments returns the parameters written in the comments of a replay by CaptureParameters.Comments.
+// The other comments are ignored, and the names are not case-sensitive. The parameters missing are zero.
+func ParseCaptureComments(comments []string) (CaptureParameters, error) {
+	var p CaptureParameters
+	for _, comment := range comments {
+		name, value, ok := strings.Cut(comment, "=")
+		if !ok {
+			continue
+		}
+
+		var err error
+		switch strings.ToUpper(name) {
+		case windowComment:
+			var seconds int
+			seconds, err = strconv.Atoi(value)
+			p.Window = time.Duration(seconds) * time.Second
+		case mixDurationComment:
+			p.MixDuration, err = ParseMixDuration(value)
+		case normalizationComment:
+			p.Normalization, err = ParseNormalization(value)
+		case spatialComment:
+			p.Spatial, err = strconv.ParseBool(value)
+		case fadeComment:
+			var ms int
+			ms, err = strconv.Atoi(value)
+			p.Fade = time.Duration(ms) * time.Millisecond
+		case framesPerPacketComment:
+			p.FramesPerPacket, err = strconv.Atoi(value)
+		case maxStreamsComment:
+			p.MaxStreams, err = strconv.Atoi(value)
+		case applicationComment:
+			p.Application, err = ParseOpusApplication(value)
+		case bitrateComment:
+			p.Bitrate, err = strconv.Atoi(value)
+		}
+		if err != nil {
+			return CaptureParameters{}, fmt.Errorf("invalid comment %s: %w", name, err)
+		}
+	}
+	return p, nil
+}
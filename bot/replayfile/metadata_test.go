@@ -0,0 +1,100 @@
+package replayfile
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCaptureParameters_roundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		params CaptureParameters
+	}{
+		{name: "zero", params: CaptureParameters{}},
+		{
+			name: "all",
+			params: CaptureParameters{
+				Window:          30 * time.Second,
+				MixDuration:     MixDurationLongest,
+				Normalization:   NormalizationLimiter,
+				Spatial:         true,
+				Fade:            50 * time.Millisecond,
+				FramesPerPacket: 3,
+				MaxStreams:      8,
+				Application:     OpusApplicationAudio,
+				Bitrate:         16_000,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The comments of the replay also contain the watermark.
+			comments := append([]string{"comment=recorded by BigBro"}, tt.params.Comments()...)
+
+			params, err := ParseCaptureComments(comments)
+			require.NoError(t, err)
+			assert.Equal(t, tt.params, params)
+		})
+	}
+}
+
+func TestParseCaptureComments(t *testing.T) {
+	tests := []struct {
+		name     string
+		comments []string
+		expected CaptureParameters
+		err      string
+	}{
+		{
+			name:     "case-insensitive",
+			comments: []string{"replay_window_seconds=10", "Replay_Spatial=true"},
+			expected: CaptureParameters{Window: 10 * time.Second, Spatial: true},
+		},
+		{name: "other comments", comments: []string{"ENCODER=Lavf", "no value"}, expected: CaptureParameters{}},
+		{name: "invalid number", comments: []string{"REPLAY_FADE_MS=short"}, err: "invalid comment REPLAY_FADE_MS"},
+		{name: "invalid mix duration", comments: []string{"REPLAY_MIX_DURATION=forever"}, err: "invalid comment REPLAY_MIX_DURATION"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := ParseCaptureComments(tt.comments)
+			if tt.err != "" {
+				assert.ErrorContains(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, params)
+		})
+	}
+}
+
+func TestCreator_mixFiles_captureParameters(t *testing.T) {
+	argsPath := filepath.Join(t.TempDir(), "args")
+	c := newTestCreator()
+	c.ffmpeg = fakeFFmpeg(t, `printf '%s\n' "$@" > `+argsPath)
+
+	opts := MixOptions{Duration: MixDurationFirst, Normalization: NormalizationAverage, Fade: 20 * time.Millisecond, FramesPerPacket: 1}
+	require.NoError(t, c.mixFiles(context.Background(), "out.ogg", []string{"a.opus"}, opts, 45*time.Second, 0, nil))
+
+	content, err := os.ReadFile(argsPath)
+	require.NoError(t, err)
+	var comments []string
+	args := strings.Split(strings.TrimSpace(string(content)), "\n")
+	for n := 1; n < len(args); n++ {
+		if args[n-1] == "-metadata" {
+			comments = append(comments, args[n])
+		}
+	}
+
+	params, err := ParseCaptureComments(comments)
+	require.NoError(t, err)
+	assert.Equal(t, 45*time.Second, params.Window)
+	assert.Equal(t, OpusApplicationVoIP, params.Application)
+	params.Application = ""
+	assert.Equal(t, captureParameters(opts, 45*time.Second), params)
+}
@@ -0,0 +1,412 @@
+package replayfile
+
+import (
+	"bigbro2/bot/ogg"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MixOptions configures how the voice streams are mixed together by ffmpeg.
+type MixOptions struct {
+	Duration      MixDuration
+	Normalization Normalization
+	// Spatial pans each voice stream to a different position in the stereo field, which makes overlapping speakers
+	// easier to tell apart.
+	Spatial bool
+	// Multitrack puts each voice stream in its own channel of the replay, in order, instead of mixing them together,
+	// so they can be edited separately. It takes precedence over Spatial. Beyond MaxMultitrackChannels streams, or if
+	// the duration of the mix is unknown, the streams are mixed as usual.
+	Multitrack bool
+	// PadPreSkip adds the pre-skip of the stream files worth of silence at the beginning of the mix.
+	// Some players drop the pre-skip from the start of the output file instead of only from the decoder output, which
+	// can cut the first syllable when someone speaks right at the start of the replay. The padding makes sure they only
+	// drop silence, at the cost of a replay starting slightly later (see preSkipPadding).
+	PadPreSkip bool
+	// FramesPerPacket is the number of consecutive 20ms frames combined in each opus packet of the stream files given
+	// to ffmpeg, up to MaxFramesPerPacket. It makes the stream files smaller, not the replay. Zero or one disables it.
+	FramesPerPacket int
+	// Watermark is an attribution text, e.g. "recorded by BigBro", written as a comment in the metadata of the stream
+	// files and of the replay. Empty means no comment.
+	Watermark string
+	// Weights is the volume of the voice streams of some users relative to the others, indexed by user ID, e.g. 0.5
+	// to turn down a loud music bot. The users missing from it have a weight of 1.
+	Weights map[string]float64
+	// MaxStreams is the largest number of voice streams mixed together. Mixing many streams is slow and uses a lot of
+	// memory: beyond it, only the most active streams are kept, see selectStreams. Zero means no limit.
+	MaxStreams int
+	// Fade is the duration of the fade-in at the start of the replay and of the fade-out at its end, so a replay
+	// starting or ending in the middle of a word does not click. Zero disables it, e.g. to keep the audio untouched.
+	Fade time.Duration
+	// Application tunes the opus encoder of the replay for a kind of audio. Empty means OpusApplicationVoIP.
+	Application OpusApplication
+	// Bitrate is the bitrate of the replay, in bits per second, e.g. to make a long replay fit the upload limit. Zero
+	// means the default of the libopus encoder, which depends on the number of channels.
+	Bitrate int
+	// Container is the format of the replay files. Empty means ContainerOgg.
+	Container Container
+}
+
+// DefaultFade is the duration of the fades when none is configured: long enough to avoid clicks, too short to cut a
+// syllable.
+const DefaultFade = 50 * time.Millisecond
+
+// MaxMultitrackChannels is the largest number of channels of a multitrack replay, the most the opus encoder of ffmpeg
+// supports with a standard channel layout.
+const MaxMultitrackChannels = 8
+
+// spatialSpread is how far from the center the outermost speakers are panned, 1 meaning completely on one side.
+// Nobody is panned completely to one side: it is tiring to listen to with headphones.
+const spatialSpread = 0.8
+
+// MixDuration controls how long the mixed output is relative to its inputs.
+// It maps directly to the "duration" parameter of ffmpeg's amix filter.
+type MixDuration string
+
+const (
+	// MixDurationLongest pads the output to the longest stream. Nothing is ever cut, but a speaker that started
+	// late can add trailing silence.
+	MixDurationLongest MixDuration = "longest"
+	// MixDurationShortest stops the output when the shortest stream ends. This removes trailing silence but may cut
+	// off the last words of the other speakers.
+	MixDurationShortest MixDuration = "shortest"
+	// MixDurationFirst stops the output when the first stream ends.
+	MixDurationFirst MixDuration = "first"
+)
+
+// ParseMixDuration parses a mix duration mode. An empty string defaults to MixDurationLongest.
+func ParseMixDuration(s string) (MixDuration, error) {
+	switch d := MixDuration(s); d {
+	case "":
+		return MixDurationLongest, nil
+	case MixDurationLongest, MixDurationShortest, MixDurationFirst:
+		return d, nil
+	default:
+		return "", fmt.Errorf("unknown mix duration %q", s)
+	}
+}
+
+// ParseFramesPerPacket parses the number of frames combined in each packet of the stream files.
+// An empty string defaults to 1, i.e. no frames are combined.
+func ParseFramesPerPacket(s string) (int, error) {
+	if s == "" {
+		return 1, nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > MaxFramesPerPacket {
+		return 0, fmt.Errorf("frames per packet must be between 1 and %d, got %q", MaxFramesPerPacket, s)
+	}
+	return n, nil
+}
+
+// ParseMaxStreams parses the largest number of voice streams mixed together. An empty string or zero means no limit.
+func ParseMaxStreams(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("max streams must be a positive number, got %q", s)
+	}
+	return n, nil
+}
+
+// ParseFade parses the duration of the fades in milliseconds. An empty string defaults to DefaultFade, zero disables
+// them.
+func ParseFade(s string) (time.Duration, error) {
+	if s == "" {
+		return DefaultFade, nil
+	}
+
+	ms, err := strconv.Atoi(s)
+	if err != nil || ms < 0 {
+		return 0, fmt.Errorf("fade must be a positive number of milliseconds, got %q", s)
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// ParseWeights parses the weights of the users, as comma-separated "userID=weight" pairs, e.g. "123=0.5,456=2".
+// An empty string means every user has the same weight.
+func ParseWeights(s string) (map[string]float64, error) {
+	weights := map[string]float64{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		userID, value, ok := strings.Cut(pair, "=")
+		userID = strings.TrimSpace(userID)
+		if !ok || userID == "" {
+			return nil, fmt.Errorf("weight must be formatted as userID=weight, got %q", pair)
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || weight < 0 || math.IsInf(weight, 0) || math.IsNaN(weight) {
+			return nil, fmt.Errorf("weight of %s must be a positive number, got %q", userID, value)
+		}
+		weights[userID] = weight
+	}
+	return weights, nil
+}
+
+// streamWeights returns the weight of each voice stream, in the same order as ssrcs. speakers is the ID of the user
+// speaking in each voice stream, indexed by SSRC. It returns nil if every stream has the same weight.
+func streamWeights(ssrcs []uint32, speakers map[uint32]string, weights map[string]float64) []float64 {
+	if len(weights) == 0 {
+		return nil
+	}
+
+	result := make([]float64, len(ssrcs))
+	weighted := false
+	for n, ssrc := range ssrcs {
+		result[n] = 1
+		if weight, ok := weights[speakers[ssrc]]; ok {
+			result[n] = weight
+			weighted = weighted || weight != 1
+		}
+	}
+	if !weighted {
+		return nil
+	}
+	return result
+}
+
+// Normalization controls how the volume of the mix is adjusted.
+type Normalization string
+
+const (
+	// NormalizationLimiter sums the streams without dividing them and runs a limiter to prevent clipping.
+	// A single speaker is as loud in a group mix as they are alone.
+	NormalizationLimiter Normalization = "limiter"
+	// NormalizationDynamic sums the streams and lets ffmpeg's dynaudnorm even out the volume over time.
+	// Quiet speakers are boosted, but the first second or so may sound quieter while the filter adapts.
+	NormalizationDynamic Normalization = "dynamic"
+	// NormalizationAverage is amix's default behavior: every stream is divided by the number of inputs.
+	// The more people in the channel, the quieter the replay.
+	NormalizationAverage Normalization = "average"
+)
+
+// ParseNormalization parses a normalization mode. An empty string defaults to NormalizationLimiter.
+func ParseNormalization(s string) (Normalization, error) {
+	switch n := Normalization(s); n {
+	case "":
+		return NormalizationLimiter, nil
+	case NormalizationLimiter, NormalizationDynamic, NormalizationAverage:
+		return n, nil
+	default:
+		return "", fmt.Errorf("unknown normalization %q", s)
+	}
+}
+
+// OpusApplication tunes the opus encoder for a kind of audio. It maps directly to the "application" option of ffmpeg's
+// libopus encoder.
+type OpusApplication string
+
+const (
+	// OpusApplicationVoIP favors the intelligibility of speech.
+	OpusApplicationVoIP OpusApplication = "voip"
+	// OpusApplicationAudio favors the faithfulness to the input, e.g. for music. It is the default of ffmpeg.
+	OpusApplicationAudio OpusApplication = "audio"
+	// OpusApplicationLowDelay minimizes the latency of the encoder, at the expense of its quality.
+	OpusApplicationLowDelay OpusApplication = "lowdelay"
+)
+
+// ParseOpusApplication parses an opus application. An empty string defaults to OpusApplicationVoIP, since the bot
+// records people talking.
+func ParseOpusApplication(s string) (OpusApplication, error) {
+	switch a := OpusApplication(s); a {
+	case "":
+		return OpusApplicationVoIP, nil
+	case OpusApplicationVoIP, OpusApplicationAudio, OpusApplicationLowDelay:
+		return a, nil
+	default:
+		return "", fmt.Errorf("unknown opus application %q", s)
+	}
+}
+
+// Container is the format of the replay files, holding the opus audio. It maps directly to the format of ffmpeg's
+// muxer.
+type Container string
+
+const (
+	// ContainerOgg is understood by most players, and by Discord, which shows a player in the message.
+	ContainerOgg Container = "ogg"
+	// ContainerWebM is preferred by some web players.
+	ContainerWebM Container = "webm"
+)
+
+// ParseContainer parses a container. An empty string defaults to ContainerOgg.
+func ParseContainer(s string) (Container, error) {
+	switch c := Container(s); c {
+	case "":
+		return ContainerOgg, nil
+	case ContainerOgg, ContainerWebM:
+		return c, nil
+	default:
+		return "", fmt.Errorf("unknown container %q", s)
+	}
+}
+
+// Extension returns the extension of the files in the container, with the dot. The empty container is ContainerOgg.
+func (c Container) Extension() string {
+	if c == ContainerWebM {
+		return ".webm"
+	}
+	return ".ogg"
+}
+
+// ContentType returns the MIME type of the replay files in the container. The empty container is ContainerOgg.
+func (c Container) ContentType() string {
+	if c == ContainerWebM {
+		return "audio/webm; codecs=opus"
+	}
+	return "audio/ogg; codecs=opus"
+}
+
+// filterGraph returns the ffmpeg filter graph mixing the given number of inputs together.
+// length is the duration of the mix, needed to fade it out. If it is zero, it is unknown and only the fade-in is
+// applied. weights is the weight of each input, in order, nil if they all have the same weight.
+func filterGraph(inputs int, opts MixOptions, length time.Duration, weights []float64) string {
+	var graph string
+	if opts.Multitrack && multitrack(inputs, length) {
+		// The channels are not summed: there is nothing to divide, only peaks to limit.
+		graph = multitrackFilters(inputs, length, weights)
+		switch opts.Normalization {
+		case NormalizationLimiter:
+			graph += ",alimiter"
+		case NormalizationDynamic:
+			graph += ",dynaudnorm"
+		}
+	} else {
+		graph = fmt.Sprintf("amix=inputs=%d:duration=%s", inputs, opts.Duration)
+		if len(weights) == inputs {
+			graph += ":weights=" + formatWeights(weights)
+		}
+		if opts.Spatial {
+			graph = spatialFilters(inputs) + graph
+		}
+
+		switch opts.Normalization {
+		case NormalizationLimiter:
+			graph += ":normalize=0,alimiter"
+		case NormalizationDynamic:
+			graph += ":normalize=0,dynaudnorm"
+		}
+	}
+
+	// The fades are applied after the normalization, which would otherwise boost the faded audio back.
+	graph += fadeFilters(opts.Fade, length)
+
+	if opts.PadPreSkip {
+		graph += fmt.Sprintf(",adelay=delays=%d:all=1", preSkipPadding(ogg.PreSkip, ogg.SamplingRateHz).Milliseconds())
+	}
+	return graph
+}
+
+// formatWeights returns the weights as expected by amix: separated by spaces.
+func formatWeights(weights []float64) string {
+	formatted := make([]string, len(weights))
+	for n, weight := range weights {
+		formatted[n] = strconv.FormatFloat(weight, 'f', -1, 64)
+	}
+	return strings.Join(formatted, " ")
+}
+
+// fadeFilters returns the afade filters fading in the first fade of a mix lasting length, and fading out its last
+// fade, each preceded by a comma. The fades are shortened to half of length so they do not overlap.
+func fadeFilters(fade, length time.Duration) string {
+	if fade <= 0 {
+		return ""
+	}
+	if length > 0 && fade > length/2 {
+		fade = length / 2
+	}
+
+	filters := fmt.Sprintf(",afade=t=in:st=0:d=%.3f", fade.Seconds())
+	if length > 0 {
+		filters += fmt.Sprintf(",afade=t=out:st=%.3f:d=%.3f", (length - fade).Seconds(), fade.Seconds())
+	}
+	return filters
+}
+
+// mixLength returns the duration of the mix of streams lasting the given durations.
+func mixLength(durations []time.Duration, mode MixDuration) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+
+	length := durations[0]
+	for _, d := range durations[1:] {
+		switch mode {
+		case MixDurationFirst:
+			return length
+		case MixDurationShortest:
+			if d < length {
+				length = d
+			}
+		default:
+			if d > length {
+				length = d
+			}
+		}
+	}
+	return length
+}
+
+// preSkipPadding returns the duration of the pre-skip, rounded up to the next millisecond as adelay only takes whole
+// milliseconds.
+func preSkipPadding(preSkip, sampleRate int) time.Duration {
+	ms := (preSkip*1000 + sampleRate - 1) / sampleRate
+	return time.Duration(ms) * time.Millisecond
+}
+
+// spatialFilters returns the filters panning each input to its own position, followed by the labels of the panned
+// streams, ready to be fed to amix.
+//
+// The inputs are spread evenly from left to right, in the order they are given: with 3 inputs, the first one is on
+// the left, the second one in the center and the third one on the right. A single input stays in the center.
+// Each input is downmixed to mono and panned with a constant power law (gains cos θ and sin θ), so a speaker is as
+// loud on the side as in the center.
+func spatialFilters(inputs int) string {
+	var filters, labels strings.Builder
+	for i := 0; i < inputs; i++ {
+		position := 0.0 // -1 is left, 1 is right.
+		if inputs > 1 {
+			position = spatialSpread * (2*float64(i)/float64(inputs-1) - 1)
+		}
+
+		angle := (position + 1) * math.Pi / 4
+		left := math.Cos(angle) / 2 // Divided by 2 as both channels are summed to downmix to mono.
+		right := math.Sin(angle) / 2
+
+		fmt.Fprintf(&filters, "[%d:a]pan=stereo|c0=%.3f*c0+%.3f*c1|c1=%.3f*c0+%.3f*c1[s%d];", i, left, left, right, right, i)
+		fmt.Fprintf(&labels, "[s%d]", i)
+	}
+	return filters.String() + labels.String()
+}
+
+// multitrack returns whether the given number of inputs, mixed into length, can be put in a multitrack replay.
+// length is needed to pad the inputs, see multitrackFilters.
+func multitrack(inputs int, length time.Duration) bool {
+	return inputs <= MaxMultitrackChannels && length > 0
+}
+
+// multitrackFilters returns the filters putting each input in its own channel, in order, with amerge: the first input
+// is the first channel. Each input is downmixed to mono, weighted, and padded with silence to length, as amerge stops
+// at the end of the shortest input.
+func multitrackFilters(inputs int, length time.Duration, weights []float64) string {
+	var filters, labels strings.Builder
+	for i := 0; i < inputs; i++ {
+		fmt.Fprintf(&filters, "[%d:a]aformat=channel_layouts=mono", i)
+		if len(weights) == inputs {
+			fmt.Fprintf(&filters, ",volume=%s", strconv.FormatFloat(weights[i], 'f', -1, 64))
+		}
+		fmt.Fprintf(&filters, ",apad=whole_dur=%.3f[t%d];", length.Seconds(), i)
+		fmt.Fprintf(&labels, "[t%d]", i)
+	}
+	return filters.String() + labels.String() + fmt.Sprintf("amerge=inputs=%d", inputs)
+}
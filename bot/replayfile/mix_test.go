@@ -0,0 +1,545 @@
+package replayfile
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestParseMixDuration(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected MixDuration
+		wantErr  bool
+	}{
+		{name: "empty defaults to longest", input: "", expected: MixDurationLongest},
+		{name: "longest", input: "longest", expected: MixDurationLongest},
+		{name: "shortest", input: "shortest", expected: MixDurationShortest},
+		{name: "first", input: "first", expected: MixDurationFirst},
+		{name: "unknown", input: "forever", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMixDuration(tt.input)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestParseNormalization(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected Normalization
+		wantErr  bool
+	}{
+		{name: "empty defaults to limiter", input: "", expected: NormalizationLimiter},
+		{name: "limiter", input: "limiter", expected: NormalizationLimiter},
+		{name: "dynamic", input: "dynamic", expected: NormalizationDynamic},
+		{name: "average", input: "average", expected: NormalizationAverage},
+		{name: "unknown", input: "loud", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseNormalization(tt.input)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestParseOpusApplication(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected OpusApplication
+		wantErr  bool
+	}{
+		{name: "empty defaults to voip", input: "", expected: OpusApplicationVoIP},
+		{name: "voip", input: "voip", expected: OpusApplicationVoIP},
+		{name: "audio", input: "audio", expected: OpusApplicationAudio},
+		{name: "lowdelay", input: "lowdelay", expected: OpusApplicationLowDelay},
+		{name: "unknown", input: "music", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseOpusApplication(tt.input)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestParseContainer(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected Container
+		wantErr  bool
+	}{
+		{name: "empty defaults to ogg", input: "", expected: ContainerOgg},
+		{name: "ogg", input: "ogg", expected: ContainerOgg},
+		{name: "webm", input: "webm", expected: ContainerWebM},
+		{name: "unknown", input: "mp3", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseContainer(tt.input)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestContainer_file(t *testing.T) {
+	tests := []struct {
+		container   Container
+		extension   string
+		contentType string
+	}{
+		{container: "", extension: ".ogg", contentType: "audio/ogg; codecs=opus"},
+		{container: ContainerOgg, extension: ".ogg", contentType: "audio/ogg; codecs=opus"},
+		{container: ContainerWebM, extension: ".webm", contentType: "audio/webm; codecs=opus"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.container), func(t *testing.T) {
+			assert.Equal(t, tt.extension, tt.container.Extension())
+			assert.Equal(t, tt.contentType, tt.container.ContentType())
+		})
+	}
+}
+
+func TestParseFramesPerPacket(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected int
+		wantErr  bool
+	}{
+		{name: "empty defaults to 1", input: "", expected: 1},
+		{name: "3", input: "3", expected: 3},
+		{name: "maximum", input: "6", expected: MaxFramesPerPacket},
+		{name: "zero", input: "0", wantErr: true},
+		{name: "too many", input: "7", wantErr: true},
+		{name: "not a number", input: "three", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseFramesPerPacket(tt.input)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestParseMaxStreams(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected int
+		wantErr  bool
+	}{
+		{name: "empty means no limit", input: "", expected: 0},
+		{name: "10", input: "10", expected: 10},
+		{name: "zero means no limit", input: "0", expected: 0},
+		{name: "negative", input: "-1", wantErr: true},
+		{name: "not a number", input: "ten", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMaxStreams(tt.input)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestParseFade(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected time.Duration
+		wantErr  bool
+	}{
+		{name: "empty defaults to DefaultFade", input: "", expected: DefaultFade},
+		{name: "100", input: "100", expected: 100 * time.Millisecond},
+		{name: "zero disables", input: "0", expected: 0},
+		{name: "negative", input: "-50", wantErr: true},
+		{name: "not a number", input: "50ms", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseFade(tt.input)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestMixLength(t *testing.T) {
+	durations := []time.Duration{2 * time.Second, 3 * time.Second, time.Second}
+
+	tests := []struct {
+		name      string
+		durations []time.Duration
+		mode      MixDuration
+		expected  time.Duration
+	}{
+		{name: "longest", durations: durations, mode: MixDurationLongest, expected: 3 * time.Second},
+		{name: "shortest", durations: durations, mode: MixDurationShortest, expected: time.Second},
+		{name: "first", durations: durations, mode: MixDurationFirst, expected: 2 * time.Second},
+		{name: "no streams", durations: nil, mode: MixDurationLongest, expected: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, mixLength(tt.durations, tt.mode))
+		})
+	}
+}
+
+func TestFilterGraph_fade(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     MixOptions
+		length   time.Duration
+		expected string
+	}{
+		{
+			name:     "disabled",
+			opts:     MixOptions{Duration: MixDurationLongest, Normalization: NormalizationLimiter},
+			length:   30 * time.Second,
+			expected: "amix=inputs=2:duration=longest:normalize=0,alimiter",
+		},
+		{
+			name:   "fade in and out after the normalization",
+			opts:   MixOptions{Duration: MixDurationLongest, Normalization: NormalizationLimiter, Fade: 50 * time.Millisecond},
+			length: 30 * time.Second,
+			expected: "amix=inputs=2:duration=longest:normalize=0,alimiter," +
+				"afade=t=in:st=0:d=0.050,afade=t=out:st=29.950:d=0.050",
+		},
+		{
+			name:     "unknown length",
+			opts:     MixOptions{Duration: MixDurationLongest, Normalization: NormalizationAverage, Fade: 50 * time.Millisecond},
+			length:   0,
+			expected: "amix=inputs=2:duration=longest,afade=t=in:st=0:d=0.050",
+		},
+		{
+			name:     "short mix",
+			opts:     MixOptions{Duration: MixDurationLongest, Normalization: NormalizationAverage, Fade: 50 * time.Millisecond},
+			length:   60 * time.Millisecond,
+			expected: "amix=inputs=2:duration=longest,afade=t=in:st=0:d=0.030,afade=t=out:st=0.030:d=0.030",
+		},
+		{
+			name:   "before the pre-skip padding",
+			opts:   MixOptions{Duration: MixDurationLongest, Normalization: NormalizationDynamic, Fade: 50 * time.Millisecond, PadPreSkip: true},
+			length: time.Second,
+			expected: "amix=inputs=2:duration=longest:normalize=0,dynaudnorm," +
+				"afade=t=in:st=0:d=0.050,afade=t=out:st=0.950:d=0.050,adelay=delays=80:all=1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, filterGraph(2, tt.opts, tt.length, nil))
+		})
+	}
+}
+
+func TestPreSkipPadding(t *testing.T) {
+	tests := []struct {
+		name       string
+		preSkip    int
+		sampleRate int
+		expected   time.Duration
+	}{
+		{name: "recommended pre-skip", preSkip: 3840, sampleRate: 48_000, expected: 80 * time.Millisecond},
+		{name: "libopus pre-skip", preSkip: 312, sampleRate: 48_000, expected: 7 * time.Millisecond},
+		{name: "whole millisecond", preSkip: 48, sampleRate: 48_000, expected: time.Millisecond},
+		{name: "no pre-skip", preSkip: 0, sampleRate: 48_000, expected: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, preSkipPadding(tt.preSkip, tt.sampleRate))
+		})
+	}
+}
+
+func TestFilterGraph(t *testing.T) {
+	tests := []struct {
+		name     string
+		inputs   int
+		opts     MixOptions
+		expected string
+	}{
+		{
+			name:     "duration longest",
+			inputs:   3,
+			opts:     MixOptions{Duration: MixDurationLongest, Normalization: NormalizationAverage},
+			expected: "amix=inputs=3:duration=longest",
+		},
+		{
+			name:     "duration shortest",
+			inputs:   2,
+			opts:     MixOptions{Duration: MixDurationShortest, Normalization: NormalizationAverage},
+			expected: "amix=inputs=2:duration=shortest",
+		},
+		{
+			name:     "duration first",
+			inputs:   1,
+			opts:     MixOptions{Duration: MixDurationFirst, Normalization: NormalizationAverage},
+			expected: "amix=inputs=1:duration=first",
+		},
+		{
+			name:     "pre-skip padding",
+			inputs:   2,
+			opts:     MixOptions{Duration: MixDurationLongest, Normalization: NormalizationLimiter, PadPreSkip: true},
+			expected: "amix=inputs=2:duration=longest:normalize=0,alimiter,adelay=delays=80:all=1",
+		},
+		{
+			name:     "pre-skip padding without normalization",
+			inputs:   1,
+			opts:     MixOptions{Duration: MixDurationLongest, Normalization: NormalizationAverage, PadPreSkip: true},
+			expected: "amix=inputs=1:duration=longest,adelay=delays=80:all=1",
+		},
+		{
+			name:     "limiter with 1 input",
+			inputs:   1,
+			opts:     MixOptions{Duration: MixDurationLongest, Normalization: NormalizationLimiter},
+			expected: "amix=inputs=1:duration=longest:normalize=0,alimiter",
+		},
+		{
+			name:     "limiter with 2 inputs",
+			inputs:   2,
+			opts:     MixOptions{Duration: MixDurationLongest, Normalization: NormalizationLimiter},
+			expected: "amix=inputs=2:duration=longest:normalize=0,alimiter",
+		},
+		{
+			name:     "limiter with 8 inputs",
+			inputs:   8,
+			opts:     MixOptions{Duration: MixDurationLongest, Normalization: NormalizationLimiter},
+			expected: "amix=inputs=8:duration=longest:normalize=0,alimiter",
+		},
+		{
+			name:     "dynamic with 1 input",
+			inputs:   1,
+			opts:     MixOptions{Duration: MixDurationLongest, Normalization: NormalizationDynamic},
+			expected: "amix=inputs=1:duration=longest:normalize=0,dynaudnorm",
+		},
+		{
+			name:     "dynamic with 2 inputs",
+			inputs:   2,
+			opts:     MixOptions{Duration: MixDurationLongest, Normalization: NormalizationDynamic},
+			expected: "amix=inputs=2:duration=longest:normalize=0,dynaudnorm",
+		},
+		{
+			name:     "dynamic with 8 inputs",
+			inputs:   8,
+			opts:     MixOptions{Duration: MixDurationLongest, Normalization: NormalizationDynamic},
+			expected: "amix=inputs=8:duration=longest:normalize=0,dynaudnorm",
+		},
+		{
+			name:     "spatial with 1 input",
+			inputs:   1,
+			opts:     MixOptions{Duration: MixDurationLongest, Normalization: NormalizationAverage, Spatial: true},
+			expected: "[0:a]pan=stereo|c0=0.354*c0+0.354*c1|c1=0.354*c0+0.354*c1[s0];[s0]amix=inputs=1:duration=longest",
+		},
+		{
+			name:   "spatial with 2 inputs",
+			inputs: 2,
+			opts:   MixOptions{Duration: MixDurationLongest, Normalization: NormalizationLimiter, Spatial: true},
+			expected: "[0:a]pan=stereo|c0=0.494*c0+0.494*c1|c1=0.078*c0+0.078*c1[s0];" +
+				"[1:a]pan=stereo|c0=0.078*c0+0.078*c1|c1=0.494*c0+0.494*c1[s1];" +
+				"[s0][s1]amix=inputs=2:duration=longest:normalize=0,alimiter",
+		},
+		{
+			name:   "spatial with 3 inputs",
+			inputs: 3,
+			opts:   MixOptions{Duration: MixDurationLongest, Normalization: NormalizationAverage, Spatial: true},
+			expected: "[0:a]pan=stereo|c0=0.494*c0+0.494*c1|c1=0.078*c0+0.078*c1[s0];" +
+				"[1:a]pan=stereo|c0=0.354*c0+0.354*c1|c1=0.354*c0+0.354*c1[s1];" +
+				"[2:a]pan=stereo|c0=0.078*c0+0.078*c1|c1=0.494*c0+0.494*c1[s2];" +
+				"[s0][s1][s2]amix=inputs=3:duration=longest",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, filterGraph(tt.inputs, tt.opts, 0, nil))
+		})
+	}
+}
+
+func TestParseWeights(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected map[string]float64
+		wantErr  bool
+	}{
+		{name: "default", value: "", expected: map[string]float64{}},
+		{name: "several", value: "123=0.5, 456=2,", expected: map[string]float64{"123": 0.5, "456": 2}},
+		{name: "muted", value: "123=0", expected: map[string]float64{"123": 0}},
+		{name: "missing weight", value: "123", wantErr: true},
+		{name: "missing user", value: "=0.5", wantErr: true},
+		{name: "not a number", value: "123=half", wantErr: true},
+		{name: "negative", value: "123=-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseWeights(tt.value)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestStreamWeights(t *testing.T) {
+	speakers := map[uint32]string{1: "alice", 2: "music-bot", 3: "bob"}
+	tests := []struct {
+		name     string
+		ssrcs    []uint32
+		weights  map[string]float64
+		expected []float64
+	}{
+		{name: "no weights", ssrcs: []uint32{1, 2, 3}, expected: nil},
+		{name: "same order as the streams", ssrcs: []uint32{3, 2, 1}, weights: map[string]float64{"music-bot": 0.25, "bob": 2}, expected: []float64{2, 0.25, 1}},
+		{name: "unknown speaker", ssrcs: []uint32{4, 2}, weights: map[string]float64{"music-bot": 0.5}, expected: []float64{1, 0.5}},
+		{name: "weighted user not speaking", ssrcs: []uint32{1, 3}, weights: map[string]float64{"music-bot": 0.5}, expected: nil},
+		{name: "weight of 1", ssrcs: []uint32{1, 2}, weights: map[string]float64{"alice": 1}, expected: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, streamWeights(tt.ssrcs, speakers, tt.weights))
+		})
+	}
+}
+
+func TestFilterGraph_weights(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     MixOptions
+		weights  []float64
+		expected string
+	}{
+		{
+			name:     "equal weights",
+			opts:     MixOptions{Duration: MixDurationLongest, Normalization: NormalizationAverage},
+			expected: "amix=inputs=3:duration=longest",
+		},
+		{
+			name:     "weighted",
+			opts:     MixOptions{Duration: MixDurationLongest, Normalization: NormalizationLimiter},
+			weights:  []float64{1, 0.25, 2},
+			expected: "amix=inputs=3:duration=longest:weights=1 0.25 2:normalize=0,alimiter",
+		},
+		{
+			name:     "spatial",
+			opts:     MixOptions{Duration: MixDurationLongest, Normalization: NormalizationAverage, Spatial: true},
+			weights:  []float64{0.5, 1, 1},
+			expected: spatialFilters(3) + "amix=inputs=3:duration=longest:weights=0.5 1 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, filterGraph(3, tt.opts, 0, tt.weights))
+		})
+	}
+}
+
+func TestFilterGraph_multitrack(t *testing.T) {
+	tests := []struct {
+		name     string
+		inputs   int
+		opts     MixOptions
+		length   time.Duration
+		weights  []float64
+		expected string
+	}{
+		{
+			name:   "2 inputs",
+			inputs: 2,
+			opts:   MixOptions{Duration: MixDurationLongest, Normalization: NormalizationAverage, Multitrack: true},
+			length: 10 * time.Second,
+			expected: "[0:a]aformat=channel_layouts=mono,apad=whole_dur=10.000[t0];" +
+				"[1:a]aformat=channel_layouts=mono,apad=whole_dur=10.000[t1];" +
+				"[t0][t1]amerge=inputs=2",
+		},
+		{
+			name:     "1 input",
+			inputs:   1,
+			opts:     MixOptions{Duration: MixDurationLongest, Normalization: NormalizationAverage, Multitrack: true},
+			length:   1500 * time.Millisecond,
+			expected: "[0:a]aformat=channel_layouts=mono,apad=whole_dur=1.500[t0];[t0]amerge=inputs=1",
+		},
+		{
+			name:    "weighted with limiter",
+			inputs:  2,
+			opts:    MixOptions{Duration: MixDurationLongest, Normalization: NormalizationLimiter, Multitrack: true},
+			length:  10 * time.Second,
+			weights: []float64{0.5, 1},
+			expected: "[0:a]aformat=channel_layouts=mono,volume=0.5,apad=whole_dur=10.000[t0];" +
+				"[1:a]aformat=channel_layouts=mono,volume=1,apad=whole_dur=10.000[t1];" +
+				"[t0][t1]amerge=inputs=2,alimiter",
+		},
+		{
+			name:   "spatial is ignored",
+			inputs: 2,
+			opts:   MixOptions{Duration: MixDurationLongest, Normalization: NormalizationDynamic, Spatial: true, Multitrack: true},
+			length: 10 * time.Second,
+			expected: "[0:a]aformat=channel_layouts=mono,apad=whole_dur=10.000[t0];" +
+				"[1:a]aformat=channel_layouts=mono,apad=whole_dur=10.000[t1];" +
+				"[t0][t1]amerge=inputs=2,dynaudnorm",
+		},
+		{
+			name:     "too many inputs",
+			inputs:   MaxMultitrackChannels + 1,
+			opts:     MixOptions{Duration: MixDurationLongest, Normalization: NormalizationAverage, Multitrack: true},
+			length:   10 * time.Second,
+			expected: "amix=inputs=9:duration=longest",
+		},
+		{
+			name:     "unknown length",
+			inputs:   2,
+			opts:     MixOptions{Duration: MixDurationLongest, Normalization: NormalizationAverage, Multitrack: true},
+			expected: "amix=inputs=2:duration=longest",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, filterGraph(tt.inputs, tt.opts, tt.length, tt.weights))
+		})
+	}
+}
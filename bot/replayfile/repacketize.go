@@ -0,0 +1,112 @@
+package replayfile
+
+import "fmt"
+
+const (
+	// MaxFramesPerPacket is the maximum number of 20ms frames in an opus packet: a packet lasts at most 120ms.
+	MaxFramesPerPacket = 6
+
+	maxOpusFrameLength = 1275 // bytes, RFC 6716 section 3.2.1.
+	tocCodeMask        = 0x03 // Frame count code, the last two bits of the TOC byte.
+	tocConfigMask      = 0xFC // Configuration and stereo flag, the first six bits of the TOC byte.
+	tocCodeArbitrary   = 0x03 // Code 3: the packet contains an arbitrary number of frames.
+	vbrFlag            = 0x80 // Set in the frame count byte of a code 3 packet if the frames have different lengths.
+)
+
+// packetEncoder encodes opus packets in a stream. It is implemented by *ogg.Encoder.
+type packetEncoder interface {
+	Encode(opusData []byte, granulePosition int64) error
+}
+
+// repacketizer combines consecutive packets of a stream into multi-frame packets before encoding them.
+// Each packet received from discord contains a single 20ms frame, and each packet has its own OGG page: combining
+// several frames in a packet saves the overhead of a page for each of them.
+//
+// Only single-frame packets (code 0, RFC 6716 section 3.2.2) with the same TOC byte and following each other without
+// a gap are combined. The other packets are encoded as they are. Flush must be called once every packet was encoded.
+type repacketizer struct {
+	encoder         packetEncoder
+	maxFrames       int
+	toc             byte
+	frames          [][]byte
+	granulePosition int64 // Granule position of the last pending frame.
+}
+
+// newRepacketizer creates a repacketizer combining up to maxFrames frames in a packet.
+// If maxFrames is 1 or less, packets are encoded as they are.
+func newRepacketizer(encoder packetEncoder, maxFrames int) *repacketizer {
+	return &repacketizer{encoder: encoder, maxFrames: maxFrames}
+}
+
+// Encode adds the packet ending at granulePosition to the stream.
+func (r *repacketizer) Encode(opus []byte, granulePosition int64) error {
+	if r.maxFrames <= 1 || len(opus) < 2 || opus[0]&tocCodeMask != 0 {
+		if err := r.Flush(); err != nil {
+			return err
+		}
+		return r.encoder.Encode(opus, granulePosition)
+	}
+
+	contiguous := len(r.frames) > 0 && opus[0] == r.toc && granulePosition == r.granulePosition+FrameSize
+	if !contiguous || len(r.frames) == r.maxFrames {
+		if err := r.Flush(); err != nil {
+			return err
+		}
+	}
+
+	r.toc = opus[0]
+	r.frames = append(r.frames, opus[1:])
+	r.granulePosition = granulePosition
+	return nil
+}
+
+// Flush encodes the pending frames.
+func (r *repacketizer) Flush() error {
+	if len(r.frames) == 0 {
+		return nil
+	}
+
+	packet, err := combineFrames(r.toc, r.frames)
+	if err != nil {
+		return err
+	}
+
+	// The packet ends with its last frame.
+	r.frames = r.frames[:0]
+	return r.encoder.Encode(packet, r.granulePosition)
+}
+
+// combineFrames builds an opus packet containing the frames, which share the toc byte.
+// A single frame is a code 0 packet, several frames are a variable bitrate code 3 packet (RFC 6716 section 3.2.5).
+func combineFrames(toc byte, frames [][]byte) ([]byte, error) {
+	if len(frames) == 1 {
+		return append([]byte{toc}, frames[0]...), nil
+	}
+	if len(frames) > MaxFramesPerPacket {
+		return nil, fmt.Errorf("too many frames in a packet: %d", len(frames))
+	}
+
+	packet := []byte{toc&tocConfigMask | tocCodeArbitrary, vbrFlag | byte(len(frames))}
+	for n, frame := range frames {
+		if len(frame) > maxOpusFrameLength {
+			return nil, fmt.Errorf("opus frame is too long: %d bytes", len(frame))
+		}
+		// The length of the last frame is implied by the length of the packet.
+		if n < len(frames)-1 {
+			packet = appendFrameLength(packet, len(frame))
+		}
+	}
+	for _, frame := range frames {
+		packet = append(packet, frame...)
+	}
+	return packet, nil
+}
+
+// appendFrameLength appends the length of a frame, coded on one or two bytes (RFC 6716 section 3.2.1).
+func appendFrameLength(packet []byte, length int) []byte {
+	if length < 252 {
+		return append(packet, byte(length))
+	}
+	first := 252 + length&0x03
+	return append(packet, byte(first), byte((length-first)/4))
+}
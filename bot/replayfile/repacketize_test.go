@@ -0,0 +1,265 @@
+package replayfile
+
+import (
+	"bigbro2/bot/circular"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"os"
+	"testing"
+	"time"
+)
+
+// splitFrames parses an opus packet built by combineFrames and returns its TOC byte, as if it was a single-frame
+// packet, and its frames.
+func splitFrames(t *testing.T, packet []byte) (byte, [][]byte) {
+	t.Helper()
+	require.NotEmpty(t, packet)
+
+	toc := packet[0]
+	if toc&tocCodeMask == 0 {
+		return toc, [][]byte{packet[1:]}
+	}
+
+	require.Equal(t, byte(tocCodeArbitrary), toc&tocCodeMask, "unexpected frame count code")
+	require.GreaterOrEqual(t, len(packet), 2)
+	require.NotZero(t, packet[1]&vbrFlag, "frames are expected to have variable lengths")
+	count := int(packet[1] & 0x3F)
+
+	b := packet[2:]
+	lengths := make([]int, count-1)
+	for n := range lengths {
+		require.NotEmpty(t, b, "truncated frame length")
+		if b[0] < 252 {
+			lengths[n] = int(b[0])
+			b = b[1:]
+			continue
+		}
+		require.GreaterOrEqual(t, len(b), 2, "truncated frame length")
+		lengths[n] = 4*int(b[1]) + int(b[0])
+		b = b[2:]
+	}
+
+	var frames [][]byte
+	for _, length := range lengths {
+		require.GreaterOrEqual(t, len(b), length, "truncated frame")
+		frames = append(frames, b[:length])
+		b = b[length:]
+	}
+	frames = append(frames, b)
+	return toc & tocConfigMask, frames
+}
+
+func TestCombineFrames(t *testing.T) {
+	long := bytes.Repeat([]byte{0x42}, 300)
+	longest := bytes.Repeat([]byte{0x43}, maxOpusFrameLength)
+
+	tests := []struct {
+		name     string
+		toc      byte
+		frames   [][]byte
+		expected []byte
+	}{
+		{
+			name:     "single frame",
+			toc:      0x78,
+			frames:   [][]byte{{0x01, 0x02}},
+			expected: []byte{0x78, 0x01, 0x02},
+		},
+		{
+			name:     "two frames",
+			toc:      0x78,
+			frames:   [][]byte{{0x01, 0x02}, {0x03}},
+			expected: []byte{0x7B, 0x82, 0x02, 0x01, 0x02, 0x03},
+		},
+		{
+			name:     "three frames",
+			toc:      0xFC,
+			frames:   [][]byte{{0x01}, {0x02, 0x03}, {0x04, 0x05, 0x06}},
+			expected: []byte{0xFF, 0x83, 0x01, 0x02, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06},
+		},
+		{
+			name:     "long frame",
+			toc:      0x78,
+			frames:   [][]byte{long, {0x01}},
+			expected: append([]byte{0x7B, 0x82, 252, 12}, append(long, 0x01)...),
+		},
+		{
+			name:     "longest frame",
+			toc:      0x78,
+			frames:   [][]byte{longest, {0x01}},
+			expected: append([]byte{0x7B, 0x82, 255, 255}, append(longest, 0x01)...),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := combineFrames(tt.toc, tt.frames)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+
+			toc, frames := splitFrames(t, got)
+			assert.Equal(t, tt.toc, toc)
+			assert.Equal(t, tt.frames, frames)
+		})
+	}
+}
+
+func TestCombineFrames_invalid(t *testing.T) {
+	_, err := combineFrames(0x78, make([][]byte, MaxFramesPerPacket+1))
+	assert.Error(t, err)
+
+	_, err = combineFrames(0x78, [][]byte{make([]byte, maxOpusFrameLength+1), {0x01}})
+	assert.Error(t, err)
+}
+
+// encodedPacket is a packet written by fakePacketEncoder.
+type encodedPacket struct {
+	opus     []byte
+	pcmIndex int64
+}
+
+type fakePacketEncoder struct {
+	packets []encodedPacket
+}
+
+func (f *fakePacketEncoder) Encode(opusData []byte, pcmSampleIndex int64) error {
+	f.packets = append(f.packets, encodedPacket{opus: append([]byte(nil), opusData...), pcmIndex: pcmSampleIndex})
+	return nil
+}
+
+func TestRepacketizer(t *testing.T) {
+	a := []byte{0x78, 0x0A}
+	b := []byte{0x78, 0x0B}
+	other := []byte{0xF8, 0x0C}
+	multi := []byte{0x79, 0x01, 0x02} // Code 1, already two frames.
+
+	tests := []struct {
+		name      string
+		maxFrames int
+		packets   []encodedPacket
+		expected  []encodedPacket
+	}{
+		{
+			name:      "disabled",
+			maxFrames: 1,
+			packets:   []encodedPacket{{a, 0}, {b, 960}},
+			expected:  []encodedPacket{{a, 0}, {b, 960}},
+		},
+		{
+			name:      "contiguous frames",
+			maxFrames: 3,
+			packets:   []encodedPacket{{a, 0}, {b, 960}, {a, 1920}},
+			expected:  []encodedPacket{{[]byte{0x7B, 0x83, 1, 1, 0x0A, 0x0B, 0x0A}, 1920}},
+		},
+		{
+			name:      "packet full",
+			maxFrames: 2,
+			packets:   []encodedPacket{{a, 0}, {b, 960}, {a, 1920}},
+			expected:  []encodedPacket{{[]byte{0x7B, 0x82, 1, 0x0A, 0x0B}, 960}, {a, 1920}},
+		},
+		{
+			name:      "gap",
+			maxFrames: 3,
+			packets:   []encodedPacket{{a, 0}, {b, 2880}, {a, 3840}},
+			expected:  []encodedPacket{{a, 0}, {[]byte{0x7B, 0x82, 1, 0x0B, 0x0A}, 3840}},
+		},
+		{
+			name:      "different TOC",
+			maxFrames: 3,
+			packets:   []encodedPacket{{a, 0}, {other, 960}, {b, 1920}},
+			expected:  []encodedPacket{{a, 0}, {other, 960}, {b, 1920}},
+		},
+		{
+			name:      "multi-frame packet",
+			maxFrames: 3,
+			packets:   []encodedPacket{{a, 0}, {multi, 960}, {b, 2880}},
+			expected:  []encodedPacket{{a, 0}, {multi, 960}, {b, 2880}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoder := &fakePacketEncoder{}
+			r := newRepacketizer(encoder, tt.maxFrames)
+			for _, pkt := range tt.packets {
+				require.NoError(t, r.Encode(pkt.opus, pkt.pcmIndex))
+			}
+			require.NoError(t, r.Flush())
+			assert.Equal(t, tt.expected, encoder.packets)
+		})
+	}
+}
+
+func TestCreator_createStreamFiles_repacketized(t *testing.T) {
+	audio := []byte{0xFC, 0x12, 0x34, 0x56, 0x78}
+
+	var packets []circular.AudioPacket
+	for _, pcmIndex := range []uint32{0, 960, 1920, 2880, 3840, 6720, 7680} {
+		packets = append(packets, circular.AudioPacket{
+			Time:     testNow.Add(-time.Second),
+			SSRC:     1,
+			PCMIndex: pcmIndex,
+			Opus:     audio,
+		})
+	}
+
+	c := NewCreator(zap.NewNop(), func() time.Time { return testNow }, MixOptions{FramesPerPacket: 3})
+	files := createStreamFiles(t, c, packets, 10*time.Second)
+	require.Len(t, files, 1)
+
+	var granules []int64
+	var frames [][]byte
+	var frameCounts []int
+	for _, p := range readOggPages(t, files[0])[2:] {
+		toc, packetFrames := splitFrames(t, p.Data)
+		granules = append(granules, p.GranulePosition)
+		frameCounts = append(frameCounts, len(packetFrames))
+		for _, frame := range packetFrames {
+			frames = append(frames, append([]byte{toc}, frame...))
+		}
+	}
+
+	// The padding frames have a different TOC byte than the audio, they are not combined with it.
+	assert.Equal(t, []int64{2880, 4800, 6720, 8640}, granules)
+	assert.Equal(t, []int{3, 2, 2, 2}, frameCounts)
+	assert.Equal(t, [][]byte{audio, audio, audio, audio, audio, silentFrame, silentFrame, audio, audio}, frames)
+}
+
+// BenchmarkRepacketize reports the size of the stream file of one minute of speech, for each number of frames per
+// packet.
+func BenchmarkRepacketize(b *testing.B) {
+	opus := append([]byte{0x78}, bytes.Repeat([]byte{0x55}, 80)...) // Typical size of a discord voice packet.
+	packets := make([]streamPacket, 3000)
+	for n := range packets {
+		packets[n] = streamPacket{
+			AudioPacket: &circular.AudioPacket{
+				Time: testNow.Add(time.Duration(n) * 20 * time.Millisecond),
+				SSRC: 1,
+				Opus: opus,
+			},
+			pcmIndex: int64(n) * FrameSize,
+		}
+	}
+
+	for _, framesPerPacket := range []int{1, 2, 3, MaxFramesPerPacket} {
+		b.Run(fmt.Sprintf("%d frames", framesPerPacket), func(b *testing.B) {
+			c := NewCreator(zap.NewNop(), time.Now, MixOptions{FramesPerPacket: framesPerPacket})
+
+			var size int64
+			for i := 0; i < b.N; i++ {
+				var files []string
+				_, err := c.createStreamFile(context.Background(), 1, packets, testNow, 0, &files)
+				for _, f := range files {
+					stat, statErr := os.Stat(f)
+					require.NoError(b, statErr)
+					size = stat.Size()
+					require.NoError(b, os.Remove(f))
+				}
+				require.NoError(b, err)
+			}
+			b.ReportMetric(float64(size), "bytes/file")
+		})
+	}
+}
@@ -0,0 +1,22 @@
+package replayfile
+
+import (
+	"context"
+	"strconv"
+)
+
+// SpeechSampleRate is the sample rate of the audio given to speech-to-text services, which rarely use more.
+const SpeechSampleRate = 16_000
+
+// ConvertForSpeech converts the replay at path into a mono WAV file at SpeechSampleRate, the format most
+// speech-to-text services expect, written at out.
+func (c *Creator) ConvertForSpeech(ctx context.Context, path, out string) error {
+	done, err := c.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	_, err = c.runFFmpeg(ctx, []string{"-y", "-i", path, "-ac", "1", "-ar", strconv.Itoa(SpeechSampleRate), "-f", "wav", out})
+	return err
+}
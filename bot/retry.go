@@ -0,0 +1,77 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"math/rand"
+	"time"
+)
+
+// backoff configures how an operation is retried: the delay between two attempts doubles after each failure, up to
+// maxDelay. A random jitter of up to half the delay is added so several instances do not retry in lockstep.
+type backoff struct {
+	maxAttempts  int
+	initialDelay time.Duration
+	maxDelay     time.Duration
+}
+
+var defaultOpenBackoff = backoff{
+	maxAttempts:  5,
+	initialDelay: time.Second,
+	maxDelay:     30 * time.Second,
+}
+
+// defaultDeferBackoff retries the deferred response to an interaction. It gives up in time for the replay to be sent
+// some other way before the user gives up on it.
+var defaultDeferBackoff = backoff{
+	maxAttempts:  3,
+	initialDelay: 250 * time.Millisecond,
+	maxDelay:     time.Second,
+}
+
+// defaultGuildBackoff waits for the guild to be in the state cache. Discord sends the large guilds some time after the
+// session is ready, the bot gives up on them after about 2 seconds.
+var defaultGuildBackoff = backoff{
+	maxAttempts:  5,
+	initialDelay: 100 * time.Millisecond,
+	maxDelay:     time.Second,
+}
+
+// retry calls f until it succeeds, the attempts are exhausted or the context is cancelled.
+// It returns the error of the last attempt.
+func retry(ctx context.Context, logger *zap.Logger, b backoff, f func() error) error {
+	delay := b.initialDelay
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		logger.Debug("attempting operation", zap.Int("attempt", attempt), zap.Int("max_attempts", b.maxAttempts))
+
+		err = f()
+		if err == nil {
+			return nil
+		}
+		if attempt >= b.maxAttempts {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+
+		wait := delay
+		if jitter := int64(delay / 2); jitter > 0 {
+			wait += time.Duration(rand.Int63n(jitter))
+		}
+		logger.Warn("operation failed, retrying", zap.Int("attempt", attempt), zap.Duration("wait", wait), zap.Error(err))
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		delay *= 2
+		if delay > b.maxDelay {
+			delay = b.maxDelay
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package bot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// settings holds the configuration of each guild that can be changed at runtime with the /config command.
+// The guilds that never changed it use the defaults, set from the environment. If path is not empty, the settings
+// are loaded from it on startup and saved to it on every change, so they survive a restart.
+// It is safe for concurrent use.
+type settings struct {
+	sync.RWMutex
+	path            string // JSON file the settings are persisted to, empty to keep them in memory.
+	defaultDuration time.Duration
+	maxDuration     time.Duration // Highest default duration accepted.
+	guilds          map[string]guildSettings
+}
+
+// guildSettings is the configuration of a guild, as persisted. Zero values mean the default.
+type guildSettings struct {
+	DefaultSeconds int `json:"default_seconds,omitempty"`
+}
+
+// settingsFile is the content of the file the settings are persisted to.
+type settingsFile struct {
+	Guilds map[string]guildSettings `json:"guilds"`
+}
+
+func newSettings(path string, defaultDuration, maxDuration time.Duration) *settings {
+	return &settings{
+		path:            path,
+		defaultDuration: defaultDuration,
+		maxDuration:     maxDuration,
+		guilds:          map[string]guildSettings{},
+	}
+}
+
+// Load reads the settings from the file, if any. A missing file is not an error: every guild uses the defaults.
+func (s *settings) Load() error {
+	if s.path == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read settings: %w", err)
+	}
+
+	var f settingsFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return fmt.Errorf("could not decode settings %q: %w", s.path, err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if f.Guilds != nil {
+		s.guilds = f.Guilds
+	}
+	return nil
+}
+
+// DefaultDuration returns the duration of a replay in the guild when the user does not specify one.
+func (s *settings) DefaultDuration(guildID string) time.Duration {
+	s.RLock()
+	defer s.RUnlock()
+
+	// A value out of range, e.g. after lowering the longest replay, falls back to the default.
+	d := time.Duration(s.guilds[guildID].DefaultSeconds) * time.Second
+	if d < minDuration || d > s.maxDuration {
+		return s.defaultDuration
+	}
+	return d
+}
+
+// CheckDefaultDuration returns an error if d is outside the range accepted by the replay command.
+func (s *settings) CheckDefaultDuration(d time.Duration) error {
+	if d < minDuration || d > s.maxDuration {
+		return fmt.Errorf("duration must be between %d and %d seconds", int(minDuration.Seconds()), int(s.maxDuration.Seconds()))
+	}
+	return nil
+}
+
+// SetDefaultDuration changes the duration of a replay in the guild when the user does not specify one, and saves
+// the settings. It returns an error if the duration is rejected by CheckDefaultDuration, or if the settings could not
+// be saved, in which case they are left unchanged.
+func (s *settings) SetDefaultDuration(guildID string, d time.Duration) error {
+	if err := s.CheckDefaultDuration(d); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	g := s.guilds[guildID]
+	g.DefaultSeconds = int(d.Seconds())
+	return s.update(guildID, g)
+}
+
+// update saves the settings with g as the settings of the guild, then applies them. s must be locked.
+func (s *settings) update(guildID string, g guildSettings) error {
+	guilds := make(map[string]guildSettings, len(s.guilds)+1)
+	for id, settings := range s.guilds {
+		guilds[id] = settings
+	}
+	guilds[guildID] = g
+
+	if err := s.save(guilds); err != nil {
+		return err
+	}
+	s.guilds = guilds
+	return nil
+}
+
+// save writes the settings to the file, if any. The file is replaced at once, so a crash while saving does not lose
+// the previous settings.
+func (s *settings) save(guilds map[string]guildSettings) error {
+	if s.path == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(settingsFile{Guilds: guilds}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode settings: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("could not save settings: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("could not save settings: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not save settings: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("could not save settings: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package bot
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSettings_SetDefaultDuration(t *testing.T) {
+	tests := []struct {
+		name     string
+		duration time.Duration
+		wantErr  bool
+	}{
+		{name: "within range", duration: 45 * time.Second},
+		{name: "minimum", duration: minDuration},
+		{name: "maximum", duration: maxDuration},
+		{name: "below minimum", duration: time.Second, wantErr: true},
+		{name: "above maximum", duration: maxDuration + time.Second, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSettings("", defaultDuration, maxDuration)
+
+			err := s.SetDefaultDuration("guild-id", tt.duration)
+			if tt.wantErr {
+				require.Error(t, err)
+				assert.Equal(t, defaultDuration, s.DefaultDuration("guild-id"))
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.duration, s.DefaultDuration("guild-id"))
+			assert.Equal(t, defaultDuration, s.DefaultDuration("other-guild-id"))
+		})
+	}
+}
+
+func TestSettings_roundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "settings.json")
+
+	s := newSettings(path, defaultDuration, maxDuration)
+	require.NoError(t, s.Load())
+	assert.Equal(t, defaultDuration, s.DefaultDuration("guild-id"))
+	require.NoError(t, s.SetDefaultDuration("guild-id", 45*time.Second))
+
+	// The settings are kept after a restart, the guilds that did not change them still use the defaults.
+	loaded := newSettings(path, 20*time.Second, maxDuration)
+	require.NoError(t, loaded.Load())
+	assert.Equal(t, 45*time.Second, loaded.DefaultDuration("guild-id"))
+	assert.Equal(t, 20*time.Second, loaded.DefaultDuration("other-guild-id"))
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "temporary file left behind")
+}
+
+func TestSettings_Load(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected time.Duration
+		wantErr  bool
+	}{
+		{name: "guild configured", content: `{"guilds":{"guild-id":{"default_seconds":45}}}`, expected: 45 * time.Second},
+		{name: "other guild configured", content: `{"guilds":{"other-guild-id":{"default_seconds":45}}}`, expected: defaultDuration},
+		{name: "no guilds", content: `{}`, expected: defaultDuration},
+		{name: "above maximum", content: `{"guilds":{"guild-id":{"default_seconds":3600}}}`, expected: defaultDuration},
+		{name: "invalid", content: `{"guilds":`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "settings.json")
+			require.NoError(t, os.WriteFile(path, []byte(tt.content), 0o600))
+
+			s := newSettings(path, defaultDuration, maxDuration)
+			err := s.Load()
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, s.DefaultDuration("guild-id"))
+		})
+	}
+}
+
+func TestSettings_SetDefaultDuration_saveFailure(t *testing.T) {
+	s := newSettings(filepath.Join(t.TempDir(), "missing", "settings.json"), defaultDuration, maxDuration)
+
+	require.Error(t, s.SetDefaultDuration("guild-id", 45*time.Second))
+	assert.Equal(t, defaultDuration, s.DefaultDuration("guild-id"))
+}
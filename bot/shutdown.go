@@ -0,0 +1,105 @@
+package bot
+
+import (
+	"bigbro2/bot/cleanup"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defaultDrainTimeout is how long the shutdown waits for the replays being created and sent.
+const defaultDrainTimeout = 2 * time.Minute
+
+// shutdownPhase is a step of the shutdown of the bot. Every cleanup of a phase runs before the ones of the next phase,
+// whatever the order they were registered in.
+type shutdownPhase int
+
+const (
+	// stopAccepting stops handling new interactions and events.
+	stopAccepting shutdownPhase = iota
+	// drainRequests waits for the requests being handled, so the replays asked right before the shutdown are sent.
+	drainRequests
+	// disconnectVoice leaves the voice channel.
+	disconnectVoice
+	// closeSession closes the connection to Discord, which the previous phases may still need.
+	closeSession
+	shutdownPhases // Number of phases.
+)
+
+// shutdown runs the cleanups of Run in a fixed order, see shutdownPhase.
+type shutdown struct {
+	cleanups [shutdownPhases][]namedCleanup
+}
+
+type namedCleanup struct {
+	name string
+	f    cleanup.Func
+}
+
+// add registers a cleanup to run during phase. The cleanups of a phase run in the order they were added in.
+func (s *shutdown) add(phase shutdownPhase, name string, f cleanup.Func) {
+	s.cleanups[phase] = append(s.cleanups[phase], namedCleanup{name: name, f: f})
+}
+
+// run runs the cleanups, phase by phase. The failure of a cleanup is logged by b and does not stop the next ones.
+func (s *shutdown) run(b *Bot) {
+	for _, cleanups := range s.cleanups {
+		for _, c := range cleanups {
+			b.cleanup(c.name, c.f)
+		}
+	}
+}
+
+// drainRequests returns the cleanup waiting for the requests being handled. If they are not done after drainTimeout,
+// they are cancelled with cancel.
+func (b *Bot) drainRequests(cancel context.CancelFunc) cleanup.Func {
+	return func() error {
+		if !b.requests.drain(b.drainTimeout) {
+			cancel()
+			return fmt.Errorf("requests still running after %s, cancelled", b.drainTimeout)
+		}
+		return nil
+	}
+}
+
+// requests tracks the interactions and reactions being handled, so the shutdown waits for their replays to be sent.
+type requests struct {
+	mu       sync.Mutex
+	closed   bool
+	inFlight sync.WaitGroup
+}
+
+// begin registers a request being handled. The returned function must be called once it is done.
+// It returns false if the bot is shutting down, in which case the request must be dropped.
+func (r *requests) begin() (func(), bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil, false
+	}
+	r.inFlight.Add(1)
+	return r.inFlight.Done, true
+}
+
+// drain stops accepting requests and waits for the ones being handled, for at most timeout.
+// It returns false if some were still being handled after timeout.
+func (r *requests) drain(timeout time.Duration) bool {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
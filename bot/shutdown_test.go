@@ -0,0 +1,103 @@
+package bot
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"sync"
+	"testing"
+	"time"
+)
+
+// shutdownEvents records what happened during a shutdown, in order.
+type shutdownEvents struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (e *shutdownEvents) record(event string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.events = append(e.events, event)
+}
+
+func (e *shutdownEvents) cleanup(event string) func() error {
+	return func() error {
+		e.record(event)
+		return nil
+	}
+}
+
+func TestShutdown_order(t *testing.T) {
+	var events shutdownEvents
+	var s shutdown
+	s.add(closeSession, "discord session", events.cleanup("session closed"))
+	s.add(disconnectVoice, "voice channel manager", events.cleanup("voice disconnected"))
+	s.add(stopAccepting, "command handler", events.cleanup("command handler removed"))
+	s.add(drainRequests, "requests", events.cleanup("requests drained"))
+	s.add(drainRequests, "replay command", events.cleanup("replay command closed"))
+	s.add(stopAccepting, "reaction handler", events.cleanup("reaction handler removed"))
+
+	s.run(&Bot{logger: zap.NewNop()})
+
+	assert.Equal(t, []string{
+		"command handler removed",
+		"reaction handler removed",
+		"requests drained",
+		"replay command closed",
+		"voice disconnected",
+		"session closed",
+	}, events.events)
+}
+
+func TestShutdown_inFlightReplay(t *testing.T) {
+	b := &Bot{logger: zap.NewNop(), drainTimeout: time.Minute}
+	var events shutdownEvents
+
+	// A replay was asked right before the shutdown, it is still being uploaded.
+	done, ok := b.requests.begin()
+	require.True(t, ok)
+	stoppedAccepting := make(chan struct{})
+	go func() {
+		<-stoppedAccepting
+		time.Sleep(10 * time.Millisecond)
+		events.record("replay uploaded")
+		done()
+	}()
+
+	requestsCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	var s shutdown
+	s.add(stopAccepting, "command handler", func() error {
+		close(stoppedAccepting)
+		return nil
+	})
+	s.add(drainRequests, "requests", b.drainRequests(cancelRequests))
+	s.add(disconnectVoice, "voice channel manager", events.cleanup("voice disconnected"))
+	s.add(closeSession, "discord session", events.cleanup("session closed"))
+	s.run(b)
+
+	assert.Equal(t, []string{"replay uploaded", "voice disconnected", "session closed"}, events.events)
+	assert.NoError(t, requestsCtx.Err())
+
+	// The interactions received once the bot is shutting down are dropped.
+	_, ok = b.requests.begin()
+	assert.False(t, ok)
+}
+
+func TestBot_drainRequests_timeout(t *testing.T) {
+	b := &Bot{logger: zap.NewNop(), drainTimeout: 10 * time.Millisecond}
+
+	done, ok := b.requests.begin()
+	require.True(t, ok)
+	defer done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err := b.drainRequests(cancel)()
+	assert.EqualError(t, err, "requests still running after 10ms, cancelled")
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+}
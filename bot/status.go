@@ -0,0 +1,117 @@
+package bot
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"go.uber.org/zap"
+	"strings"
+	"text/template"
+)
+
+// DefaultStatusTemplate is the status of the bot when none is configured, shown as "Listening to ...".
+const DefaultStatusTemplate = `{{if .Channel}}#{{.Channel}}, {{.Members}} {{if eq .Members 1}}person{{else}}people{{end}}{{else}}nobody{{end}}`
+
+// maxStatusLength is the longest activity name Discord accepts.
+const maxStatusLength = 128
+
+type (
+	// statusData is what the status template can show.
+	statusData struct {
+		Channel string // Name of the voice channel the bot is in, empty if it is not in one.
+		Members int    // Number of people in the voice channel, the bot excluded.
+	}
+	// statusSession is the part of the discord session used to update the presence of the bot.
+	statusSession interface {
+		UpdateStatusComplex(usd discordgo.UpdateStatusData) error
+	}
+)
+
+// ParseStatusTemplate parses the template of the status of the bot, e.g. "{{.Members}} people in {{.Channel}}".
+// The empty string is DefaultStatusTemplate.
+func ParseStatusTemplate(s string) (*template.Template, error) {
+	if s == "" {
+		s = DefaultStatusTemplate
+	}
+
+	tmpl, err := template.New("status").Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fields that do not exist are only detected when the template is executed.
+	if _, err := renderStatus(tmpl, statusData{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// renderStatus returns the status shown for the data, trimmed and shortened to maxStatusLength.
+func renderStatus(tmpl *template.Template, data statusData) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("could not render status: %w", err)
+	}
+
+	status := strings.TrimSpace(b.String())
+	if runes := []rune(status); len(runes) > maxStatusLength {
+		status = string(runes[:maxStatusLength-1]) + "…"
+	}
+	return status, nil
+}
+
+// channelStatus returns the statusData of the bot in the voice channel. A nil channel means the bot is in none.
+func (b *Bot) channelStatus(channelID *string) statusData {
+	if channelID == nil {
+		return statusData{}
+	}
+
+	data := statusData{Channel: *channelID}
+	if channel, err := b.session.State.Channel(*channelID); err == nil {
+		data.Channel = channel.Name
+	}
+
+	botUserID := ""
+	if b.session.State.User != nil {
+		botUserID = b.session.State.User.ID
+	}
+	if guild, err := b.session.State.Guild(b.guildID); err == nil {
+		for _, vs := range guild.VoiceStates {
+			if vs.ChannelID == *channelID && vs.UserID != botUserID {
+				data.Members++
+			}
+		}
+	}
+	return data
+}
+
+// updateStatus shows the status of the bot in the voice channel, unless it is already shown.
+// The status is cosmetic: failing to update it is only logged.
+func (b *Bot) updateStatus(channelID *string) {
+	status, err := renderStatus(b.statusTemplate, b.channelStatus(channelID))
+	if err != nil {
+		b.logger.Warn("could not update status", zap.Error(err))
+		return
+	}
+
+	b.statusMu.Lock()
+	defer b.statusMu.Unlock()
+
+	if status == b.lastStatus {
+		return
+	}
+
+	// An empty status removes the activity.
+	activities := []*discordgo.Activity{}
+	if status != "" {
+		activities = append(activities, &discordgo.Activity{Name: status, Type: discordgo.ActivityTypeListening})
+	}
+	err = b.status.UpdateStatusComplex(discordgo.UpdateStatusData{
+		Activities: activities,
+		Status:     string(discordgo.StatusOnline),
+	})
+	if err != nil {
+		b.logger.Warn("could not update status", zap.Error(err))
+		return
+	}
+	b.lastStatus = status
+}
@@ -0,0 +1,115 @@
+package bot
+
+import (
+	"errors"
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+type fakeStatusSession struct {
+	err     error
+	updates []discordgo.UpdateStatusData
+}
+
+func (f *fakeStatusSession) UpdateStatusComplex(usd discordgo.UpdateStatusData) error {
+	f.updates = append(f.updates, usd)
+	return f.err
+}
+
+func TestParseStatusTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		data     statusData
+		expected string
+		wantErr  bool
+	}{
+		{name: "default", data: statusData{Channel: "general", Members: 3}, expected: "#general, 3 people"},
+		{name: "default with one member", data: statusData{Channel: "general", Members: 1}, expected: "#general, 1 person"},
+		{name: "default without channel", data: statusData{}, expected: "nobody"},
+		{
+			name:     "custom",
+			template: "{{.Members}} speakers in {{.Channel}}",
+			data:     statusData{Channel: "gaming", Members: 2},
+			expected: "2 speakers in gaming",
+		},
+		{
+			name:     "too long",
+			template: "{{.Channel}}",
+			data:     statusData{Channel: strings.Repeat("é", 200)},
+			expected: strings.Repeat("é", maxStatusLength-1) + "…",
+		},
+		{name: "invalid syntax", template: "{{.Channel", wantErr: true},
+		{name: "unknown field", template: "{{.Speakers}}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := ParseStatusTemplate(tt.template)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			got, err := renderStatus(tmpl, tt.data)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestBot_channelStatus(t *testing.T) {
+	session := newTestSessionWithVoiceStates(t, "guild-id", []*discordgo.VoiceState{
+		{UserID: "a", ChannelID: "channel-id"},
+		{UserID: "b", ChannelID: "channel-id", SelfMute: true},
+		{UserID: "bot-user-id", ChannelID: "channel-id"},
+		{UserID: "c", ChannelID: "other-channel-id"},
+	})
+	require.NoError(t, session.State.ChannelAdd(&discordgo.Channel{ID: "channel-id", GuildID: "guild-id", Name: "general"}))
+	b := &Bot{session: session, guildID: "guild-id"}
+
+	channelID := "channel-id"
+	assert.Equal(t, statusData{Channel: "general", Members: 2}, b.channelStatus(&channelID))
+
+	// The name of a channel missing from the state is unknown.
+	otherID := "other-channel-id"
+	assert.Equal(t, statusData{Channel: "other-channel-id", Members: 1}, b.channelStatus(&otherID))
+
+	assert.Equal(t, statusData{}, b.channelStatus(nil))
+}
+
+func TestBot_updateStatus(t *testing.T) {
+	session := newTestSessionWithVoiceStates(t, "guild-id", []*discordgo.VoiceState{{UserID: "a", ChannelID: "channel-id"}})
+	status := &fakeStatusSession{}
+	b := &Bot{
+		logger:         zap.NewNop(),
+		session:        session,
+		guildID:        "guild-id",
+		status:         status,
+		statusTemplate: template.Must(ParseStatusTemplate("{{.Members}} in {{.Channel}}")),
+	}
+	channelID := "channel-id"
+
+	b.updateStatus(&channelID)
+	require.Len(t, status.updates, 1)
+	require.Len(t, status.updates[0].Activities, 1)
+	assert.Equal(t, "1 in channel-id", status.updates[0].Activities[0].Name)
+	assert.Equal(t, discordgo.ActivityTypeListening, status.updates[0].Activities[0].Type)
+
+	// The status did not change, it is not sent again.
+	b.updateStatus(&channelID)
+	assert.Len(t, status.updates, 1)
+
+	// A failed update is retried with the next change.
+	status.err = errors.New("websocket closed")
+	b.updateStatus(nil)
+	status.err = nil
+	b.updateStatus(nil)
+	require.Len(t, status.updates, 3)
+	assert.Equal(t, "0 in", status.updates[2].Activities[0].Name)
+}
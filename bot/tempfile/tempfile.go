@@ -0,0 +1,88 @@
+package tempfile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Prefix starts the name of every temporary file created by the bot, so Sweep only removes those.
+const Prefix = "replay-bot-"
+
+// Create creates a new temporary file in the default directory for temporary files, like os.CreateTemp. Its name
+// starts with Prefix.
+func Create(pattern string) (*os.File, error) {
+	return os.CreateTemp("", Prefix+pattern)
+}
+
+// Sweep removes the temporary files of the bot in dir last modified more than maxAge before now. They are normally
+// removed once used, but are left behind if the bot crashes while creating a replay.
+// It returns the number of files removed.
+func Sweep(dir string, now time.Time, maxAge time.Duration) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, fmt.Errorf("could not list temporary files: %w", err)
+	}
+
+	files := make([]fs.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // Removed since it was listed.
+		}
+		if err != nil {
+			return 0, fmt.Errorf("could not read temporary file info: %w", err)
+		}
+		files = append(files, info)
+	}
+
+	removed := 0
+	for _, name := range stale(files, now, maxAge) {
+		err := os.Remove(filepath.Join(dir, name))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return removed, fmt.Errorf("could not remove temporary file: %w", err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// stale returns the names of the regular files named with Prefix last modified more than maxAge before now.
+func stale(files []fs.FileInfo, now time.Time, maxAge time.Duration) []string {
+	var names []string
+	for _, f := range files {
+		if !f.Mode().IsRegular() || !strings.HasPrefix(f.Name(), Prefix) {
+			continue
+		}
+		if now.Sub(f.ModTime()) > maxAge {
+			names = append(names, f.Name())
+		}
+	}
+	return names
+}
+
+// Run calls Sweep on dir every interval until ctx is done.
+func Run(ctx context.Context, logger *zap.Logger, dir string, now func() time.Time, maxAge, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			removed, err := Sweep(dir, now(), maxAge)
+			if err != nil {
+				logger.Warn("failed to sweep temporary files", zap.Error(err))
+			} else if removed > 0 {
+				logger.Info("removed stale temporary files", zap.Int("removed", removed))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
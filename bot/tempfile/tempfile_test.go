@@ -0,0 +1,105 @@
+package tempfile
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeFileInfo is a file of a fake directory.
+type fakeFileInfo struct {
+	name    string
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (f fakeFileInfo) Name() string       { return f.name }
+func (f fakeFileInfo) Size() int64        { return 0 }
+func (f fakeFileInfo) Mode() fs.FileMode  { return f.mode }
+func (f fakeFileInfo) ModTime() time.Time { return f.modTime }
+func (f fakeFileInfo) IsDir() bool        { return f.mode.IsDir() }
+func (f fakeFileInfo) Sys() interface{}   { return nil }
+
+func TestStale(t *testing.T) {
+	now := time.Unix(1_000_000, 0)
+	tests := []struct {
+		name     string
+		file     fakeFileInfo
+		expected bool
+	}{
+		{
+			name:     "old file of the bot",
+			file:     fakeFileInfo{name: Prefix + "123.opus", modTime: now.Add(-2 * time.Hour)},
+			expected: true,
+		},
+		{
+			name: "recent file of the bot",
+			file: fakeFileInfo{name: Prefix + "123.opus", modTime: now.Add(-time.Minute)},
+		},
+		{
+			name: "exactly max age",
+			file: fakeFileInfo{name: Prefix + "123.opus", modTime: now.Add(-time.Hour)},
+		},
+		{
+			name: "old file of another program",
+			file: fakeFileInfo{name: "123.opus", modTime: now.Add(-2 * time.Hour)},
+		},
+		{
+			name: "old directory of the bot",
+			file: fakeFileInfo{name: Prefix + "dir", mode: fs.ModeDir, modTime: now.Add(-2 * time.Hour)},
+		},
+		{
+			name: "old symlink of the bot",
+			file: fakeFileInfo{name: Prefix + "link", mode: fs.ModeSymlink, modTime: now.Add(-2 * time.Hour)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names := stale([]fs.FileInfo{tt.file}, now, time.Hour)
+			if tt.expected {
+				assert.Equal(t, []string{tt.file.name}, names)
+			} else {
+				assert.Empty(t, names)
+			}
+		})
+	}
+}
+
+func TestSweep(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	create := func(name string, modTime time.Time) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, nil, 0o600))
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+		return path
+	}
+
+	stalePath := create(Prefix+"stale.opus", now.Add(-2*time.Hour))
+	recentPath := create(Prefix+"recent.opus", now)
+	otherPath := create("other.opus", now.Add(-2*time.Hour))
+
+	removed, err := Sweep(dir, now, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.NoFileExists(t, stalePath)
+	assert.FileExists(t, recentPath)
+	assert.FileExists(t, otherPath)
+}
+
+func TestCreate(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+
+	f, err := Create("*.opus")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	name := filepath.Base(f.Name())
+	assert.True(t, strings.HasPrefix(name, Prefix), name)
+	assert.True(t, strings.HasSuffix(name, ".opus"), name)
+}
@@ -0,0 +1,62 @@
+package voicechannel
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+)
+
+// AccessError is returned when the bot cannot record a voice channel, because of its permissions or because the
+// channel is full. Discord would refuse the connection anyway, but with an error that does not say why.
+type AccessError struct {
+	ChannelID string
+	Reason    string // Why the bot cannot join, e.g. "missing the Connect permission".
+}
+
+func (e *AccessError) Error() string {
+	return fmt.Sprintf("cannot join voice channel %s: %s", e.ChannelID, e.Reason)
+}
+
+// checkAccess returns an AccessError if the bot cannot join and hear the voice channel, using the permission overwrites
+// of the channel, the roles of the bot and the user limit of the channel as cached in the state.
+// The bot joins muted, so it does not need the Speak permission. It returns nil when the state does not know the
+// channel, the guild or the bot: the cache may be incomplete, Discord then has the final say.
+func checkAccess(state *discordgo.State, channelID string) error {
+	if state == nil || state.User == nil {
+		return nil
+	}
+	botUserID := state.User.ID
+
+	channel, err := state.Channel(channelID)
+	if err != nil {
+		return nil
+	}
+	permissions, err := state.UserChannelPermissions(botUserID, channelID)
+	if err != nil {
+		return nil
+	}
+
+	if permissions&discordgo.PermissionViewChannel == 0 {
+		return &AccessError{ChannelID: channelID, Reason: "missing the View Channel permission"}
+	}
+	if permissions&discordgo.PermissionVoiceConnect == 0 {
+		return &AccessError{ChannelID: channelID, Reason: "missing the Connect permission"}
+	}
+
+	// Members who can move members join full channels.
+	if channel.UserLimit > 0 && permissions&discordgo.PermissionVoiceMoveMembers == 0 {
+		guild, err := state.Guild(channel.GuildID)
+		if err != nil {
+			return nil
+		}
+		users := 0
+		for _, vs := range guild.VoiceStates {
+			if vs.ChannelID == channelID && vs.UserID != botUserID {
+				users++
+			}
+		}
+		if users >= channel.UserLimit {
+			return &AccessError{ChannelID: channelID, Reason: fmt.Sprintf("the channel is full (%d/%d)", users, channel.UserLimit)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package voicechannel
+
+import (
+	"bigbro2/bot/replayfile"
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+const (
+	accessGuildID   = "guild-id"
+	accessChannelID = "channel-id"
+	accessBotID     = "bot-id"
+	accessRoleID    = "bot-role-id"
+)
+
+// newAccessState returns a state where the bot has a role with rolePermissions, and the voice channel has the
+// overwrites, the user limit and the users given.
+func newAccessState(t *testing.T, rolePermissions int64, overwrites []*discordgo.PermissionOverwrite, userLimit int, users ...string) *discordgo.State {
+	t.Helper()
+
+	state := discordgo.NewState()
+	state.User = &discordgo.User{ID: accessBotID}
+
+	var voiceStates []*discordgo.VoiceState
+	for _, userID := range users {
+		voiceStates = append(voiceStates, &discordgo.VoiceState{GuildID: accessGuildID, ChannelID: accessChannelID, UserID: userID})
+	}
+	require.NoError(t, state.GuildAdd(&discordgo.Guild{
+		ID:      accessGuildID,
+		OwnerID: "owner-id",
+		Roles: []*discordgo.Role{
+			// @everyone cannot do anything.
+			{ID: accessGuildID},
+			{ID: accessRoleID, Permissions: rolePermissions},
+		},
+		Channels: []*discordgo.Channel{{
+			ID:                   accessChannelID,
+			GuildID:              accessGuildID,
+			Type:                 discordgo.ChannelTypeGuildVoice,
+			PermissionOverwrites: overwrites,
+			UserLimit:            userLimit,
+		}},
+		VoiceStates: voiceStates,
+	}))
+	require.NoError(t, state.MemberAdd(&discordgo.Member{
+		GuildID: accessGuildID,
+		User:    &discordgo.User{ID: accessBotID},
+		Roles:   []string{accessRoleID},
+	}))
+	return state
+}
+
+func TestCheckAccess(t *testing.T) {
+	const voice = discordgo.PermissionViewChannel | discordgo.PermissionVoiceConnect
+
+	tests := []struct {
+		name            string
+		rolePermissions int64
+		overwrites      []*discordgo.PermissionOverwrite
+		userLimit       int
+		users           []string
+		expected        string
+	}{
+		{name: "allowed", rolePermissions: voice},
+		{name: "no permissions", expected: "missing the View Channel permission"},
+		{
+			name:            "connect missing",
+			rolePermissions: discordgo.PermissionViewChannel,
+			expected:        "missing the Connect permission",
+		},
+		{name: "administrator", rolePermissions: discordgo.PermissionAdministrator},
+		{
+			name:            "connect denied to the role",
+			rolePermissions: voice,
+			overwrites: []*discordgo.PermissionOverwrite{
+				{ID: accessRoleID, Type: discordgo.PermissionOverwriteTypeRole, Deny: discordgo.PermissionVoiceConnect},
+			},
+			expected: "missing the Connect permission",
+		},
+		{
+			name:            "connect allowed to the bot",
+			rolePermissions: discordgo.PermissionViewChannel,
+			overwrites: []*discordgo.PermissionOverwrite{
+				{ID: accessRoleID, Type: discordgo.PermissionOverwriteTypeRole, Deny: discordgo.PermissionVoiceConnect},
+				{ID: accessBotID, Type: discordgo.PermissionOverwriteTypeMember, Allow: discordgo.PermissionVoiceConnect},
+			},
+		},
+		{
+			name:            "channel hidden from everyone",
+			rolePermissions: voice,
+			overwrites: []*discordgo.PermissionOverwrite{
+				{ID: accessGuildID, Type: discordgo.PermissionOverwriteTypeRole, Deny: discordgo.PermissionViewChannel},
+			},
+			expected: "missing the View Channel permission",
+		},
+		{
+			name:            "channel hidden from everyone but the role",
+			rolePermissions: voice,
+			overwrites: []*discordgo.PermissionOverwrite{
+				{ID: accessGuildID, Type: discordgo.PermissionOverwriteTypeRole, Deny: discordgo.PermissionViewChannel},
+				{ID: accessRoleID, Type: discordgo.PermissionOverwriteTypeRole, Allow: discordgo.PermissionViewChannel},
+			},
+		},
+		{
+			name:            "room left",
+			rolePermissions: voice,
+			userLimit:       3,
+			users:           []string{"alice-id", "bob-id"},
+		},
+		{
+			name:            "full",
+			rolePermissions: voice,
+			userLimit:       2,
+			users:           []string{"alice-id", "bob-id"},
+			expected:        "the channel is full (2/2)",
+		},
+		{
+			name:            "full but allowed to move members",
+			rolePermissions: voice | discordgo.PermissionVoiceMoveMembers,
+			userLimit:       2,
+			users:           []string{"alice-id", "bob-id"},
+		},
+		{
+			name:            "bot already counted",
+			rolePermissions: voice,
+			userLimit:       2,
+			users:           []string{"alice-id", accessBotID},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := newAccessState(t, tt.rolePermissions, tt.overwrites, tt.userLimit, tt.users...)
+
+			err := checkAccess(state, accessChannelID)
+			if tt.expected == "" {
+				assert.NoError(t, err)
+				return
+			}
+			var accessErr *AccessError
+			require.ErrorAs(t, err, &accessErr)
+			assert.Equal(t, accessChannelID, accessErr.ChannelID)
+			assert.Equal(t, tt.expected, accessErr.Reason)
+		})
+	}
+}
+
+func TestCheckAccess_unknown(t *testing.T) {
+	assert.NoError(t, checkAccess(nil, accessChannelID))
+	assert.NoError(t, checkAccess(discordgo.NewState(), accessChannelID))
+
+	// The channel is not cached.
+	state := newAccessState(t, 0, nil, 0)
+	assert.NoError(t, checkAccess(state, "other-channel-id"))
+}
+
+func TestManager_connectToNewVoiceChannel_noAccess(t *testing.T) {
+	h := newVoiceHarness(t, time.Unix(1_000_000, 0), replayfile.MixOptions{})
+	h.manager.session.State = newAccessState(t, discordgo.PermissionViewChannel, nil, 0)
+
+	h.join(accessChannelID)
+
+	assert.Nil(t, h.manager.CurrentChannelID())
+	assert.Nil(t, h.connection)
+	assert.EqualError(t, h.manager.AccessErr(), "cannot join voice channel channel-id: missing the Connect permission")
+
+	// The next request starts over.
+	h.manager.session.State = newAccessState(t, discordgo.PermissionViewChannel|discordgo.PermissionVoiceConnect, nil, 0)
+	h.join(accessChannelID)
+	assert.NotNil(t, h.connection)
+	assert.NoError(t, h.manager.AccessErr())
+}
@@ -0,0 +1,31 @@
+package voicechannel
+
+import (
+	"sync"
+	"time"
+)
+
+// activity keeps the last time each user started speaking.
+// Zero value is safe to use. It is safe for concurrent use.
+type activity struct {
+	sync.RWMutex
+	lastSpoke map[string]time.Time // Indexed by user ID.
+}
+
+func (a *activity) record(userID string, t time.Time) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.lastSpoke == nil {
+		a.lastSpoke = map[string]time.Time{}
+	}
+	a.lastSpoke[userID] = t
+}
+
+func (a *activity) get(userID string) (time.Time, bool) {
+	a.RLock()
+	defer a.RUnlock()
+
+	t, ok := a.lastSpoke[userID]
+	return t, ok
+}
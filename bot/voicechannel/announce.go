@@ -0,0 +1,55 @@
+package voicechannel
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+)
+
+// sendMessageFunc posts a message in a text channel, it is discordgo.Session.ChannelMessageSend.
+type sendMessageFunc = func(channelID, content string) error
+
+// announcementContent is the message telling the members of the guild the voice channel is being recorded.
+func announcementContent(channelID string) string {
+	return fmt.Sprintf("🔴 Voice recording buffer is active in <#%s>.", channelID)
+}
+
+// announce queues the announcement that the bot records the voice channel, unless it already did since it joined it:
+// the bot is asked to join the channel it is in on every voice state update, and the voice connection may be restored
+// without the bot leaving the channel. It does nothing if there is no announcement channel, or while the capture is
+// disarmed: the recording is announced once it is armed, see Arm.
+// The manager must be locked. The announcement is posted by sendAnnouncement, once it is unlocked.
+func (m *Manager) announce(channelID string) {
+	if m.announceChannelID == "" || m.announcedChannelID == channelID || !m.capture.running() {
+		return
+	}
+
+	// A failed announcement is not retried on the next voice state update, the members would get it late and once
+	// per failure.
+	m.announcedChannelID = channelID
+	m.queuedAnnouncement = channelID
+}
+
+// sendAnnouncement posts the announcement queued by announce in the announcement channel, if there is one.
+// The manager must not be locked: a slow or rate limited Discord API would block every request reading it.
+func (m *Manager) sendAnnouncement() {
+	m.Lock()
+	channelID := m.queuedAnnouncement
+	m.queuedAnnouncement = ""
+	m.Unlock()
+
+	if channelID == "" {
+		return
+	}
+	if err := m.sendMessage(m.announceChannelID, announcementContent(channelID)); err != nil {
+		m.logger.Warn("failed to announce the recording", zap.String("channel", channelID), zap.Error(err))
+		return
+	}
+	m.logger.Info("announced the recording", zap.String("channel", channelID))
+}
+
+// forgetAnnouncement makes the next join announced, once the bot left the voice channel or the capture was disarmed.
+// The manager must be locked.
+func (m *Manager) forgetAnnouncement() {
+	m.announcedChannelID = ""
+	m.queuedAnnouncement = ""
+}
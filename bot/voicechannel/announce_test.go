@@ -0,0 +1,89 @@
+package voicechannel
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"testing"
+)
+
+func TestManager_announce(t *testing.T) {
+	tests := []struct {
+		name              string
+		announceChannelID string
+		joins             []string // Voice channels joined, empty when the bot leaves.
+		sendErr           error
+		expected          []string
+	}{
+		{name: "no announcement channel", joins: []string{"a"}},
+		{
+			name:              "announced once per channel",
+			announceChannelID: "text",
+			joins:             []string{"a", "a", "b", "b", "a"},
+			expected:          []string{"a", "b", "a"},
+		},
+		{
+			name:              "announced again after leaving",
+			announceChannelID: "text",
+			joins:             []string{"a", "", "a"},
+			expected:          []string{"a", "a"},
+		},
+		{
+			name:              "failure not retried",
+			announceChannelID: "text",
+			joins:             []string{"a", "a"},
+			sendErr:           errors.New("missing access"),
+			expected:          []string{"a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var announced []string
+			m := &Manager{
+				logger:            zap.NewNop(),
+				announceChannelID: tt.announceChannelID,
+				sendMessage: func(channelID, content string) error {
+					assert.Equal(t, "text", channelID)
+					announced = append(announced, content)
+					return tt.sendErr
+				},
+			}
+
+			for _, channelID := range tt.joins {
+				if channelID == "" {
+					m.forgetAnnouncement()
+					continue
+				}
+				m.announce(channelID)
+				m.sendAnnouncement()
+			}
+
+			var expected []string
+			for _, channelID := range tt.expected {
+				expected = append(expected, announcementContent(channelID))
+			}
+			assert.Equal(t, expected, announced)
+		})
+	}
+}
+
+func TestManager_sendAnnouncement_unlocked(t *testing.T) {
+	m := &Manager{logger: zap.NewNop(), announceChannelID: "text"}
+	sent := false
+	m.sendMessage = func(channelID, content string) error {
+		// The other requests are not blocked while the announcement is sent.
+		if assert.True(t, m.TryLock()) {
+			m.Unlock()
+		}
+		sent = true
+		return nil
+	}
+
+	m.Lock()
+	m.announce("a")
+	m.Unlock()
+	assert.False(t, sent)
+
+	m.sendAnnouncement()
+	assert.True(t, sent)
+}
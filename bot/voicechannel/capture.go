@@ -0,0 +1,47 @@
+package voicechannel
+
+import (
+	"bigbro2/bot/circular"
+	"github.com/bwmarrin/discordgo"
+	"sync"
+	"time"
+)
+
+// capture decides whether the packets received are stored in the audio buffer. The zero value stores them all, as the
+// bot always did; when arming is required, they are only stored between Manager.Arm and Manager.Disarm.
+type capture struct {
+	mu      sync.RWMutex
+	stopped bool
+}
+
+// add stores the packet received at time t, unless the capture is stopped. It returns whether it was stored.
+// The packet is added under the lock, so once stop returns no packet is added until the capture is started again.
+func (c *capture) add(store circular.Store, t time.Time, pkt discordgo.Packet) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.stopped {
+		return false
+	}
+	store.Add(t, pkt)
+	return true
+}
+
+func (c *capture) start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopped = false
+}
+
+// stop waits for the packet being added, if any, and makes add drop the next ones.
+func (c *capture) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopped = true
+}
+
+func (c *capture) running() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return !c.stopped
+}
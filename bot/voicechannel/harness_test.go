@@ -0,0 +1,323 @@
+package voicechannel
+
+import (
+	"bigbro2/bot/circular"
+	"bigbro2/bot/replayfile"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const harnessGuildID = "guild-id"
+
+// voiceHarness runs a manager connected to a fake voice channel: the packets sent to it go through the manager and the
+// audio buffer as if they were received from Discord, and the replays are mixed by a fake ffmpeg keeping the stream
+// files and its arguments in dir.
+type voiceHarness struct {
+	t          *testing.T
+	manager    *Manager
+	buffers    *circular.BufferRegistry
+	creator    *replayfile.Creator
+	connection *discordgo.VoiceConnection
+	opusRecv   chan *discordgo.Packet
+	dir        string
+	received   int // Number of packets sent to the manager.
+
+	mu  sync.Mutex
+	now time.Time
+}
+
+// newVoiceHarness creates a harness whose clock starts at start. ffmpeg is replaced for the whole test.
+func newVoiceHarness(t *testing.T, start time.Time, mixOptions replayfile.MixOptions) *voiceHarness {
+	t.Helper()
+
+	h := &voiceHarness{
+		t:        t,
+		buffers:  circular.NewBufferRegistry(func(string) (circular.Store, error) { return &circular.Buffer{}, nil }),
+		opusRecv: make(chan *discordgo.Packet),
+		dir:      t.TempDir(),
+		now:      start,
+	}
+	h.fakeFFmpeg()
+
+	session := &discordgo.Session{VoiceConnections: map[string]*discordgo.VoiceConnection{}}
+	h.manager = &Manager{
+		logger:       zap.NewNop(),
+		now:          h.clock,
+		guildID:      harnessGuildID,
+		session:      session,
+		audioBuffers: h.buffers,
+		joinVoice: func(guildID, channelID string, _, _ bool) (*discordgo.VoiceConnection, error) {
+			// Like discordgo, the connection is registered in the session.
+			connection := &discordgo.VoiceConnection{GuildID: guildID, ChannelID: channelID, OpusRecv: h.opusRecv}
+			session.Lock()
+			session.VoiceConnections[guildID] = connection
+			session.Unlock()
+			h.connection = connection
+			return connection, nil
+		},
+	}
+	h.creator = replayfile.NewCreator(zap.NewNop(), h.clock, mixOptions)
+	t.Cleanup(func() {
+		h.manager.stopListeners()
+		require.NoError(t, h.creator.Close())
+	})
+	return h
+}
+
+// fakeFFmpeg puts an ffmpeg in the PATH copying its inputs to stream-<n>.opus and writing its arguments to args, one
+// per line, in dir. The output file only contains the magic number of an ogg page.
+func (h *voiceHarness) fakeFFmpeg() {
+	h.t.Helper()
+
+	script := fmt.Sprintf(`#!/bin/sh
+printf '%%s\n' "$@" > '%[1]s/args'
+n=0
+previous=""
+for arg in "$@"; do
+	if [ "$previous" = "-i" ]; then
+		cp "$arg" "%[1]s/stream-$n.opus"
+		n=$((n+1))
+	fi
+	previous="$arg"
+done
+printf 'OggS' > "$arg"
+`, h.dir)
+
+	bin := h.t.TempDir()
+	require.NoError(h.t, os.WriteFile(filepath.Join(bin, "ffmpeg"), []byte(script), 0o700))
+	h.t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func (h *voiceHarness) clock() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.now
+}
+
+func (h *voiceHarness) advance(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.now = h.now.Add(d)
+}
+
+// join makes the manager join the voice channel.
+func (h *voiceHarness) join(channelID string) {
+	h.t.Helper()
+	require.NoError(h.t, h.manager.handleJoinRequest(&channelID))
+}
+
+// dropConnection removes the voice connection from the session, as discordgo does when it is lost.
+func (h *voiceHarness) dropConnection() {
+	h.manager.session.Lock()
+	defer h.manager.session.Unlock()
+	delete(h.manager.session.VoiceConnections, harnessGuildID)
+}
+
+// speak tells the manager the user speaks in the voice stream, as Discord does before the first packet.
+func (h *voiceHarness) speak(userID string, ssrc uint32) {
+	update := &discordgo.VoiceSpeakingUpdate{UserID: userID, SSRC: int(ssrc), Speaking: true}
+	h.manager.handleSpeakingUpdate(h.connection, update)
+	h.manager.handleSpeakingActivity(h.connection, update)
+}
+
+// voiceState sends the manager the voice state of the user, in channelID, empty if they are in no channel.
+func (h *voiceHarness) voiceState(userID, channelID string) {
+	h.manager.HandleVoiceStateUpdate(&discordgo.VoiceStateUpdate{
+		VoiceState: &discordgo.VoiceState{GuildID: harnessGuildID, UserID: userID, ChannelID: channelID},
+	})
+}
+
+// receive feeds the packet to the manager at the current time, and waits for it to be in the audio buffer so the next
+// one is received later.
+func (h *voiceHarness) receive(pkt *discordgo.Packet) {
+	h.t.Helper()
+
+	h.opusRecv <- pkt
+	h.received++
+	require.Eventually(h.t, func() bool {
+		return h.buffers.Stats(harnessGuildID).Packets == h.received
+	}, time.Second, time.Millisecond)
+}
+
+// talk feeds frames consecutive 20ms packets of the voice stream, starting at the RTP timestamp.
+func (h *voiceHarness) talk(ssrc uint32, timestamp uint32, frames int) {
+	h.t.Helper()
+
+	for n := 0; n < frames; n++ {
+		h.receive(&discordgo.Packet{
+			SSRC:      ssrc,
+			Timestamp: timestamp + uint32(n*replayfile.FrameSize),
+			Opus:      []byte{0x78, byte(ssrc), byte(n)},
+		})
+		h.advance(replayfile.FrameLengthNs)
+	}
+}
+
+// replay creates a replay of the last duration, and returns its result along with the arguments given to ffmpeg and
+// the content of the stream files, in the order they were given to it.
+func (h *voiceHarness) replay(duration time.Duration) (replayfile.Result, []string, [][]byte) {
+	h.t.Helper()
+
+	buffer, err := h.buffers.Get(harnessGuildID)
+	require.NoError(h.t, err)
+
+	result, err := h.creator.Create(context.Background(), buffer, filepath.Join(h.dir, "replay.ogg"), duration, replayfile.Options{
+		Speakers:   h.manager.Speakers(),
+		JoinedAt:   h.manager.JoinedAt(),
+		Departures: h.manager.Departures(),
+	})
+	require.NoError(h.t, err)
+
+	args, err := os.ReadFile(filepath.Join(h.dir, "args"))
+	require.NoError(h.t, err)
+
+	streamFiles, err := filepath.Glob(filepath.Join(h.dir, "stream-*.opus"))
+	require.NoError(h.t, err)
+	sort.Strings(streamFiles)
+	var streams [][]byte
+	for _, f := range streamFiles {
+		content, err := os.ReadFile(f)
+		require.NoError(h.t, err)
+		streams = append(streams, content)
+	}
+	return result, strings.Split(strings.TrimSuffix(string(args), "\n"), "\n"), streams
+}
+
+func TestHarness_replay(t *testing.T) {
+	start := time.Unix(1_000_000, 0)
+	h := newVoiceHarness(t, start, replayfile.MixOptions{
+		Duration:      replayfile.MixDurationLongest,
+		Normalization: replayfile.NormalizationAverage,
+		Weights:       map[string]float64{"music-bot-id": 0.5},
+	})
+
+	h.join("channel-id")
+	assert.Equal(t, start, h.manager.JoinedAt())
+
+	// Alice talks right after the bot joins, the music bot starts 200ms later.
+	h.advance(100 * time.Millisecond)
+	h.speak("alice-id", 11)
+	h.talk(11, 48_000, 10)
+	h.speak("music-bot-id", 22)
+	h.talk(22, 960_000, 5)
+
+	result, args, streams := h.replay(10 * time.Second)
+
+	assert.Equal(t, []uint32{11, 22}, result.SSRCs)
+	require.Greater(t, len(args), 14)
+	assert.Equal(t, "-y", args[0])
+	assert.Equal(t, []string{"-i", "-i"}, []string{args[1], args[3]})
+	assert.Equal(t, []string{"-filter_complex", "amix=inputs=2:duration=longest:weights=1 0.5"}, args[5:7])
+	assert.Equal(t, []string{"-c:a", "libopus", "-application", "voip", "-f", "ogg"}, args[7:13])
+	assert.Equal(t, []string{"-metadata", "REPLAY_WINDOW_SECONDS=10"}, args[13:15])
+	assert.Equal(t, filepath.Join(h.dir, "replay.ogg"), args[len(args)-1])
+
+	// Each stream file has the two header pages, then one page per frame: the silence since the bot joined and the
+	// packets.
+	require.Len(t, streams, 2)
+	assert.Equal(t, 2+5+10, bytes.Count(streams[0], []byte("OggS")))
+	assert.Equal(t, 2+15+5, bytes.Count(streams[1], []byte("OggS")))
+	for n := 0; n < 10; n++ {
+		assert.Contains(t, string(streams[0]), string([]byte{0x78, 11, byte(n)}))
+	}
+	for n := 0; n < 5; n++ {
+		assert.Contains(t, string(streams[1]), string([]byte{0x78, 22, byte(n)}))
+	}
+}
+
+func TestHarness_announce(t *testing.T) {
+	h := newVoiceHarness(t, time.Unix(1_000_000, 0), replayfile.MixOptions{})
+	var messages []string
+	h.manager.announceChannelID = "text-channel-id"
+	h.manager.sendMessage = func(channelID, content string) error {
+		messages = append(messages, channelID+": "+content)
+		return nil
+	}
+
+	h.join("channel-id")
+	// The bot is asked to join the channel it is in on every voice state update.
+	h.join("channel-id")
+	h.join("channel-id")
+	assert.Equal(t, []string{"text-channel-id: 🔴 Voice recording buffer is active in <#channel-id>."}, messages)
+
+	// The voice connection is lost and restored, the bot never left the channel.
+	h.dropConnection()
+	h.join("channel-id")
+	assert.Len(t, messages, 1)
+}
+
+func TestHarness_announce_arming(t *testing.T) {
+	h := newVoiceHarness(t, time.Unix(1_000_000, 0), replayfile.MixOptions{})
+	h.manager.armingRequired = true
+	h.manager.capture.stop()
+	var messages []string
+	h.manager.announceChannelID = "text-channel-id"
+	h.manager.sendMessage = func(channelID, content string) error {
+		messages = append(messages, content)
+		return nil
+	}
+
+	// Nothing is recorded yet.
+	h.join("channel-id")
+	assert.Empty(t, messages)
+
+	h.manager.Arm()
+	assert.Equal(t, []string{announcementContent("channel-id")}, messages)
+	h.manager.Arm()
+	h.join("channel-id")
+	assert.Len(t, messages, 1)
+
+	// The recording starts over once armed again.
+	require.NoError(t, h.manager.Disarm())
+	h.join("channel-id")
+	assert.Len(t, messages, 1)
+	h.manager.Arm()
+	assert.Len(t, messages, 2)
+}
+
+func TestHarness_departures(t *testing.T) {
+	h := newVoiceHarness(t, time.Unix(1_000_000, 0), replayfile.MixOptions{})
+	h.join("channel-id")
+
+	h.speak("alice-id", 11)
+	h.speak("bob-id", 22)
+	h.speak("carol-id", 33)
+	h.talk(22, 0, 5)
+	// Alice mutes herself, she is still in the channel.
+	h.voiceState("alice-id", "channel-id")
+	// Bob and Carol leave, but packets of their streams are still received.
+	h.voiceState("bob-id", "")
+	h.voiceState("carol-id", "other-channel-id")
+	assert.Equal(t, map[uint32]time.Time{22: h.clock(), 33: h.clock()}, h.manager.Departures())
+	h.advance(time.Second)
+	h.talk(11, 0, 5)
+	h.talk(22, 5*replayfile.FrameSize, 5)
+	h.talk(33, 0, 5)
+
+	result, _, streams := h.replay(10 * time.Second)
+
+	// Carol's stream only has packets received after she left, it is left out. Bob's keeps what he said before.
+	assert.Equal(t, []uint32{22, 11}, result.SSRCs)
+	require.Len(t, streams, 2)
+	for n := 0; n < 5; n++ {
+		assert.Contains(t, string(streams[0]), string([]byte{0x78, 22, byte(n)}))
+		assert.NotContains(t, string(streams[1]), string([]byte{0x78, 22, byte(n)}))
+	}
+	assert.Contains(t, string(streams[1]), string([]byte{0x78, 11, 0}))
+
+	// Speaking again, Carol is back.
+	h.speak("carol-id", 33)
+	assert.Equal(t, map[uint32]time.Time{22: h.clock().Add(-time.Second - 15*replayfile.FrameLengthNs)}, h.manager.Departures())
+}
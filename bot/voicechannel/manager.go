@@ -8,42 +8,87 @@ import (
 	"github.com/bwmarrin/discordgo"
 	"go.uber.org/zap"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Manager struct {
 	sync.RWMutex
 	logger             *zap.Logger
+	now                func() time.Time // Time at which the packets and the speaking updates are received.
 	guildID            string
 	session            *discordgo.Session
-	audioBuffer        *circular.Buffer
+	joinVoice          joinVoiceFunc
+	sendMessage        sendMessageFunc
+	announceChannelID  string // Text channel where the recording is announced, empty to not announce it.
+	announcedChannelID string // Voice channel whose recording was announced, see announce.
+	queuedAnnouncement string // Voice channel to announce once the manager is unlocked, see sendAnnouncement.
+	audioBuffers       *circular.BufferRegistry
 	voiceChannelToJoin chan *string
-	stopListenersCh    chan struct{}
+	doneCh             chan struct{}  // Closed once the manager is stopped, nil if it never is.
+	stopListenersCh    chan struct{}  // Closed to stop the listeners, nil when they are not running.
+	listeners          sync.WaitGroup // Goroutines started by startListeners.
+	activeListeners    int32          // Number of goroutines listening to a voice connection, accessed atomically.
+	joinedAt           time.Time      // Time the listeners started, zero when they are not running.
+	accessErr          error          // Why the bot could not join the last channel it was asked to, see AccessErr.
+	speakers           speakers
+	activity           activity
+	armingRequired     bool    // The packets are only stored once an admin arms the capture, see Arm.
+	capture            capture // Whether the packets received are stored.
 }
 
+// joinVoiceFunc joins a voice channel, it is discordgo.Session.ChannelVoiceJoin. The packets are read from the
+// OpusRecv channel of the connection it returns, so tests can feed packets to the manager without Discord.
+type joinVoiceFunc = func(guildID, channelID string, mute, deaf bool) (*discordgo.VoiceConnection, error)
+
 type CreateManager = func(context.Context) (*Manager, cleanup.Func, error)
 
-func NewManagerFactory(logger *zap.Logger, guildID string, session *discordgo.Session, audioBuffer *circular.Buffer) CreateManager {
+// ManagerOptions contains the optional settings of the voice channel manager.
+type ManagerOptions struct {
+	// AnnounceChannelID is a text channel the manager posts in when it starts recording a voice channel. Empty
+	// disables the announcement.
+	AnnounceChannelID string
+	// ArmingRequired only stores the packets received between Arm and Disarm.
+	ArmingRequired bool
+}
+
+// NewManagerFactory returns a function creating the manager of the voice channel recorded in the guild.
+func NewManagerFactory(logger *zap.Logger, now func() time.Time, guildID string, session *discordgo.Session, audioBuffers *circular.BufferRegistry, options ManagerOptions) CreateManager {
 	return func(ctx context.Context) (*Manager, cleanup.Func, error) {
 		m := &Manager{
-			logger:             logger,
-			guildID:            guildID,
-			session:            session,
-			audioBuffer:        audioBuffer,
+			logger:    logger,
+			now:       now,
+			guildID:   guildID,
+			session:   session,
+			joinVoice: session.ChannelVoiceJoin,
+			sendMessage: func(channelID, content string) error {
+				_, err := session.ChannelMessageSend(channelID, content)
+				return err
+			},
+			announceChannelID:  options.AnnounceChannelID,
+			audioBuffers:       audioBuffers,
 			voiceChannelToJoin: make(chan *string),
+			doneCh:             make(chan struct{}),
+			armingRequired:     options.ArmingRequired,
+		}
+		if options.ArmingRequired {
+			m.capture.stop()
 		}
 
-		doneCh := make(chan struct{})
+		stoppedCh := make(chan struct{})
 
 		go func() {
-			err := m.run(doneCh)
+			defer close(stoppedCh)
+			err := m.run(m.doneCh)
 			if err != nil {
 				logger.Panic("voice channel manager failed", zap.Error(err))
 			}
 		}()
 
+		// The cleanup returns once the bot left the voice channel, so the session can be closed right after it.
 		cleanupFunc := func() error {
-			close(doneCh)
+			close(m.doneCh)
+			<-stoppedCh
 			return nil
 		}
 
@@ -51,9 +96,15 @@ func NewManagerFactory(logger *zap.Logger, guildID string, session *discordgo.Se
 	}
 }
 
+// JoinChannel asks the manager to join the voice channel, or to leave the one it is in if channelID is nil. The request
+// is dropped once the manager is stopped.
 func (m *Manager) JoinChannel(channelID *string) {
 	m.logger.Debug("asking to join channel", zap.Stringp("channel", channelID))
-	m.voiceChannelToJoin <- channelID
+	select {
+	case m.voiceChannelToJoin <- channelID:
+	case <-m.doneCh:
+		m.logger.Debug("join request dropped as the manager is stopped", zap.Stringp("channel", channelID))
+	}
 }
 
 func (m *Manager) run(doneCh <-chan struct{}) error {
@@ -78,115 +129,335 @@ func (m *Manager) run(doneCh <-chan struct{}) error {
 		}
 	}
 }
-func (m *Manager) CurrentChannel() *discordgo.VoiceConnection {
+
+// voiceSnapshot is the voice connection of the guild and the channel it is in, read together.
+type voiceSnapshot struct {
+	connection *discordgo.VoiceConnection // Nil if the bot is in no voice channel.
+	channelID  string
+}
+
+// currentVoice returns the voice connection of the guild and its channel. Both are read under the lock of the session,
+// so a connection appearing or going away in between cannot be seen half way.
+func (m *Manager) currentVoice() voiceSnapshot {
 	m.session.RLock()
 	defer m.session.RUnlock()
 
-	voice, _ := m.session.VoiceConnections[m.guildID]
+	voice := m.session.VoiceConnections[m.guildID]
 	if voice == nil {
-		return nil
+		return voiceSnapshot{}
 	}
 
-	return voice
+	voice.RLock()
+	defer voice.RUnlock()
+
+	return voiceSnapshot{connection: voice, channelID: voice.ChannelID}
+}
+
+func (m *Manager) CurrentChannel() *discordgo.VoiceConnection {
+	return m.currentVoice().connection
 }
 
 func (m *Manager) CurrentChannelID() *string {
-	voice := m.CurrentChannel()
-	if voice == nil {
+	voice := m.currentVoice()
+	if voice.connection == nil {
 		return nil
 	}
+	return &voice.channelID
+}
 
-	voice.RLock()
-	defer voice.RUnlock()
+// Speakers returns the ID of the user speaking in each voice stream heard recently, indexed by SSRC.
+func (m *Manager) Speakers() map[uint32]string {
+	return m.speakers.snapshot(m.now())
+}
+
+// Departures returns when the user of each voice stream left the voice channel recorded, indexed by SSRC. The packets
+// of a stream received after its user left are not theirs, see replayfile.Options.Departures.
+func (m *Manager) Departures() map[uint32]time.Time {
+	return m.speakers.departures(m.now())
+}
 
-	channelID := voice.ChannelID
-	return &channelID
+// Speaker returns the ID of the user speaking in the voice stream. It returns false if the stream was not heard
+// recently.
+func (m *Manager) Speaker(ssrc uint32) (string, bool) {
+	return m.speakers.get(ssrc, m.now())
+}
+
+// JoinedAt returns the time the bot started recording the voice channel it is in, or zero if it is in none.
+func (m *Manager) JoinedAt() time.Time {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.joinedAt
+}
+
+// AccessErr returns the *AccessError explaining why the bot could not join the voice channel it was last asked to
+// join, or nil if it could.
+func (m *Manager) AccessErr() error {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.accessErr
+}
+
+// LastSpoke returns the last time the user started speaking in a voice channel the bot was in.
+// It returns false if the bot never heard the user.
+func (m *Manager) LastSpoke(userID string) (time.Time, bool) {
+	return m.activity.get(userID)
 }
 
 func (m *Manager) handleJoinRequest(channelID *string) error {
+	// Runs after the unlock.
+	defer m.sendAnnouncement()
 
 	m.Lock()
 	defer m.Unlock()
 
 	m.logger.Debug("request to join a voice channel received", zap.Stringp("channel", channelID))
+	m.accessErr = nil
+	// The connection is read once, the decision and the action are taken on the same one.
+	voice := m.currentVoice()
 	if channelID != nil {
-		if m.CurrentChannelID() == nil {
+		if voice.connection == nil {
 			return m.connectToNewVoiceChannel(*channelID)
 		} else {
-			return m.changeChannel(*channelID)
+			return m.changeChannel(voice, *channelID)
 		}
 	} else {
-		return m.disconnectFromChannel()
+		return m.disconnectFromChannel(voice)
 	}
 }
 
 func (m *Manager) connectToNewVoiceChannel(channelID string) error {
 	m.logger.Debug("connecting bot to new voice channel")
 
+	if !m.canJoin(channelID) {
+		return nil
+	}
+
+	audioBuffer, err := m.audioBuffers.Get(m.guildID)
+	if err != nil {
+		return err
+	}
+
 	// The recording should not include data from previous channels.
-	m.audioBuffer.Reset()
+	audioBuffer.Reset()
 
 	// Join the new channel.
-	c, err := m.session.ChannelVoiceJoin(m.guildID, channelID, true, false)
+	c, err := m.joinVoice(m.guildID, channelID, true, false)
 	if err != nil {
 		return fmt.Errorf("could not join voice channel: %w", err)
 	}
 
 	m.logger.Debug("bot joined the voice channel")
 
-	// Create listeners that will put raw audio data in the buffer.
-	m.stopListenersCh = make(chan struct{})
+	// Keep track of who is speaking in which voice stream, and when.
+	c.AddHandler(m.handleSpeakingUpdate)
+	c.AddHandler(m.handleSpeakingActivity)
+
+	m.startListeners(c.OpusRecv, audioBuffer)
+	m.announce(channelID)
+	return nil
+}
+
+// canJoin returns whether the bot can join the voice channel, see checkAccess. The bot not being allowed in the channel
+// is not a failure of the manager: it stays where it is until it is asked to join another channel, and the users are
+// told why, see AccessErr.
+// The manager must be locked.
+func (m *Manager) canJoin(channelID string) bool {
+	if err := checkAccess(m.session.State, channelID); err != nil {
+		m.logger.Warn("bot cannot join the voice channel", zap.String("channel", channelID), zap.Error(err))
+		m.accessErr = err
+		return false
+	}
+	return true
+}
+
+// startListeners starts the goroutines putting the packets received from opusRecv in the audio buffer.
+// The packets go through a queue so the listener is never slowed down by the buffer.
+// The listeners of the previous voice connection are stopped first, so there is never more than one listener.
+func (m *Manager) startListeners(opusRecv <-chan *discordgo.Packet, audioBuffer circular.Store) {
+	m.stopListeners()
+
+	stopCh := make(chan struct{})
+	m.stopListenersCh = stopCh
+	m.joinedAt = m.now()
+	queue := newPacketQueue(audioBuffer, &m.capture, packetQueueSize)
+
+	m.listeners.Add(2)
+	atomic.AddInt32(&m.activeListeners, 1)
+	go func() {
+		defer m.listeners.Done()
+		queue.run(stopCh)
+	}()
 	go func() {
-		for {
-			select {
-			case pkt := <-c.OpusRecv:
-				m.audioBuffer.Add(time.Now(), *pkt)
-			case <-m.stopListenersCh:
-				m.logger.Debug("closing voice channel listener")
+		defer m.listeners.Done()
+		defer atomic.AddInt32(&m.activeListeners, -1)
+		m.listen(opusRecv, queue, stopCh)
+	}()
+}
+
+// stopListeners stops the goroutines started by startListeners and waits for them to return.
+// It does nothing if they are not running.
+func (m *Manager) stopListeners() {
+	if m.stopListenersCh == nil {
+		return
+	}
+
+	close(m.stopListenersCh)
+	m.stopListenersCh = nil
+	m.joinedAt = time.Time{}
+	m.listeners.Wait()
+}
+
+// ArmingRequired returns whether the packets are only stored between Arm and Disarm. Otherwise, they always are.
+func (m *Manager) ArmingRequired() bool {
+	return m.armingRequired
+}
+
+// Armed returns whether the packets received are stored in the audio buffer.
+func (m *Manager) Armed() bool {
+	return m.capture.running()
+}
+
+// Arm starts storing the packets received in the audio buffer, and announces the recording of the voice channel the
+// bot is in, if it was not yet.
+func (m *Manager) Arm() {
+	m.capture.start()
+	m.logger.Info("capture armed")
+
+	// Runs after the unlock.
+	defer m.sendAnnouncement()
+
+	m.Lock()
+	defer m.Unlock()
+	if voice := m.currentVoice(); voice.connection != nil {
+		m.announce(voice.channelID)
+	}
+}
+
+// Disarm stops storing the packets received and clears the audio buffer, so nothing heard before can be replayed.
+// The recording is announced again once it is armed.
+func (m *Manager) Disarm() error {
+	m.capture.stop()
+
+	m.Lock()
+	m.forgetAnnouncement()
+	m.Unlock()
+
+	audioBuffer, err := m.audioBuffers.Get(m.guildID)
+	if err != nil {
+		return fmt.Errorf("could not get audio buffer: %w", err)
+	}
+	audioBuffer.Reset()
+	m.logger.Info("capture disarmed, audio buffer cleared")
+	return nil
+}
+
+// handleSpeakingUpdate records the user speaking in the voice stream.
+func (m *Manager) handleSpeakingUpdate(_ *discordgo.VoiceConnection, vs *discordgo.VoiceSpeakingUpdate) {
+	m.speakers.set(uint32(vs.SSRC), vs.UserID, m.now())
+}
+
+// HandleVoiceStateUpdate records that the member left the voice channel recorded, if they did.
+func (m *Manager) HandleVoiceStateUpdate(u *discordgo.VoiceStateUpdate) {
+	if u.VoiceState == nil || u.GuildID != m.guildID {
+		return
+	}
+	channelID := m.CurrentChannelID()
+	if channelID == nil || u.ChannelID == *channelID {
+		return
+	}
+	m.speakers.leave(u.UserID, m.now())
+}
+
+// handleSpeakingActivity records when a user starts speaking.
+func (m *Manager) handleSpeakingActivity(_ *discordgo.VoiceConnection, vs *discordgo.VoiceSpeakingUpdate) {
+	if vs.Speaking {
+		m.activity.record(vs.UserID, m.now())
+	}
+}
+
+// listen queues the packets received from opusRecv, stamped with the time they are received, until stopCh or opusRecv
+// is closed.
+// The packets received while the capture is stopped are dropped.
+func (m *Manager) listen(opusRecv <-chan *discordgo.Packet, queue *packetQueue, stopCh <-chan struct{}) {
+	for {
+		select {
+		case pkt, ok := <-opusRecv:
+			if !ok {
+				// discordgo closes the receiving channel when the voice connection is closed.
+				m.logger.Debug("voice connection closed, stopping voice channel listener")
 				return
 			}
+			if !m.capture.running() {
+				continue
+			}
+			// A packet without audio carries nothing to replay. The gap it leaves is filled with silence, like any
+			// packet lost on the way.
+			if pkt == nil || len(pkt.Opus) == 0 {
+				continue
+			}
+			if !queue.push(m.now(), pkt) && queue.Dropped()%100 == 1 {
+				m.logger.Warn("audio buffer is too slow, dropping packets", zap.Int64("dropped", queue.Dropped()))
+			}
+		case <-stopCh:
+			m.logger.Debug("closing voice channel listener")
+			return
 		}
-	}()
-	return nil
+	}
 }
 
-func (m *Manager) changeChannel(channelID string) error {
+func (m *Manager) changeChannel(voice voiceSnapshot, channelID string) error {
 	logger := m.logger.With(zap.String("channel", channelID))
-	chanID := m.CurrentChannelID()
 
-	if chanID != nil && *chanID == channelID {
+	if voice.channelID == channelID {
 		logger.Debug("bot is already in the voice channel")
 		return nil
 	}
 
 	logger.Debug("moving bot to another voice channel")
 
+	// Checked before the audio buffer is reset: the bot keeps recording the channel it is in.
+	if !m.canJoin(channelID) {
+		return nil
+	}
+
+	audioBuffer, err := m.audioBuffers.Get(m.guildID)
+	if err != nil {
+		return err
+	}
+
 	// The recording should not include data from previous channels.
-	m.audioBuffer.Reset()
+	audioBuffer.Reset()
 
 	// Move the bot.
-	err := m.CurrentChannel().ChangeChannel(channelID, true, false)
-	if err != nil {
+	if err := voice.connection.ChangeChannel(channelID, true, false); err != nil {
 		return fmt.Errorf("could not change voice channel: %w", err)
 	}
 
+	// The voice connection is kept, and so is its receiving channel for now. The listeners are restarted anyway, so
+	// they always read from the channel of the current connection and the old ones never outlive it.
+	voice.connection.RLock()
+	opusRecv := voice.connection.OpusRecv
+	voice.connection.RUnlock()
+	m.startListeners(opusRecv, audioBuffer)
+	m.announce(channelID)
 	return nil
 }
 
-func (m *Manager) disconnectFromChannel() error {
-	if m.CurrentChannel() == nil {
+func (m *Manager) disconnectFromChannel(voice voiceSnapshot) error {
+	if voice.connection == nil {
 		m.logger.Debug("bot is already disconnected from voice channel")
 		return nil
 	}
 
 	m.logger.Debug("disconnecting bot from voice channel")
 
-	// Close the listeners.
-	close(m.stopListenersCh)
-	m.stopListenersCh = nil
+	m.stopListeners()
+	m.forgetAnnouncement()
 
 	// Disconnect from actual channel.
-	if err := m.CurrentChannel().Disconnect(); err != nil {
+	if err := voice.connection.Disconnect(); err != nil {
 		return fmt.Errorf("could not disconnect from channel: %w", err)
 	}
 
@@ -195,19 +466,26 @@ func (m *Manager) disconnectFromChannel() error {
 }
 
 func (m *Manager) cleanupVoiceChannel() {
-	if m.CurrentChannel() == nil {
+	m.Lock()
+	defer m.Unlock()
+
+	m.stopListeners()
+	m.forgetAnnouncement()
+
+	voice := m.currentVoice()
+	if voice.connection == nil {
 		return
 	}
 
 	m.logger.Debug(
 		"disconnecting bot from voice channel",
-		zap.Stringp("channel", m.CurrentChannelID()),
+		zap.String("channel", voice.channelID),
 	)
-	err := m.CurrentChannel().Disconnect()
+	err := voice.connection.Disconnect()
 	if err != nil {
 		m.logger.Warn(
 			"could not disconnect from voice channel",
-			zap.String("channel", m.CurrentChannel().ChannelID),
+			zap.String("channel", voice.channelID),
 			zap.Error(err),
 		)
 	}
@@ -0,0 +1,337 @@
+package voicechannel
+
+import (
+	"bigbro2/bot/circular"
+	"bigbro2/bot/replayfile"
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock returns the given times, one per call, then keeps returning the last one.
+func fakeClock(times ...time.Time) func() time.Time {
+	return func() time.Time {
+		t := times[0]
+		if len(times) > 1 {
+			times = times[1:]
+		}
+		return t
+	}
+}
+
+func TestManager_listen(t *testing.T) {
+	start := time.Unix(1000, 0)
+	m := &Manager{
+		logger: zap.NewNop(),
+		now:    fakeClock(start, start.Add(20*time.Millisecond), start.Add(45*time.Millisecond)),
+	}
+
+	var store circular.Buffer
+	queue := newPacketQueue(&store, &capture{}, 10)
+	opusRecv := make(chan *discordgo.Packet)
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		m.listen(opusRecv, queue, stopCh)
+		close(done)
+	}()
+
+	for i := 0; i < 3; i++ {
+		opusRecv <- &discordgo.Packet{SSRC: 1, Timestamp: uint32(i * 960), Opus: []byte{byte(i)}}
+	}
+	close(stopCh)
+	<-done
+
+	// The queue is not run concurrently: the queued packets are stored once the listener is done.
+	for len(queue.packets) > 0 {
+		p := <-queue.packets
+		store.Add(p.time, *p.pkt)
+	}
+
+	var times []time.Time
+	require.NoError(t, store.WithIterator(func(iterator circular.Iterator) error {
+		for iterator.HasNext() {
+			times = append(times, iterator.Next().Time)
+		}
+		return nil
+	}))
+	assert.Equal(t, []time.Time{start, start.Add(20 * time.Millisecond), start.Add(45 * time.Millisecond)}, times)
+}
+
+func TestManager_listen_emptyPayload(t *testing.T) {
+	m := &Manager{logger: zap.NewNop(), now: fakeClock(time.Unix(1000, 0))}
+
+	queue := newPacketQueue(&circular.Buffer{}, &m.capture, 10)
+	opusRecv := make(chan *discordgo.Packet)
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		m.listen(opusRecv, queue, stopCh)
+		close(done)
+	}()
+
+	opusRecv <- &discordgo.Packet{SSRC: 1, Timestamp: 0, Opus: []byte{0x78, 0x01, 0x00}}
+	opusRecv <- &discordgo.Packet{SSRC: 1, Timestamp: 960}
+	opusRecv <- &discordgo.Packet{SSRC: 1, Timestamp: 1920, Opus: []byte{}}
+	opusRecv <- &discordgo.Packet{SSRC: 1, Timestamp: 2880, Opus: []byte{0x78, 0x01, 0x00}}
+	close(stopCh)
+	<-done
+
+	var timestamps []uint32
+	for len(queue.packets) > 0 {
+		timestamps = append(timestamps, (<-queue.packets).pkt.Timestamp)
+	}
+	assert.Equal(t, []uint32{0, 2880}, timestamps)
+}
+
+func TestManager_listen_closed(t *testing.T) {
+	m := &Manager{logger: zap.NewNop(), now: fakeClock(time.Unix(1000, 0))}
+
+	queue := newPacketQueue(&circular.Buffer{}, &m.capture, 10)
+	opusRecv := make(chan *discordgo.Packet)
+	done := make(chan struct{})
+	go func() {
+		m.listen(opusRecv, queue, make(chan struct{}))
+		close(done)
+	}()
+
+	// The listener stops with the voice connection, without waiting for stopCh.
+	close(opusRecv)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the listener is still running once the receiving channel is closed")
+	}
+	assert.Empty(t, queue.packets)
+}
+
+func TestManager_JoinChannel_stopped(t *testing.T) {
+	m := &Manager{logger: zap.NewNop(), voiceChannelToJoin: make(chan *string), doneCh: make(chan struct{})}
+	close(m.doneCh)
+
+	done := make(chan struct{})
+	go func() {
+		channelID := "channel-id"
+		m.JoinChannel(&channelID)
+		close(done)
+	}()
+
+	// Nothing reads the join requests once the manager is stopped.
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("JoinChannel is blocked once the manager is stopped")
+	}
+}
+
+func TestManager_handleSpeakingActivity(t *testing.T) {
+	spoke := time.Unix(1000, 0)
+	m := &Manager{logger: zap.NewNop(), now: fakeClock(spoke)}
+
+	m.handleSpeakingActivity(nil, &discordgo.VoiceSpeakingUpdate{UserID: "silent-user-id", Speaking: false})
+	m.handleSpeakingActivity(nil, &discordgo.VoiceSpeakingUpdate{UserID: "user-id", Speaking: true})
+
+	got, ok := m.LastSpoke("user-id")
+	require.True(t, ok)
+	assert.Equal(t, spoke, got)
+
+	_, ok = m.LastSpoke("silent-user-id")
+	assert.False(t, ok)
+}
+
+func TestManager_startListeners(t *testing.T) {
+	m := &Manager{logger: zap.NewNop(), now: time.Now}
+	var store circular.Buffer
+
+	first := make(chan *discordgo.Packet)
+	second := make(chan *discordgo.Packet)
+
+	// Join, then move to another channel twice.
+	m.startListeners(first, &store)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&m.activeListeners))
+	m.startListeners(second, &store)
+	m.startListeners(second, &store)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&m.activeListeners))
+
+	// Only the current receiving channel is read.
+	select {
+	case first <- &discordgo.Packet{SSRC: 1}:
+		t.Fatal("the listener of the previous connection is still running")
+	case <-time.After(10 * time.Millisecond):
+	}
+	select {
+	case second <- &discordgo.Packet{SSRC: 2}:
+	case <-time.After(time.Second):
+		t.Fatal("the listener of the current connection is not running")
+	}
+
+	// Disconnect, twice as the cleanup does it again.
+	m.stopListeners()
+	m.stopListeners()
+	assert.EqualValues(t, 0, atomic.LoadInt32(&m.activeListeners))
+	assert.Nil(t, m.stopListenersCh)
+
+	// Join again.
+	m.startListeners(first, &store)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&m.activeListeners))
+	m.stopListeners()
+	assert.EqualValues(t, 0, atomic.LoadInt32(&m.activeListeners))
+}
+
+func TestManager_JoinedAt(t *testing.T) {
+	joined := time.Unix(1000, 0)
+	moved := joined.Add(time.Minute)
+	m := &Manager{logger: zap.NewNop(), now: fakeClock(joined, moved)}
+	var store circular.Buffer
+	opusRecv := make(chan *discordgo.Packet)
+
+	assert.True(t, m.JoinedAt().IsZero())
+
+	m.startListeners(opusRecv, &store)
+	assert.Equal(t, joined, m.JoinedAt())
+
+	// Moving to another channel starts a new recording.
+	m.startListeners(opusRecv, &store)
+	assert.Equal(t, moved, m.JoinedAt())
+
+	m.stopListeners()
+	assert.True(t, m.JoinedAt().IsZero())
+}
+
+func TestManager_handleJoinRequest_connectionRace(t *testing.T) {
+	h := newVoiceHarness(t, time.Unix(1_000_000, 0), replayfile.MixOptions{})
+	h.join("channel-id")
+
+	// Discord drops and restores the voice connection while the bot is asked to join the channel it is in.
+	session := h.manager.session
+	restored := &discordgo.VoiceConnection{GuildID: harnessGuildID, ChannelID: "channel-id", OpusRecv: h.opusRecv}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			session.Lock()
+			if session.VoiceConnections[harnessGuildID] == nil {
+				session.VoiceConnections[harnessGuildID] = restored
+			} else {
+				delete(session.VoiceConnections, harnessGuildID)
+			}
+			session.Unlock()
+		}
+	}()
+
+	for n := 0; n < 20000; n++ {
+		h.join("channel-id")
+		if channelID := h.manager.CurrentChannelID(); channelID != nil {
+			assert.Equal(t, "channel-id", *channelID)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	// Whichever connection is left, the bot is in the channel once asked again.
+	h.join("channel-id")
+	require.NotNil(t, h.manager.CurrentChannel())
+	assert.Equal(t, "channel-id", *h.manager.CurrentChannelID())
+}
+
+func TestManager_listen_disarmed(t *testing.T) {
+	m := &Manager{logger: zap.NewNop(), now: fakeClock(time.Unix(1000, 0))}
+	m.capture.stop()
+
+	queue := newPacketQueue(&circular.Buffer{}, &m.capture, 10)
+	opusRecv := make(chan *discordgo.Packet)
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		m.listen(opusRecv, queue, stopCh)
+		close(done)
+	}()
+
+	opusRecv <- &discordgo.Packet{SSRC: 1, Opus: []byte{0x78, 0x01, 0x00}}
+	close(stopCh)
+	<-done
+
+	assert.Empty(t, queue.packets)
+}
+
+func TestManager_arming(t *testing.T) {
+	h := newVoiceHarness(t, time.Unix(1_000_000, 0), replayfile.MixOptions{})
+	h.manager.armingRequired = true
+	h.manager.capture.stop()
+	h.join("channel-id")
+
+	packet := func(ssrc uint32) *discordgo.Packet {
+		return &discordgo.Packet{SSRC: ssrc, Opus: []byte{0x78, byte(ssrc), 0x00}}
+	}
+	ssrcs := func() []uint32 {
+		buffer, err := h.buffers.Get(harnessGuildID)
+		require.NoError(t, err)
+
+		var ssrcs []uint32
+		require.NoError(t, buffer.WithIterator(func(iterator circular.Iterator) error {
+			for iterator.HasNext() {
+				ssrcs = append(ssrcs, iterator.Next().SSRC)
+			}
+			return nil
+		}))
+		return ssrcs
+	}
+
+	assert.False(t, h.manager.Armed())
+	h.manager.Arm()
+	assert.True(t, h.manager.Armed())
+	h.receive(packet(1))
+	h.receive(packet(2))
+	assert.Equal(t, []uint32{1, 2}, ssrcs())
+
+	// Disarming forgets what was stored, and stops storing.
+	require.NoError(t, h.manager.Disarm())
+	assert.False(t, h.manager.Armed())
+	assert.Empty(t, ssrcs())
+
+	h.opusRecv <- packet(3)
+	h.manager.stopListeners()
+	assert.Empty(t, ssrcs())
+}
+
+func TestManager_changeChannel_noAccess(t *testing.T) {
+	h := newVoiceHarness(t, time.Unix(1_000_000, 0), replayfile.MixOptions{})
+	state := newAccessState(t, discordgo.PermissionViewChannel|discordgo.PermissionVoiceConnect, nil, 0)
+	require.NoError(t, state.ChannelAdd(&discordgo.Channel{
+		ID:      "locked-channel-id",
+		GuildID: accessGuildID,
+		Type:    discordgo.ChannelTypeGuildVoice,
+		PermissionOverwrites: []*discordgo.PermissionOverwrite{
+			{ID: accessRoleID, Type: discordgo.PermissionOverwriteTypeRole, Deny: discordgo.PermissionVoiceConnect},
+		},
+	}))
+	h.manager.session.State = state
+
+	h.join(accessChannelID)
+	h.speak("alice-id", 11)
+	h.talk(11, 0, 5)
+
+	// The bot is not moved, and keeps what it recorded. The connection of the harness cannot change channel: the move
+	// would fail if it was attempted.
+	h.join("locked-channel-id")
+
+	assert.Equal(t, accessChannelID, *h.manager.CurrentChannelID())
+	assert.EqualError(t, h.manager.AccessErr(), "cannot join voice channel locked-channel-id: missing the Connect permission")
+	assert.Equal(t, 5, h.buffers.Stats(harnessGuildID).Packets)
+
+	// It still records the channel it is in.
+	h.talk(11, 5*replayfile.FrameSize, 5)
+	assert.Equal(t, 10, h.buffers.Stats(harnessGuildID).Packets)
+}
@@ -0,0 +1,63 @@
+package voicechannel
+
+import (
+	"bigbro2/bot/circular"
+	"github.com/bwmarrin/discordgo"
+	"sync/atomic"
+	"time"
+)
+
+// packetQueueSize is the number of packets waiting to be stored before new ones are dropped, about 20 seconds of audio
+// for a single speaker.
+const packetQueueSize = 1000
+
+// packetQueue decouples the reception of the voice packets from their storage, so receiving never waits for the
+// audio buffer (e.g. while a replay is created and holds its lock).
+type packetQueue struct {
+	store   circular.Store
+	capture *capture // Drops the packets while the capture is stopped.
+	packets chan receivedPacket
+	dropped int64 // Accessed atomically.
+}
+
+type receivedPacket struct {
+	time time.Time
+	pkt  *discordgo.Packet
+}
+
+func newPacketQueue(store circular.Store, capture *capture, size int) *packetQueue {
+	return &packetQueue{
+		store:   store,
+		capture: capture,
+		packets: make(chan receivedPacket, size),
+	}
+}
+
+// push queues a packet received at time t, without blocking.
+// It returns false if the queue is full, in which case the packet is dropped.
+func (q *packetQueue) push(t time.Time, pkt *discordgo.Packet) bool {
+	select {
+	case q.packets <- receivedPacket{time: t, pkt: pkt}:
+		return true
+	default:
+		atomic.AddInt64(&q.dropped, 1)
+		return false
+	}
+}
+
+// Dropped returns the number of packets dropped because the queue was full.
+func (q *packetQueue) Dropped() int64 {
+	return atomic.LoadInt64(&q.dropped)
+}
+
+// run stores the queued packets until doneCh is closed. They are dropped while the capture is stopped.
+func (q *packetQueue) run(doneCh <-chan struct{}) {
+	for {
+		select {
+		case p := <-q.packets:
+			q.capture.add(q.store, p.time, *p.pkt)
+		case <-doneCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package voicechannel
+
+import (
+	"bigbro2/bot/circular"
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowStore is a store whose Add blocks until it is released.
+type slowStore struct {
+	sync.Mutex
+	release chan struct{}
+	added   []uint32
+}
+
+func (s *slowStore) Add(_ time.Time, pkt discordgo.Packet) {
+	<-s.release
+
+	s.Lock()
+	defer s.Unlock()
+	s.added = append(s.added, pkt.SSRC)
+}
+
+func (s *slowStore) WithIterator(func(iterator circular.Iterator) error) error { return nil }
+func (s *slowStore) Reset()                                                    {}
+func (s *slowStore) Stats() circular.Stats                                     { return circular.Stats{} }
+
+func (s *slowStore) addedCount() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.added)
+}
+
+func TestPacketQueue_slowStore(t *testing.T) {
+	store := &slowStore{release: make(chan struct{})}
+	queue := newPacketQueue(store, &capture{}, 10)
+
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	go queue.run(doneCh)
+
+	// The store is stuck: pushing never blocks, the packets that do not fit in the queue are dropped.
+	pushed := make(chan int)
+	go func() {
+		var n int
+		for i := 0; i < 100; i++ {
+			if queue.push(time.Now(), &discordgo.Packet{SSRC: uint32(i)}) {
+				n++
+			}
+		}
+		pushed <- n
+	}()
+
+	var n int
+	select {
+	case n = <-pushed:
+	case <-time.After(time.Second):
+		require.FailNow(t, "push blocked on the slow store")
+	}
+
+	// The worker holds one packet while it is blocked in Add, the queue holds the others.
+	assert.GreaterOrEqual(t, n, 10)
+	assert.LessOrEqual(t, n, 11)
+	assert.Equal(t, int64(100-n), queue.Dropped())
+
+	// Once the store is available again, every queued packet is stored in order.
+	close(store.release)
+	require.Eventually(t, func() bool { return store.addedCount() == n }, time.Second, time.Millisecond)
+	for i, ssrc := range store.added {
+		assert.Equal(t, uint32(i), ssrc)
+	}
+}
@@ -0,0 +1,143 @@
+package voicechannel
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultSpeakersCapacity is the number of voice streams remembered when none is configured. It is much more than
+	// the number of people who can be heard in a replay.
+	defaultSpeakersCapacity = 256
+	// defaultSpeakersTTL is how long a voice stream is remembered after its user last started speaking when none is
+	// configured. It is longer than the audio buffer, so every stream of a replay can be named.
+	defaultSpeakersTTL = 2 * time.Hour
+)
+
+// speakers maps the SSRC of the voice streams to the ID of the user speaking.
+// The mapping survives channel changes, so a user resolved late is still named in the packets received before. It
+// keeps at most capacity streams, evicting the least recently updated ones, and forgets the streams not updated for
+// ttl.
+// Zero value is safe to use. It is safe for concurrent use.
+type speakers struct {
+	sync.Mutex
+	capacity int           // Maximum number of streams remembered, defaultSpeakersCapacity if zero.
+	ttl      time.Duration // How long a stream is remembered after it was last updated, defaultSpeakersTTL if zero.
+	entries  map[uint32]*list.Element
+	order    list.List // Of *speakerEntry, most recently updated first.
+}
+
+type speakerEntry struct {
+	ssrc    uint32
+	userID  string
+	updated time.Time
+	leftAt  time.Time // When the user left the voice channel, zero if they did not.
+}
+
+// set associates the voice stream with the user, at time now. The user speaking in it again, they are not considered
+// gone anymore.
+func (s *speakers) set(ssrc uint32, userID string, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.entries == nil {
+		s.entries = map[uint32]*list.Element{}
+	}
+
+	if e, ok := s.entries[ssrc]; ok {
+		entry := e.Value.(*speakerEntry)
+		entry.userID = userID
+		entry.updated = now
+		entry.leftAt = time.Time{}
+		s.order.MoveToFront(e)
+		return
+	}
+
+	s.entries[ssrc] = s.order.PushFront(&speakerEntry{ssrc: ssrc, userID: userID, updated: now})
+	for len(s.entries) > s.maxEntries() {
+		s.remove(s.order.Back())
+	}
+}
+
+// get returns the ID of the user speaking in the voice stream, or false if it is unknown or expired.
+func (s *speakers) get(ssrc uint32, now time.Time) (string, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.removeExpired(now)
+	e, ok := s.entries[ssrc]
+	if !ok {
+		return "", false
+	}
+	return e.Value.(*speakerEntry).userID, true
+}
+
+// snapshot returns a copy of the SSRC to user ID mapping, without the expired streams.
+func (s *speakers) snapshot(now time.Time) map[uint32]string {
+	s.Lock()
+	defer s.Unlock()
+
+	s.removeExpired(now)
+	result := make(map[uint32]string, len(s.entries))
+	for ssrc, e := range s.entries {
+		result[ssrc] = e.Value.(*speakerEntry).userID
+	}
+	return result
+}
+
+// leave records that the user left the voice channel at time now. The streams of the user are remembered, so their
+// packets received before can still be named.
+func (s *speakers) leave(userID string, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, e := range s.entries {
+		entry := e.Value.(*speakerEntry)
+		if entry.userID == userID && entry.leftAt.IsZero() {
+			entry.leftAt = now
+		}
+	}
+}
+
+// departures returns when the user of each voice stream left the voice channel, indexed by SSRC, without the expired
+// streams and the streams of the users still there.
+func (s *speakers) departures(now time.Time) map[uint32]time.Time {
+	s.Lock()
+	defer s.Unlock()
+
+	s.removeExpired(now)
+	result := map[uint32]time.Time{}
+	for ssrc, e := range s.entries {
+		if leftAt := e.Value.(*speakerEntry).leftAt; !leftAt.IsZero() {
+			result[ssrc] = leftAt
+		}
+	}
+	return result
+}
+
+// removeExpired removes the streams not updated for ttl. The oldest ones are at the back of the list.
+func (s *speakers) removeExpired(now time.Time) {
+	for e := s.order.Back(); e != nil && now.Sub(e.Value.(*speakerEntry).updated) > s.expiry(); e = s.order.Back() {
+		s.remove(e)
+	}
+}
+
+func (s *speakers) remove(e *list.Element) {
+	s.order.Remove(e)
+	delete(s.entries, e.Value.(*speakerEntry).ssrc)
+}
+
+func (s *speakers) maxEntries() int {
+	if s.capacity <= 0 {
+		return defaultSpeakersCapacity
+	}
+	return s.capacity
+}
+
+func (s *speakers) expiry() time.Duration {
+	if s.ttl <= 0 {
+		return defaultSpeakersTTL
+	}
+	return s.ttl
+}
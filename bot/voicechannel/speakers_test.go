@@ -0,0 +1,105 @@
+package voicechannel
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSpeakers_ttl(t *testing.T) {
+	start := time.Unix(1000, 0)
+	s := &speakers{ttl: time.Minute}
+
+	s.set(1, "alice", start)
+	s.set(2, "bob", start.Add(30*time.Second))
+
+	// Alice started speaking exactly a minute ago, she is still remembered.
+	userID, ok := s.get(1, start.Add(time.Minute))
+	assert.True(t, ok)
+	assert.Equal(t, "alice", userID)
+	assert.Equal(t, map[uint32]string{1: "alice", 2: "bob"}, s.snapshot(start.Add(time.Minute)))
+
+	// Speaking again keeps the stream.
+	s.set(2, "bob", start.Add(80*time.Second))
+
+	_, ok = s.get(1, start.Add(61*time.Second))
+	assert.False(t, ok)
+	assert.Equal(t, map[uint32]string{2: "bob"}, s.snapshot(start.Add(2*time.Minute)))
+	assert.Empty(t, s.snapshot(start.Add(3*time.Minute)))
+}
+
+func TestSpeakers_eviction(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tests := []struct {
+		name     string
+		updates  []uint32
+		expected map[uint32]string
+	}{
+		{
+			name:     "under capacity",
+			updates:  []uint32{1, 2},
+			expected: map[uint32]string{1: "user-1", 2: "user-2"},
+		},
+		{
+			name:     "least recently updated evicted",
+			updates:  []uint32{1, 2, 3, 4},
+			expected: map[uint32]string{2: "user-2", 3: "user-3", 4: "user-4"},
+		},
+		{
+			name:     "updated stream kept",
+			updates:  []uint32{1, 2, 3, 1, 4},
+			expected: map[uint32]string{1: "user-1", 3: "user-3", 4: "user-4"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &speakers{capacity: 3}
+			for _, ssrc := range tt.updates {
+				s.set(ssrc, fmt.Sprintf("user-%d", ssrc), now)
+			}
+			assert.Equal(t, tt.expected, s.snapshot(now))
+		})
+	}
+}
+
+func TestSpeakers_zeroValue(t *testing.T) {
+	var s speakers
+	now := time.Unix(1000, 0)
+
+	_, ok := s.get(1, now)
+	assert.False(t, ok)
+
+	s.set(1, "alice", now)
+	s.set(1, "bob", now)
+	userID, ok := s.get(1, now.Add(defaultSpeakersTTL))
+	assert.True(t, ok)
+	assert.Equal(t, "bob", userID)
+}
+
+func TestSpeakers_departures(t *testing.T) {
+	start := time.Unix(1000, 0)
+	s := &speakers{ttl: time.Minute}
+
+	s.set(1, "alice", start)
+	s.set(2, "bob", start)
+	s.set(3, "bob", start)
+	assert.Empty(t, s.departures(start))
+
+	// Every stream of the user is gone, the first time they left is kept.
+	s.leave("bob", start.Add(time.Second))
+	s.leave("bob", start.Add(2*time.Second))
+	s.leave("carol", start.Add(2*time.Second))
+	leftAt := start.Add(time.Second)
+	assert.Equal(t, map[uint32]time.Time{2: leftAt, 3: leftAt}, s.departures(start.Add(2*time.Second)))
+
+	// The user is still named in their streams, until one is heard again.
+	userID, ok := s.get(2, start.Add(2*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, "bob", userID)
+	s.set(3, "bob", start.Add(3*time.Second))
+	assert.Equal(t, map[uint32]time.Time{2: leftAt}, s.departures(start.Add(3*time.Second)))
+
+	// Expired streams are forgotten.
+	assert.Empty(t, s.departures(start.Add(2*time.Minute)))
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"time"
+)
+
+// newDiscordLogger returns a function to use as discordgo.Logger, writing the logs of discordgo to logger.
+//
+// The logs of discordgo have their own minimum level, and at most perSecond of them are written each second, for each
+// level. Voice reconnection storms make discordgo log the same messages over and over, they must not drown the logs of
+// the bot. Zero or less means there is no limit.
+func newDiscordLogger(logger *zap.Logger, minLevel zapcore.Level, perSecond int) func(msgL, caller int, format string, a ...interface{}) {
+	if perSecond > 0 {
+		logger = logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+			return zapcore.NewSamplerWithOptions(core, time.Second, perSecond, 0)
+		}))
+	}
+
+	return func(msgL, caller int, format string, a ...interface{}) {
+		var level zapcore.Level
+		switch msgL {
+		case discordgo.LogError:
+			level = zap.ErrorLevel
+		case discordgo.LogWarning:
+			level = zap.WarnLevel
+		case discordgo.LogInformational:
+			level = zap.InfoLevel
+		case discordgo.LogDebug:
+			level = zap.DebugLevel
+		default:
+			panic("unknown log level")
+		}
+
+		if !minLevel.Enabled(level) {
+			return
+		}
+		if ce := logger.Check(level, "discord_go"); ce != nil {
+			ce.Write(zap.String("message", fmt.Sprintf(format, a...)))
+		}
+	}
+}
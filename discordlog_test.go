@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"testing"
+)
+
+func TestNewDiscordLogger_levels(t *testing.T) {
+	tests := []struct {
+		name     string
+		msgL     int
+		minLevel zapcore.Level
+		expected []zapcore.Level
+	}{
+		{name: "error", msgL: discordgo.LogError, minLevel: zapcore.DebugLevel, expected: []zapcore.Level{zapcore.ErrorLevel}},
+		{name: "warning", msgL: discordgo.LogWarning, minLevel: zapcore.DebugLevel, expected: []zapcore.Level{zapcore.WarnLevel}},
+		{name: "informational", msgL: discordgo.LogInformational, minLevel: zapcore.DebugLevel, expected: []zapcore.Level{zapcore.InfoLevel}},
+		{name: "debug", msgL: discordgo.LogDebug, minLevel: zapcore.DebugLevel, expected: []zapcore.Level{zapcore.DebugLevel}},
+		{name: "debug below the minimum level", msgL: discordgo.LogDebug, minLevel: zapcore.InfoLevel},
+		{name: "warning at the minimum level", msgL: discordgo.LogWarning, minLevel: zapcore.WarnLevel, expected: []zapcore.Level{zapcore.WarnLevel}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			log := newDiscordLogger(zap.New(core), tt.minLevel, 0)
+
+			log(tt.msgL, 0, "hello %s", "world")
+
+			var levels []zapcore.Level
+			for _, entry := range logs.All() {
+				levels = append(levels, entry.Level)
+				assert.Equal(t, "discord_go", entry.Message)
+				assert.Equal(t, "hello world", entry.ContextMap()["message"])
+			}
+			assert.Equal(t, tt.expected, levels)
+		})
+	}
+}
+
+func TestNewDiscordLogger_rateLimit(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	log := newDiscordLogger(zap.New(core), zapcore.DebugLevel, 3)
+
+	for i := 0; i < 10; i++ {
+		log(discordgo.LogDebug, 0, "reconnecting")
+	}
+	log(discordgo.LogError, 0, "could not reconnect")
+
+	// Each level has its own limit.
+	assert.Equal(t, 3, logs.FilterLevelExact(zapcore.DebugLevel).Len())
+	assert.Equal(t, 1, logs.FilterLevelExact(zapcore.ErrorLevel).Len())
+}
@@ -4,7 +4,9 @@ import (
 	"bigbro2/bot"
 	"bigbro2/bot/circular"
 	"bigbro2/bot/command"
+	"bigbro2/bot/ratelimit"
 	"bigbro2/bot/replayfile"
+	"bigbro2/bot/tempfile"
 	"bigbro2/bot/voicechannel"
 	"context"
 	"errors"
@@ -14,15 +16,62 @@ import (
 	"go.uber.org/zap/zapcore"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 const (
-	DiscordToken   = "DISCORD_TOKEN"
-	DiscordGuildId = "DISCORD_GUILD_ID"
-	Development    = "DEVELOPMENT"
+	DiscordToken       = "DISCORD_TOKEN"
+	DiscordGuildId     = "DISCORD_GUILD_ID"
+	Development        = "DEVELOPMENT"
+	MixDuration        = "MIX_DURATION"
+	MixNormalization   = "MIX_NORMALIZATION"
+	MixPadPreSkip      = "MIX_PAD_PRESKIP"
+	MixFramesPerPacket = "MIX_FRAMES_PER_PACKET"
+	MixFadeMS          = "MIX_FADE_MS"
+	MixWeights         = "MIX_WEIGHTS"
+	MixMaxStreams      = "MIX_MAX_STREAMS"
+	MixApplication     = "MIX_OPUS_APPLICATION"
+	MixContainer       = "MIX_CONTAINER"
+	AllowedRoleID      = "ALLOWED_ROLE_ID"
+	BufferMaxMB        = "BUFFER_MAX_MB"
+	BufferSeconds      = "BUFFER_SECONDS"
+	GlobalCommands     = "GLOBAL_COMMANDS"
+	SummaryWebhookURL  = "SUMMARY_WEBHOOK_URL"
+	IncludeMuted       = "INCLUDE_MUTED"
+	SkipStageChannels  = "SKIP_STAGE_CHANNELS"
+	AllowDMs           = "ALLOW_DMS"
+	ReactionMessageID  = "REACTION_MESSAGE_ID"
+	ReactionEmoji      = "REACTION_EMOJI"
+	OpenMaxAttempts    = "OPEN_MAX_ATTEMPTS"
+	DiskBufferDir      = "DISK_BUFFER_DIR"
+	DiskBufferMinutes  = "DISK_BUFFER_MINUTES"
+	LogLevel           = "LOG_LEVEL"
+	LogFile            = "LOG_FILE"
+	GuildAllowlist     = "GUILD_ALLOWLIST"
+	MinSpeakers        = "MIN_SPEAKERS"
+	RecordingWatermark = "RECORDING_WATERMARK"
+	DiscordLogLevel    = "DISCORD_LOG_LEVEL"
+	DiscordLogRate     = "DISCORD_LOG_PER_SECOND"
+	VoiceStateDebounce = "VOICE_STATE_DEBOUNCE_MS"
+	DiscordIntents     = "DISCORD_INTENTS"
+	TranscriptionURL   = "TRANSCRIPTION_URL"
+	BotStatus          = "BOT_STATUS"
+	FilenameTemplate   = "FILENAME_TEMPLATE"
+	AnnounceChannelID  = "ANNOUNCE_CHANNEL_ID"
+	ArmingRequired     = "ARMING_REQUIRED"
+	TempMaxAgeMinutes  = "TEMP_MAX_AGE_MINUTES"
+	TempSweepMinutes   = "TEMP_SWEEP_INTERVAL_MINUTES"
+	SettingsFile       = "SETTINGS_FILE"
+	ReplayReactions    = "REPLAY_REACTIONS"
 )
 
+// diskSegmentDuration is the duration of the audio stored in each segment file when the audio is kept on disk.
+const diskSegmentDuration = time.Minute
+
 func run() error {
 	token, err := getEnvVar(DiscordToken)
 	if err != nil {
@@ -34,58 +83,148 @@ func run() error {
 		return err
 	}
 
+	mixOptions, err := getMixOptions()
+	if err != nil {
+		return err
+	}
+
+	bufferMaxMB, err := getOptionalIntEnvVar(BufferMaxMB, 0)
+	if err != nil {
+		return err
+	}
+
+	bufferSeconds, err := getOptionalIntEnvVar(BufferSeconds, circular.DefaultCapacity/circular.PacketsPerSecond)
+	if err != nil {
+		return err
+	}
+
+	diskBufferMinutes, err := getOptionalIntEnvVar(DiskBufferMinutes, 180)
+	if err != nil {
+		return err
+	}
+
+	minSpeakers, err := getOptionalIntEnvVar(MinSpeakers, 1)
+	if err != nil {
+		return err
+	}
+
+	discordLogRate, err := getOptionalIntEnvVar(DiscordLogRate, 100)
+	if err != nil {
+		return err
+	}
+
+	voiceStateDebounceMS, err := getOptionalIntEnvVar(VoiceStateDebounce, 500)
+	if err != nil {
+		return err
+	}
+
+	openMaxAttempts, err := getOptionalIntEnvVar(OpenMaxAttempts, 0)
+	if err != nil {
+		return err
+	}
+
+	tempMaxAgeMinutes, err := getOptionalIntEnvVar(TempMaxAgeMinutes, 60)
+	if err != nil {
+		return err
+	}
+
+	tempSweepMinutes, err := getOptionalIntEnvVar(TempSweepMinutes, 0)
+	if err != nil {
+		return err
+	}
+
+	intents, err := bot.ParseIntents(os.Getenv(DiscordIntents))
+	if err != nil {
+		return UserError{fmt.Sprintf("invalid %s: %s", DiscordIntents, err)}
+	}
+
+	filenameTemplate, err := command.ParseFilenameTemplate(os.Getenv(FilenameTemplate))
+	if err != nil {
+		return UserError{fmt.Sprintf("invalid %s: %s", FilenameTemplate, err)}
+	}
+
+	replayReactions, err := command.ParseReactions(os.Getenv(ReplayReactions))
+	if err != nil {
+		return UserError{fmt.Sprintf("invalid %s: %s", ReplayReactions, err)}
+	}
+
+	statusTemplate, err := bot.ParseStatusTemplate(os.Getenv(BotStatus))
+	if err != nil {
+		return UserError{fmt.Sprintf("invalid %s: %s", BotStatus, err)}
+	}
+
+	reactionEmoji := os.Getenv(ReactionEmoji)
+	if reactionEmoji == "" {
+		reactionEmoji = "🔁"
+	}
+
+	botOptions := bot.Options{
+		AllowedRoleID:      os.Getenv(AllowedRoleID),
+		GlobalCommands:     os.Getenv(GlobalCommands) == "true",
+		IncludeMuted:       os.Getenv(IncludeMuted) == "true",
+		SkipStageChannels:  os.Getenv(SkipStageChannels) == "true",
+		AllowDMs:           os.Getenv(AllowDMs) == "true",
+		ReactionMessageID:  os.Getenv(ReactionMessageID),
+		ReactionEmoji:      reactionEmoji,
+		OpenMaxAttempts:    openMaxAttempts,
+		GuildAllowlist:     parseGuildAllowlist(os.Getenv(GuildAllowlist)),
+		VoiceStateDebounce: time.Duration(voiceStateDebounceMS) * time.Millisecond,
+		Intents:            intents,
+		StatusTemplate:     statusTemplate,
+		SettingsPath:       os.Getenv(SettingsFile),
+	}
+
 	dev := false
 	devStr := os.Getenv(Development)
 	if devStr == "true" {
 		dev = true
 	}
 
-	var loggerFunc func() (*zap.Logger, error)
+	logLevel, validLogLevel := parseLogLevel(os.Getenv(LogLevel))
+	outputPaths := []string{"stderr"}
+	if logFile := os.Getenv(LogFile); logFile != "" {
+		outputPaths = []string{logFile}
+	}
+
+	var loggerConfig zap.Config
 	if dev {
-		loggerFunc = func() (*zap.Logger, error) {
-			return zap.NewDevelopment()
-		}
+		loggerConfig = zap.NewDevelopmentConfig()
 	} else {
-		loggerFunc = func() (*zap.Logger, error) {
-			return zap.Config{
-				Level:       zap.NewAtomicLevelAt(zap.DebugLevel),
-				Development: false,
-				Sampling: &zap.SamplingConfig{
-					Initial:    100,
-					Thereafter: 100,
-				},
-				Encoding:         "json",
-				EncoderConfig:    zap.NewProductionEncoderConfig(),
-				OutputPaths:      []string{"stderr"},
-				ErrorOutputPaths: []string{"stderr"},
-			}.Build()
+		loggerConfig = zap.Config{
+			Development: false,
+			Sampling: &zap.SamplingConfig{
+				Initial:    100,
+				Thereafter: 100,
+			},
+			Encoding:         "json",
+			EncoderConfig:    zap.NewProductionEncoderConfig(),
+			ErrorOutputPaths: []string{"stderr"},
 		}
 	}
-	logger, err := loggerFunc()
+	loggerConfig.Level = zap.NewAtomicLevelAt(logLevel)
+	loggerConfig.OutputPaths = outputPaths
+
+	logger, err := loggerConfig.Build()
 	if err != nil {
 		return fmt.Errorf("could not create logger: %w", err)
 	}
+	if !validLogLevel {
+		logger.Warn("invalid log level, using debug", zap.String("level", os.Getenv(LogLevel)))
+	}
 
-	discordgo.Logger = func(msgL, caller int, format string, a ...interface{}) {
-		var level zapcore.Level
-		switch msgL {
-		case discordgo.LogError:
-			level = zap.ErrorLevel
-		case discordgo.LogWarning:
-			level = zap.WarnLevel
-		case discordgo.LogInformational:
-			level = zap.InfoLevel
-		case discordgo.LogDebug:
-			level = zap.DebugLevel
-		default:
-			panic("unknown log level")
-		}
-
-		if ce := logger.Check(level, "discord_go"); ce != nil {
-			ce.Write(zap.String("message", fmt.Sprintf(format, a...)))
-		}
+	// The temporary files left behind by a crash are removed before new ones are created.
+	tempMaxAge := time.Duration(tempMaxAgeMinutes) * time.Minute
+	if removed, err := tempfile.Sweep(os.TempDir(), time.Now(), tempMaxAge); err != nil {
+		logger.Warn("failed to sweep temporary files", zap.Error(err))
+	} else if removed > 0 {
+		logger.Info("removed stale temporary files", zap.Int("removed", removed))
+	}
 
+	discordLogLevel, validDiscordLogLevel := parseLogLevel(os.Getenv(DiscordLogLevel))
+	if !validDiscordLogLevel {
+		logger.Warn("invalid discord log level, using debug", zap.String("level", os.Getenv(DiscordLogLevel)))
 	}
+	discordgo.Logger = newDiscordLogger(logger, discordLogLevel, discordLogRate)
 
 	session, err := discordgo.New("Bot " + token)
 	if err != nil {
@@ -95,23 +234,82 @@ func run() error {
 	session.LogLevel = discordgo.LogDebug
 	session.ShouldReconnectOnError = true
 
+	newAudioBuffer := func(string) (circular.Store, error) {
+		return &circular.Buffer{
+			MaxBytes: bufferMaxMB * 1024 * 1024,
+			Capacity: bufferSeconds * circular.PacketsPerSecond,
+		}, nil
+	}
+	if dir := os.Getenv(DiskBufferDir); dir != "" {
+		retention := time.Duration(diskBufferMinutes) * time.Minute
+		newAudioBuffer = func(guildID string) (circular.Store, error) {
+			diskBuffer, err := circular.NewDiskBuffer(logger, filepath.Join(dir, guildID), diskSegmentDuration, retention)
+			if err != nil {
+				return nil, fmt.Errorf("could not create disk buffer: %w", err)
+			}
+			return diskBuffer, nil
+		}
+	}
+
+	audioBuffers := circular.NewBufferRegistry(newAudioBuffer)
+	defer func() {
+		if err := audioBuffers.Close(); err != nil {
+			logger.Warn("failed to close audio buffers", zap.Error(err))
+		}
+	}()
+
+	// Fail early if the buffer of the recorded guild cannot be created, e.g. the disk buffer directory is not writable.
+	if _, err := audioBuffers.Get(guildID); err != nil {
+		return err
+	}
+
+	replayCreator := replayfile.NewCreator(logger, time.Now, mixOptions)
+
+	var transcriber command.Transcriber
+	if url := os.Getenv(TranscriptionURL); url != "" {
+		transcriber = command.NewHTTPTranscriber(logger, url, replayCreator.ConvertForSpeech)
+	}
+
+	// The bot and the replay command are rate limited together by Discord.
+	breaker := ratelimit.NewBreaker(logger, time.Now)
+	botOptions.Breaker = breaker
+
 	var (
-		audioBuffer    = circular.Buffer{}
-		replayCreator  = replayfile.NewCreator(logger, time.Now)
-		replayCmd      = command.NewReplay(logger, replayCreator, session, &audioBuffer)
-		managerFactory = voicechannel.NewManagerFactory(logger, guildID, session, &audioBuffer)
-		botInstance    = bot.NewBot(logger, session, guildID, managerFactory, replayCmd)
+		replayOptions = command.ReplayOptions{
+			SummaryWebhookURL: os.Getenv(SummaryWebhookURL),
+			MinSpeakers:       minSpeakers,
+			Transcriber:       transcriber,
+			Breaker:           breaker,
+			FilenameTemplate:  filenameTemplate,
+			Reactions:         replayReactions,
+		}
+		managerOptions = voicechannel.ManagerOptions{
+			AnnounceChannelID: os.Getenv(AnnounceChannelID),
+			ArmingRequired:    os.Getenv(ArmingRequired) == "true",
+		}
+		replayCmd      = command.NewReplay(logger, replayCreator, session, audioBuffers, replayOptions)
+		managerFactory = voicechannel.NewManagerFactory(logger, time.Now, guildID, session, audioBuffers, managerOptions)
+		botInstance    = bot.NewBot(logger, session, guildID, managerFactory, audioBuffers, replayCmd, botOptions)
 	)
 
 	ctx := context.Background()
 	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
 	defer stop()
 
+	if tempSweepMinutes > 0 {
+		go tempfile.Run(ctx, logger, os.TempDir(), time.Now, tempMaxAge, time.Duration(tempSweepMinutes)*time.Minute)
+	}
+
 	return botInstance.Run(ctx)
 }
 
 func main() {
-	err := run()
+	var err error
+	if len(os.Args) > 1 && os.Args[1] == mixCommand {
+		err = runMix(os.Args[2:])
+	} else {
+		err = run()
+	}
 
 	var userError UserError
 	switch {
@@ -131,6 +329,67 @@ func main() {
 	}
 }
 
+// getMixOptions reads the settings of the mix from the environment.
+func getMixOptions() (replayfile.MixOptions, error) {
+	mixDuration, err := replayfile.ParseMixDuration(os.Getenv(MixDuration))
+	if err != nil {
+		return replayfile.MixOptions{}, UserError{fmt.Sprintf("invalid %s: %s", MixDuration, err)}
+	}
+
+	mixNormalization, err := replayfile.ParseNormalization(os.Getenv(MixNormalization))
+	if err != nil {
+		return replayfile.MixOptions{}, UserError{fmt.Sprintf("invalid %s: %s", MixNormalization, err)}
+	}
+
+	mixFramesPerPacket, err := replayfile.ParseFramesPerPacket(os.Getenv(MixFramesPerPacket))
+	if err != nil {
+		return replayfile.MixOptions{}, UserError{fmt.Sprintf("invalid %s: %s", MixFramesPerPacket, err)}
+	}
+
+	mixFade, err := replayfile.ParseFade(os.Getenv(MixFadeMS))
+	if err != nil {
+		return replayfile.MixOptions{}, UserError{fmt.Sprintf("invalid %s: %s", MixFadeMS, err)}
+	}
+
+	mixWeights, err := replayfile.ParseWeights(os.Getenv(MixWeights))
+	if err != nil {
+		return replayfile.MixOptions{}, UserError{fmt.Sprintf("invalid %s: %s", MixWeights, err)}
+	}
+
+	mixMaxStreams, err := replayfile.ParseMaxStreams(os.Getenv(MixMaxStreams))
+	if err != nil {
+		return replayfile.MixOptions{}, UserError{fmt.Sprintf("invalid %s: %s", MixMaxStreams, err)}
+	}
+
+	mixApplication, err := replayfile.ParseOpusApplication(os.Getenv(MixApplication))
+	if err != nil {
+		return replayfile.MixOptions{}, UserError{fmt.Sprintf("invalid %s: %s", MixApplication, err)}
+	}
+
+	mixContainer, err := replayfile.ParseContainer(os.Getenv(MixContainer))
+	if err != nil {
+		return replayfile.MixOptions{}, UserError{fmt.Sprintf("invalid %s: %s", MixContainer, err)}
+	}
+
+	watermark := os.Getenv(RecordingWatermark)
+	if !utf8.ValidString(watermark) {
+		return replayfile.MixOptions{}, UserError{fmt.Sprintf("invalid %s: not valid UTF-8", RecordingWatermark)}
+	}
+
+	return replayfile.MixOptions{
+		Duration:        mixDuration,
+		Normalization:   mixNormalization,
+		PadPreSkip:      os.Getenv(MixPadPreSkip) == "true",
+		FramesPerPacket: mixFramesPerPacket,
+		Watermark:       watermark,
+		Fade:            mixFade,
+		Weights:         mixWeights,
+		MaxStreams:      mixMaxStreams,
+		Application:     mixApplication,
+		Container:       mixContainer,
+	}, nil
+}
+
 func getEnvVar(key string) (string, error) {
 	envVar := os.Getenv(key)
 	if envVar == "" {
@@ -139,6 +398,44 @@ func getEnvVar(key string) (string, error) {
 	return envVar, nil
 }
 
+// parseLogLevel parses the level of the logs (debug, info, warn, error...). The empty string is the debug level.
+// If the level is not valid, it returns the debug level and false.
+func parseLogLevel(s string) (zapcore.Level, bool) {
+	if s == "" {
+		return zapcore.DebugLevel, true
+	}
+
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return zapcore.DebugLevel, false
+	}
+	return level, true
+}
+
+// parseGuildAllowlist parses a comma-separated list of guild IDs. Blank entries are ignored.
+func parseGuildAllowlist(s string) []string {
+	var ids []string
+	for _, id := range strings.Split(s, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func getOptionalIntEnvVar(key string, defaultValue int) (int, error) {
+	envVar := os.Getenv(key)
+	if envVar == "" {
+		return defaultValue, nil
+	}
+
+	v, err := strconv.Atoi(envVar)
+	if err != nil || v < 0 {
+		return 0, UserError{fmt.Sprintf("environment variable %q must be a positive integer", key)}
+	}
+	return v, nil
+}
+
 type UserError struct{ Reason string }
 
 func (e UserError) Error() string { return e.Reason }
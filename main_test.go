@@ -0,0 +1,47 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zapcore"
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		name          string
+		value         string
+		expected      zapcore.Level
+		expectedValid bool
+	}{
+		{name: "default", value: "", expected: zapcore.DebugLevel, expectedValid: true},
+		{name: "info", value: "info", expected: zapcore.InfoLevel, expectedValid: true},
+		{name: "upper case", value: "WARN", expected: zapcore.WarnLevel, expectedValid: true},
+		{name: "error", value: "error", expected: zapcore.ErrorLevel, expectedValid: true},
+		{name: "invalid", value: "verbose", expected: zapcore.DebugLevel, expectedValid: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, valid := parseLogLevel(tt.value)
+			assert.Equal(t, tt.expected, got)
+			assert.Equal(t, tt.expectedValid, valid)
+		})
+	}
+}
+
+func TestParseGuildAllowlist(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected []string
+	}{
+		{name: "unset", value: "", expected: nil},
+		{name: "single", value: "123", expected: []string{"123"}},
+		{name: "multiple", value: "123,456", expected: []string{"123", "456"}},
+		{name: "spaces and blanks", value: " 123 , ,456,", expected: []string{"123", "456"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, parseGuildAllowlist(tt.value))
+		})
+	}
+}
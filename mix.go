@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bigbro2/bot/replayfile"
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+)
+
+// mixCommand is the first argument running the mix of stream files captured earlier, instead of the bot.
+const mixCommand = "mix"
+
+// mixer mixes stream files together. It is implemented by *replayfile.Creator.
+type mixer interface {
+	Mix(ctx context.Context, path string, files []string, opts replayfile.Options) error
+}
+
+// runMix mixes the stream files of a directory the same way the bot mixes the replays.
+// The mix is configured with the same environment variables as the bot.
+func runMix(args []string) error {
+	mixOptions, err := getMixOptions()
+	if err != nil {
+		return err
+	}
+
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		return fmt.Errorf("could not create logger: %w", err)
+	}
+
+	creator := replayfile.NewCreator(logger, time.Now, mixOptions)
+	defer func() {
+		if err := creator.Close(); err != nil {
+			logger.Warn("failed to close replay creator", zap.Error(err))
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	return mixDirectory(ctx, creator, args)
+}
+
+// mixDirectory mixes the .opus files of the input directory, in the order of their names, into the output file.
+// args are the input directory and the output file.
+func mixDirectory(ctx context.Context, m mixer, args []string) error {
+	if len(args) != 2 {
+		return UserError{fmt.Sprintf("usage: %s %s <in-dir> <out-file>", filepath.Base(os.Args[0]), mixCommand)}
+	}
+	inDir, outFile := args[0], args[1]
+
+	files, err := filepath.Glob(filepath.Join(inDir, "*.opus"))
+	if err != nil {
+		return fmt.Errorf("could not list stream files: %w", err)
+	}
+	if len(files) == 0 {
+		return UserError{fmt.Sprintf("no .opus file in %q", inDir)}
+	}
+
+	if err := m.Mix(ctx, outFile, files, replayfile.Options{}); err != nil {
+		return fmt.Errorf("could not mix stream files: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bigbro2/bot/replayfile"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeMixer records the files it is asked to mix instead of running ffmpeg.
+type fakeMixer struct {
+	path  string
+	files []string
+	err   error
+}
+
+func (f *fakeMixer) Mix(_ context.Context, path string, files []string, _ replayfile.Options) error {
+	f.path = path
+	f.files = files
+	return f.err
+}
+
+func TestMixDirectory(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"b.opus", "a.opus", "notes.txt"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("OggS"), 0o600))
+	}
+	emptyDir := t.TempDir()
+
+	tests := []struct {
+		name          string
+		args          []string
+		mixErr        error
+		expectedFiles []string
+		wantErr       bool
+	}{
+		{
+			name:          "mix",
+			args:          []string{dir, "out.ogg"},
+			expectedFiles: []string{filepath.Join(dir, "a.opus"), filepath.Join(dir, "b.opus")},
+		},
+		{name: "missing output", args: []string{dir}, wantErr: true},
+		{name: "too many arguments", args: []string{dir, "out.ogg", "extra"}, wantErr: true},
+		{name: "no stream files", args: []string{emptyDir, "out.ogg"}, wantErr: true},
+		{name: "mix failure", args: []string{dir, "out.ogg"}, mixErr: errors.New("ffmpeg errored"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &fakeMixer{err: tt.mixErr}
+			err := mixDirectory(context.Background(), m, tt.args)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "out.ogg", m.path)
+			assert.Equal(t, tt.expectedFiles, m.files)
+		})
+	}
+}